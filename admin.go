@@ -0,0 +1,147 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Admin is an http.Handler reporting the status of the registered Canal
+// instances and controlling them:
+//
+//	GET  /replicas               status of every replica
+//	GET  /replicas/{name}        status of one replica
+//	POST /replicas/{name}/pause  see Canal.Pause
+//	POST /replicas/{name}/resume see Canal.Resume
+//	POST /replicas/{name}/resync see Canal.ForceFullResync
+//
+// Mount it under a prefix with http.StripPrefix.
+type Admin struct {
+	mu     sync.Mutex
+	canals map[string]*Canal
+}
+
+// ReplicaStatus is the Status of a named replica.
+type ReplicaStatus struct {
+	Name string `json:"name"`
+	Status
+}
+
+// NewAdmin returns an Admin without replicas.
+func NewAdmin() *Admin {
+	return &Admin{canals: make(map[string]*Canal)}
+}
+
+// Register exposes c under name, replacing any replica of the same name.
+func (a *Admin) Register(name string, c *Canal) {
+	a.mu.Lock()
+	a.canals[name] = c
+	a.mu.Unlock()
+}
+
+// Unregister removes the replica name.
+func (a *Admin) Unregister(name string) {
+	a.mu.Lock()
+	delete(a.canals, name)
+	a.mu.Unlock()
+}
+
+// Replicas returns the status of every replica, sorted by name.
+func (a *Admin) Replicas() []ReplicaStatus {
+	a.mu.Lock()
+	names := make([]string, 0, len(a.canals))
+	for name := range a.canals {
+		names = append(names, name)
+	}
+	canals := make([]*Canal, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		canals[i] = a.canals[name]
+	}
+	a.mu.Unlock()
+
+	sts := make([]ReplicaStatus, len(names))
+	for i, name := range names {
+		sts[i] = ReplicaStatus{Name: name, Status: canals[i].Status()}
+	}
+	return sts
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "replicas" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, a.Replicas())
+		return
+	}
+
+	name := parts[1]
+	a.mu.Lock()
+	c, ok := a.canals[name]
+	a.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown replica "+name, http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, ReplicaStatus{Name: name, Status: c.Status()})
+		return
+	}
+
+	var action func()
+	switch parts[2] {
+	case "pause":
+		action = c.Pause
+	case "resume":
+		action = c.Resume
+	case "resync":
+		action = c.ForceFullResync
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	action()
+	writeJSON(w, ReplicaStatus{Name: name, Status: c.Status()})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
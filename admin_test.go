@@ -0,0 +1,111 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := &Canal{
+		cfg:          &Config{addr: "127.0.0.1:6379", conns: []net.Conn{client}},
+		replId:       "abc",
+		offset:       42,
+		phase:        int32(PhaseStreaming),
+		closeReplica: make(chan struct{}),
+		ackErrC:      make(chan error, 1),
+	}
+	a := NewAdmin()
+	a.Register("main", c)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	rec := do("GET", "/replicas")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var sts []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &sts))
+	assert.Equal(t, 1, len(sts))
+	assert.Equal(t, "main", sts[0]["name"])
+	assert.Equal(t, "streaming", sts[0]["phase"])
+	assert.Equal(t, "abc", sts[0]["repl_id"])
+	assert.Equal(t, float64(42), sts[0]["offset"])
+
+	assert.Equal(t, http.StatusNotFound, do("GET", "/replicas/other").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("GET", "/replicas/main/pause").Code)
+
+	assert.Equal(t, http.StatusOK, do("POST", "/replicas/main/pause").Code)
+	assert.True(t, c.Status().Paused)
+	assert.Equal(t, http.StatusOK, do("POST", "/replicas/main/resume").Code)
+	assert.False(t, c.Status().Paused)
+
+	assert.Equal(t, http.StatusOK, do("POST", "/replicas/main/resync").Code)
+	_, err := client.Write([]byte("x"))
+	assert.NotNil(t, err)
+	assert.True(t, c.takeResync())
+	assert.Equal(t, "", c.GetReplId())
+	assert.Equal(t, int64(-1), c.Checkpoint().Offset)
+}
+
+func TestCanalPause(t *testing.T) {
+	d := &nopCommander{}
+	c := &Canal{cfg: &Config{}, cmder: d, closeReplica: make(chan struct{}), ackErrC: make(chan error, 1)}
+	c.wr = newWriter(ioutil.Discard)
+	c.Pause()
+
+	r, w := io.Pipe()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = c.handler(r, stop)
+	}()
+
+	written := make(chan struct{})
+	go func() {
+		_, _ = w.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("paused canal read the stream")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Resume()
+	<-written
+	_ = w.Close()
+	wg.Wait()
+	close(stop)
+	assert.Equal(t, 1, len(d.cmds))
+}
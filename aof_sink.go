@@ -0,0 +1,433 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AOFSinkOption specifies an option for an AOFSink.
+type AOFSinkOption struct {
+	f func(*aofSinkOptions)
+}
+
+type aofSinkOptions struct {
+	filename  string
+	multiPart bool
+	fsync     FsyncPolicy
+}
+
+// AOFSinkFilename specifies the appendfilename. Default is "appendonly.aof".
+func AOFSinkFilename(name string) AOFSinkOption {
+	return AOFSinkOption{func(o *aofSinkOptions) {
+		o.filename = name
+	}}
+}
+
+// AOFSinkMultiPart specifies whether the sink writes the multi-part AOF of
+// Redis 7: the directory is the appenddirname holding a base file, incr
+// files and the manifest listing them.
+func AOFSinkMultiPart(multiPart bool) AOFSinkOption {
+	return AOFSinkOption{func(o *aofSinkOptions) {
+		o.multiPart = multiPart
+	}}
+}
+
+// AOFSinkFsync specifies when the AOF is synced. Default is FsyncEverySec.
+func AOFSinkFsync(p FsyncPolicy) AOFSinkOption {
+	return AOFSinkOption{func(o *aofSinkOptions) {
+		o.fsync = p
+	}}
+}
+
+// AOFSink is a CommandDecoder writing an append only file redis-server can
+// load: the commands translated from the snapshot, then the commands of the
+// stream. A new snapshot replaces the file once it is complete, until then
+// the previous one stays in place. SELECT is written when the database
+// changes only, replication heartbeats are dropped. The stream keys of the
+// snapshot are missing, see RDBStats.Skipped.
+type AOFSink struct {
+	dir  string
+	opts aofSinkOptions
+
+	sinkCore
+	f        *os.File
+	w        *bufio.Writer
+	dbs      dbTracker
+	fileDB   int  // database selected in f, -1 if unknown
+	snapshot bool // f is a snapshot not published yet
+	manifest aofManifest
+	last     int64
+	dirty    bool
+
+	applied int64
+}
+
+// NewAOFSink writes the AOF in dir, created if missing. A run resuming the
+// stream appends to the AOF found there.
+func NewAOFSink(dir string, opts ...AOFSinkOption) (*AOFSink, error) {
+	s := &AOFSink{
+		dir:     dir,
+		opts:    aofSinkOptions{filename: "appendonly.aof"},
+		applied: -1,
+	}
+	for _, opt := range opts {
+		opt.f(&s.opts)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if s.opts.multiPart {
+		m, err := readAOFManifest(s.path(s.opts.filename + ".manifest"))
+		if err != nil {
+			return nil, err
+		}
+		s.manifest = m
+	}
+	s.startFlusher(time.Second, func() error {
+		return s.flush(s.opts.fsync == FsyncEverySec)
+	})
+	return s, nil
+}
+
+// Applied returns the offset of the last command written out of a
+// published snapshot, synced unless the policy is FsyncNo, -1 while a
+// snapshot is written.
+func (s *AOFSink) Applied() int64 { return atomic.LoadInt64(&s.applied) }
+
+// Command implements CommandDecoder.
+func (s *AOFSink) Command(cmd *Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	heartbeat := false
+	switch cmd.Name() {
+	case "", "PING", "REPLCONF":
+		heartbeat = true
+	}
+	// the snapshot starts with a PING, and is complete once the stream
+	// follows it
+	switch {
+	case cmd.Phase == PhaseRDB && (!s.snapshot || heartbeat):
+		if err := s.startSnapshot(); err != nil {
+			return s.fail(err)
+		}
+	case cmd.Phase != PhaseRDB && s.snapshot:
+		if err := s.publish(); err != nil {
+			return s.fail(err)
+		}
+		atomic.StoreInt64(&s.applied, s.last)
+	}
+
+	s.last = cmd.Offset
+	switch {
+	case heartbeat:
+		// the offset moves on with the heartbeats
+		if s.f == nil && !s.snapshot {
+			atomic.StoreInt64(&s.applied, s.last)
+		}
+		s.dirty = s.dirty || s.f != nil
+		return nil
+	case cmd.Name() == "SELECT":
+		s.dbs.event(cmd)
+		return nil
+	}
+	if s.f == nil {
+		if err := s.openAppend(); err != nil {
+			return s.fail(err)
+		}
+	}
+	if db := s.dbs.db; db != s.fileDB {
+		if err := s.write(MultiBulkValue("SELECT", db)); err != nil {
+			return s.fail(err)
+		}
+		s.fileDB = db
+	}
+	if err := s.write(MultiBulkValue(cmd.D[0], cmd.Args()...)); err != nil {
+		return s.fail(err)
+	}
+	s.dirty = true
+	if s.opts.fsync == FsyncAlways {
+		return s.fail(s.flush(true))
+	}
+	return nil
+}
+
+// Flush writes out the buffered commands, syncing them unless the policy
+// is FsyncNo.
+func (s *AOFSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.fail(s.flush(s.opts.fsync != FsyncNo))
+}
+
+// Close flushes the AOF. An incomplete snapshot is removed, the previous
+// AOF is kept.
+func (s *AOFSink) Close() error {
+	s.stopFlusher()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.f == nil {
+		return s.err
+	}
+	if s.snapshot {
+		path := s.f.Name()
+		err := s.f.Close()
+		if rerr := os.Remove(path); err == nil {
+			err = rerr
+		}
+		return err
+	}
+	err := s.closeFile()
+	if s.err != nil {
+		err = s.err
+	}
+	return err
+}
+
+func (s *AOFSink) path(name string) string { return filepath.Join(s.dir, name) }
+
+func (s *AOFSink) write(v Value) error {
+	b, _ := MultiBulkBytes(v)
+	_, err := s.w.Write(b)
+	return err
+}
+
+func (s *AOFSink) create(path string, flag int) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return err
+	}
+	s.f, s.w, s.fileDB = f, bufio.NewWriter(f), -1
+	return nil
+}
+
+// startSnapshot writes the next commands into a new base, in place of the
+// file being appended to or of an interrupted snapshot.
+func (s *AOFSink) startSnapshot() error {
+	if s.f != nil {
+		if err := s.closeFile(); err != nil {
+			return err
+		}
+	}
+	s.snapshot = true
+	atomic.StoreInt64(&s.applied, -1)
+	if !s.opts.multiPart {
+		return s.create(s.path(s.opts.filename+".tmp"), os.O_TRUNC)
+	}
+	return s.create(s.path(s.manifest.name(s.opts.filename, aofBase, s.manifest.baseSeq+1)), os.O_TRUNC)
+}
+
+// publish makes the snapshot written the AOF, followed by the stream.
+func (s *AOFSink) publish() error {
+	path := s.f.Name()
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	s.snapshot = false
+	if !s.opts.multiPart {
+		return os.Rename(path, s.path(s.opts.filename))
+	}
+
+	old := s.manifest
+	m := aofManifest{baseSeq: old.baseSeq + 1, incrSeq: old.incrSeq + 1}
+	m.files = []aofFile{
+		{name: filepath.Base(path), seq: m.baseSeq, typ: aofBase},
+		{name: m.name(s.opts.filename, aofIncr, m.incrSeq), seq: m.incrSeq, typ: aofIncr},
+	}
+	if err := s.create(s.path(m.files[1].name), os.O_TRUNC); err != nil {
+		return err
+	}
+	if err := writeAOFManifest(s.path(s.opts.filename+".manifest"), m); err != nil {
+		return err
+	}
+	s.manifest = m
+	for _, f := range old.files {
+		_ = os.Remove(s.path(f.name))
+	}
+	return nil
+}
+
+// openAppend opens the AOF to append the stream to, the last incr file of
+// a multi-part AOF.
+func (s *AOFSink) openAppend() error {
+	if !s.opts.multiPart {
+		return s.create(s.path(s.opts.filename), os.O_APPEND)
+	}
+	if last, ok := s.manifest.lastIncr(); ok {
+		return s.create(s.path(last.name), os.O_APPEND)
+	}
+	m := s.manifest
+	m.incrSeq++
+	name := m.name(s.opts.filename, aofIncr, m.incrSeq)
+	m.files = append(append([]aofFile(nil), m.files...), aofFile{name: name, seq: m.incrSeq, typ: aofIncr})
+	if err := s.create(s.path(name), os.O_TRUNC); err != nil {
+		return err
+	}
+	if err := writeAOFManifest(s.path(s.opts.filename+".manifest"), m); err != nil {
+		return err
+	}
+	s.manifest = m
+	return nil
+}
+
+func (s *AOFSink) closeFile() error {
+	err := s.flush(s.opts.fsync != FsyncNo)
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f, s.w = nil, nil
+	return err
+}
+
+func (s *AOFSink) flush(sync bool) error {
+	if s.f == nil || !s.dirty {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+	}
+	s.dirty = false
+	if !s.snapshot {
+		atomic.StoreInt64(&s.applied, s.last)
+	}
+	return nil
+}
+
+const (
+	aofBase = "b"
+	aofIncr = "i"
+)
+
+type aofFile struct {
+	name string
+	seq  int
+	typ  string
+}
+
+// aofManifest is the manifest of a Redis 7 multi-part AOF, one line per file:
+//
+//	file appendonly.aof.1.base.aof seq 1 type b
+//	file appendonly.aof.1.incr.aof seq 1 type i
+type aofManifest struct {
+	files   []aofFile
+	baseSeq int
+	incrSeq int
+}
+
+func (m aofManifest) name(filename, typ string, seq int) string {
+	if typ == aofBase {
+		return fmt.Sprintf("%s.%d.base.aof", filename, seq)
+	}
+	return fmt.Sprintf("%s.%d.incr.aof", filename, seq)
+}
+
+func (m aofManifest) lastIncr() (aofFile, bool) {
+	for i := len(m.files) - 1; i >= 0; i-- {
+		if m.files[i].typ == aofIncr {
+			return m.files[i], true
+		}
+	}
+	return aofFile{}, false
+}
+
+// readAOFManifest returns the empty manifest if path does not exist. Files
+// of the history type are left out.
+func readAOFManifest(path string) (aofManifest, error) {
+	var m aofManifest
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return m, err
+	}
+	for n, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return m, fmt.Errorf("%s:%d: invalid manifest line", path, n+1)
+		}
+		var f aofFile
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.name = fields[i+1]
+			case "seq":
+				if f.seq, err = strconv.Atoi(fields[i+1]); err != nil {
+					return m, fmt.Errorf("%s:%d: invalid seq", path, n+1)
+				}
+			case "type":
+				f.typ = fields[i+1]
+			}
+		}
+		if f.name == "" {
+			return m, fmt.Errorf("%s:%d: missing file", path, n+1)
+		}
+		switch f.typ {
+		case aofBase:
+			if f.seq > m.baseSeq {
+				m.baseSeq = f.seq
+			}
+		case aofIncr:
+			if f.seq > m.incrSeq {
+				m.incrSeq = f.seq
+			}
+		default:
+			continue
+		}
+		m.files = append(m.files, f)
+	}
+	return m, nil
+}
+
+func writeAOFManifest(path string, m aofManifest) error {
+	var b strings.Builder
+	for _, f := range m.files {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", f.name, f.seq, f.typ)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readAOF returns the commands of an AOF file, one string each.
+func readAOF(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rd := newReader(f)
+	var cmds []string
+	for {
+		val, _, err := rd.readBulk()
+		if err == io.EOF {
+			return cmds
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d []string
+		for _, v := range val.Array() {
+			d = append(d, v.String())
+		}
+		cmds = append(cmds, strings.Join(d, " "))
+	}
+}
+
+func aofCommands(s *AOFSink, phase Phase, offset int64, cmds ...string) error {
+	for _, c := range cmds {
+		if err := s.Command(&Command{D: strings.Fields(c), Offset: offset, Phase: phase}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAOFSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "appendonly.aof")
+
+	s, err := NewAOFSink(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, aofCommands(s, PhaseRDB, 100, "SELECT 0", "SET a 1", "SELECT 2", "SET b 2"))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "published before the snapshot is complete")
+	assert.Nil(t, aofCommands(s, PhaseStreaming, 110, "PING", "SELECT 2", "INCR b", "SELECT 0", "DEL a"))
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, int64(110), s.Applied())
+	assert.Nil(t, s.Close())
+	assert.Equal(t, []string{"SELECT 0", "SET a 1", "SELECT 2", "SET b 2", "SELECT 2", "INCR b", "SELECT 0", "DEL a"}, readAOF(t, path))
+
+	// resuming appends, an interrupted snapshot leaves the AOF as is
+	s, err = NewAOFSink(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, aofCommands(s, PhaseStreaming, 120, "SET c 3"))
+	assert.Nil(t, aofCommands(s, PhaseRDB, 200, "SET x 1"))
+	assert.Nil(t, s.Close())
+	assert.Equal(t, []string{"SELECT 0", "SET a 1", "SELECT 2", "SET b 2", "SELECT 2", "INCR b", "SELECT 0", "DEL a", "SELECT 0", "SET c 3"}, readAOF(t, path))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestAOFSinkSnapshotKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewAOFSink(dir)
+	assert.Nil(t, err)
+	var end RDBStats
+	cfg := &Config{}
+	cfg.SetHooks(Hooks{OnRDBEnd: func(stats RDBStats) { end = stats }})
+	c := &Canal{cfg: cfg, cmder: s, replId: "abc", offset: 10}
+
+	// the snapshot as decoded from the RDB
+	c.setPhase(PhaseRDB)
+	ping, _ := NewCommand("PING")
+	assert.Nil(t, c.Command(ping))
+	c.BeginRDB()
+	c.BeginDatabase(0)
+	c.Set([]byte("a"), []byte("1"), 0)
+	c.Set([]byte("b"), []byte("2"), 1700000000000)
+	c.BeginHash([]byte("h"), 1, 1700000000001)
+	c.Hset([]byte("h"), []byte("f"), []byte("v"))
+	c.EndHash([]byte("h"))
+	c.BeginStream([]byte("s"), 1, 0)
+	c.Xadd([]byte("s"), []byte("1-0"), []byte("f v"))
+	c.EndStream([]byte("s"))
+	c.BeginList([]byte("l"), 1, 0)
+	c.Rpush([]byte("l"), []byte("x"))
+	c.EndList([]byte("l"))
+	c.EndDatabase(0)
+	c.EndRDB()
+	c.setPhase(PhaseStreaming)
+	assert.Nil(t, c.Command(ping))
+	assert.Nil(t, s.Close())
+
+	assert.Equal(t, []string{
+		"SELECT 0", "SET a 1", "SET b 2", "PEXPIREAT b 1700000000000",
+		"HSET h f v", "PEXPIREAT h 1700000000001", "RPUSH l x",
+	}, readAOF(t, filepath.Join(dir, "appendonly.aof")))
+	assert.Equal(t, int64(5), end.Keys)
+	assert.Equal(t, int64(1), end.Skipped)
+}
+
+func TestAOFSinkMultiPart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	manifest := filepath.Join(dir, "appendonly.aof.manifest")
+
+	s, err := NewAOFSink(dir, AOFSinkMultiPart(true), AOFSinkFsync(FsyncAlways))
+	assert.Nil(t, err)
+	assert.Nil(t, aofCommands(s, PhaseRDB, 100, "SET a 1"))
+	assert.Nil(t, aofCommands(s, PhaseStreaming, 110, "SET b 2"))
+	assert.Equal(t, int64(110), s.Applied())
+	assert.Nil(t, s.Close())
+	b, err := ioutil.ReadFile(manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, "file appendonly.aof.1.base.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n", string(b))
+	assert.Equal(t, []string{"SELECT 0", "SET a 1"}, readAOF(t, filepath.Join(dir, "appendonly.aof.1.base.aof")))
+	assert.Equal(t, []string{"SELECT 0", "SET b 2"}, readAOF(t, filepath.Join(dir, "appendonly.aof.1.incr.aof")))
+
+	// a new snapshot replaces the files once complete
+	s, err = NewAOFSink(dir, AOFSinkMultiPart(true))
+	assert.Nil(t, err)
+	assert.Nil(t, aofCommands(s, PhaseStreaming, 120, "SET c 3"))
+	assert.Nil(t, aofCommands(s, PhaseRDB, 200, "SET x 1"))
+	assert.Nil(t, aofCommands(s, PhaseStreaming, 210, "SET y 2"))
+	assert.Nil(t, s.Close())
+	b, err = ioutil.ReadFile(manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, "file appendonly.aof.2.base.aof seq 2 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n", string(b))
+	assert.Equal(t, []string{"SELECT 0", "SET x 1"}, readAOF(t, filepath.Join(dir, "appendonly.aof.2.base.aof")))
+	assert.Equal(t, []string{"SELECT 0", "SET y 2"}, readAOF(t, filepath.Join(dir, "appendonly.aof.2.incr.aof")))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 3)
+}
+
+func TestAOFSinkEmptySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "appendonly.aof")
+
+	s, err := NewAOFSink(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, aofCommands(s, PhaseStreaming, 10, "SET a 1"))
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, int64(10), s.Applied())
+
+	// an interrupted snapshot is started over by the next one
+	assert.Nil(t, aofCommands(s, PhaseRDB, 100, "PING", "SET x 1"))
+	assert.Equal(t, int64(-1), s.Applied())
+	// the master has no key left, the snapshot holds the PING only
+	assert.Nil(t, aofCommands(s, PhaseRDB, 200, "PING"))
+	assert.Nil(t, aofCommands(s, PhaseStreaming, 214, "PING"))
+	assert.Equal(t, int64(214), s.Applied())
+	assert.Empty(t, readAOF(t, path))
+
+	assert.Nil(t, aofCommands(s, PhaseStreaming, 230, "SET b 2"))
+	assert.Nil(t, s.Close())
+	assert.Equal(t, int64(230), s.Applied())
+	assert.Equal(t, []string{"SELECT 0", "SET b 2"}, readAOF(t, path))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
@@ -20,7 +20,10 @@ import (
 	"bytes"
 	"errors"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -35,16 +38,23 @@ type Config struct {
 	opts  []DialOption
 
 	repl_master bool
+	sentinel    *sentinel
+	metrics     *InstanceMetrics
+	logger      Logger
+	hooks       *Hooks
+
+	spillDir string
+	spillMax int64
+
+	fullSyncs *fullSyncLimiter
 }
 
 func iter(i int) []struct{} { return make([]struct{}, i) }
 
 func (c *Config) reconfig() error {
 	for i := range c.conns {
-		err := c.conns[i].Close()
-		if err != nil {
-			return err
-		}
+		// the connection may already be broken, which is why we redial
+		_ = c.conns[i].Close()
 	}
 	for i := range iter(1) {
 		conn, err := dial("tcp", c.addr, c.opts...)
@@ -76,22 +86,54 @@ func NewConfig(addr string, opts ...DialOption) (*Config, error) {
 func (c *Config) ReplMaster()          { c.repl_master = true }
 func (c *Config) Connection() net.Conn { return c.conns[0] }
 
+// SetMetrics attaches m to the Canal instances of c, nil detaches it. The
+// master_repl_offset the offset lag is computed against is polled by the
+// LagTracker of the Canal, or every 5s on a side connection without one.
+func (c *Config) SetMetrics(m *Metrics) {
+	if m == nil {
+		c.metrics = nil
+		return
+	}
+	c.metrics = m.Instance(c.addr)
+}
+
+// Checkpoint is a replication position a Canal can be resumed from,
+// see FromCheckpointCanal. DB is the database selected by the stream at
+// Offset: a partial resync does not select it again.
+type Checkpoint struct {
+	ReplId string `json:"repl_id"`
+	Offset int64  `json:"offset"`
+	DB     int    `json:"db,omitempty"`
+}
+
 type Canal struct {
 	cfg *Config
 
-	cmder CommandDecoder
+	cmder  CommandDecoder
+	cmdErr error
+	lag    *LagTracker
 
 	ip     string
 	port   string
-	db     int
+	db     int64 // selected by the stream
 	replId string
 	offset int64
 
 	wr   *writer
 	resp *reader
 
+	rdb          rdbProgress
+	fullSyncHeld bool
+
+	phase   int32
+	resync  int32
+	pauseC  chan struct{}
+	lastErr error
+
 	ackErrC      chan error
 	closeReplica chan struct{}
+	closeOnce    sync.Once
+	mu           sync.Mutex
 
 	redisInfo map[string]map[string]string
 }
@@ -107,6 +149,7 @@ func NewCanal(cfg *Config) (*Canal, error) {
 func newCanal(cfg *Config) (*Canal, error) {
 	c := new(Canal)
 	c.closeReplica = make(chan struct{})
+	c.ackErrC = make(chan error, 1)
 	c.cfg = cfg
 	c.offset = -1
 
@@ -115,6 +158,7 @@ func newCanal(cfg *Config) (*Canal, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.cfg.metrics.SetMasterOffset(c.masterReplOffset())
 
 	if !c.cfg.repl_master {
 		return c, nil
@@ -132,30 +176,114 @@ func newCanal(cfg *Config) (*Canal, error) {
 	return c, nil
 }
 
+// FromOffsetCanal returns a Canal resuming the replication of replId after
+// offset, the offset of the last byte received as returned by Checkpoint.
 func FromOffsetCanal(cfg *Config, replId string, offset int64) (*Canal, error) {
 	c, err := newCanal(cfg)
 	if err != nil {
 		return nil, err
 	}
-	c.replId = replId
+	c.setReplId(replId)
 	c.set(offset)
 
 	return c, nil
 }
 
+// FromCheckpointCanal returns a Canal resuming the replication after cp.
+// Once the master continues, a SELECT of cp.DB is passed to the
+// CommandDecoder before the stream, unless it is 0.
+func FromCheckpointCanal(cfg *Config, cp Checkpoint) (*Canal, error) {
+	c, err := FromOffsetCanal(cfg, cp.ReplId, cp.Offset)
+	if err != nil {
+		return nil, err
+	}
+	c.db = int64(cp.DB)
+	return c, nil
+}
+
 func (c *Canal) Run(commandDecode CommandDecoder) error {
 	if commandDecode == nil {
 		return errors.New("command decode is nil")
 	}
 	c.cmder = commandDecode
+	defer c.setPhase(PhaseStopped)
+	if c.cfg.metrics != nil && c.lag == nil {
+		t := newLagTracker(c)
+		t.Start()
+		defer t.Close()
+	}
+
+	if c.cfg.sentinel != nil {
+		return c.followMaster()
+	}
+
+	for {
+		err := c.dumpAndParse()
+		if c.closed() {
+			return nil
+		}
+		c.setLastErr(err)
+		if !c.takeResync() {
+			return err
+		}
+		c.cfg.hooks.reconnect(err, 1)
+		c.mu.Lock()
+		err = c.cfg.reconfig()
+		c.mu.Unlock()
+		if err != nil {
+			c.setLastErr(err)
+			return err
+		}
+	}
+}
+
+// Close stops the replication, Run returns once the connection is closed.
+func (c *Canal) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closeReplica)
+		c.mu.Lock()
+		for i := range c.cfg.conns {
+			_ = c.cfg.conns[i].Close()
+		}
+		c.mu.Unlock()
+	})
+}
+
+func (c *Canal) closed() bool {
+	select {
+	case <-c.closeReplica:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Canal) GetReplId() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replId
+}
 
-	return c.dumpAndParse()
+func (c *Canal) setReplId(replId string) {
+	c.mu.Lock()
+	c.replId = replId
+	c.mu.Unlock()
 }
 
-func (c *Canal) Close()            { c.closeReplica <- struct{}{} }
-func (c *Canal) GetReplId() string { return c.replId }
+// Checkpoint returns the replication position reached so far. During a
+// snapshot, which cannot be resumed, it has no ReplId and an Offset of -1.
+func (c *Canal) Checkpoint() Checkpoint {
+	if c.Phase() == PhaseRDB {
+		return Checkpoint{Offset: -1}
+	}
+	return Checkpoint{ReplId: c.GetReplId(), Offset: atomic.LoadInt64(&c.offset), DB: int(atomic.LoadInt64(&c.db))}
+}
 
-func (c *Canal) getNetConn() net.Conn { return c.cfg.conns[0] }
+func (c *Canal) getNetConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg.conns[0]
+}
 
 func (c *Canal) replconf() error {
 	conn := c.getNetConn()
@@ -221,15 +349,21 @@ func (c *Canal) replconf() error {
 		}
 	}
 
-	if c.replId == "" {
-		c.replId = "?"
+	replId := c.GetReplId()
+	if replId == "" {
+		replId = "?"
+		c.setReplId(replId)
 	}
-
-	return c.wr.writeMultiBulk("psync", c.replId, c.offset)
+	if replId == "?" {
+		return c.wr.writeMultiBulk("psync", replId, -1)
+	}
+	// the offset is that of the last byte received, the master sends from
+	// the one following it
+	return c.wr.writeMultiBulk("psync", replId, atomic.LoadInt64(&c.offset)+1)
 }
 
 func (c *Canal) info() error {
-	rw := NewRedisReaderWriter(c.cfg.conns[0])
+	rw := NewRedisReaderWriter(c.getNetConn())
 	err := rw.writeMultiBulk("info")
 	if err != nil {
 		return err
@@ -275,6 +409,15 @@ func (c *Canal) version() string {
 	return version
 }
 
+func (c *Canal) masterReplOffset() int64 {
+	replication, ok := c.redisInfo["Replication"]
+	if !ok {
+		return 0
+	}
+	offset, _ := strconv.ParseInt(replication["master_repl_offset"], 10, 64)
+	return offset
+}
+
 func (c *Canal) realMaster() (string, string) {
 	replication, ok := c.redisInfo["Replication"]
 	if !ok {
@@ -292,7 +435,7 @@ func (c *Canal) realMaster() (string, string) {
 	if !ok {
 		return "", ""
 	}
-	c.replId = replId
+	c.setReplId(replId)
 
 	return host, port
 }
@@ -0,0 +1,87 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoints are the positions saved by a CheckpointStore: the Checkpoint
+// of a single instance, or one per shard of a cluster.
+type Checkpoints struct {
+	Checkpoint
+	Shards map[string]Checkpoint `json:"shards,omitempty"`
+}
+
+// CheckpointStore persists replication positions.
+type CheckpointStore interface {
+	// Load returns the zero Checkpoints if nothing was saved yet.
+	Load() (Checkpoints, error)
+	Save(cps Checkpoints) error
+}
+
+// FileCheckpointStore stores Checkpoints in a JSON file, replaced atomically
+// on Save:
+//
+//	{"repl_id": "...", "offset": 42}
+type FileCheckpointStore struct {
+	Path string
+}
+
+func (s FileCheckpointStore) Load() (Checkpoints, error) {
+	var cps Checkpoints
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return cps, nil
+	} else if err != nil {
+		return cps, err
+	}
+	if err := json.Unmarshal(b, &cps); err != nil {
+		return cps, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	return cps, nil
+}
+
+func (s FileCheckpointStore) Save(cps Checkpoints) error {
+	b, err := json.Marshal(cps)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// resumable reports whether cp can be resumed from with PSYNC.
+func (cp Checkpoint) resumable() bool {
+	return cp.ReplId != "" && cp.ReplId != "?"
+}
@@ -0,0 +1,481 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterCanalOption specifies an option for a ClusterCanal.
+type ClusterCanalOption struct {
+	f func(*ClusterCanal)
+}
+
+// ClusterCanalDialOptions specifies the options used to dial every node.
+func ClusterCanalDialOptions(opts ...DialOption) ClusterCanalOption {
+	return ClusterCanalOption{func(cc *ClusterCanal) {
+		cc.dialOpts = opts
+	}}
+}
+
+// ClusterCanalRefreshInterval specifies how often the topology is
+// re-discovered to pick up resharding. Default is 10s.
+// A shard losing its link always triggers an immediate re-discovery.
+func ClusterCanalRefreshInterval(d time.Duration) ClusterCanalOption {
+	return ClusterCanalOption{func(cc *ClusterCanal) {
+		cc.refresh = d
+	}}
+}
+
+// ClusterCanalCheckpoints resumes the shards from previously saved
+// checkpoints, as returned by ClusterCanal.Checkpoints.
+func ClusterCanalCheckpoints(cps map[string]Checkpoint) ClusterCanalOption {
+	return ClusterCanalOption{func(cc *ClusterCanal) {
+		for id, cp := range cps {
+			cc.checkpoints[id] = cp
+		}
+	}}
+}
+
+// ClusterCanalLogger specifies the Logger of the ClusterCanal and of the
+// replica of every shard.
+func ClusterCanalLogger(l Logger) ClusterCanalOption {
+	return ClusterCanalOption{func(cc *ClusterCanal) {
+		cc.logger = l
+	}}
+}
+
+// ClusterCanalMetrics records the metrics of the replica of every shard
+// into m, labelled with the address of its master.
+func ClusterCanalMetrics(m *Metrics) ClusterCanalOption {
+	return ClusterCanalOption{func(cc *ClusterCanal) {
+		cc.metrics = m
+	}}
+}
+
+// ClusterCanalHooks specifies the Hooks of the replica of every shard.
+// OnMasterChange is also called when a shard moves to another master, and
+// OnReconnect before a shard is restarted on the same master after its
+// link broke.
+func ClusterCanalHooks(h Hooks) ClusterCanalOption {
+	return ClusterCanalOption{func(cc *ClusterCanal) {
+		cc.hooks = &h
+	}}
+}
+
+// ClusterCanal replicates every master of a Redis Cluster, merging their
+// streams into a single CommandDecoder. Each command carries the ID of its
+// shard, the node ID of the first master seen serving it, which survives
+// failovers so that checkpoints stay meaningful.
+type ClusterCanal struct {
+	seeds    []string
+	dialOpts []DialOption
+	refresh  time.Duration
+	logger   Logger
+	metrics  *Metrics
+	hooks    *Hooks
+
+	mu          sync.Mutex
+	shards      map[string]*clusterShard
+	checkpoints map[string]Checkpoint
+
+	cmdMu sync.Mutex
+	cmder CommandDecoder
+
+	errC      chan error
+	wake      chan struct{}
+	closeC    chan struct{}
+	closeOnce sync.Once
+}
+
+type clusterShard struct {
+	id      string
+	nodeID  string // current master
+	addr    string
+	members map[string]bool // node IDs ever seen in the shard
+	canal   *Canal
+	err     error // that stopped the last replica
+	retries int   // restarts on the same master since the last start
+}
+
+// shardStart is a shard to (re)start by reconcile.
+type shardStart struct {
+	sh      *clusterShard
+	old     string // address of the previous master
+	err     error  // that stopped the replica on the same master
+	attempt int
+}
+
+// NewClusterCanal returns a ClusterCanal discovering the cluster through seeds.
+func NewClusterCanal(seeds []string, opts ...ClusterCanalOption) (*ClusterCanal, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no cluster seed address")
+	}
+	cc := &ClusterCanal{
+		seeds:       seeds,
+		refresh:     10 * time.Second,
+		shards:      make(map[string]*clusterShard),
+		checkpoints: make(map[string]Checkpoint),
+		errC:        make(chan error, 1),
+		wake:        make(chan struct{}, 1),
+		closeC:      make(chan struct{}),
+		logger:      defaultLogger,
+	}
+	for _, opt := range opts {
+		opt.f(cc)
+	}
+	if _, err := cc.discover(); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Run replicates every shard until Close is called or the decoder fails.
+func (cc *ClusterCanal) Run(commandDecode CommandDecoder) error {
+	if commandDecode == nil {
+		return errors.New("command decode is nil")
+	}
+	cc.cmder = commandDecode
+	defer cc.stopAll()
+
+	ticker := time.NewTicker(cc.refresh)
+	defer ticker.Stop()
+	for {
+		if err := cc.reconcile(); err != nil {
+			cc.logger.Warn("cluster canal topology discovery failed", "err", err)
+		}
+		select {
+		case <-cc.closeC:
+			return nil
+		case err := <-cc.errC:
+			return err
+		case <-cc.wake:
+			// give the cluster a moment to elect a new master
+			select {
+			case <-cc.closeC:
+				return nil
+			case <-time.After(time.Second):
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops every shard, Run returns once they are closed.
+func (cc *ClusterCanal) Close() {
+	cc.closeOnce.Do(func() { close(cc.closeC) })
+}
+
+// Checkpoints returns the replication position of every shard.
+func (cc *ClusterCanal) Checkpoints() map[string]Checkpoint {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cps := make(map[string]Checkpoint, len(cc.shards))
+	for id, cp := range cc.checkpoints {
+		cps[id] = cp
+	}
+	for id, sh := range cc.shards {
+		if sh.canal != nil {
+			cps[id] = sh.canal.Checkpoint()
+		}
+	}
+	return cps
+}
+
+// Shards returns the address of the current master of every shard.
+func (cc *ClusterCanal) Shards() map[string]string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	addrs := make(map[string]string, len(cc.shards))
+	for id, sh := range cc.shards {
+		addrs[id] = sh.addr
+	}
+	return addrs
+}
+
+func (cc *ClusterCanal) stopAll() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for _, sh := range cc.shards {
+		cc.stop(sh)
+	}
+}
+
+// stop closes the replica of sh, keeping its checkpoint. A replica stopped
+// during its snapshot leaves none, the next one asks a full sync again.
+// cc.mu is held.
+func (cc *ClusterCanal) stop(sh *clusterShard) {
+	if sh.canal == nil {
+		return
+	}
+	if cp := sh.canal.Checkpoint(); cp.resumable() {
+		cc.checkpoints[sh.id] = cp
+	} else {
+		delete(cc.checkpoints, sh.id)
+	}
+	sh.canal.Close()
+	sh.canal = nil
+}
+
+// discover returns the cluster nodes, asking the known masters first.
+func (cc *ClusterCanal) discover() ([]clusterNodeInfo, error) {
+	cc.mu.Lock()
+	var addrs []string
+	for _, sh := range cc.shards {
+		addrs = append(addrs, sh.addr)
+	}
+	cc.mu.Unlock()
+	addrs = append(addrs, cc.seeds...)
+
+	var lastErr error = ErrNoClusterNode
+	for _, addr := range addrs {
+		nodes, err := clusterNodes(addr, cc.dialOpts...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return nodes, nil
+	}
+	return nil, lastErr
+}
+
+// reconcile maps the current masters onto shards, following failovers
+// through the replicas recorded for each shard, (re)starts the replicas
+// whose master changed and stops those of the masters gone from the
+// cluster. The masters are dialed without cc.mu held.
+func (cc *ClusterCanal) reconcile() error {
+	nodes, err := cc.discover()
+	if err != nil {
+		return err
+	}
+
+	cc.mu.Lock()
+	var starts []shardStart
+	masters := make(map[*clusterShard]bool)
+	for _, n := range nodes {
+		if !n.master || n.failed {
+			continue
+		}
+		sh := cc.shardOf(n.id)
+		if sh == nil {
+			sh = &clusterShard{id: n.id, members: make(map[string]bool)}
+			cc.shards[sh.id] = sh
+		}
+		masters[sh] = true
+		sh.members[n.id] = true
+		for _, r := range nodes {
+			if r.masterID == n.id {
+				sh.members[r.id] = true
+			}
+		}
+		if sh.nodeID == n.id && sh.addr == n.addr && sh.canal != nil {
+			continue
+		}
+		if sh.nodeID != "" && sh.nodeID != n.id {
+			cc.logger.Info("cluster canal shard master changed", "shard", sh.id, "from", sh.nodeID+"("+sh.addr+")", "to", n.id+"("+n.addr+")")
+		}
+		cc.stop(sh)
+		st := shardStart{sh: sh, old: sh.addr}
+		if sh.addr == n.addr && sh.err != nil {
+			sh.retries++
+			st.err, st.attempt = sh.err, sh.retries
+		}
+		sh.nodeID, sh.addr = n.id, n.addr
+		starts = append(starts, st)
+	}
+	for _, sh := range cc.shards {
+		if !masters[sh] && sh.canal != nil {
+			cc.logger.Info("cluster canal shard master gone", "shard", sh.id, "addr", sh.addr)
+			cc.stop(sh)
+		}
+	}
+	cc.mu.Unlock()
+
+	for _, st := range starts {
+		if st.attempt > 0 {
+			cc.hooks.reconnect(st.err, st.attempt)
+		} else if st.old != "" {
+			cc.hooks.masterChange(st.old, st.sh.addr)
+		}
+		err := cc.start(st.sh)
+		cc.mu.Lock()
+		if st.sh.err = err; err == nil {
+			st.sh.retries = 0
+		}
+		cc.mu.Unlock()
+		if err != nil {
+			cc.logger.Warn("cluster canal shard start failed", "shard", st.sh.id, "addr", st.sh.addr, "err", err)
+		}
+	}
+	return nil
+}
+
+func (cc *ClusterCanal) shardOf(nodeID string) *clusterShard {
+	if sh, ok := cc.shards[nodeID]; ok {
+		return sh
+	}
+	for _, sh := range cc.shards {
+		if sh.members[nodeID] {
+			return sh
+		}
+	}
+	return nil
+}
+
+// start runs a replica of the current master of sh. cc.mu is not held:
+// only the goroutine of Run changes the master of a shard.
+func (cc *ClusterCanal) start(sh *clusterShard) error {
+	cc.mu.Lock()
+	addr := sh.addr
+	cp := cc.checkpoints[sh.id]
+	cc.mu.Unlock()
+
+	cfg, err := NewConfig(addr, cc.dialOpts...)
+	if err != nil {
+		return err
+	}
+	cfg.SetLogger(cc.logger)
+	if cc.metrics != nil {
+		cfg.SetMetrics(cc.metrics)
+	}
+	cfg.hooks = cc.hooks
+	var c *Canal
+	if cp.resumable() {
+		c, err = FromCheckpointCanal(cfg, cp)
+	} else {
+		c, err = NewCanal(cfg)
+	}
+	if err != nil {
+		_ = cfg.Connection().Close()
+		return err
+	}
+	cc.mu.Lock()
+	sh.canal = c
+	cc.mu.Unlock()
+
+	d := &shardDecoder{cc: cc, shard: sh.id}
+	go func() {
+		err := c.Run(d)
+		cc.mu.Lock()
+		if sh.canal == c {
+			cc.stop(sh)
+			sh.err = err
+		}
+		cc.mu.Unlock()
+		if d.err != nil {
+			select {
+			case cc.errC <- fmt.Errorf("shard %s: %v", sh.id, d.err):
+			default:
+			}
+			return
+		}
+		if err != nil {
+			cc.logger.Warn("cluster canal shard stopped", "shard", sh.id, "addr", cfg.addr, "err", err)
+			select {
+			case cc.wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
+
+// shardDecoder tags the commands of a shard and serialises them into the
+// decoder of the ClusterCanal.
+type shardDecoder struct {
+	cc    *ClusterCanal
+	shard string
+	err   error
+}
+
+func (d *shardDecoder) Command(cmd *Command) error {
+	cmd.Shard = d.shard
+	d.cc.cmdMu.Lock()
+	err := d.cc.cmder.Command(cmd)
+	d.cc.cmdMu.Unlock()
+	if err != nil {
+		d.err = err
+	}
+	return err
+}
+
+type clusterNodeInfo struct {
+	id       string
+	addr     string
+	masterID string
+	master   bool
+	failed   bool
+}
+
+// clusterNodes returns the nodes reported by CLUSTER NODES on addr.
+func clusterNodes(addr string, opts ...DialOption) ([]clusterNodeInfo, error) {
+	conn, err := dial("tcp", addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rw := NewRedisReaderWriter(conn)
+	if err := rw.writeMultiBulk("CLUSTER", "NODES"); err != nil {
+		return nil, err
+	}
+	val, _, err := rw.readBulk()
+	if err != nil {
+		return nil, err
+	}
+	if err := val.Error(); err != nil {
+		return nil, err
+	}
+	return parseClusterNodes(val.String())
+}
+
+// parseClusterNodes parses lines of the form
+// <id> <ip:port@cport[,hostname]> <flags> <master> <ping> <pong> <epoch> <link> <slot>...
+func parseClusterNodes(s string) ([]clusterNodeInfo, error) {
+	var nodes []clusterNodeInfo
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("invalid CLUSTER NODES line %q", line)
+		}
+		addr := fields[1]
+		if i := strings.IndexAny(addr, "@,"); i >= 0 {
+			addr = addr[:i]
+		}
+		n := clusterNodeInfo{id: fields[0], addr: addr}
+		for _, flag := range strings.Split(fields[2], ",") {
+			switch flag {
+			case "master":
+				n.master = true
+			case "fail", "noaddr", "handshake":
+				n.failed = true
+			}
+		}
+		if fields[3] != "-" {
+			n.masterID = fields[3]
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseClusterNodes(t *testing.T) {
+	nodes, err := parseClusterNodes("" +
+		"07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected\n" +
+		"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922\n" +
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001,node1 myself,master - 0 0 1 connected 0-5460\n" +
+		"6ec23923021cf3ffec47632106199cb7f496ce01 127.0.0.1:30005 master,fail - 1426238316232 0 5 disconnected\n")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(nodes))
+	assert.Equal(t, "127.0.0.1:30004", nodes[0].addr)
+	assert.Equal(t, "e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca", nodes[0].masterID)
+	assert.False(t, nodes[0].master)
+	assert.True(t, nodes[1].master)
+	assert.Equal(t, "127.0.0.1:30001", nodes[2].addr)
+	assert.True(t, nodes[2].master)
+	assert.True(t, nodes[3].failed)
+
+	_, err = parseClusterNodes("garbage\n")
+	assert.NotNil(t, err)
+}
+
+// fakeCluster is a set of fake nodes answering CLUSTER NODES with the same
+// topology, where every node is a master accepting PSYNC.
+type fakeCluster struct {
+	mu       sync.Mutex
+	nodes    map[string]*fakeRedis
+	topology string
+}
+
+func newFakeCluster(t *testing.T, ids ...string) *fakeCluster {
+	fc := &fakeCluster{nodes: make(map[string]*fakeRedis)}
+	for _, id := range ids {
+		fc.nodes[id] = newFakeRedis(t, fc.reply)
+	}
+	return fc
+}
+
+func (fc *fakeCluster) reply(d []string) Value {
+	switch strings.ToUpper(d[0]) {
+	case "CLUSTER":
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return StringValue(fc.topology)
+	case "INFO":
+		return StringValue("# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n")
+	case "PSYNC":
+		return SimpleStringValue("CONTINUE abc")
+	}
+	return SimpleStringValue("OK")
+}
+
+// setTopology sets the nodes, given as "id flags master-id" lines.
+func (fc *fakeCluster) setTopology(lines ...string) {
+	var b strings.Builder
+	for _, line := range lines {
+		f := strings.Fields(line)
+		b.WriteString(f[0] + " " + fc.nodes[f[0]].addr() + "@1 " + f[1] + " " + f[2] + " 0 0 1 connected\n")
+	}
+	fc.mu.Lock()
+	fc.topology = b.String()
+	fc.mu.Unlock()
+}
+
+func (fc *fakeCluster) psyncs(id string) int {
+	n := 0
+	for _, cmd := range fc.nodes[id].commands() {
+		if strings.HasPrefix(cmd, "psync") {
+			n++
+		}
+	}
+	return n
+}
+
+func (fc *fakeCluster) close() {
+	for _, n := range fc.nodes {
+		n.close()
+	}
+}
+
+func TestClusterCanal(t *testing.T) {
+	fc := newFakeCluster(t, "a", "b", "c")
+	defer fc.close()
+	fc.setTopology("a master -", "b master -", "c slave b")
+
+	var mu sync.Mutex
+	var changes []string
+	cc, err := NewClusterCanal([]string{fc.nodes["a"].addr()},
+		ClusterCanalRefreshInterval(10*time.Millisecond), ClusterCanalLogger(NopLogger{}),
+		ClusterCanalHooks(Hooks{OnMasterChange: func(old, new string) {
+			mu.Lock()
+			changes = append(changes, old+" "+new)
+			mu.Unlock()
+		}}))
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() { done <- cc.Run(&nopCommander{}) }()
+
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("condition not met")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	running := func(id string) bool {
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		return cc.shards[id] != nil && cc.shards[id].canal != nil
+	}
+	waitFor(func() bool { return running("a") && running("b") })
+	assert.Equal(t, map[string]string{"a": fc.nodes["a"].addr(), "b": fc.nodes["b"].addr()}, cc.Shards())
+	assert.Equal(t, 1, fc.psyncs("a"))
+	assert.Equal(t, 1, fc.psyncs("b"))
+
+	// a leaves the cluster, c takes over from b
+	fc.setTopology("b master,fail -", "c master -")
+	waitFor(func() bool { return !running("a") && cc.Shards()["b"] == fc.nodes["c"].addr() && running("b") })
+	waitFor(func() bool { return fc.psyncs("c") > 0 })
+	assert.Equal(t, 1, fc.psyncs("c"))
+	mu.Lock()
+	assert.Equal(t, []string{fc.nodes["b"].addr() + " " + fc.nodes["c"].addr()}, changes)
+	mu.Unlock()
+	assert.Equal(t, "abc", cc.Checkpoints()["a"].ReplId)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, fc.psyncs("a"))
+
+	cc.Close()
+	assert.Nil(t, <-done)
+}
+
+func TestClusterCanalStopInSnapshot(t *testing.T) {
+	cc := &ClusterCanal{checkpoints: map[string]Checkpoint{"a": {ReplId: "abc", Offset: 5}, "b": {ReplId: "abc", Offset: 5}}}
+	shard := func(id string, phase Phase) *clusterShard {
+		c := &Canal{cfg: &Config{}, replId: "abc", offset: 10, closeReplica: make(chan struct{})}
+		c.setPhase(phase)
+		return &clusterShard{id: id, canal: c}
+	}
+
+	// neither the position of a snapshot cut short nor the one before it can
+	// be resumed from
+	cc.stop(shard("a", PhaseRDB))
+	cc.stop(shard("b", PhaseStreaming))
+	assert.Equal(t, map[string]Checkpoint{"b": {ReplId: "abc", Offset: 10}}, cc.Checkpoints())
+}
+
+func TestClusterCanalCloseWhileWaiting(t *testing.T) {
+	fc := newFakeCluster(t, "a")
+	defer fc.close()
+	fc.setTopology("a master -")
+
+	cc, err := NewClusterCanal([]string{fc.nodes["a"].addr()}, ClusterCanalLogger(NopLogger{}))
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() { done <- cc.Run(&nopCommander{}) }()
+
+	// Run waits for the election of a new master
+	cc.wake <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	cc.Close()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Run not returned")
+	}
+}
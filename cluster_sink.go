@@ -0,0 +1,586 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrCrossSlot     = errors.New("CROSSSLOT keys in request don't hash to the same slot")
+	ErrNoClusterNode = errors.New("unable to reach any cluster node")
+)
+
+// ClusterSinkOption specifies an option for a ClusterSink.
+type ClusterSinkOption struct {
+	f func(*clusterSinkOptions)
+}
+
+type clusterSinkOptions struct {
+	dialOpts      []DialOption
+	window        int
+	flushInterval time.Duration
+	maxRedirects  int
+	onApplied     func(offset int64)
+}
+
+// ClusterSinkDialOptions specifies the options used to dial cluster nodes.
+func ClusterSinkDialOptions(opts ...DialOption) ClusterSinkOption {
+	return ClusterSinkOption{func(o *clusterSinkOptions) {
+		o.dialOpts = opts
+	}}
+}
+
+// ClusterSinkWindow specifies how many commands may be in flight across
+// all nodes before the sink waits for their replies. Default is 128.
+func ClusterSinkWindow(n int) ClusterSinkOption {
+	return ClusterSinkOption{func(o *clusterSinkOptions) {
+		o.window = n
+	}}
+}
+
+// ClusterSinkFlushInterval specifies how long a partially filled window
+// may wait before it is flushed. Default is 100ms.
+func ClusterSinkFlushInterval(d time.Duration) ClusterSinkOption {
+	return ClusterSinkOption{func(o *clusterSinkOptions) {
+		o.flushInterval = d
+	}}
+}
+
+// ClusterSinkMaxRedirects specifies how many MOVED/ASK redirections or
+// node failures a command may go through. Default is 5.
+func ClusterSinkMaxRedirects(n int) ClusterSinkOption {
+	return ClusterSinkOption{func(o *clusterSinkOptions) {
+		o.maxRedirects = n
+	}}
+}
+
+// ClusterSinkOnApplied registers a callback receiving the replication offset
+// up to which every command was acknowledged by the cluster.
+func ClusterSinkOnApplied(fn func(offset int64)) ClusterSinkOption {
+	return ClusterSinkOption{func(o *clusterSinkOptions) {
+		o.onApplied = fn
+	}}
+}
+
+// ClusterSink is a CommandDecoder replaying the replication stream into a
+// Redis Cluster, routing each command to the master owning its slot.
+type ClusterSink struct {
+	seeds []string
+	opts  clusterSinkOptions
+
+	sinkCore
+	slots    [ClusterSlots]string
+	nodes    map[string]*clusterNode
+	inFlight int
+	lastSent int64
+	multi    []*Command // queued transaction, nil outside MULTI
+	inMulti  bool
+
+	applied int64
+}
+
+type clusterNode struct {
+	addr    string
+	conn    net.Conn
+	wr      *writer
+	rd      *reader
+	pending []*clusterRequest
+}
+
+// clusterRequest is a group of commands written back to back to one node,
+// such as MULTI ... EXEC or ASKING followed by the command.
+type clusterRequest struct {
+	cmds      []*Command
+	slot      int
+	ask       string // target of an ASK redirection, sent with ASKING
+	redirects int
+}
+
+// NewClusterSink loads the slot map from the first reachable seed.
+func NewClusterSink(seeds []string, opts ...ClusterSinkOption) (*ClusterSink, error) {
+	s := &ClusterSink{
+		seeds: seeds,
+		opts: clusterSinkOptions{
+			window:        128,
+			flushInterval: 100 * time.Millisecond,
+			maxRedirects:  5,
+		},
+		nodes:    make(map[string]*clusterNode),
+		lastSent: -1,
+		applied:  -1,
+	}
+	for _, opt := range opts {
+		opt.f(&s.opts)
+	}
+	if err := s.loadSlots(); err != nil {
+		return nil, err
+	}
+	s.startFlusher(s.opts.flushInterval, func() error {
+		if s.inFlight == 0 {
+			return nil
+		}
+		return s.sync()
+	})
+	return s, nil
+}
+
+// Applied returns the offset up to which every command was acknowledged.
+func (s *ClusterSink) Applied() int64 { return atomic.LoadInt64(&s.applied) }
+
+// Command implements CommandDecoder.
+func (s *ClusterSink) Command(cmd *Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+	switch cmd.Name() {
+	case "", "PING", "REPLCONF":
+		if cmd.Phase == PhaseRDB {
+			// the start of a snapshot, possibly an empty one
+			if err := s.fail(s.sync()); err != nil {
+				return err
+			}
+			s.lastSent = -1
+			atomic.StoreInt64(&s.applied, -1)
+		} else if !s.inMulti && s.inFlight == 0 && cmd.Offset > s.lastSent {
+			s.lastSent = cmd.Offset
+		}
+		return nil
+	case "SELECT":
+		if len(cmd.D) != 2 || cmd.D[1] != "0" {
+			return s.fail(fmt.Errorf("cluster target only supports database 0, got %q", cmd.String()))
+		}
+		return nil
+	case "MULTI":
+		s.inMulti, s.multi = true, nil
+		return nil
+	case "DISCARD":
+		s.inMulti, s.multi = false, nil
+		return nil
+	case "EXEC":
+		return s.fail(s.exec())
+	}
+	if s.inMulti {
+		s.multi = append(s.multi, cmd)
+		return nil
+	}
+	return s.fail(s.route(cmd))
+}
+
+// Flush sends the buffered commands and waits for their replies.
+func (s *ClusterSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.fail(s.sync())
+}
+
+// Close flushes the pending commands and closes every node connection.
+func (s *ClusterSink) Close() error {
+	s.stopFlusher()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.err == nil {
+		err = s.sync()
+	}
+	for _, n := range s.nodes {
+		_ = n.conn.Close()
+	}
+	return err
+}
+
+// route sends cmd to the owner of its slot, splitting the multi-key
+// commands that Redis Cluster allows to be split.
+func (s *ClusterSink) route(cmd *Command) error {
+	spec, ok := cmd.Spec()
+	if !ok {
+		return s.any(cmd)
+	}
+	idx := spec.KeyIndexes(cmd.D)
+	if len(idx) == 0 {
+		switch cmd.Name() {
+		case "FLUSHALL", "FLUSHDB", "SCRIPT", "FUNCTION":
+			return s.broadcast(cmd)
+		case "SWAPDB":
+			return fmt.Errorf("%q is not supported by a cluster target", cmd.String())
+		}
+		return s.any(cmd)
+	}
+
+	slot := KeySlot(cmd.D[idx[0]])
+	same := true
+	for _, i := range idx[1:] {
+		if KeySlot(cmd.D[i]) != slot {
+			same = false
+			break
+		}
+	}
+	if same {
+		return s.enqueue(&clusterRequest{cmds: []*Command{cmd}, slot: slot})
+	}
+
+	switch cmd.Name() {
+	case "MSET":
+		return s.split(cmd, idx, 2)
+	case "DEL", "UNLINK":
+		return s.split(cmd, idx, 1)
+	}
+	return fmt.Errorf("%q: %v", cmd.String(), ErrCrossSlot)
+}
+
+// split breaks cmd into one command per slot, each key carrying width
+// arguments (the key and its value for MSET).
+func (s *ClusterSink) split(cmd *Command, idx []int, width int) error {
+	var order []int
+	parts := make(map[int]*Command)
+	for _, i := range idx {
+		slot := KeySlot(cmd.D[i])
+		part, ok := parts[slot]
+		if !ok {
+			part = &Command{D: []string{cmd.D[0]}, Offset: cmd.Offset}
+			parts[slot] = part
+			order = append(order, slot)
+		}
+		part.D = append(part.D, cmd.D[i:i+width]...)
+	}
+	for _, slot := range order {
+		if err := s.enqueue(&clusterRequest{cmds: []*Command{parts[slot]}, slot: slot}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec sends the queued transaction, which must target a single slot.
+func (s *ClusterSink) exec() error {
+	cmds := s.multi
+	s.inMulti, s.multi = false, nil
+	slot := -1
+	for _, cmd := range cmds {
+		for _, key := range cmd.Keys() {
+			ks := KeySlot(key)
+			if slot == -1 {
+				slot = ks
+			} else if ks != slot {
+				return fmt.Errorf("transaction spans slots %d and %d: %v", slot, ks, ErrCrossSlot)
+			}
+		}
+	}
+	if slot == -1 {
+		slot = 0
+	}
+	multi, _ := NewCommand("MULTI")
+	exec, _ := NewCommand("EXEC")
+	req := &clusterRequest{slot: slot}
+	req.cmds = append(req.cmds, multi)
+	req.cmds = append(req.cmds, cmds...)
+	req.cmds = append(req.cmds, exec)
+	return s.enqueue(req)
+}
+
+func (s *ClusterSink) any(cmd *Command) error {
+	return s.enqueue(&clusterRequest{cmds: []*Command{cmd}, slot: 0})
+}
+
+func (s *ClusterSink) broadcast(cmd *Command) error {
+	seen := make(map[string]bool)
+	for slot, addr := range s.slots {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		n, err := s.node(addr)
+		if err != nil {
+			return err
+		}
+		if err := s.write(n, &clusterRequest{cmds: []*Command{cmd}, slot: slot}); err != nil {
+			return err
+		}
+	}
+	return s.maybeSync()
+}
+
+func (s *ClusterSink) enqueue(req *clusterRequest) error {
+	addr := s.slots[req.slot]
+	if addr == "" {
+		return fmt.Errorf("slot %d is not served by any node", req.slot)
+	}
+	n, err := s.node(addr)
+	if err != nil {
+		return err
+	}
+	if err := s.write(n, req); err != nil {
+		return err
+	}
+	return s.maybeSync()
+}
+
+func (s *ClusterSink) maybeSync() error {
+	if s.inFlight >= s.opts.window {
+		return s.sync()
+	}
+	return nil
+}
+
+func (s *ClusterSink) write(n *clusterNode, req *clusterRequest) error {
+	n.pending = append(n.pending, req)
+	s.inFlight += len(req.cmds)
+	for _, cmd := range req.cmds {
+		// the snapshot offset is only reached once the snapshot is applied,
+		// there is no position to resume from until then
+		switch {
+		case cmd.Phase == PhaseRDB:
+			s.lastSent = -1
+		case cmd.Offset > s.lastSent:
+			s.lastSent = cmd.Offset
+		}
+	}
+	if req.ask != "" {
+		if err := n.wr.writeValue(MultiBulkValue("ASKING")); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range req.cmds {
+		if err := n.wr.writeValue(MultiBulkValue(cmd.D[0], cmd.Args()...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ClusterSink) node(addr string) (*clusterNode, error) {
+	if n, ok := s.nodes[addr]; ok {
+		return n, nil
+	}
+	conn, err := dial("tcp", addr, s.opts.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	n := &clusterNode{addr: addr, conn: conn, wr: newWriter(conn), rd: newReader(conn)}
+	s.nodes[addr] = n
+	return n, nil
+}
+
+func (s *ClusterSink) dropNode(n *clusterNode) {
+	_ = n.conn.Close()
+	delete(s.nodes, n.addr)
+}
+
+// sync drains every node pipeline, following redirections and rerouting
+// the requests of failed nodes, until everything is acknowledged.
+func (s *ClusterSink) sync() error {
+	for s.inFlight > 0 {
+		var retry []*clusterRequest
+		for _, n := range s.nodes {
+			reqs, err := s.drain(n)
+			if err != nil {
+				return err
+			}
+			retry = append(retry, reqs...)
+		}
+		s.inFlight = 0
+		for _, req := range retry {
+			if req.redirects > s.opts.maxRedirects {
+				return fmt.Errorf("%q: too many cluster redirections", req.cmds[0].String())
+			}
+			if err := s.enqueueTo(req); err != nil {
+				return err
+			}
+		}
+	}
+	atomic.StoreInt64(&s.applied, s.lastSent)
+	if s.lastSent >= 0 && s.opts.onApplied != nil {
+		s.opts.onApplied(s.lastSent)
+	}
+	return nil
+}
+
+// enqueueTo writes a redirected request without triggering a nested sync.
+func (s *ClusterSink) enqueueTo(req *clusterRequest) error {
+	addr := s.slots[req.slot]
+	if req.ask != "" {
+		addr = req.ask
+	}
+	n, err := s.node(addr)
+	if err != nil {
+		if lerr := s.loadSlots(); lerr != nil {
+			return err
+		}
+		req.ask = ""
+		if n, err = s.node(s.slots[req.slot]); err != nil {
+			return err
+		}
+	}
+	return s.write(n, req)
+}
+
+// drain reads the replies of every request pending on n and returns the
+// requests that must be sent again elsewhere.
+func (s *ClusterSink) drain(n *clusterNode) ([]*clusterRequest, error) {
+	pending := n.pending
+	n.pending = nil
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	var retry []*clusterRequest
+	if err := n.wr.Flush(); err != nil {
+		return s.nodeFailed(n, pending, err)
+	}
+	for i, req := range pending {
+		replies := len(req.cmds)
+		if req.ask != "" {
+			replies++
+		}
+		var redirect string
+		var rerr error
+		for j := 0; j < replies; j++ {
+			val, _, err := n.rd.readBulk()
+			if err != nil {
+				return s.nodeFailed(n, pending[i:], err)
+			}
+			if err := replyError(val); err != nil && rerr == nil && redirect == "" {
+				msg := err.Error()
+				if strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ") {
+					redirect = msg
+				} else if !strings.HasPrefix(msg, "EXECABORT") {
+					rerr = fmt.Errorf("%q: %v", req.cmds[0].String(), err)
+				}
+			}
+		}
+		if redirect != "" {
+			if err := s.redirect(req, redirect); err != nil {
+				return nil, err
+			}
+			retry = append(retry, req)
+			continue
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+	return retry, nil
+}
+
+// redirect updates req and the slot map after a MOVED or ASK reply.
+func (s *ClusterSink) redirect(req *clusterRequest, msg string) error {
+	ss := strings.Fields(msg)
+	if len(ss) != 3 {
+		return fmt.Errorf("invalid redirection %q", msg)
+	}
+	slot, err := strconv.Atoi(ss[1])
+	if err != nil || slot < 0 || slot >= ClusterSlots {
+		return fmt.Errorf("invalid redirection %q", msg)
+	}
+	req.redirects++
+	if ss[0] == "ASK" {
+		req.ask = ss[2]
+		return nil
+	}
+	req.ask = ""
+	s.slots[slot] = ss[2]
+	return nil
+}
+
+// nodeFailed drops a broken node and reloads the slot map so that the
+// unacknowledged requests can be rerouted.
+func (s *ClusterSink) nodeFailed(n *clusterNode, pending []*clusterRequest, cause error) ([]*clusterRequest, error) {
+	s.dropNode(n)
+	if err := s.loadSlots(); err != nil {
+		return nil, fmt.Errorf("node %s: %v (%v)", n.addr, cause, err)
+	}
+	for _, req := range pending {
+		req.redirects++
+		req.ask = ""
+	}
+	return pending, nil
+}
+
+// loadSlots refreshes the slot map with CLUSTER SLOTS, asking the known
+// nodes first and the seeds last.
+func (s *ClusterSink) loadSlots() error {
+	var addrs []string
+	for addr := range s.nodes {
+		addrs = append(addrs, addr)
+	}
+	addrs = append(addrs, s.seeds...)
+	var lastErr error = ErrNoClusterNode
+	for _, addr := range addrs {
+		slots, err := clusterSlots(addr, s.opts.dialOpts...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.slots = slots
+		return nil
+	}
+	return lastErr
+}
+
+// clusterSlots returns the master address of every slot, as reported
+// by the node at addr.
+func clusterSlots(addr string, opts ...DialOption) (slots [ClusterSlots]string, err error) {
+	conn, err := dial("tcp", addr, opts...)
+	if err != nil {
+		return slots, err
+	}
+	defer conn.Close()
+	rw := NewRedisReaderWriter(conn)
+	if err := rw.writeMultiBulk("CLUSTER", "SLOTS"); err != nil {
+		return slots, err
+	}
+	val, _, err := rw.readBulk()
+	if err != nil {
+		return slots, err
+	}
+	if err := val.Error(); err != nil {
+		return slots, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	for _, rng := range val.Array() {
+		r := rng.Array()
+		if len(r) < 3 || len(r[2].Array()) < 2 {
+			return slots, fmt.Errorf("invalid CLUSTER SLOTS entry %q", rng.String())
+		}
+		start, end := r[0].Integer(), r[1].Integer()
+		master := r[2].Array()
+		ip := master[0].String()
+		if ip == "" || ip == "?" {
+			ip = host
+		}
+		owner := net.JoinHostPort(ip, strconv.Itoa(master[1].Integer()))
+		for slot := start; slot <= end && slot < ClusterSlots; slot++ {
+			slots[slot] = owner
+		}
+	}
+	return slots, nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, 12182, KeySlot("foo"))
+	assert.Equal(t, 5061, KeySlot("bar"))
+	assert.Equal(t, 12739, KeySlot("123456789"))
+	assert.Equal(t, KeySlot("user1000"), KeySlot("{user1000}.following"))
+	assert.Equal(t, KeySlot("{user1000}.followers"), KeySlot("{user1000}.following"))
+	assert.Equal(t, crc16([]byte("{}x"))&(ClusterSlots-1), uint16(KeySlot("{}x")))
+}
+
+// slotsReply answers CLUSTER SLOTS with the low half of the slots served
+// by low and the high half served by high.
+func slotsReply(low, high string) Value {
+	entry := func(start, end int, addr string) Value {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		return ArrayValue([]Value{
+			IntegerValue(start), IntegerValue(end),
+			ArrayValue([]Value{StringValue(host), IntegerValue(p)}),
+		})
+	}
+	return ArrayValue([]Value{entry(0, 8191, low), entry(8192, ClusterSlots-1, high)})
+}
+
+func TestClusterSink(t *testing.T) {
+	var low, high *fakeRedis
+	reply := func(d []string) Value {
+		if strings.EqualFold(d[0], "CLUSTER") {
+			return slotsReply(low.addr(), high.addr())
+		}
+		// "a" moved from low to high after the slot map was loaded
+		if d[0] == "SET" && d[1] == "a" && !strings.Contains(strings.Join(high.commands(), ","), "SET a") {
+			return ErrorValue(errors.New("MOVED 15495 " + high.addr()))
+		}
+		return SimpleStringValue("OK")
+	}
+	low = newFakeRedis(t, reply)
+	defer low.close()
+	high = newFakeRedis(t, reply)
+	defer high.close()
+
+	var applied int64
+	sink, err := NewClusterSink([]string{low.addr()},
+		ClusterSinkFlushInterval(time.Hour),
+		ClusterSinkOnApplied(func(offset int64) { applied = offset }),
+	)
+	assert.Nil(t, err)
+
+	// pretend the whole keyspace lives on low so that "a" gets redirected
+	for slot := range sink.slots {
+		sink.slots[slot] = low.addr()
+	}
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 1}))
+	assert.Nil(t, sink.Flush())
+	assert.Contains(t, high.commands(), "SET a 1")
+
+	for slot := range sink.slots {
+		if slot < 8192 {
+			sink.slots[slot] = low.addr()
+		} else {
+			sink.slots[slot] = high.addr()
+		}
+	}
+	assert.Nil(t, sink.Command(&Command{D: []string{"MSET", "foo", "1", "bar", "2", "b", "3"}, Offset: 2}))
+	assert.Nil(t, sink.Command(&Command{D: []string{"DEL", "{x}1", "{x}2"}, Offset: 3}))
+	assert.Nil(t, sink.Flush())
+	assert.Contains(t, high.commands(), "MSET foo 1")
+	assert.Contains(t, low.commands(), "MSET bar 2")
+	assert.Contains(t, low.commands(), "MSET b 3")
+	assert.Contains(t, high.commands(), "DEL {x}1 {x}2")
+	assert.Equal(t, int64(3), applied)
+
+	assert.Nil(t, sink.Command(&Command{D: []string{"MULTI"}, Offset: 4}))
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "foo", "1"}, Offset: 5}))
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "bar", "1"}, Offset: 6}))
+	err = sink.Command(&Command{D: []string{"EXEC"}, Offset: 7})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "CROSSSLOT")
+	_ = sink.Close()
+}
+
+func TestClusterSinkSnapshot(t *testing.T) {
+	var node *fakeRedis
+	node = newFakeRedis(t, func(d []string) Value {
+		if strings.EqualFold(d[0], "CLUSTER") {
+			return slotsReply(node.addr(), node.addr())
+		}
+		return SimpleStringValue("OK")
+	})
+	defer node.close()
+
+	sink, err := NewClusterSink([]string{node.addr()}, ClusterSinkFlushInterval(time.Hour))
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "old", "1"}, Offset: 50, Phase: PhaseStreaming}))
+	assert.Nil(t, sink.Flush())
+	assert.Equal(t, int64(50), sink.Applied())
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 100, Phase: PhaseRDB}))
+	assert.Nil(t, sink.Command(&Command{D: []string{"PING"}, Offset: 100, Phase: PhaseRDB}))
+	assert.Nil(t, sink.Flush())
+	assert.Equal(t, int64(-1), sink.Applied())
+
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "b", "1"}, Offset: 130, Phase: PhaseStreaming}))
+	assert.Nil(t, sink.Close())
+	assert.Equal(t, int64(130), sink.Applied())
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/yametech/canal"
+)
+
+func init() {
+	canal.RegisterSink("print", func() canal.SinkParams { return new(printSinkParams) })
+}
+
+// printSinkParams are the parameters of the "print" sink, writing the
+// commands to the standard output as tail does.
+type printSinkParams struct {
+	Format string `json:"format,omitempty"`
+}
+
+func (p *printSinkParams) Validate() error {
+	switch p.Format {
+	case "", "text", "json":
+		return nil
+	}
+	return &canal.FieldError{Field: "format", Msg: fmt.Sprintf("unknown format %q, one of text, json", p.Format)}
+}
+
+func (p *printSinkParams) Build() (canal.CommandDecoder, error) {
+	format := p.Format
+	if format == "" {
+		format = "text"
+	}
+	pr, err := newPrinter(os.Stdout, format)
+	if err != nil {
+		return nil, err
+	}
+	pr.live = true
+	return pr, nil
+}
+
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	var src source
+	src.register(fs)
+	format := fs.String("format", "text", "output format, text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pc, err := src.pipelineConfig(fs, map[string]interface{}{"type": "print", "format": *format})
+	if err != nil {
+		return err
+	}
+	return runConfig(pc, false)
+}
+
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	var src source
+	src.register(fs)
+	target := fs.String("target", "", "address of the target Redis")
+	targetPassword := fs.String("target-password", "", "password of the target Redis")
+	window := fs.Int("window", 128, "commands in flight to the target")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *target == "" {
+		return errors.New("-target is required")
+	}
+	pc, err := src.pipelineConfig(fs, map[string]interface{}{
+		"type":     "redis",
+		"addr":     *target,
+		"password": *targetPassword,
+		"window":   *window,
+	})
+	if err != nil {
+		return err
+	}
+	return runConfig(pc, false)
+}
+
+// runDump saves the snapshot and the commands following it in an AOF
+// redis-server can load, the "aof" sink of a pipeline. Resuming from a
+// checkpoint appends to the AOF; the commands written after the last
+// checkpoint saved are appended again.
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	var src source
+	src.register(fs)
+	out := fs.String("out", ".", "directory of the AOF")
+	multiPart := fs.Bool("multi-part", false, "write the multi-part AOF of Redis 7")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pc, err := src.pipelineConfig(fs, map[string]interface{}{
+		"type":       "aof",
+		"dir":        *out,
+		"multi_part": *multiPart,
+	})
+	if err != nil {
+		return err
+	}
+	return runConfig(pc, false)
+}
+
+func runRDB(args []string) error {
+	fs := flag.NewFlagSet("rdb", flag.ExitOnError)
+	format := fs.String("format", "text", "output format, text or json")
+	count := fs.Bool("count", false, "only print the number of commands by name")
+	out := fs.String("out", "", "rewrite the file to this RDB file instead of printing it")
+	version := fs.Int("version", 9, "RDB version written by -out")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: canal rdb [flags] file.rdb")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if *out != "" {
+		return rewriteRDB(bufio.NewReader(f), *out, *version)
+	}
+	if *count {
+		counts := make(commandCounter)
+		if err := canal.DecodeRDBCommands(bufio.NewReader(f), counts); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(counts))
+		for name := range counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s\t%d\n", name, counts[name])
+		}
+		return nil
+	}
+
+	p, err := newPrinter(os.Stdout, *format)
+	if err != nil {
+		return err
+	}
+	defer p.Flush()
+	return canal.DecodeRDBCommands(bufio.NewReader(f), p)
+}
+
+func runPipeline(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "log debug messages")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: canal run [flags] pipeline.json")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	pc, err := canal.LoadPipelineConfig(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return runConfig(pc, *verbose)
+}
+
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	dir := fs.String("dir", "", "directory of the segments recorded by a file sink")
+	from := fs.Int64("from", -1, "offset to start at")
+	since := fs.String("since", "", "time to start at, RFC 3339")
+	speed := fs.Float64("speed", 0, "pace relative to the recording, 0 for full speed")
+	target := fs.String("target", "", "address of a Redis to replay into instead of printing")
+	targetPassword := fs.String("target-password", "", "password of the target Redis")
+	format := fs.String("format", "text", "output format without -target, text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+	opts := []canal.ReplayerOption{canal.ReplaySpeed(*speed)}
+	if *from >= 0 {
+		opts = append(opts, canal.ReplayFromOffset(*from))
+	}
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return fmt.Errorf("-since: %v", err)
+		}
+		opts = append(opts, canal.ReplaySince(t))
+	}
+	r := canal.NewReplayer(*dir, opts...)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		r.Close()
+	}()
+
+	if *target == "" {
+		p, err := newPrinter(os.Stdout, *format)
+		if err != nil {
+			return err
+		}
+		defer p.Flush()
+		p.live = *speed > 0
+		return r.Run(p)
+	}
+	var dialOpts []canal.DialOption
+	if *targetPassword != "" {
+		dialOpts = append(dialOpts, canal.DialPassword(*targetPassword))
+	}
+	sink, err := canal.NewRedisSink(*target, canal.RedisSinkDialOptions(dialOpts...))
+	if err != nil {
+		return err
+	}
+	err = r.Run(sink)
+	if cerr := sink.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rewriteRDB writes the keys read from r into the RDB file out.
+func rewriteRDB(r io.Reader, out string, version int) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	w := canal.NewRDBWriter(f, canal.RDBWriterVersion(version))
+	if err := w.Err(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = canal.DecodeRDB(r, w)
+	if err == nil {
+		err = w.Err()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if n := w.Skipped(); n > 0 && err == nil {
+		fmt.Fprintf(os.Stderr, "%d stream keys skipped\n", n)
+	}
+	return err
+}
+
+type commandCounter map[string]int
+
+func (c commandCounter) Command(cmd *canal.Command) error {
+	c[cmd.Name()]++
+	return nil
+}
+
+// printer writes commands one per line, as text or canal.Event JSON.
+type printer struct {
+	w      *bufio.Writer
+	events *canal.EventWriter
+	live   bool // flush every line
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	p := &printer{w: bufio.NewWriter(w)}
+	switch format {
+	case "text":
+		return p, nil
+	case "json":
+		p.events = canal.NewEventWriter(p.w, canal.EventJSON)
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func (p *printer) Command(cmd *canal.Command) error {
+	if p.events != nil {
+		if err := p.events.Command(cmd); err != nil {
+			return err
+		}
+	} else {
+		p.w.WriteString(strconv.FormatInt(cmd.Offset, 10))
+		for _, arg := range cmd.D {
+			p.w.WriteByte(' ')
+			p.w.WriteString(quoteArg(arg))
+		}
+		if err := p.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	if p.live {
+		return p.w.Flush()
+	}
+	return nil
+}
+
+func (p *printer) Flush() { _ = p.w.Flush() }
+
+// Close flushes the printer when it is the sink of a pipeline.
+func (p *printer) Close() error { return p.w.Flush() }
+
+// quoteArg quotes arguments that would not read back as a single word.
+func quoteArg(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) || r == '"' {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
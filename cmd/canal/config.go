@@ -0,0 +1,96 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/yametech/canal"
+)
+
+// pipelineConfig returns the canal.PipelineConfig of a command writing to
+// sink: the pipeline file given by -config if any, completed by the flags
+// of s. Flags given on the command line win over the file, the others only
+// fill in what the file leaves out. The sink of the file is replaced.
+func (s *source) pipelineConfig(fs *flag.FlagSet, sink map[string]interface{}) (*canal.PipelineConfig, error) {
+	doc := make(map[string]interface{})
+	if s.configFile != "" {
+		b, err := ioutil.ReadFile(s.configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.configFile, err)
+		}
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	put := func(m map[string]interface{}, key, flag string, v interface{}) {
+		if _, ok := m[key]; !ok || set[flag] {
+			m[key] = v
+		}
+	}
+
+	src := object(doc, "source")
+	put(src, "addr", "addr", s.addr)
+	put(src, "password", "password", s.password)
+	put(src, "repl_master", "repl-master", s.replMaster)
+	put(src, "connect_timeout", "connect-timeout", s.connectTimeout.String())
+	put(src, "keep_alive", "", "1m")
+	if s.sentinels != "" {
+		put(src, "sentinel", "sentinels", map[string]interface{}{
+			"master_name": s.masterName,
+			"addrs":       strings.Split(s.sentinels, ","),
+		})
+	}
+	if _, ok := doc["checkpoint"]; ok || s.checkpoint != "" {
+		cp := object(doc, "checkpoint")
+		put(cp, "type", "checkpoint", "file")
+		put(cp, "path", "checkpoint", s.checkpoint)
+		put(cp, "interval", "checkpoint-interval", s.saveInterval.String())
+	}
+	doc["sink"] = sink
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := canal.ParsePipelineConfig(b)
+	if err != nil && s.configFile != "" {
+		return nil, fmt.Errorf("%s: %v", s.configFile, err)
+	}
+	return pc, err
+}
+
+// object returns the object at key of m, added if missing. A value of
+// another type is left for the pipeline config to report.
+func object(m map[string]interface{}, key string) map[string]interface{} {
+	v, ok := m[key]
+	if !ok {
+		obj := make(map[string]interface{})
+		m[key] = obj
+		return obj
+	}
+	if obj, ok := v.(map[string]interface{}); ok {
+		return obj
+	}
+	return make(map[string]interface{})
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command canal replicates a Redis master from the command line.
+//
+//	canal tail -addr 127.0.0.1:6379 [-format text|json]
+//	canal sync -addr 127.0.0.1:6379 -target 127.0.0.1:6380
+//	canal dump -addr 127.0.0.1:6379 -out ./dump [-multi-part]
+//	canal rdb [-format text|json] [-count] dump.rdb
+//	canal rdb -out old.rdb -version 7 dump.rdb
+//	canal replay -dir ./segments [-from offset] [-speed 1] [-target 127.0.0.1:6380]
+//	canal run pipeline.json
+//
+// tail, sync and dump run a canal.Pipeline with the sink of the command.
+// Their source and checkpoint can be read from a pipeline file, the one of
+// run, given by -config; flags given on the command line win over it. With
+// -checkpoint, they save their replication position to a file and resume
+// from it on the next run.
+//
+// Pipeline files, of run and -config, are JSON only: canal has no
+// dependency to read YAML or TOML with, convert such files to JSON first.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/yametech/canal"
+)
+
+const usage = `usage: canal <command> [flags]
+
+commands:
+  tail   print the live command stream
+  sync   replicate the source into a target Redis
+  dump   save the snapshot and the following commands to an AOF
+  rdb    print the commands of a local RDB file
+  replay replay the commands recorded by a file sink
+  run    run the pipeline declared in a file, see canal.PipelineConfig
+
+run "canal <command> -h" for the flags of a command
+`
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "tail":
+		err = runTail(args)
+	case "sync":
+		err = runSync(args)
+	case "dump":
+		err = runDump(args)
+	case "rdb":
+		err = runRDB(args)
+	case "replay":
+		err = runReplay(args)
+	case "run":
+		err = runPipeline(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Printf("%s: %v", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// source holds the flags selecting and dialing the master.
+type source struct {
+	addr           string
+	password       string
+	masterName     string
+	sentinels      string
+	replMaster     bool
+	connectTimeout time.Duration
+	checkpoint     string
+	saveInterval   time.Duration
+	configFile     string
+}
+
+func (s *source) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.addr, "addr", "127.0.0.1:6379", "address of the master")
+	fs.StringVar(&s.password, "password", "", "password of the master")
+	fs.StringVar(&s.masterName, "sentinel-master", "", "name of the master monitored by the sentinels")
+	fs.StringVar(&s.sentinels, "sentinels", "", "comma separated sentinel addresses, overrides -addr")
+	fs.BoolVar(&s.replMaster, "repl-master", false, "replicate the master of -addr if it is a replica")
+	fs.DurationVar(&s.connectTimeout, "connect-timeout", 10*time.Second, "dial timeout")
+	fs.StringVar(&s.checkpoint, "checkpoint", "", "file saving the replication position, resumed from if it exists")
+	fs.DurationVar(&s.saveInterval, "checkpoint-interval", time.Second, "how often the checkpoint file is saved")
+	fs.StringVar(&s.configFile, "config", "", "pipeline file of the source and checkpoint, see canal.PipelineConfig")
+}
+
+// runConfig runs the pipeline of pc until it fails or the process is
+// interrupted.
+func runConfig(pc *canal.PipelineConfig, verbose bool) error {
+	p, err := canal.NewPipeline(pc, canal.PipelineLogger(canal.StdLogger{Verbose: verbose}))
+	if err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		p.Close()
+	}()
+	return p.Run()
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yametech/canal"
+)
+
+func TestPipelineConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pipeline.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{
+		"source": {"addr": "10.0.0.1:6379", "password": "p#ss", "connect_timeout": "3s"},
+		"filters": [{"type": "db", "dbs": [0]}],
+		"sink": {"type": "file", "dir": "x"},
+		"checkpoint": {"type": "file", "path": "/tmp/cp.json"}
+	}`), 0644))
+
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	var src source
+	src.register(fs)
+	assert.Nil(t, fs.Parse([]string{"-config", path, "-checkpoint", "cli.json", "-repl-master"}))
+	pc, err := src.pipelineConfig(fs, map[string]interface{}{"type": "print", "format": "json"})
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:6379", pc.Source.Addr)
+	assert.Equal(t, "p#ss", pc.Source.Password)
+	assert.Equal(t, canal.Duration(3*time.Second), pc.Source.ConnectTimeout)
+	assert.Equal(t, canal.Duration(time.Minute), pc.Source.KeepAlive)
+	assert.True(t, pc.Source.ReplMaster)
+	assert.Equal(t, 1, len(pc.Filters))
+	assert.Equal(t, "print", pc.Sink.Type)
+	assert.Equal(t, "cli.json", pc.Checkpoint.Path)
+	assert.Equal(t, canal.Duration(time.Second), pc.Checkpoint.Interval)
+
+	// without a file, the flags alone make the pipeline
+	fs = flag.NewFlagSet("tail", flag.ContinueOnError)
+	src = source{}
+	src.register(fs)
+	assert.Nil(t, fs.Parse(nil))
+	pc, err = src.pipelineConfig(fs, map[string]interface{}{"type": "print"})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:6379", pc.Source.Addr)
+	assert.Nil(t, pc.Checkpoint)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"source": {"adr": "x"}}`), 0644))
+	fs = flag.NewFlagSet("tail", flag.ContinueOnError)
+	src = source{}
+	src.register(fs)
+	assert.Nil(t, fs.Parse([]string{"-config", path}))
+	_, err = src.pipelineConfig(fs, map[string]interface{}{"type": "print", "format": "xml"})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), path+": ")
+		assert.Contains(t, err.Error(), "adr")
+	}
+}
+
+func TestPrinter(t *testing.T) {
+	var sb strings.Builder
+	p, err := newPrinter(&sb, "text")
+	assert.Nil(t, err)
+	cmd, _ := canal.NewCommand("SET", "a key", "")
+	cmd.Offset = 7
+	assert.Nil(t, p.Command(cmd))
+	p.Flush()
+	assert.Equal(t, "7 SET \"a key\" \"\"\n", sb.String())
+
+	sb.Reset()
+	p, _ = newPrinter(&sb, "json")
+	cmd.ReplId, cmd.Phase = "abc", canal.PhaseStreaming
+	assert.Nil(t, p.Command(cmd))
+	p.Flush()
+	assert.Equal(t, `{"v":1,"repl_id":"abc","offset":7,"phase":"streaming","db":0,"command":"SET","keys":["a key"],"args":["a key",""]}`+"\n", sb.String())
+}
+
+// serveMaster answers PING, INFO and REPLCONF, then replies to PSYNC with psync
+// and closes the connection.
+func serveMaster(t *testing.T, psync func(args []string) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(rd)
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(args[0]) {
+					case "PING":
+						_, _ = io.WriteString(conn, "+PONG\r\n")
+					case "INFO":
+						info := "# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n"
+						_, _ = io.WriteString(conn, "$"+strconv.Itoa(len(info))+"\r\n"+info+"\r\n")
+					case "PSYNC":
+						_, _ = io.WriteString(conn, psync(args))
+						return
+					default:
+						_, _ = io.WriteString(conn, "+OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimRight(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cp := filepath.Join(dir, "cp.json")
+
+	var rdb bytes.Buffer
+	w := canal.NewRDBWriter(&rdb)
+	w.BeginRDB()
+	w.BeginDatabase(0)
+	w.Set([]byte("a"), []byte("1"), 0)
+	w.EndDatabase(0)
+	w.EndRDB()
+	assert.Nil(t, w.Err())
+
+	var psyncs [][]string
+	addr := serveMaster(t, func(args []string) string {
+		psyncs = append(psyncs, args)
+		if args[1] == "?" {
+			return "+FULLRESYNC abc 100\r\n$" + strconv.Itoa(rdb.Len()) + "\r\n" + rdb.String() +
+				"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+		}
+		return "+CONTINUE abc\r\n*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n"
+	})
+
+	args := []string{"-addr", addr, "-out", dir, "-checkpoint", cp}
+	assert.Equal(t, io.EOF, runDump(args))
+	cps, err := canal.FileCheckpointStore{Path: cp}.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, canal.Checkpoint{ReplId: "abc", Offset: 127}, cps.Checkpoint)
+
+	assert.Equal(t, io.EOF, runDump(args))
+	assert.Equal(t, []string{"psync", "abc", "128"}, psyncs[1])
+	aof, _ := ioutil.ReadFile(filepath.Join(dir, "appendonly.aof"))
+	assert.Equal(t, "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n"+
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"+
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n"+
+		"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"+
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n"+
+		"*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n", string(aof))
+}
@@ -24,6 +24,18 @@ import (
 // Command all the command combinations
 type Command struct {
 	D []string
+	// Offset is the replication offset reached once the command is applied.
+	// Commands translated from the RDB snapshot carry the snapshot offset.
+	Offset int64
+	// Shard is the ID of the cluster shard the command was replicated from,
+	// set by ClusterCanal.
+	Shard string
+	// ReplId is the replication ID of the master the command came from.
+	ReplId string
+	// Phase is PhaseRDB for commands translated from the snapshot,
+	// PhaseStreaming for the commands of the replication stream. Every
+	// snapshot starts with a PING of PhaseRDB, even an empty one.
+	Phase Phase
 }
 
 func (c *Command) Set(v ...string) { c.D = v }
@@ -42,8 +54,45 @@ func (c *Command) Args() []interface{} {
 	return args
 }
 
-func buildStrCommand(s string) []string {
-	return strings.Split(s, "\r\n")
+// Name returns the upper-cased command name.
+func (c *Command) Name() string {
+	if len(c.D) == 0 {
+		return ""
+	}
+	return strings.ToUpper(c.D[0])
+}
+
+// Spec returns the key-spec of the command from the built-in command table.
+func (c *Command) Spec() (*CommandSpec, bool) {
+	if len(c.D) == 0 {
+		return nil, false
+	}
+	return LookupCommand(c.D[0])
+}
+
+// Keys returns the key arguments of the command, in argument order.
+// Unknown commands have no keys.
+func (c *Command) Keys() []string {
+	s, ok := c.Spec()
+	if !ok {
+		return nil
+	}
+	idx := s.KeyIndexes(c.D)
+	keys := make([]string, len(idx))
+	for i := range idx {
+		keys[i] = c.D[idx[i]]
+	}
+	return keys
+}
+
+// buildStrCommand returns the arguments of a command array, which may hold
+// any byte, CRLF included.
+func buildStrCommand(v Value) []string {
+	args := make([]string, len(v.ArrayV))
+	for i := range v.ArrayV {
+		args[i] = v.ArrayV[i].String()
+	}
+	return args
 }
 
 func NewCommand(args ...string) (*Command, error) {
@@ -0,0 +1,365 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CommandFlag describes how a command touches the keyspace.
+type CommandFlag int
+
+const (
+	// CmdWrite marks commands that may modify the dataset.
+	CmdWrite CommandFlag = 1 << iota
+	// CmdReadOnly marks commands that never modify the dataset.
+	CmdReadOnly
+	// CmdAdmin marks connection or server level commands (SELECT, FLUSHALL...).
+	CmdAdmin
+	// CmdMovableKeys marks commands whose key positions depend on the arguments.
+	CmdMovableKeys
+)
+
+// CommandSpec is the key-spec of a command, modelled after COMMAND INFO.
+// Positions are indexes into Command.D, where 0 is the command name.
+// A negative LastKey counts from the end, -1 being the last argument.
+type CommandSpec struct {
+	Name     string
+	Arity    int // negative means at least -Arity arguments
+	Flags    CommandFlag
+	FirstKey int
+	LastKey  int
+	Step     int
+
+	movable func(d []string) []int
+}
+
+// IsWrite reports whether the command may modify the dataset.
+func (s *CommandSpec) IsWrite() bool { return s.Flags&CmdWrite != 0 }
+
+// CheckArity reports whether n arguments (including the name) are accepted.
+func (s *CommandSpec) CheckArity(n int) bool {
+	if s.Arity < 0 {
+		return n >= -s.Arity
+	}
+	return n == s.Arity
+}
+
+// KeyIndexes returns the positions of the keys within d.
+func (s *CommandSpec) KeyIndexes(d []string) []int {
+	var idx []int
+	if s.FirstKey > 0 {
+		last := s.LastKey
+		if last < 0 {
+			last = len(d) + last
+		}
+		step := s.Step
+		if step < 1 {
+			step = 1
+		}
+		for i := s.FirstKey; i <= last && i < len(d); i += step {
+			idx = append(idx, i)
+		}
+	}
+	if s.movable != nil {
+		idx = append(idx, s.movable(d)...)
+	}
+	return idx
+}
+
+// LookupCommand returns the spec of the named command, case-insensitively.
+func LookupCommand(name string) (*CommandSpec, bool) {
+	s, ok := commandTable[strings.ToLower(name)]
+	return s, ok
+}
+
+// numKeysAt handles commands of the form `CMD ... numkeys key [key ...]`,
+// with numkeys stored at position pos.
+func numKeysAt(pos int) func(d []string) []int {
+	return func(d []string) []int {
+		if len(d) <= pos {
+			return nil
+		}
+		n, err := strconv.Atoi(d[pos])
+		if err != nil || n < 0 {
+			return nil
+		}
+		var idx []int
+		for i := pos + 1; i <= pos+n && i < len(d); i++ {
+			idx = append(idx, i)
+		}
+		return idx
+	}
+}
+
+// tokenKey returns the argument following any of the given tokens,
+// like the destination of `SORT ... STORE dst`.
+func tokenKey(from int, tokens ...string) func(d []string) []int {
+	return func(d []string) []int {
+		var idx []int
+		for i := from; i < len(d)-1; i++ {
+			for _, t := range tokens {
+				if strings.EqualFold(d[i], t) {
+					idx = append(idx, i+1)
+					i++
+					break
+				}
+			}
+		}
+		return idx
+	}
+}
+
+// streamsKeys handles XREAD and XREADGROUP, where the keys are the first
+// half of the arguments following STREAMS.
+func streamsKeys(d []string) []int {
+	for i := 1; i < len(d); i++ {
+		if !strings.EqualFold(d[i], "STREAMS") {
+			continue
+		}
+		rest := len(d) - i - 1
+		var idx []int
+		for j := i + 1; j <= i+rest/2; j++ {
+			idx = append(idx, j)
+		}
+		return idx
+	}
+	return nil
+}
+
+// migrateKeys handles both `MIGRATE host port key db timeout` and the
+// `MIGRATE host port "" db timeout ... KEYS k1 k2` form.
+func migrateKeys(d []string) []int {
+	if len(d) > 3 && d[3] != "" {
+		return []int{3}
+	}
+	for i := 6; i < len(d); i++ {
+		if strings.EqualFold(d[i], "KEYS") {
+			var idx []int
+			for j := i + 1; j < len(d); j++ {
+				idx = append(idx, j)
+			}
+			return idx
+		}
+	}
+	return nil
+}
+
+// xgroupKeys handles XGROUP subcommands, all of which carry the key at 2.
+func xgroupKeys(d []string) []int {
+	if len(d) > 2 && !strings.EqualFold(d[1], "HELP") {
+		return []int{2}
+	}
+	return nil
+}
+
+func spec(name string, arity int, flags CommandFlag, first, last, step int) *CommandSpec {
+	return &CommandSpec{Name: name, Arity: arity, Flags: flags, FirstKey: first, LastKey: last, Step: step}
+}
+
+func movable(name string, arity int, flags CommandFlag, first, last, step int, fn func(d []string) []int) *CommandSpec {
+	s := spec(name, arity, flags|CmdMovableKeys, first, last, step)
+	s.movable = fn
+	return s
+}
+
+var commandTable = map[string]*CommandSpec{}
+
+func init() {
+	const (
+		w  = CmdWrite
+		r  = CmdReadOnly
+		ad = CmdAdmin
+	)
+	for _, s := range []*CommandSpec{
+		// strings
+		spec("set", -3, w, 1, 1, 1),
+		spec("setnx", 3, w, 1, 1, 1),
+		spec("setex", 4, w, 1, 1, 1),
+		spec("psetex", 4, w, 1, 1, 1),
+		spec("append", 3, w, 1, 1, 1),
+		spec("setrange", 4, w, 1, 1, 1),
+		spec("setbit", 4, w, 1, 1, 1),
+		spec("bitfield", -2, w, 1, 1, 1),
+		spec("bitop", -4, w, 2, -1, 1),
+		spec("incr", 2, w, 1, 1, 1),
+		spec("decr", 2, w, 1, 1, 1),
+		spec("incrby", 3, w, 1, 1, 1),
+		spec("decrby", 3, w, 1, 1, 1),
+		spec("incrbyfloat", 3, w, 1, 1, 1),
+		spec("getset", 3, w, 1, 1, 1),
+		spec("getdel", 2, w, 1, 1, 1),
+		spec("getex", -2, w, 1, 1, 1),
+		spec("mset", -3, w, 1, -1, 2),
+		spec("msetnx", -3, w, 1, -1, 2),
+		spec("get", 2, r, 1, 1, 1),
+		spec("mget", -2, r, 1, -1, 1),
+		spec("strlen", 2, r, 1, 1, 1),
+		spec("getrange", 4, r, 1, 1, 1),
+		spec("getbit", 3, r, 1, 1, 1),
+		spec("bitcount", -2, r, 1, 1, 1),
+
+		// generic keyspace
+		spec("del", -2, w, 1, -1, 1),
+		spec("unlink", -2, w, 1, -1, 1),
+		spec("expire", -3, w, 1, 1, 1),
+		spec("pexpire", -3, w, 1, 1, 1),
+		spec("expireat", -3, w, 1, 1, 1),
+		spec("pexpireat", -3, w, 1, 1, 1),
+		spec("persist", 2, w, 1, 1, 1),
+		spec("rename", 3, w, 1, 2, 1),
+		spec("renamenx", 3, w, 1, 2, 1),
+		spec("move", 3, w, 1, 1, 1),
+		spec("copy", -3, w, 1, 2, 1),
+		spec("restore", -4, w, 1, 1, 1),
+		spec("restore-asking", -4, w, 1, 1, 1),
+		movable("sort", -2, w, 1, 1, 1, tokenKey(2, "STORE")),
+		spec("sort_ro", -2, r, 1, 1, 1),
+		movable("migrate", -6, w, 0, 0, 0, migrateKeys),
+		spec("exists", -2, r, 1, -1, 1),
+		spec("type", 2, r, 1, 1, 1),
+		spec("ttl", 2, r, 1, 1, 1),
+		spec("pttl", 2, r, 1, 1, 1),
+		spec("dump", 2, r, 1, 1, 1),
+
+		// hashes
+		spec("hset", -4, w, 1, 1, 1),
+		spec("hsetnx", 4, w, 1, 1, 1),
+		spec("hmset", -4, w, 1, 1, 1),
+		spec("hdel", -3, w, 1, 1, 1),
+		spec("hincrby", 4, w, 1, 1, 1),
+		spec("hincrbyfloat", 4, w, 1, 1, 1),
+		spec("hget", 3, r, 1, 1, 1),
+		spec("hmget", -3, r, 1, 1, 1),
+		spec("hgetall", 2, r, 1, 1, 1),
+		spec("hlen", 2, r, 1, 1, 1),
+		spec("hexists", 3, r, 1, 1, 1),
+
+		// lists
+		spec("lpush", -3, w, 1, 1, 1),
+		spec("rpush", -3, w, 1, 1, 1),
+		spec("lpushx", -3, w, 1, 1, 1),
+		spec("rpushx", -3, w, 1, 1, 1),
+		spec("linsert", 5, w, 1, 1, 1),
+		spec("lset", 4, w, 1, 1, 1),
+		spec("lrem", 4, w, 1, 1, 1),
+		spec("ltrim", 4, w, 1, 1, 1),
+		spec("lpop", -2, w, 1, 1, 1),
+		spec("rpop", -2, w, 1, 1, 1),
+		spec("rpoplpush", 3, w, 1, 2, 1),
+		spec("brpoplpush", 4, w, 1, 2, 1),
+		spec("lmove", 5, w, 1, 2, 1),
+		spec("blmove", 6, w, 1, 2, 1),
+		spec("blpop", -3, w, 1, -2, 1),
+		spec("brpop", -3, w, 1, -2, 1),
+		movable("lmpop", -4, w, 0, 0, 0, numKeysAt(1)),
+		movable("blmpop", -5, w, 0, 0, 0, numKeysAt(2)),
+		spec("lrange", 4, r, 1, 1, 1),
+		spec("llen", 2, r, 1, 1, 1),
+		spec("lindex", 3, r, 1, 1, 1),
+
+		// sets
+		spec("sadd", -3, w, 1, 1, 1),
+		spec("srem", -3, w, 1, 1, 1),
+		spec("spop", -2, w, 1, 1, 1),
+		spec("smove", 4, w, 1, 2, 1),
+		spec("sinterstore", -3, w, 1, -1, 1),
+		spec("sunionstore", -3, w, 1, -1, 1),
+		spec("sdiffstore", -3, w, 1, -1, 1),
+		spec("smembers", 2, r, 1, 1, 1),
+		spec("scard", 2, r, 1, 1, 1),
+		spec("sismember", 3, r, 1, 1, 1),
+		spec("sinter", -2, r, 1, -1, 1),
+		spec("sunion", -2, r, 1, -1, 1),
+		spec("sdiff", -2, r, 1, -1, 1),
+		movable("sintercard", -3, r, 0, 0, 0, numKeysAt(1)),
+
+		// sorted sets
+		spec("zadd", -4, w, 1, 1, 1),
+		spec("zincrby", 4, w, 1, 1, 1),
+		spec("zrem", -3, w, 1, 1, 1),
+		spec("zremrangebyscore", 4, w, 1, 1, 1),
+		spec("zremrangebyrank", 4, w, 1, 1, 1),
+		spec("zremrangebylex", 4, w, 1, 1, 1),
+		spec("zpopmin", -2, w, 1, 1, 1),
+		spec("zpopmax", -2, w, 1, 1, 1),
+		spec("bzpopmin", -3, w, 1, -2, 1),
+		spec("bzpopmax", -3, w, 1, -2, 1),
+		spec("zrangestore", -5, w, 1, 2, 1),
+		movable("zunionstore", -4, w, 1, 1, 1, numKeysAt(2)),
+		movable("zinterstore", -4, w, 1, 1, 1, numKeysAt(2)),
+		movable("zdiffstore", -4, w, 1, 1, 1, numKeysAt(2)),
+		movable("zmpop", -4, w, 0, 0, 0, numKeysAt(1)),
+		movable("bzmpop", -5, w, 0, 0, 0, numKeysAt(2)),
+		spec("zrange", -4, r, 1, 1, 1),
+		spec("zscore", 3, r, 1, 1, 1),
+		spec("zcard", 2, r, 1, 1, 1),
+		spec("zrank", -3, r, 1, 1, 1),
+		movable("zunion", -3, r, 0, 0, 0, numKeysAt(1)),
+		movable("zinter", -3, r, 0, 0, 0, numKeysAt(1)),
+		movable("zdiff", -3, r, 0, 0, 0, numKeysAt(1)),
+
+		// hyperloglog and geo
+		spec("pfadd", -2, w, 1, 1, 1),
+		spec("pfmerge", -2, w, 1, -1, 1),
+		spec("pfcount", -2, r, 1, -1, 1),
+		spec("geoadd", -5, w, 1, 1, 1),
+		movable("georadius", -6, w, 1, 1, 1, tokenKey(6, "STORE", "STOREDIST")),
+		movable("georadiusbymember", -5, w, 1, 1, 1, tokenKey(5, "STORE", "STOREDIST")),
+		spec("geosearchstore", -8, w, 1, 2, 1),
+
+		// streams
+		spec("xadd", -5, w, 1, 1, 1),
+		spec("xdel", -3, w, 1, 1, 1),
+		spec("xtrim", -4, w, 1, 1, 1),
+		spec("xack", -4, w, 1, 1, 1),
+		spec("xclaim", -6, w, 1, 1, 1),
+		spec("xautoclaim", -6, w, 1, 1, 1),
+		spec("xsetid", -3, w, 1, 1, 1),
+		movable("xgroup", -2, w, 0, 0, 0, xgroupKeys),
+		movable("xreadgroup", -7, w, 0, 0, 0, streamsKeys),
+		movable("xread", -4, r, 0, 0, 0, streamsKeys),
+		spec("xrange", -4, r, 1, 1, 1),
+		spec("xlen", 2, r, 1, 1, 1),
+
+		// scripting and functions
+		movable("eval", -3, w, 0, 0, 0, numKeysAt(2)),
+		movable("evalsha", -3, w, 0, 0, 0, numKeysAt(2)),
+		movable("eval_ro", -3, r, 0, 0, 0, numKeysAt(2)),
+		movable("evalsha_ro", -3, r, 0, 0, 0, numKeysAt(2)),
+		movable("fcall", -3, w, 0, 0, 0, numKeysAt(2)),
+		movable("fcall_ro", -3, r, 0, 0, 0, numKeysAt(2)),
+		spec("script", -2, w|ad, 0, 0, 0),
+		spec("function", -2, w|ad, 0, 0, 0),
+
+		// server, connection and transactions
+		spec("select", 2, ad, 0, 0, 0),
+		spec("swapdb", 3, w|ad, 0, 0, 0),
+		spec("flushdb", -1, w|ad, 0, 0, 0),
+		spec("flushall", -1, w|ad, 0, 0, 0),
+		spec("multi", 1, ad, 0, 0, 0),
+		spec("exec", 1, ad, 0, 0, 0),
+		spec("discard", 1, ad, 0, 0, 0),
+		spec("publish", 3, ad, 0, 0, 0),
+		spec("spublish", 3, ad, 1, 1, 1),
+		spec("ping", -1, ad, 0, 0, 0),
+		spec("replconf", -1, ad, 0, 0, 0),
+	} {
+		commandTable[s.Name] = s
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandKeys(t *testing.T) {
+	var testSet = []struct {
+		d    []string
+		keys []string
+	}{
+		{[]string{"SET", "a", "1"}, []string{"a"}},
+		{[]string{"set", "a", "1", "EX", "10"}, []string{"a"}},
+		{[]string{"MSET", "a", "1", "b", "2"}, []string{"a", "b"}},
+		{[]string{"DEL", "a", "b", "c"}, []string{"a", "b", "c"}},
+		{[]string{"RENAME", "a", "b"}, []string{"a", "b"}},
+		{[]string{"BITOP", "AND", "dst", "a", "b"}, []string{"dst", "a", "b"}},
+		{[]string{"BLPOP", "a", "b", "0"}, []string{"a", "b"}},
+		{[]string{"EVAL", "return 1", "2", "a", "b", "arg"}, []string{"a", "b"}},
+		{[]string{"EVALSHA", "abc", "0", "arg"}, []string{}},
+		{[]string{"ZUNIONSTORE", "dst", "2", "a", "b", "WEIGHTS", "1", "2"}, []string{"dst", "a", "b"}},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "COUNT", "1", "STREAMS", "s1", "s2", ">", ">"}, []string{"s1", "s2"}},
+		{[]string{"SORT", "src", "BY", "w_*", "STORE", "dst"}, []string{"src", "dst"}},
+		{[]string{"SORT", "src", "LIMIT", "0", "10"}, []string{"src"}},
+		{[]string{"MIGRATE", "h", "6379", "k", "0", "1000"}, []string{"k"}},
+		{[]string{"MIGRATE", "h", "6379", "", "0", "1000", "REPLACE", "KEYS", "a", "b"}, []string{"a", "b"}},
+		{[]string{"XGROUP", "CREATE", "s", "g", "$"}, []string{"s"}},
+		{[]string{"SELECT", "1"}, []string{}},
+		{[]string{"UNKNOWN", "a"}, nil},
+	}
+
+	for _, ts := range testSet {
+		cmd, err := NewCommand(ts.d...)
+		assert.Nil(t, err)
+		keys := cmd.Keys()
+		if ts.keys == nil {
+			assert.Nil(t, keys, "%v", ts.d)
+			continue
+		}
+		assert.Equal(t, ts.keys, keys, "%v", ts.d)
+	}
+}
+
+func TestCommandSpec(t *testing.T) {
+	s, ok := LookupCommand("Set")
+	assert.True(t, ok)
+	assert.True(t, s.IsWrite())
+	assert.True(t, s.CheckArity(3))
+	assert.False(t, s.CheckArity(2))
+
+	s, ok = LookupCommand("GET")
+	assert.True(t, ok)
+	assert.False(t, s.IsWrite())
+	assert.False(t, s.CheckArity(3))
+
+	_, ok = LookupCommand("nosuchcommand")
+	assert.False(t, ok)
+}
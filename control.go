@@ -0,0 +1,162 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Phase is the state of the replication of a Canal.
+type Phase int32
+
+const (
+	PhaseIdle Phase = iota
+	PhaseHandshake
+	PhaseRDB
+	PhaseStreaming
+	PhaseStopped
+)
+
+var phaseNames = [...]string{"idle", "handshake", "rdb", "streaming", "stopped"}
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return fmt.Sprintf("phase(%d)", int32(p))
+	}
+	return phaseNames[p]
+}
+
+func (p Phase) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *Phase) UnmarshalText(b []byte) error {
+	for i, name := range phaseNames {
+		if name == string(b) {
+			*p = Phase(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown phase %q", b)
+}
+
+// Status is a snapshot of the state of a Canal.
+type Status struct {
+	Addr      string        `json:"addr"`
+	Phase     Phase         `json:"phase"`
+	Paused    bool          `json:"paused"`
+	ReplId    string        `json:"repl_id"`
+	Offset    int64         `json:"offset"`
+	LagBytes  int64         `json:"lag_bytes"`
+	LagTime   time.Duration `json:"lag_time_ns"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// Status returns the current state of c. The lag is read from the
+// LagTracker of c if any, from its Metrics otherwise.
+func (c *Canal) Status() Status {
+	c.mu.Lock()
+	st := Status{
+		Addr:   c.cfg.addr,
+		Paused: c.pauseC != nil,
+		ReplId: c.replId,
+	}
+	if c.lastErr != nil {
+		st.LastError = c.lastErr.Error()
+	}
+	c.mu.Unlock()
+	st.Phase = c.Phase()
+	st.Offset = atomic.LoadInt64(&c.offset)
+	if c.lag != nil {
+		lag := c.lag.Lag()
+		st.LagBytes, st.LagTime = lag.Bytes, lag.Time
+	} else {
+		st.LagBytes = c.cfg.metrics.Lag()
+	}
+	return st
+}
+
+// Phase returns the current replication phase of c.
+func (c *Canal) Phase() Phase { return Phase(atomic.LoadInt32(&c.phase)) }
+
+func (c *Canal) setPhase(p Phase) { atomic.StoreInt32(&c.phase, int32(p)) }
+
+func (c *Canal) setLastErr(err error) {
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+}
+
+// Pause stops feeding the CommandDecoder. The replication link is kept:
+// the socket is no longer read and REPLCONF ACK goes on reporting the
+// offset applied so far, the master keeps the rest in its backlog.
+func (c *Canal) Pause() {
+	c.mu.Lock()
+	if c.pauseC == nil {
+		c.pauseC = make(chan struct{})
+	}
+	c.mu.Unlock()
+}
+
+// Resume undoes Pause.
+func (c *Canal) Resume() {
+	c.mu.Lock()
+	if c.pauseC != nil {
+		close(c.pauseC)
+		c.pauseC = nil
+	}
+	c.mu.Unlock()
+}
+
+// errPausedLinkDown stops a paused handler when the link breaks, the
+// stream it did not apply is requested again with PSYNC.
+var errPausedLinkDown = errors.New("replication link closed while paused")
+
+// waitResume blocks while c is paused, it fails if stop is closed meanwhile.
+func (c *Canal) waitResume(stop <-chan struct{}) error {
+	c.mu.Lock()
+	p := c.pauseC
+	c.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	select {
+	case <-p:
+		return nil
+	case <-stop:
+	case <-c.closeReplica:
+	}
+	return errPausedLinkDown
+}
+
+// ForceFullResync drops the current link and replicates again from a
+// FULLRESYNC, as a brand new replica would.
+func (c *Canal) ForceFullResync() {
+	atomic.StoreInt32(&c.resync, 1)
+	_ = c.getNetConn().Close()
+}
+
+// takeResync forgets the replication position if a full resync was requested.
+func (c *Canal) takeResync() bool {
+	if !atomic.CompareAndSwapInt32(&c.resync, 1, 0) {
+		return false
+	}
+	c.setReplId("")
+	c.set(-1)
+	return true
+}
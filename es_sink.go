@@ -0,0 +1,590 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ElasticsearchSinkOption specifies an option for an ElasticsearchSink.
+type ElasticsearchSinkOption struct {
+	f func(*esSinkOptions)
+}
+
+type esSinkOptions struct {
+	client        *http.Client
+	header        http.Header
+	indices       []esIndexRoute
+	batchSize     int
+	batchInterval time.Duration
+	maxRetries    int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	logger        Logger
+}
+
+// ElasticsearchSinkClient specifies the HTTP client. Default has a 30s timeout.
+func ElasticsearchSinkClient(c *http.Client) ElasticsearchSinkOption {
+	return ElasticsearchSinkOption{func(o *esSinkOptions) {
+		o.client = c
+	}}
+}
+
+// ElasticsearchSinkHeader adds a header to the requests, for authentication.
+func ElasticsearchSinkHeader(key, value string) ElasticsearchSinkOption {
+	return ElasticsearchSinkOption{func(o *esSinkOptions) {
+		o.header.Add(key, value)
+	}}
+}
+
+// ElasticsearchSinkIndex writes the keys starting with prefix to index
+// instead of the default one. The longest matching prefix wins.
+func ElasticsearchSinkIndex(prefix, index string) ElasticsearchSinkOption {
+	return ElasticsearchSinkOption{func(o *esSinkOptions) {
+		o.indices = append(o.indices, esIndexRoute{prefix, index})
+	}}
+}
+
+// ElasticsearchSinkBatch specifies how many actions a bulk request holds at
+// most and how long a partial one waits before it is sent, zero waiting for
+// Flush or Close. Default is 500 and 1s.
+func ElasticsearchSinkBatch(size int, interval time.Duration) ElasticsearchSinkOption {
+	return ElasticsearchSinkOption{func(o *esSinkOptions) {
+		o.batchSize = size
+		o.batchInterval = interval
+	}}
+}
+
+// ElasticsearchSinkRetry specifies how many times a bulk request, or its
+// actions from the first one rejected with 429 or 5xx on, are sent again,
+// waiting from min to max, doubling each time. Default is 5 retries from
+// 100ms to 10s.
+func ElasticsearchSinkRetry(maxRetries int, min, max time.Duration) ElasticsearchSinkOption {
+	return ElasticsearchSinkOption{func(o *esSinkOptions) {
+		o.maxRetries = maxRetries
+		o.minBackoff = min
+		o.maxBackoff = max
+	}}
+}
+
+// ElasticsearchSinkLogger specifies the Logger of retries and rejected actions.
+func ElasticsearchSinkLogger(l Logger) ElasticsearchSinkOption {
+	return ElasticsearchSinkOption{func(o *esSinkOptions) {
+		o.logger = l
+	}}
+}
+
+type esIndexRoute struct {
+	prefix string
+	index  string
+}
+
+// ElasticsearchError is a request answered with a non 2xx status.
+type ElasticsearchError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ElasticsearchError) Error() string {
+	return fmt.Sprintf("elasticsearch: %d %s", e.StatusCode, e.Body)
+}
+
+// esRetryable reports whether a request may succeed later: transport
+// errors, 5xx and 429.
+func esRetryable(err error) bool {
+	if e, ok := err.(*ElasticsearchError); ok {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// esAction is one action of a bulk request: its metadata line and, but for
+// deletes, its document line.
+type esAction struct {
+	meta []byte
+	doc  []byte
+}
+
+type esBulkResponse struct {
+	Errors bool                    `json:"errors"`
+	Items  []map[string]esBulkItem `json:"items"`
+}
+
+type esBulkItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// ElasticsearchSink is a CommandDecoder keeping one document per key in
+// Elasticsearch, through the _bulk API. The document id is the key:
+//
+//	SET, SETNX, SETEX, PSETEX, GETSET, MSET, MSETNX  upsert {"value": value}
+//	HSET, HSETNX, HMSET                              upsert the fields
+//	HDEL                                             remove the fields
+//	DEL, UNLINK, expiring EXPIRE and alike           delete the document
+//	RENAME, RENAMENX, COPY                           copy the document
+//	FLUSHDB, FLUSHALL                                delete every document
+//
+// Databases are ignored: keys of every database share the indices, and a
+// FLUSHDB empties them all. A full sync empties the indices too, before
+// the snapshot is indexed, so they must not hold other documents; the
+// shards of a cluster share the indices, their full syncs keep the
+// documents of the keys deleted while disconnected. Other write commands,
+// like INCR or APPEND, are skipped and counted by Skipped. Non UTF-8
+// values are not preserved. Actions rejected with 429 or 5xx are retried
+// with the actions after them, other rejections are logged and counted by
+// Rejected; 404 of deletes and updates of missing documents are ignored.
+type ElasticsearchSink struct {
+	url  string
+	opts esSinkOptions
+
+	sinkCore
+	index    string
+	batch    []esAction
+	last     int64 // offset of the last command, -1 during a snapshot
+	applied  int64
+	rejected int64
+	skipped  int64
+}
+
+// NewElasticsearchSink returns an ElasticsearchSink sending to the cluster
+// at url, like "http://127.0.0.1:9200", into index by default.
+func NewElasticsearchSink(url, index string, opts ...ElasticsearchSinkOption) *ElasticsearchSink {
+	s := &ElasticsearchSink{
+		url:   strings.TrimRight(url, "/"),
+		index: index,
+		opts: esSinkOptions{
+			client:        &http.Client{Timeout: 30 * time.Second},
+			header:        make(http.Header),
+			batchSize:     500,
+			batchInterval: time.Second,
+			maxRetries:    5,
+			minBackoff:    100 * time.Millisecond,
+			maxBackoff:    10 * time.Second,
+			logger:        defaultLogger,
+		},
+		last:    -1,
+		applied: -1,
+	}
+	for _, opt := range opts {
+		opt.f(&s.opts)
+	}
+	if s.opts.batchSize < 1 {
+		s.opts.batchSize = 1
+	}
+	sort.SliceStable(s.opts.indices, func(i, j int) bool {
+		return len(s.opts.indices[i].prefix) > len(s.opts.indices[j].prefix)
+	})
+	s.startFlusher(s.opts.batchInterval, func() error {
+		if len(s.batch) == 0 {
+			return nil
+		}
+		return s.bulk()
+	})
+	return s
+}
+
+// Applied returns the offset of the last command whose actions succeeded
+// or were rejected, -1 until the snapshot of a full sync is indexed.
+func (s *ElasticsearchSink) Applied() int64 { return atomic.LoadInt64(&s.applied) }
+
+// Rejected returns the number of actions rejected permanently.
+func (s *ElasticsearchSink) Rejected() int64 { return atomic.LoadInt64(&s.rejected) }
+
+// Skipped returns the number of write commands ignored, the documents of
+// their keys no longer matching the dataset.
+func (s *ElasticsearchSink) Skipped() int64 { return atomic.LoadInt64(&s.skipped) }
+
+// Command implements CommandDecoder.
+func (s *ElasticsearchSink) Command(cmd *Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	actions, err := s.actions(cmd)
+	if err != nil {
+		return s.fail(err)
+	}
+	// the snapshot commands all carry the offset of the full sync, which
+	// is only reached once the whole snapshot is indexed
+	if s.last = cmd.Offset; cmd.Phase == PhaseRDB {
+		s.last = -1
+	}
+	if len(actions) == 0 {
+		if len(s.batch) == 0 {
+			atomic.StoreInt64(&s.applied, s.last)
+		}
+		return nil
+	}
+	s.batch = append(s.batch, actions...)
+	if len(s.batch) >= s.opts.batchSize {
+		return s.fail(s.bulk())
+	}
+	return nil
+}
+
+// Flush sends the pending actions.
+func (s *ElasticsearchSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.fail(s.bulk())
+}
+
+// Close sends the pending actions. Actions being retried are given up.
+func (s *ElasticsearchSink) Close() error {
+	s.stopFlusher()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.err != nil {
+		return s.err
+	}
+	return s.bulk()
+}
+
+func (s *ElasticsearchSink) indexFor(key string) string {
+	for _, r := range s.opts.indices {
+		if strings.HasPrefix(key, r.prefix) {
+			return r.index
+		}
+	}
+	return s.index
+}
+
+// actions maps cmd to bulk actions, none if it does not change documents.
+// Flushes and snapshots delete the documents, RENAME and COPY read the
+// source document, after the pending actions are sent.
+func (s *ElasticsearchSink) actions(cmd *Command) ([]esAction, error) {
+	d := cmd.D
+	switch cmd.Name() {
+	case "PING":
+		if cmd.Phase == PhaseRDB && cmd.Shard == "" {
+			// the snapshot replaces every document, of the keys deleted
+			// while disconnected as well; the shards of a cluster share
+			// the indices, their snapshots only add documents
+			return nil, s.deleteAll()
+		}
+		return nil, nil
+	case "FLUSHDB", "FLUSHALL":
+		return nil, s.deleteAll()
+	case "RENAME", "RENAMENX", "COPY":
+		if len(d) >= 3 {
+			return s.copyDoc(d[1], d[2], cmd.Name() != "COPY")
+		}
+	}
+	if actions, ok := s.keyActions(cmd); ok {
+		return actions, nil
+	}
+	if spec, ok := LookupCommand(cmd.Name()); ok && spec.IsWrite() {
+		atomic.AddInt64(&s.skipped, 1)
+		s.opts.logger.Debug("elasticsearch command skipped", "command", cmd.Name())
+	}
+	return nil, nil
+}
+
+// keyActions maps the commands changing a document to bulk actions, false
+// for the other ones.
+func (s *ElasticsearchSink) keyActions(cmd *Command) ([]esAction, bool) {
+	d := cmd.D
+	if len(d) < 2 {
+		return nil, false
+	}
+	key := d[1]
+	switch cmd.Name() {
+	case "SET", "SETNX", "GETSET":
+		if len(d) >= 3 {
+			return []esAction{s.upsert(key, map[string]string{"value": d[2]})}, true
+		}
+	case "SETEX", "PSETEX":
+		if len(d) == 4 {
+			return []esAction{s.upsert(key, map[string]string{"value": d[3]})}, true
+		}
+	case "MSET", "MSETNX":
+		var actions []esAction
+		for i := 1; i+1 < len(d); i += 2 {
+			actions = append(actions, s.upsert(d[i], map[string]string{"value": d[i+1]}))
+		}
+		return actions, true
+	case "HSET", "HSETNX", "HMSET":
+		fields := make(map[string]string)
+		for i := 2; i+1 < len(d); i += 2 {
+			fields[d[i]] = d[i+1]
+		}
+		if len(fields) > 0 {
+			return []esAction{s.upsert(key, fields)}, true
+		}
+	case "HDEL":
+		if len(d) >= 3 {
+			return []esAction{s.action("update", key, map[string]interface{}{
+				"script": map[string]interface{}{
+					"source": "for (f in params.fields) { ctx._source.remove(f) }",
+					"params": map[string]interface{}{"fields": d[2:]},
+				},
+			})}, true
+		}
+	case "DEL", "UNLINK":
+		var actions []esAction
+		for _, k := range d[1:] {
+			actions = append(actions, s.action("delete", k, nil))
+		}
+		return actions, true
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		if len(d) >= 3 && expiresNow(cmd.Name(), d[2]) {
+			return []esAction{s.action("delete", key, nil)}, true
+		}
+		// keys expiring later are deleted by the DEL the master sends then
+		return nil, true
+	case "PERSIST", "MOVE", "SWAPDB":
+		// documents have no TTL and databases share the indices
+		return nil, true
+	}
+	return nil, false
+}
+
+// expiresNow reports whether an expiry command deletes its key right away.
+// Keys expiring later are deleted by the DEL the master sends then.
+func expiresNow(name, arg string) bool {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return false
+	}
+	switch name {
+	case "EXPIREAT":
+		return n <= time.Now().Unix()
+	case "PEXPIREAT":
+		return n <= time.Now().UnixNano()/int64(time.Millisecond)
+	}
+	return n <= 0
+}
+
+func (s *ElasticsearchSink) upsert(key string, fields map[string]string) esAction {
+	return s.action("update", key, map[string]interface{}{"doc": fields, "doc_as_upsert": true})
+}
+
+func (s *ElasticsearchSink) action(op, key string, doc interface{}) esAction {
+	meta, _ := json.Marshal(map[string]interface{}{
+		op: map[string]string{"_index": s.indexFor(key), "_id": key},
+	})
+	a := esAction{meta: meta}
+	if doc != nil {
+		a.doc, _ = json.Marshal(doc)
+	}
+	return a
+}
+
+// bulk sends the batch, retrying it whole on transport errors, 429 and
+// 5xx. When actions are rejected with 429 or 5xx, the batch is retried
+// from the first of them on, so that the actions on a document are
+// applied in order.
+func (s *ElasticsearchSink) bulk() error {
+	pending := s.batch
+	b := newBackoff(s.opts.minBackoff, s.opts.maxBackoff)
+	for attempt := 0; len(pending) > 0; attempt++ {
+		var retry []esAction
+		items, err := s.send(pending)
+		if err == nil {
+			for i, item := range items {
+				if item.Status == http.StatusTooManyRequests || item.Status >= 500 {
+					retry = pending[i:]
+					err = fmt.Errorf("elasticsearch: action %s failed: %d %s", pending[i].meta, item.Status, item.Error)
+					break
+				}
+				if item.Status/100 != 2 && item.Status != http.StatusNotFound {
+					atomic.AddInt64(&s.rejected, 1)
+					s.opts.logger.Warn("elasticsearch action rejected",
+						"action", string(pending[i].meta), "status", item.Status, "err", string(item.Error))
+				}
+			}
+			if len(retry) == 0 {
+				break
+			}
+		} else if !esRetryable(err) {
+			return err
+		} else {
+			retry = pending
+		}
+		if attempt >= s.opts.maxRetries {
+			s.batch = retry
+			return err
+		}
+		s.opts.logger.Debug("elasticsearch bulk retried", "actions", len(retry), "attempt", attempt+1, "err", err)
+		if !b.wait(s.stop) {
+			s.batch = retry
+			return ErrSinkClosed
+		}
+		pending = retry
+	}
+	s.batch = nil
+	atomic.StoreInt64(&s.applied, s.last)
+	return nil
+}
+
+// send posts actions to _bulk and returns the result of each.
+func (s *ElasticsearchSink) send(actions []esAction) ([]esBulkItem, error) {
+	var body bytes.Buffer
+	for _, a := range actions {
+		body.Write(a.meta)
+		body.WriteByte('\n')
+		if a.doc != nil {
+			body.Write(a.doc)
+			body.WriteByte('\n')
+		}
+	}
+	resp, err := s.request(http.MethodPost, "/_bulk", "application/x-ndjson", &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var br esBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		return nil, fmt.Errorf("elasticsearch: invalid bulk response: %v", err)
+	}
+	if len(br.Items) != len(actions) {
+		return nil, fmt.Errorf("elasticsearch: %d bulk results for %d actions", len(br.Items), len(actions))
+	}
+	items := make([]esBulkItem, len(br.Items))
+	for i, m := range br.Items {
+		for _, item := range m {
+			items[i] = item
+		}
+	}
+	return items, nil
+}
+
+// request sends a request to path, an ElasticsearchError for a non 2xx
+// status.
+func (s *ElasticsearchSink) request(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.opts.header {
+		req.Header[k] = v
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.opts.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &ElasticsearchError{StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(msg))}
+	}
+	return resp, nil
+}
+
+// retry calls fn until it succeeds, fails permanently or the retries are
+// exhausted.
+func (s *ElasticsearchSink) retry(what string, fn func() error) error {
+	b := newBackoff(s.opts.minBackoff, s.opts.maxBackoff)
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !esRetryable(err) || attempt >= s.opts.maxRetries {
+			return err
+		}
+		s.opts.logger.Debug("elasticsearch request retried", "request", what, "attempt", attempt+1, "err", err)
+		if !b.wait(s.stop) {
+			return ErrSinkClosed
+		}
+	}
+}
+
+// deleteAll sends the pending actions and deletes every document of the
+// indices.
+func (s *ElasticsearchSink) deleteAll() error {
+	if err := s.bulk(); err != nil {
+		return err
+	}
+	seen := map[string]bool{s.index: true}
+	indices := []string{url.PathEscape(s.index)}
+	for _, r := range s.opts.indices {
+		if !seen[r.index] {
+			seen[r.index] = true
+			indices = append(indices, url.PathEscape(r.index))
+		}
+	}
+	path := "/" + strings.Join(indices, ",") + "/_delete_by_query?conflicts=proceed&ignore_unavailable=true&refresh=true"
+	return s.retry("delete_by_query", func() error {
+		resp, err := s.request(http.MethodPost, path, "application/json", strings.NewReader(`{"query":{"match_all":{}}}`))
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+}
+
+// copyDoc sends the pending actions and returns those copying the
+// document of from to to, deleting the one of from if move is set. The
+// document of to is deleted when from has none, its value not being
+// indexed.
+func (s *ElasticsearchSink) copyDoc(from, to string, move bool) ([]esAction, error) {
+	if err := s.bulk(); err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Source map[string]interface{} `json:"_source"`
+	}
+	path := "/" + url.PathEscape(s.indexFor(from)) + "/_doc/" + url.PathEscape(from)
+	err := s.retry("get", func() error {
+		doc.Source = nil
+		resp, err := s.request(http.MethodGet, path, "", nil)
+		if e, ok := err.(*ElasticsearchError); ok && e.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return fmt.Errorf("elasticsearch: invalid document of %q: %v", from, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	actions := []esAction{s.action("delete", to, nil)}
+	if doc.Source != nil {
+		actions[0] = s.action("index", to, doc.Source)
+	}
+	if move && from != to {
+		actions = append(actions, s.action("delete", from, nil))
+	}
+	return actions, nil
+}
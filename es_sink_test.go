@@ -0,0 +1,341 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeES is a stand-in for the _bulk API keeping documents in memory.
+// fail returns the status of an action instead of applying it, 0 applies.
+type fakeES struct {
+	mu       sync.Mutex
+	docs     map[string]map[string]interface{} // by index/id
+	requests int
+	fail     func(op, index, id string) int
+}
+
+func newFakeES() (*fakeES, *httptest.Server) {
+	es := &fakeES{docs: make(map[string]map[string]interface{})}
+	return es, httptest.NewServer(es)
+}
+
+func (es *fakeES) doc(index, id string) map[string]interface{} {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.docs[index+"/"+id]
+}
+
+func (es *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.requests++
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[1] == "_doc":
+		doc, ok := es.docs[parts[0]+"/"+parts[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"found":false}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"found": true, "_source": doc})
+		return
+	case len(parts) == 2 && parts[1] == "_delete_by_query":
+		deleted := 0
+		for _, index := range strings.Split(parts[0], ",") {
+			for path := range es.docs {
+				if strings.HasPrefix(path, index+"/") {
+					delete(es.docs, path)
+					deleted++
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+		return
+	case r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson":
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var items []map[string]esBulkItem
+	sc := bufio.NewScanner(r.Body)
+	for sc.Scan() {
+		var meta map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &meta); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for op, m := range meta {
+			var body struct {
+				Doc    map[string]interface{} `json:"doc"`
+				Script struct {
+					Params struct {
+						Fields []string `json:"fields"`
+					} `json:"params"`
+				} `json:"script"`
+			}
+			var source map[string]interface{}
+			if op != "delete" {
+				sc.Scan()
+				_ = json.Unmarshal(sc.Bytes(), &body)
+				_ = json.Unmarshal(sc.Bytes(), &source)
+			}
+			status := http.StatusOK
+			if es.fail != nil {
+				if s := es.fail(op, m.Index, m.ID); s != 0 {
+					status = s
+				}
+			}
+			path := m.Index + "/" + m.ID
+			switch {
+			case status != http.StatusOK:
+			case op == "delete":
+				if es.docs[path] == nil {
+					status = http.StatusNotFound
+				}
+				delete(es.docs, path)
+			case op == "index":
+				es.docs[path] = source
+			case body.Doc != nil:
+				if es.docs[path] == nil {
+					es.docs[path] = make(map[string]interface{})
+				}
+				for k, v := range body.Doc {
+					es.docs[path][k] = v
+				}
+			default:
+				if es.docs[path] == nil {
+					status = http.StatusNotFound
+				}
+				for _, f := range body.Script.Params.Fields {
+					delete(es.docs[path], f)
+				}
+			}
+			items = append(items, map[string]esBulkItem{op: {Status: status}})
+		}
+	}
+	_ = json.NewEncoder(w).Encode(esBulkResponse{Items: items})
+}
+
+func esCommands(s *ElasticsearchSink, cmds ...string) error {
+	for i, c := range cmds {
+		if err := s.Command(&Command{D: strings.Fields(c), Offset: int64(10 * (i + 1))}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	es, srv := newFakeES()
+	defer srv.Close()
+	s := NewElasticsearchSink(srv.URL+"/", "redis", ElasticsearchSinkBatch(100, 0),
+		ElasticsearchSinkIndex("user:", "users"))
+
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).UnixNano()/int64(time.Millisecond), 10)
+	assert.Nil(t, esCommands(s,
+		"SET a 1",
+		"HSET user:1 name x age 3",
+		"HMSET user:2 name y",
+		"HDEL user:1 age",
+		"MSET b 2 c 3",
+		"SETEX d 100 4",
+		"RPUSH list x",
+		"DEL b nokey",
+		"EXPIRE c 100",
+		"PEXPIREAT d "+past,
+		"UNLINK user:2",
+	))
+	assert.Equal(t, int64(-1), s.Applied())
+	assert.Nil(t, s.Close())
+	assert.Equal(t, int64(110), s.Applied())
+	assert.Equal(t, 1, es.requests)
+
+	assert.Equal(t, map[string]interface{}{"value": "1"}, es.doc("redis", "a"))
+	assert.Equal(t, map[string]interface{}{"name": "x"}, es.doc("users", "user:1"))
+	assert.Nil(t, es.doc("users", "user:2"))
+	assert.Nil(t, es.doc("redis", "b"))
+	assert.Equal(t, map[string]interface{}{"value": "3"}, es.doc("redis", "c"))
+	assert.Nil(t, es.doc("redis", "d"))
+	assert.Equal(t, int64(0), s.Rejected())
+}
+
+func TestElasticsearchSinkPartialFailure(t *testing.T) {
+	es, srv := newFakeES()
+	defer srv.Close()
+	throttled := 0
+	es.fail = func(op, index, id string) int {
+		switch id {
+		case "busy":
+			if throttled < 2 {
+				throttled++
+				return http.StatusTooManyRequests
+			}
+		case "bad":
+			return http.StatusBadRequest
+		}
+		return 0
+	}
+	s := NewElasticsearchSink(srv.URL, "redis", ElasticsearchSinkBatch(3, 0),
+		ElasticsearchSinkRetry(3, time.Millisecond, time.Millisecond))
+
+	assert.Nil(t, esCommands(s, "SET a 1", "SET busy 2", "SET bad 3"))
+	assert.Equal(t, int64(30), s.Applied())
+	assert.Equal(t, int64(1), s.Rejected())
+	assert.Equal(t, 3, es.requests)
+	assert.Equal(t, map[string]interface{}{"value": "2"}, es.doc("redis", "busy"))
+	assert.Nil(t, es.doc("redis", "bad"))
+	assert.Nil(t, s.Close())
+}
+
+func TestElasticsearchSinkRetriesExhausted(t *testing.T) {
+	es, srv := newFakeES()
+	defer srv.Close()
+	es.fail = func(op, index, id string) int { return http.StatusServiceUnavailable }
+	s := NewElasticsearchSink(srv.URL, "redis", ElasticsearchSinkBatch(1, 0),
+		ElasticsearchSinkRetry(1, time.Millisecond, time.Millisecond))
+
+	err := esCommands(s, "SET a 1")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, es.requests)
+	assert.Equal(t, int64(-1), s.Applied())
+	assert.Equal(t, err, esCommands(s, "SET b 2"))
+	assert.Equal(t, err, s.Close())
+}
+
+func TestElasticsearchSinkRequestError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such index", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	s := NewElasticsearchSink(srv.URL, "redis", ElasticsearchSinkBatch(1, 0))
+
+	err := esCommands(s, "SET a 1")
+	if assert.IsType(t, &ElasticsearchError{}, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*ElasticsearchError).StatusCode)
+	}
+	_ = s.Close()
+}
+
+func TestElasticsearchSinkSnapshot(t *testing.T) {
+	es, srv := newFakeES()
+	defer srv.Close()
+	s := NewElasticsearchSink(srv.URL, "redis", ElasticsearchSinkBatch(2, 0))
+
+	assert.Nil(t, s.Command(&Command{D: []string{"SET", "old", "1"}, Offset: 5, Phase: PhaseStreaming}))
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, int64(5), s.Applied())
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Nil(t, s.Command(&Command{D: []string{"SET", key, "1"}, Offset: 100, Phase: PhaseRDB}))
+	}
+	// the first half of the snapshot is indexed, not the snapshot offset
+	assert.Equal(t, 2, es.requests)
+	assert.Equal(t, int64(-1), s.Applied())
+	assert.Nil(t, s.Command(&Command{D: []string{"PING"}, Offset: 100, Phase: PhaseRDB}))
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, int64(-1), s.Applied())
+
+	assert.Nil(t, s.Command(&Command{D: []string{"PING"}, Offset: 114, Phase: PhaseStreaming}))
+	assert.Equal(t, int64(114), s.Applied())
+	assert.Nil(t, s.Command(&Command{D: []string{"SET", "d", "1"}, Offset: 130, Phase: PhaseStreaming}))
+	assert.Nil(t, s.Close())
+	assert.Equal(t, int64(130), s.Applied())
+}
+
+func TestElasticsearchSinkRetryOrder(t *testing.T) {
+	es, srv := newFakeES()
+	defer srv.Close()
+	throttled := false
+	es.fail = func(op, index, id string) int {
+		if id == "a" && !throttled {
+			throttled = true
+			return http.StatusTooManyRequests
+		}
+		return 0
+	}
+	s := NewElasticsearchSink(srv.URL, "redis", ElasticsearchSinkBatch(3, 0),
+		ElasticsearchSinkRetry(1, time.Millisecond, time.Millisecond))
+
+	// the later update of a is sent again after the throttled one
+	assert.Nil(t, esCommands(s, "SET a 1", "SET b 2", "SET a 3"))
+	assert.Equal(t, 2, es.requests)
+	assert.Equal(t, map[string]interface{}{"value": "3"}, es.doc("redis", "a"))
+	assert.Equal(t, int64(30), s.Applied())
+	assert.Nil(t, s.Close())
+}
+
+func TestElasticsearchSinkKeyspace(t *testing.T) {
+	es, srv := newFakeES()
+	defer srv.Close()
+	s := NewElasticsearchSink(srv.URL, "redis", ElasticsearchSinkBatch(100, 0),
+		ElasticsearchSinkIndex("user:", "users"), ElasticsearchSinkLogger(NopLogger{}))
+
+	assert.Nil(t, esCommands(s,
+		"HSET user:1 name x",
+		"SET a 1",
+		"RENAME user:1 user:2",
+		"COPY a b",
+		"SET c 1",
+		"RPUSH list x",
+		"RENAME list c",
+		"INCR a",
+		"APPEND b x",
+		"EXPIRE a 100",
+	))
+	assert.Nil(t, s.Flush())
+	assert.Nil(t, es.doc("users", "user:1"))
+	assert.Equal(t, map[string]interface{}{"name": "x"}, es.doc("users", "user:2"))
+	assert.Equal(t, map[string]interface{}{"value": "1"}, es.doc("redis", "b"))
+	// the list is not indexed, the document of c is gone all the same
+	assert.Nil(t, es.doc("redis", "c"))
+	assert.Equal(t, int64(3), s.Skipped()) // RPUSH, INCR, APPEND
+	assert.Equal(t, int64(100), s.Applied())
+
+	assert.Nil(t, s.Command(&Command{D: []string{"SET", "d", "1"}, Offset: 110}))
+	assert.Nil(t, s.Command(&Command{D: []string{"FLUSHALL"}, Offset: 120}))
+	assert.Nil(t, es.doc("redis", "a"))
+	assert.Nil(t, es.doc("redis", "d"))
+	assert.Nil(t, es.doc("users", "user:2"))
+	assert.Equal(t, int64(120), s.Applied())
+
+	// a full sync drops the documents of the keys deleted meanwhile
+	assert.Nil(t, s.Command(&Command{D: []string{"SET", "stale", "1"}, Offset: 130}))
+	assert.Nil(t, s.Command(&Command{D: []string{"PING"}, Offset: 200, Phase: PhaseRDB}))
+	assert.Nil(t, s.Command(&Command{D: []string{"SET", "e", "1"}, Offset: 200, Phase: PhaseRDB}))
+	assert.Nil(t, s.Flush())
+	assert.Nil(t, es.doc("redis", "stale"))
+	assert.Equal(t, map[string]interface{}{"value": "1"}, es.doc("redis", "e"))
+
+	// but not the one of a cluster shard, the others share the indices
+	assert.Nil(t, s.Command(&Command{D: []string{"PING"}, Offset: 300, Phase: PhaseRDB, Shard: "s1"}))
+	assert.Nil(t, s.Close())
+	assert.Equal(t, map[string]interface{}{"value": "1"}, es.doc("redis", "e"))
+}
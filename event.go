@@ -0,0 +1,480 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// EventVersion is the version of the Event encodings written by this
+// package. Decoders reject events of a later version.
+const EventVersion = 1
+
+// Event is a replicated command as seen by consumers outside Redis. Its JSON
+// encoding is
+//
+//	{"v": 1, "repl_id": "...", "offset": 42, "phase": "streaming", "db": 0,
+//	 "command": "SET", "keys": ["k"], "args": ["k", "v"]}
+//
+// with "shard" for commands of a cluster. If a key or argument is not valid
+// UTF-8, "encoding" is "base64" and all keys and args are base64 encoded.
+type Event struct {
+	Version int
+	ReplId  string
+	Offset  int64
+	Phase   Phase
+	DB      int
+	Shard   string
+	// Command is the upper-cased command name.
+	Command string
+	// Keys are the key arguments, see Command.Keys.
+	Keys []string
+	// Args are the arguments following the command name, keys included.
+	Args []string
+}
+
+// NewEvent returns the Event of cmd run against db.
+func NewEvent(cmd *Command, db int) *Event {
+	e := &Event{
+		Version: EventVersion,
+		ReplId:  cmd.ReplId,
+		Offset:  cmd.Offset,
+		Phase:   cmd.Phase,
+		DB:      db,
+		Shard:   cmd.Shard,
+		Command: cmd.Name(),
+	}
+	if keys := cmd.Keys(); len(keys) > 0 {
+		e.Keys = keys
+	}
+	if len(cmd.D) > 1 {
+		e.Args = cmd.D[1:]
+	}
+	return e
+}
+
+// Cmd returns the Command of e.
+func (e *Event) Cmd() *Command {
+	d := make([]string, 0, 1+len(e.Args))
+	d = append(d, e.Command)
+	d = append(d, e.Args...)
+	return &Command{D: d, Offset: e.Offset, Shard: e.Shard, ReplId: e.ReplId, Phase: e.Phase}
+}
+
+type jsonEvent struct {
+	Version  int      `json:"v"`
+	ReplId   string   `json:"repl_id"`
+	Offset   int64    `json:"offset"`
+	Phase    Phase    `json:"phase"`
+	DB       int      `json:"db"`
+	Shard    string   `json:"shard,omitempty"`
+	Command  string   `json:"command"`
+	Keys     []string `json:"keys"`
+	Args     []string `json:"args"`
+	Encoding string   `json:"encoding,omitempty"`
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	je := jsonEvent{
+		Version: e.Version,
+		ReplId:  e.ReplId,
+		Offset:  e.Offset,
+		Phase:   e.Phase,
+		DB:      e.DB,
+		Shard:   e.Shard,
+		Command: e.Command,
+		Keys:    e.Keys,
+		Args:    e.Args,
+	}
+	if je.Keys == nil {
+		je.Keys = []string{}
+	}
+	if je.Args == nil {
+		je.Args = []string{}
+	}
+	if !validUTF8(e.Keys) || !validUTF8(e.Args) {
+		je.Encoding = "base64"
+		je.Keys, je.Args = encodeBase64(e.Keys), encodeBase64(e.Args)
+	}
+	return json.Marshal(je)
+}
+
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var je jsonEvent
+	if err := json.Unmarshal(b, &je); err != nil {
+		return err
+	}
+	if err := checkEventVersion(je.Version); err != nil {
+		return err
+	}
+	switch je.Encoding {
+	case "":
+	case "base64":
+		var err error
+		if je.Keys, err = decodeBase64(je.Keys); err != nil {
+			return err
+		}
+		if je.Args, err = decodeBase64(je.Args); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("canal: unknown event encoding %q", je.Encoding)
+	}
+	if len(je.Keys) == 0 {
+		je.Keys = nil
+	}
+	if len(je.Args) == 0 {
+		je.Args = nil
+	}
+	*e = Event{
+		Version: je.Version,
+		ReplId:  je.ReplId,
+		Offset:  je.Offset,
+		Phase:   je.Phase,
+		DB:      je.DB,
+		Shard:   je.Shard,
+		Command: je.Command,
+		Keys:    je.Keys,
+		Args:    je.Args,
+	}
+	return nil
+}
+
+// MarshalBinary returns the compact encoding of e: the version, replId,
+// offset, phase, db, shard, command, keys and args, each integer a varint
+// and each string a uvarint length followed by its bytes.
+func (e *Event) MarshalBinary() ([]byte, error) {
+	size := 5*binary.MaxVarintLen64 + len(e.ReplId) + len(e.Shard) + len(e.Command)
+	for _, s := range e.Keys {
+		size += binary.MaxVarintLen64 + len(s)
+	}
+	for _, s := range e.Args {
+		size += binary.MaxVarintLen64 + len(s)
+	}
+	b := make([]byte, 0, size)
+	b = appendUvarint(b, uint64(e.Version))
+	b = appendString(b, e.ReplId)
+	b = appendVarint(b, e.Offset)
+	b = appendVarint(b, int64(e.Phase))
+	b = appendVarint(b, int64(e.DB))
+	b = appendString(b, e.Shard)
+	b = appendString(b, e.Command)
+	b = appendUvarint(b, uint64(len(e.Keys)))
+	for _, s := range e.Keys {
+		b = appendString(b, s)
+	}
+	b = appendUvarint(b, uint64(len(e.Args)))
+	for _, s := range e.Args {
+		b = appendString(b, s)
+	}
+	return b, nil
+}
+
+func (e *Event) UnmarshalBinary(b []byte) error {
+	d := binaryDecoder{b: b}
+	version := int(d.uvarint())
+	if d.err == nil {
+		if err := checkEventVersion(version); err != nil {
+			return err
+		}
+	}
+	ev := Event{Version: version}
+	ev.ReplId = d.string()
+	ev.Offset = d.varint()
+	ev.Phase = Phase(d.varint())
+	ev.DB = int(d.varint())
+	ev.Shard = d.string()
+	ev.Command = d.string()
+	ev.Keys = d.strings()
+	ev.Args = d.strings()
+	if d.err != nil {
+		return d.err
+	}
+	*e = ev
+	return nil
+}
+
+// ErrEventCorrupt is returned when decoding a truncated or malformed
+// binary Event.
+var ErrEventCorrupt = errors.New("canal: corrupt event")
+
+func checkEventVersion(v int) error {
+	if v < 1 || v > EventVersion {
+		return fmt.Errorf("canal: unsupported event version %d", v)
+	}
+	return nil
+}
+
+type binaryDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrEventCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrEventCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *binaryDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.b)) {
+		d.err = ErrEventCorrupt
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *binaryDecoder) strings() []string {
+	n := d.uvarint()
+	// every string takes at least a byte
+	if d.err != nil || n > uint64(len(d.b)) {
+		if d.err == nil {
+			d.err = ErrEventCorrupt
+		}
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		ss[i] = d.string()
+	}
+	return ss
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func validUTF8(ss []string) bool {
+	for _, s := range ss {
+		if !utf8.ValidString(s) {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeBase64(ss []string) []string {
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return out
+}
+
+func decodeBase64(ss []string) ([]string, error) {
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = string(b)
+	}
+	return out, nil
+}
+
+// EventFormat is the encoding of a stream of events.
+type EventFormat int
+
+const (
+	// EventJSON writes one JSON Event per line.
+	EventJSON EventFormat = iota
+	// EventBinary writes each binary Event after its uvarint length.
+	EventBinary
+)
+
+func (f EventFormat) String() string {
+	switch f {
+	case EventJSON:
+		return "json"
+	case EventBinary:
+		return "binary"
+	}
+	return "format(" + strconv.Itoa(int(f)) + ")"
+}
+
+// ParseEventFormat returns the EventFormat named "json" or "binary".
+func ParseEventFormat(name string) (EventFormat, error) {
+	switch name {
+	case "json":
+		return EventJSON, nil
+	case "binary":
+		return EventBinary, nil
+	}
+	return 0, fmt.Errorf("unknown event format %q, one of json, binary", name)
+}
+
+// Encode returns the encoding of e in the stream format f.
+func (f EventFormat) Encode(e *Event) ([]byte, error) {
+	switch f {
+	case EventJSON:
+		b, err := json.Marshal(e)
+		return append(b, '\n'), err
+	case EventBinary:
+		b, err := e.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return append(appendUvarint(make([]byte, 0, len(b)+binary.MaxVarintLen64), uint64(len(b))), b...), nil
+	}
+	return nil, fmt.Errorf("canal: unknown event format %v", f)
+}
+
+// dbTracker follows SELECT to know the database of each command.
+type dbTracker struct {
+	db int
+}
+
+func (t *dbTracker) event(cmd *Command) *Event {
+	if db, ok := selectedDB(cmd); ok {
+		t.db = db
+	}
+	return NewEvent(cmd, t.db)
+}
+
+// selectedDB returns the database selected by cmd, if it is a SELECT.
+func selectedDB(cmd *Command) (int, bool) {
+	if cmd.Name() != "SELECT" || len(cmd.D) < 2 {
+		return 0, false
+	}
+	db, err := strconv.Atoi(cmd.D[1])
+	return db, err == nil
+}
+
+// EventWriter is a CommandDecoder writing the Event of each command to w.
+type EventWriter struct {
+	w      io.Writer
+	format EventFormat
+	dbs    dbTracker
+}
+
+// NewEventWriter returns an EventWriter writing in the given format. Each
+// event is written with a single Write.
+func NewEventWriter(w io.Writer, format EventFormat) *EventWriter {
+	return &EventWriter{w: w, format: format}
+}
+
+func (ew *EventWriter) Command(cmd *Command) error {
+	b, err := ew.format.Encode(ew.dbs.event(cmd))
+	if err != nil {
+		return err
+	}
+	_, err = ew.w.Write(b)
+	return err
+}
+
+// maxEventSize bounds the length read before a binary event, that of the
+// largest bulk string of Redis.
+const maxEventSize = 512 << 20
+
+// EventReader reads the events written by an EventWriter.
+type EventReader struct {
+	r      *bufio.Reader
+	format EventFormat
+}
+
+// NewEventReader returns an EventReader of events in the given format.
+func NewEventReader(r io.Reader, format EventFormat) *EventReader {
+	return &EventReader{r: bufio.NewReader(r), format: format}
+}
+
+// Read returns the next event, io.EOF at the end of the stream and
+// io.ErrUnexpectedEOF if it ends within an event.
+func (er *EventReader) Read() (*Event, error) {
+	e := new(Event)
+	switch er.format {
+	case EventJSON:
+		line, err := er.r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case EventBinary:
+		n, err := binary.ReadUvarint(er.r)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxEventSize {
+			return nil, ErrEventCorrupt
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(er.r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if err := e.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("canal: unknown event format %v", er.format)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventJSON(t *testing.T) {
+	cmd := &Command{D: []string{"set", "k", "v"}, Offset: 42, ReplId: "abc", Phase: PhaseStreaming}
+	b, err := json.Marshal(NewEvent(cmd, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"v":1,"repl_id":"abc","offset":42,"phase":"streaming","db":2,"command":"SET","keys":["k"],"args":["k","v"]}`, string(b))
+
+	cmd = &Command{D: []string{"SET", "k", "\xff\x00"}, Phase: PhaseRDB}
+	b, err = json.Marshal(NewEvent(cmd, 0))
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"keys":["aw=="],"args":["aw==","/wA="],"encoding":"base64"`)
+	var e Event
+	assert.Nil(t, json.Unmarshal(b, &e))
+	assert.Equal(t, []string{"k", "\xff\x00"}, e.Args)
+	assert.Equal(t, PhaseRDB, e.Phase)
+
+	// an Event value, in a slice or a struct, marshals the same
+	vb, err := json.Marshal([]Event{e})
+	assert.Nil(t, err)
+	assert.Equal(t, "["+string(b)+"]", string(vb))
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"v":2,"command":"PING"}`), &e))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"v":1,"command":"PING","encoding":"hex"}`), &e))
+}
+
+func TestEventStream(t *testing.T) {
+	cmds := []*Command{
+		{D: []string{"SET", "k", "v"}, Offset: 10, ReplId: "abc", Phase: PhaseRDB},
+		{D: []string{"SELECT", "3"}, Offset: 20, ReplId: "abc", Phase: PhaseStreaming},
+		{D: []string{"MSET", "a", "\x00\xff", "b", ""}, Offset: 30, ReplId: "abc", Phase: PhaseStreaming, Shard: "s1"},
+		{D: []string{"PING"}, Offset: 40, ReplId: "abc", Phase: PhaseStreaming},
+	}
+	for _, format := range []EventFormat{EventJSON, EventBinary} {
+		var buf bytes.Buffer
+		w := NewEventWriter(&buf, format)
+		for _, cmd := range cmds {
+			assert.Nil(t, w.Command(cmd))
+		}
+
+		r := NewEventReader(bytes.NewReader(buf.Bytes()), format)
+		for i, cmd := range cmds {
+			e, err := r.Read()
+			if !assert.Nil(t, err, format) {
+				break
+			}
+			assert.Equal(t, EventVersion, e.Version)
+			assert.Equal(t, NewEvent(cmd, e.DB).Keys, e.Keys, format)
+			if e.Command == "MSET" {
+				assert.Equal(t, []string{"a", "b"}, e.Keys, format)
+			}
+			assert.Equal(t, cmd, e.Cmd(), format)
+			if i > 0 {
+				assert.Equal(t, 3, e.DB, format)
+			}
+		}
+		_, err := r.Read()
+		assert.Equal(t, io.EOF, err, format)
+
+		r = NewEventReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), format)
+		for err == io.EOF || err == nil {
+			_, err = r.Read()
+		}
+		assert.Equal(t, io.ErrUnexpectedEOF, err, format)
+	}
+
+	var e Event
+	assert.Equal(t, ErrEventCorrupt, e.UnmarshalBinary([]byte{1, 10, 'a'}))
+	huge := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(huge, maxEventSize+1)
+	_, err := NewEventReader(bytes.NewReader(huge[:n]), EventBinary).Read()
+	assert.Equal(t, ErrEventCorrupt, err)
+	_, err = ParseEventFormat("xml")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,424 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SlowSinkPolicy is what a FanOut does with a command for a sink whose
+// queue is full.
+type SlowSinkPolicy int
+
+const (
+	// SlowSinkBlock waits for room, holding back the other sinks and the
+	// replication.
+	SlowSinkBlock SlowSinkPolicy = iota
+	// SlowSinkDrop drops the command for that sink, counted by Dropped.
+	// The sink then holds back Applied at the offset preceding its first
+	// drop until the next full sync: what it applied afterwards is missing
+	// commands.
+	SlowSinkDrop
+	// SlowSinkDetach stops sending commands to the sink, which then no
+	// longer holds back Applied.
+	SlowSinkDetach
+)
+
+func (p SlowSinkPolicy) String() string {
+	switch p {
+	case SlowSinkBlock:
+		return "block"
+	case SlowSinkDrop:
+		return "drop"
+	case SlowSinkDetach:
+		return "detach"
+	}
+	return fmt.Sprintf("policy(%d)", int(p))
+}
+
+// ParseSlowSinkPolicy returns the SlowSinkPolicy named "block", "drop" or
+// "detach".
+func ParseSlowSinkPolicy(name string) (SlowSinkPolicy, error) {
+	for _, p := range []SlowSinkPolicy{SlowSinkBlock, SlowSinkDrop, SlowSinkDetach} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow sink policy %q, one of block, drop, detach", name)
+}
+
+// FanOutOption specifies an option for a FanOut.
+type FanOutOption struct {
+	f func(*fanOutOptions)
+}
+
+type fanOutOptions struct {
+	queueSize   int
+	policy      SlowSinkPolicy
+	slowTimeout time.Duration
+	logger      Logger
+}
+
+// FanOutQueueSize specifies the number of commands queued per sink.
+// Default is 1024.
+func FanOutQueueSize(n int) FanOutOption {
+	return FanOutOption{func(o *fanOutOptions) {
+		o.queueSize = n
+	}}
+}
+
+// FanOutSlowSink specifies the policy for the sinks whose queue is full,
+// applied once the queue stayed full for timeout. Default is SlowSinkBlock.
+// With SlowSinkDetach, a sink failing is detached as well instead of
+// stopping the FanOut.
+func FanOutSlowSink(policy SlowSinkPolicy, timeout time.Duration) FanOutOption {
+	return FanOutOption{func(o *fanOutOptions) {
+		o.policy = policy
+		o.slowTimeout = timeout
+	}}
+}
+
+// FanOutLogger specifies the Logger reporting detached sinks.
+func FanOutLogger(l Logger) FanOutOption {
+	return FanOutOption{func(o *fanOutOptions) {
+		o.logger = l
+	}}
+}
+
+// FanOutSinkStatus is the progress of a sink of a FanOut.
+type FanOutSinkStatus struct {
+	// Applied is the offset acknowledged by the sink, its Applied if it
+	// has one, else the offset of the last command it returned from. It
+	// stays before the first command dropped for the sink.
+	Applied  int64
+	Queued   int
+	Dropped  int64
+	Detached bool
+	Err      error
+}
+
+type fanOutItem struct {
+	cmd     *Command
+	flushed chan error // set for a flush request instead of cmd
+}
+
+type fanOutSink struct {
+	sink     CommandDecoder
+	queue    chan fanOutItem
+	closed   bool  // queue closed, guarded by FanOut.sendMu
+	handled  int64 // offset of the last command handled
+	dropped  int64
+	pinned   int64 // offset preceding the first drop, noPin without drop
+	detached int32
+
+	mu  sync.Mutex
+	err error
+}
+
+func (s *fanOutSink) isDetached() bool { return atomic.LoadInt32(&s.detached) == 1 }
+
+func (s *fanOutSink) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// noPin is the pinned offset of a sink without dropped commands.
+const noPin = math.MaxInt64
+
+func (s *fanOutSink) applied() int64 {
+	applied := atomic.LoadInt64(&s.handled)
+	if a, ok := s.sink.(interface{ Applied() int64 }); ok {
+		applied = a.Applied()
+	}
+	if pinned := atomic.LoadInt64(&s.pinned); pinned < applied {
+		return pinned
+	}
+	return applied
+}
+
+// FanOut is a CommandDecoder dispatching every command to several sinks,
+// so that one replication feeds them all. Each sink has its own queue and
+// goroutine and progresses independently; Applied is the lowest offset
+// they acknowledged, so a checkpoint never skips a command for any of
+// them. A sink whose queue is full is handled by the SlowSinkPolicy.
+// Commands are shared by the sinks, which must not modify them. An error
+// of a sink stops the FanOut: it is returned by Command from then on.
+type FanOut struct {
+	opts  fanOutOptions
+	sinks []*fanOutSink
+	wg    sync.WaitGroup
+
+	sendMu     sync.Mutex // guards the queues against Close
+	dispatched int64
+	mu         sync.Mutex
+	err        error
+	closed     bool
+}
+
+// NewFanOut starts dispatching to sinks.
+func NewFanOut(sinks []CommandDecoder, opts ...FanOutOption) *FanOut {
+	f := &FanOut{
+		opts: fanOutOptions{
+			queueSize: 1024,
+			logger:    defaultLogger,
+		},
+		dispatched: -1,
+	}
+	for _, opt := range opts {
+		opt.f(&f.opts)
+	}
+	if f.opts.queueSize < 1 {
+		f.opts.queueSize = 1
+	}
+	for _, sink := range sinks {
+		s := &fanOutSink{sink: sink, queue: make(chan fanOutItem, f.opts.queueSize), handled: -1, pinned: noPin}
+		f.sinks = append(f.sinks, s)
+		f.wg.Add(1)
+		go f.run(len(f.sinks)-1, s)
+	}
+	return f
+}
+
+// run applies the queued commands to a sink until its queue is closed.
+// After an error the remaining commands are discarded.
+func (f *FanOut) run(i int, s *fanOutSink) {
+	defer f.wg.Done()
+	for item := range s.queue {
+		err := s.failed()
+		if item.flushed != nil {
+			if flusher, ok := s.sink.(interface{ Flush() error }); ok && err == nil {
+				err = flusher.Flush()
+			}
+			item.flushed <- err
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if err := s.sink.Command(item.cmd); err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			if f.opts.policy == SlowSinkDetach {
+				f.opts.logger.Warn("fanout sink failed, detached", "sink", i, "err", err)
+				atomic.StoreInt32(&s.detached, 1)
+			} else {
+				f.fail(fmt.Errorf("fanout sink %d: %v", i, err))
+			}
+			continue
+		}
+		atomic.StoreInt64(&s.handled, item.cmd.Offset)
+	}
+}
+
+func (f *FanOut) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *FanOut) failed() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed && f.err == nil {
+		return ErrSinkClosed
+	}
+	return f.err
+}
+
+// Command implements CommandDecoder.
+func (f *FanOut) Command(cmd *Command) error {
+	f.sendMu.Lock()
+	defer f.sendMu.Unlock()
+	if err := f.failed(); err != nil {
+		return err
+	}
+	for i, s := range f.sinks {
+		if s.isDetached() {
+			f.release(s)
+			continue
+		}
+		f.send(i, s, cmd)
+	}
+	atomic.StoreInt64(&f.dispatched, cmd.Offset)
+	return f.failed()
+}
+
+// send queues cmd for a sink, applying the policy if its queue is full.
+func (f *FanOut) send(i int, s *fanOutSink, cmd *Command) {
+	item := fanOutItem{cmd: cmd}
+	select {
+	case s.queue <- item:
+		f.queued(s, cmd)
+		return
+	default:
+	}
+	if f.opts.policy == SlowSinkBlock {
+		s.queue <- item
+		f.queued(s, cmd)
+		return
+	}
+	if f.opts.slowTimeout > 0 {
+		timer := time.NewTimer(f.opts.slowTimeout)
+		defer timer.Stop()
+		select {
+		case s.queue <- item:
+			f.queued(s, cmd)
+			return
+		case <-timer.C:
+		}
+	}
+	if f.opts.policy == SlowSinkDrop {
+		atomic.AddInt64(&s.dropped, 1)
+		if atomic.LoadInt64(&s.pinned) == noPin {
+			f.pin(s, cmd)
+		}
+		return
+	}
+	f.opts.logger.Warn("fanout sink too slow, detached", "sink", i, "offset", cmd.Offset)
+	atomic.StoreInt32(&s.detached, 1)
+	f.release(s)
+}
+
+// pin holds back the applied offset of a sink before cmd, dropped for it.
+// A command dropped during a snapshot leaves no position to resume from.
+func (f *FanOut) pin(s *fanOutSink, cmd *Command) {
+	pinned := atomic.LoadInt64(&f.dispatched)
+	if cmd.Phase == PhaseRDB {
+		pinned = -1
+	}
+	atomic.StoreInt64(&s.pinned, pinned)
+}
+
+// queued unpins a sink once it gets the start of a full sync, which
+// replaces whatever it missed.
+func (f *FanOut) queued(s *fanOutSink, cmd *Command) {
+	if cmd.Phase == PhaseRDB && cmd.Name() == "PING" {
+		atomic.StoreInt64(&s.pinned, noPin)
+	}
+}
+
+// release closes the queue of a detached sink, letting its goroutine end.
+func (f *FanOut) release(s *fanOutSink) {
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+}
+
+// Applied returns the lowest offset acknowledged by the attached sinks, or
+// the offset of the last command once all of them are detached.
+func (f *FanOut) Applied() int64 {
+	min, attached := int64(0), false
+	for _, s := range f.sinks {
+		if s.isDetached() {
+			continue
+		}
+		if a := s.applied(); !attached || a < min {
+			min, attached = a, true
+		}
+	}
+	if !attached {
+		return atomic.LoadInt64(&f.dispatched)
+	}
+	return min
+}
+
+// Status returns the progress of the sinks, in the order given to NewFanOut.
+func (f *FanOut) Status() []FanOutSinkStatus {
+	out := make([]FanOutSinkStatus, len(f.sinks))
+	for i, s := range f.sinks {
+		out[i] = FanOutSinkStatus{
+			Applied:  s.applied(),
+			Queued:   len(s.queue),
+			Dropped:  atomic.LoadInt64(&s.dropped),
+			Detached: s.isDetached(),
+			Err:      s.failed(),
+		}
+	}
+	return out
+}
+
+// Flush waits until the attached sinks applied the queued commands, and
+// flushes the sinks having a Flush method.
+func (f *FanOut) Flush() error {
+	f.sendMu.Lock()
+	if err := f.failed(); err != nil {
+		f.sendMu.Unlock()
+		return err
+	}
+	var pending []chan error
+	for _, s := range f.sinks {
+		if s.isDetached() {
+			f.release(s)
+			continue
+		}
+		flushed := make(chan error, 1)
+		s.queue <- fanOutItem{flushed: flushed}
+		pending = append(pending, flushed)
+	}
+	f.sendMu.Unlock()
+	for _, flushed := range pending {
+		if err := <-flushed; err != nil && f.opts.policy != SlowSinkDetach {
+			f.fail(err)
+		}
+	}
+	return f.failed()
+}
+
+// Close waits until the sinks applied the queued commands and closes the
+// sinks implementing io.Closer.
+func (f *FanOut) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return ErrSinkClosed
+	}
+	f.closed = true
+	f.mu.Unlock()
+
+	f.sendMu.Lock()
+	for _, s := range f.sinks {
+		f.release(s)
+	}
+	f.sendMu.Unlock()
+	f.wg.Wait()
+	for i, s := range f.sinks {
+		closer, ok := s.sink.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil && err != ErrSinkClosed {
+			if s.isDetached() {
+				f.opts.logger.Warn("fanout sink close failed", "sink", i, "err", err)
+			} else {
+				f.fail(fmt.Errorf("fanout sink %d: %v", i, err))
+			}
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
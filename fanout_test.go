@@ -0,0 +1,253 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordSink records the commands it gets. With gate set, each command
+// waits for a value on it after signaling started.
+type recordSink struct {
+	mu      sync.Mutex
+	cmds    []string
+	closed  bool
+	gate    chan struct{}
+	started chan struct{}
+	err     error
+}
+
+func newGatedSink() *recordSink {
+	return &recordSink{gate: make(chan struct{}), started: make(chan struct{}, 100)}
+}
+
+func (s *recordSink) Command(cmd *Command) error {
+	if s.gate != nil {
+		s.started <- struct{}{}
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.cmds = append(s.cmds, strings.Join(cmd.D, " "))
+	return nil
+}
+
+func (s *recordSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *recordSink) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+// ackSink acknowledges the offsets the test sets.
+type ackSink struct {
+	recordSink
+	applied int64
+}
+
+func (s *ackSink) Applied() int64 { return atomic.LoadInt64(&s.applied) }
+
+func fanOutCommands(t *testing.T, f *FanOut, cmds ...string) {
+	for i, c := range cmds {
+		assert.Nil(t, f.Command(&Command{D: strings.Fields(c), Offset: int64(10 * (i + 1))}))
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	r := &recordSink{}
+	a := &ackSink{applied: -1}
+	f := NewFanOut([]CommandDecoder{r, a})
+	assert.Equal(t, int64(-1), f.Applied())
+
+	fanOutCommands(t, f, "SET a 1", "SET b 2", "DEL a")
+	assert.Nil(t, f.Flush())
+	assert.Equal(t, []string{"SET a 1", "SET b 2", "DEL a"}, r.commands())
+	assert.Equal(t, r.commands(), a.commands())
+	assert.Equal(t, int64(-1), f.Applied())
+
+	atomic.StoreInt64(&a.applied, 20)
+	assert.Equal(t, int64(20), f.Applied())
+	atomic.StoreInt64(&a.applied, 30)
+	assert.Equal(t, int64(30), f.Applied())
+
+	assert.Nil(t, f.Close())
+	assert.True(t, r.closed)
+	assert.True(t, a.closed)
+	assert.Equal(t, ErrSinkClosed, f.Command(&Command{D: []string{"PING"}}))
+}
+
+// slowFanOut returns a FanOut with a queue of one command, a fast sink
+// and a slow one holding the first command, SET a 1 at offset 10.
+func slowFanOut(t *testing.T, policy SlowSinkPolicy) (*FanOut, *recordSink, *recordSink) {
+	fast, slow := &recordSink{}, newGatedSink()
+	f := NewFanOut([]CommandDecoder{fast, slow}, FanOutQueueSize(1),
+		FanOutSlowSink(policy, 0), FanOutLogger(NopLogger{}))
+	assert.Nil(t, f.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 10}))
+	<-slow.started
+	waitCommands(fast, 1)
+	return f, fast, slow
+}
+
+// waitCommands waits until s recorded n commands.
+func waitCommands(s *recordSink, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.commands()) < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// sendSlow sends SET b, c and d, letting the fast sink keep up.
+func sendSlow(t *testing.T, f *FanOut, fast *recordSink) {
+	for i, key := range []string{"b", "c", "d"} {
+		assert.Nil(t, f.Command(&Command{D: []string{"SET", key, "1"}, Offset: int64(20 + 10*i)}))
+		waitCommands(fast, i+2)
+	}
+}
+
+// release lets the slow sink apply its commands from now on.
+func release(slow *recordSink) {
+	go func() {
+		for range slow.started {
+			slow.gate <- struct{}{}
+		}
+	}()
+	slow.gate <- struct{}{}
+}
+
+func TestFanOutSlowSinkDrop(t *testing.T) {
+	f, fast, slow := slowFanOut(t, SlowSinkDrop)
+	sendSlow(t, f, fast)
+	assert.Equal(t, int64(2), f.Status()[1].Dropped)
+	assert.Equal(t, 1, f.Status()[1].Queued)
+
+	release(slow)
+	waitCommands(slow, 2)
+	assert.Nil(t, f.Command(&Command{D: []string{"SET", "e", "1"}, Offset: 50}))
+	assert.Nil(t, f.Flush())
+	// the slow sink missed SET c and d
+	assert.Equal(t, int64(20), f.Status()[1].Applied)
+	assert.Equal(t, int64(20), f.Applied())
+
+	// a full sync brings it back
+	assert.Nil(t, f.Command(&Command{D: []string{"PING"}, Offset: 100, Phase: PhaseRDB}))
+	assert.Nil(t, f.Flush())
+	assert.Nil(t, f.Command(&Command{D: []string{"SET", "f", "1"}, Offset: 110, Phase: PhaseStreaming}))
+	assert.Nil(t, f.Flush())
+	assert.Equal(t, int64(110), f.Applied())
+
+	assert.Nil(t, f.Close())
+	close(slow.started)
+	assert.Equal(t, []string{"SET a 1", "SET b 1", "SET c 1", "SET d 1", "SET e 1", "PING", "SET f 1"}, fast.commands())
+	assert.Equal(t, []string{"SET a 1", "SET b 1", "SET e 1", "PING", "SET f 1"}, slow.commands())
+}
+
+func TestFanOutSlowSinkDetach(t *testing.T) {
+	f, fast, slow := slowFanOut(t, SlowSinkDetach)
+	sendSlow(t, f, fast)
+	assert.True(t, f.Status()[1].Detached)
+	assert.False(t, f.Status()[0].Detached)
+	assert.Nil(t, f.Flush())
+	// the detached sink no longer holds back the others
+	assert.Equal(t, int64(40), f.Applied())
+
+	release(slow)
+	assert.Nil(t, f.Close())
+	close(slow.started)
+	assert.Equal(t, []string{"SET a 1", "SET b 1", "SET c 1", "SET d 1"}, fast.commands())
+	assert.Equal(t, []string{"SET a 1", "SET b 1"}, slow.commands())
+}
+
+func TestFanOutSinkError(t *testing.T) {
+	failing := &recordSink{err: errors.New("boom")}
+	f := NewFanOut([]CommandDecoder{&recordSink{}, failing})
+	assert.Nil(t, f.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 10}))
+	err := f.Flush()
+	assert.EqualError(t, err, "fanout sink 1: boom")
+	assert.Equal(t, err, f.Command(&Command{D: []string{"SET", "b", "2"}, Offset: 20}))
+	assert.Equal(t, "boom", f.Status()[1].Err.Error())
+	assert.Equal(t, err, f.Close())
+
+	// with detach, the failing sink is dropped instead
+	ok := &recordSink{}
+	f = NewFanOut([]CommandDecoder{ok, &recordSink{err: errors.New("boom")}},
+		FanOutSlowSink(SlowSinkDetach, time.Second), FanOutLogger(NopLogger{}))
+	fanOutCommands(t, f, "SET a 1", "SET b 2")
+	assert.Nil(t, f.Flush())
+	assert.True(t, f.Status()[1].Detached)
+	assert.Equal(t, int64(20), f.Applied())
+	assert.Nil(t, f.Close())
+	assert.Len(t, ok.commands(), 2)
+}
+
+func TestFanOutPipelineSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fanout")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	pc, err := ParsePipelineConfig([]byte(`{
+		"source": {"addr": "127.0.0.1:6379"},
+		"sink": {"type": "fanout", "queue_size": 16, "slow_sink": "detach", "slow_timeout": "1s",
+		         "sinks": [{"type": "file", "dir": "` + dir + `/a"}, {"type": "file", "dir": "` + dir + `/b"}]}
+	}`))
+	assert.Nil(t, err)
+	params := pc.Sink.Params.(*fanOutSinkParams)
+	assert.Len(t, params.Sinks, 2)
+	assert.Equal(t, "file", params.Sinks[1].Type)
+
+	sink, err := params.Build()
+	assert.Nil(t, err)
+	f := sink.(*FanOut)
+	assert.Equal(t, 16, f.opts.queueSize)
+	assert.Equal(t, SlowSinkDetach, f.opts.policy)
+	assert.Nil(t, f.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 10}))
+	assert.Nil(t, f.Close())
+	assert.Equal(t, int64(10), f.Applied())
+}
+
+func TestFanOutAck(t *testing.T) {
+	a := &ackSink{applied: -1}
+	f := NewFanOut([]CommandDecoder{&recordSink{}, a})
+	defer f.Close()
+	c := &Canal{cmder: NewFilterChain(f, CommandFilter(nil, []string{"FLUSHALL"})), offset: 100}
+	// nothing applied yet
+	assert.Equal(t, int64(0), c.ackOffset())
+	fanOutCommands(t, f, "SET a 1", "SET b 2", "SET c 3", "SET d 4")
+	assert.Nil(t, f.Flush())
+	atomic.StoreInt64(&a.applied, 30)
+	assert.Equal(t, int64(30), c.ackOffset())
+
+	c.cmder = &recordSink{}
+	assert.Equal(t, int64(100), c.ackOffset())
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FsyncPolicy specifies when written data is synced to disk, as the
+// appendfsync setting of Redis.
+type FsyncPolicy int
+
+const (
+	// FsyncEverySec syncs once per second.
+	FsyncEverySec FsyncPolicy = iota
+	// FsyncAlways syncs after every command.
+	FsyncAlways
+	// FsyncNo leaves it to the operating system.
+	FsyncNo
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncEverySec:
+		return "everysec"
+	case FsyncAlways:
+		return "always"
+	case FsyncNo:
+		return "no"
+	}
+	return fmt.Sprintf("fsync(%d)", int(p))
+}
+
+// ParseFsyncPolicy returns the FsyncPolicy named "always", "everysec" or "no".
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	for _, p := range []FsyncPolicy{FsyncEverySec, FsyncAlways, FsyncNo} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown fsync policy %q, one of always, everysec, no", name)
+}
+
+// FileSinkOption specifies an option for a FileSink.
+type FileSinkOption struct {
+	f func(*fileSinkOptions)
+}
+
+type fileSinkOptions struct {
+	maxSize       int64
+	maxAge        time.Duration
+	fsync         FsyncPolicy
+	compress      bool
+	indexInterval int64
+	logger        Logger
+}
+
+// FileSinkMaxSize specifies the size a segment is rotated at. Default is 64MB.
+func FileSinkMaxSize(n int64) FileSinkOption {
+	return FileSinkOption{func(o *fileSinkOptions) {
+		o.maxSize = n
+	}}
+}
+
+// FileSinkMaxAge specifies how long a segment is written to before it is
+// rotated. Default is zero, segments are rotated by size only.
+func FileSinkMaxAge(d time.Duration) FileSinkOption {
+	return FileSinkOption{func(o *fileSinkOptions) {
+		o.maxAge = d
+	}}
+}
+
+// FileSinkFsync specifies when segments are synced. Default is FsyncEverySec.
+func FileSinkFsync(p FsyncPolicy) FileSinkOption {
+	return FileSinkOption{func(o *fileSinkOptions) {
+		o.fsync = p
+	}}
+}
+
+// FileSinkCompress specifies whether closed segments are gzipped.
+func FileSinkCompress(compress bool) FileSinkOption {
+	return FileSinkOption{func(o *fileSinkOptions) {
+		o.compress = compress
+	}}
+}
+
+// FileSinkIndexInterval specifies how many segment bytes are written
+// between two index entries. Default is 4KB.
+func FileSinkIndexInterval(n int64) FileSinkOption {
+	return FileSinkOption{func(o *fileSinkOptions) {
+		o.indexInterval = n
+	}}
+}
+
+// FileSinkLogger specifies the Logger of the background compression.
+func FileSinkLogger(l Logger) FileSinkOption {
+	return FileSinkOption{func(o *fileSinkOptions) {
+		o.logger = l
+	}}
+}
+
+// FileSink is a CommandDecoder recording the commands with their offset
+// and time into numbered segment files of dir, read back by a
+// SegmentReader. Each run starts a new segment.
+type FileSink struct {
+	dir  string
+	opts fileSinkOptions
+
+	sinkCore
+	seq         int64
+	f           *os.File
+	w           *bufio.Writer
+	idx         *os.File
+	idxw        *bufio.Writer
+	size        int64 // bytes written to the segment
+	lastIndexed int64 // position of the last index entry
+	opened      time.Time
+	dbs         dbTracker
+	last        int64 // offset of the last command written
+	snapshot    bool  // the last command written is one of a snapshot
+	dirty       bool
+	buf         []byte
+
+	applied     int64
+	compressing sync.WaitGroup
+}
+
+// NewFileSink records into dir, created if missing. Segments left
+// uncompressed by a previous run are compressed if FileSinkCompress is set.
+func NewFileSink(dir string, opts ...FileSinkOption) (*FileSink, error) {
+	s := &FileSink{
+		dir: dir,
+		opts: fileSinkOptions{
+			maxSize:       64 << 20,
+			indexInterval: 4 << 10,
+			logger:        defaultLogger,
+		},
+		applied: -1,
+	}
+	for _, opt := range opts {
+		opt.f(&s.opts)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) > 0 {
+		s.seq = segs[len(segs)-1].seq
+	}
+	if s.opts.compress {
+		for _, seg := range segs {
+			if !seg.gz {
+				s.compress(seg.path)
+			}
+		}
+	}
+	s.startFlusher(time.Second, func() error {
+		if s.f == nil {
+			return nil
+		}
+		if s.opts.maxAge > 0 && time.Since(s.opened) >= s.opts.maxAge {
+			return s.rotate()
+		}
+		return s.flush(s.opts.fsync == FsyncEverySec)
+	})
+	return s, nil
+}
+
+// Applied returns the offset of the last command flushed, and synced
+// unless the policy is FsyncNo, -1 while a snapshot is recorded.
+func (s *FileSink) Applied() int64 { return atomic.LoadInt64(&s.applied) }
+
+// Command implements CommandDecoder.
+func (s *FileSink) Command(cmd *Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	var err error
+	if s.buf, err = appendRecord(s.buf[:0], time.Now(), s.dbs.event(cmd)); err != nil {
+		return err
+	}
+	if s.f != nil && s.size > int64(len(segmentMagic)) && s.size+int64(len(s.buf)) > s.opts.maxSize {
+		if err := s.rotate(); err != nil {
+			return s.fail(err)
+		}
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return s.fail(err)
+		}
+	}
+	if s.size == int64(len(segmentMagic)) || s.size-s.lastIndexed >= s.opts.indexInterval {
+		var entry [segmentIndexSize]byte
+		binary.BigEndian.PutUint64(entry[:], uint64(cmd.Offset))
+		binary.BigEndian.PutUint64(entry[8:], uint64(s.size))
+		if _, err := s.idxw.Write(entry[:]); err != nil {
+			return s.fail(err)
+		}
+		s.lastIndexed = s.size
+	}
+	if _, err := s.w.Write(s.buf); err != nil {
+		return s.fail(err)
+	}
+	s.size += int64(len(s.buf))
+	if cmd.Phase == PhaseRDB && !s.snapshot {
+		// the snapshot starts with a PING, it has no position to resume
+		// from until the first command of the stream follows it
+		atomic.StoreInt64(&s.applied, -1)
+	}
+	s.last, s.snapshot, s.dirty = cmd.Offset, cmd.Phase == PhaseRDB, true
+	if s.opts.fsync == FsyncAlways {
+		return s.fail(s.flush(true))
+	}
+	return nil
+}
+
+// Flush writes out the buffered commands, syncing them unless the policy
+// is FsyncNo.
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.fail(s.flush(s.opts.fsync != FsyncNo))
+}
+
+// Close flushes the segment being written and waits for the compression
+// of closed segments.
+func (s *FileSink) Close() error {
+	s.stopFlusher()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.err
+	if s.f != nil {
+		if rerr := s.rotate(); err == nil {
+			err = rerr
+		}
+	}
+	s.mu.Unlock()
+	s.compressing.Wait()
+	return err
+}
+
+func (s *FileSink) open() error {
+	s.seq++
+	base := filepath.Join(s.dir, segmentName(s.seq))
+	f, err := os.OpenFile(base+segmentExt, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	idx, err := os.OpenFile(base+segmentIndexExt, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.f, s.idx = f, idx
+	s.w, s.idxw = bufio.NewWriter(f), bufio.NewWriter(idx)
+	if _, err := s.w.WriteString(segmentMagic); err != nil {
+		return err
+	}
+	s.size, s.lastIndexed, s.opened = int64(len(segmentMagic)), 0, time.Now()
+	return nil
+}
+
+// rotate closes the segment being written, compressing it in the background.
+func (s *FileSink) rotate() error {
+	err := s.flush(s.opts.fsync != FsyncNo)
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := s.idx.Close(); err == nil {
+		err = cerr
+	}
+	path := s.f.Name()
+	s.f, s.idx, s.w, s.idxw = nil, nil, nil, nil
+	if err == nil && s.opts.compress {
+		s.compress(path)
+	}
+	return err
+}
+
+func (s *FileSink) flush(sync bool) error {
+	if s.f == nil || !s.dirty {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.idxw.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+	}
+	s.dirty = false
+	if !s.snapshot {
+		atomic.StoreInt64(&s.applied, s.last)
+	}
+	return nil
+}
+
+func (s *FileSink) compress(path string) {
+	s.compressing.Add(1)
+	go func() {
+		defer s.compressing.Done()
+		if err := gzipFile(path); err != nil {
+			s.opts.logger.Warn("segment compression failed", "path", path, "err", err)
+		}
+	}()
+}
+
+// gzipFile replaces path by path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + segmentGzipExt + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+segmentGzipExt)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSink(dir, FileSinkMaxSize(1024), FileSinkIndexInterval(128), FileSinkCompress(true), FileSinkFsync(FsyncAlways))
+	assert.Nil(t, err)
+	start := time.Now()
+	for i := 1; i <= 200; i++ {
+		cmd := &Command{D: []string{"SET", "key:" + strconv.Itoa(i), "value"}, Offset: int64(i * 10)}
+		if i == 100 {
+			cmd.D = []string{"SELECT", "1"}
+		}
+		assert.Nil(t, s.Command(cmd))
+	}
+	assert.Equal(t, int64(2000), s.Applied())
+	assert.Nil(t, s.Close())
+	assert.Equal(t, ErrSinkClosed, s.Command(&Command{D: []string{"PING"}}))
+
+	segs, err := listSegments(dir)
+	assert.Nil(t, err)
+	assert.True(t, len(segs) > 3)
+	for _, seg := range segs {
+		assert.True(t, seg.gz, seg.path)
+	}
+
+	r, err := OpenSegments(dir)
+	assert.Nil(t, err)
+	defer r.Close()
+	for i := 1; i <= 200; i++ {
+		rec, err := r.Next()
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Equal(t, int64(i*10), rec.Event.Offset)
+		assert.False(t, rec.Time.Before(start.Truncate(time.Second)))
+		if i > 100 {
+			assert.Equal(t, 1, rec.Event.DB)
+		}
+	}
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+
+	for _, offset := range []int64{0, 10, 995, 1000, 1555, 2000} {
+		assert.Nil(t, r.SeekOffset(offset))
+		rec, err := r.Next()
+		if assert.Nil(t, err, offset) {
+			want := (offset + 9) / 10 * 10
+			if want == 0 {
+				want = 10
+			}
+			assert.Equal(t, want, rec.Event.Offset, offset)
+		}
+	}
+	assert.Nil(t, r.SeekOffset(2001))
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// a new run starts a new segment after the last one
+	s, err = NewFileSink(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Command(&Command{D: []string{"SET", "a", "b"}, Offset: 2010}))
+	assert.Nil(t, s.Close())
+	after, err := listSegments(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, segs[len(segs)-1].seq+1, after[len(after)-1].seq)
+	assert.False(t, after[len(after)-1].gz)
+}
+
+func TestFileSinkSnapshotApplied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSink(dir, FileSinkFsync(FsyncAlways))
+	assert.Nil(t, err)
+	cmd := func(phase Phase, offset int64, d ...string) {
+		assert.Nil(t, s.Command(&Command{D: d, Offset: offset, Phase: phase}))
+	}
+	cmd(PhaseStreaming, 10, "SET", "a", "1")
+	assert.Equal(t, int64(10), s.Applied())
+
+	// the snapshot is flushed without a position to resume from
+	cmd(PhaseRDB, 100, "PING")
+	assert.Equal(t, int64(-1), s.Applied())
+	cmd(PhaseRDB, 100, "SET", "x", "1")
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, int64(-1), s.Applied())
+	cmd(PhaseStreaming, 114, "PING")
+	assert.Equal(t, int64(114), s.Applied())
+	assert.Nil(t, s.Close())
+}
+
+func TestSegmentReaderTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSink(dir, FileSinkFsync(FsyncNo))
+	assert.Nil(t, err)
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, s.Command(&Command{D: []string{"INCR", "n"}, Offset: int64(i)}))
+	}
+	assert.Nil(t, s.Close())
+
+	// a crash lost the end of the last record and the index
+	path := filepath.Join(dir, segmentName(1)+segmentExt)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, info.Size()-2))
+	assert.Nil(t, os.Remove(filepath.Join(dir, segmentName(1)+segmentIndexExt)))
+
+	r, err := OpenSegments(dir)
+	assert.Nil(t, err)
+	defer r.Close()
+	assert.Nil(t, r.SeekOffset(2))
+	rec, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), rec.Event.Offset)
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Filter decides whether a command goes on to the next CommandDecoder.
+type Filter interface {
+	Keep(cmd *Command) bool
+}
+
+// FilterFunc adapts a function to a Filter.
+type FilterFunc func(cmd *Command) bool
+
+func (f FilterFunc) Keep(cmd *Command) bool { return f(cmd) }
+
+// passThrough are kept by every built-in filter: sinks need them to keep
+// transactions and the selected database consistent.
+var passThrough = map[string]bool{"SELECT": true, "MULTI": true, "EXEC": true, "DISCARD": true}
+
+type filterChain struct {
+	next    CommandDecoder
+	filters []Filter
+}
+
+// NewFilterChain returns a CommandDecoder passing to next the commands
+// every filter keeps.
+func NewFilterChain(next CommandDecoder, filters ...Filter) CommandDecoder {
+	if len(filters) == 0 {
+		return next
+	}
+	fc := &filterChain{next: next, filters: filters}
+	if a, ok := next.(interface{ Applied() int64 }); ok {
+		return appliedFilterChain{fc, a}
+	}
+	return fc
+}
+
+// appliedFilterChain reports the applied offset of next, which the Canal
+// acknowledges to the master.
+type appliedFilterChain struct {
+	*filterChain
+	applied interface{ Applied() int64 }
+}
+
+func (fc appliedFilterChain) Applied() int64 { return fc.applied.Applied() }
+
+func (fc *filterChain) Command(cmd *Command) error {
+	for _, f := range fc.filters {
+		if !f.Keep(cmd) {
+			return nil
+		}
+	}
+	return fc.next.Command(cmd)
+}
+
+// CommandFilter keeps the commands named in include, all if it is empty,
+// and not named in exclude. Names are case insensitive.
+func CommandFilter(include, exclude []string) Filter {
+	in, ex := upperSet(include), upperSet(exclude)
+	return FilterFunc(func(cmd *Command) bool {
+		name := cmd.Name()
+		if passThrough[name] {
+			return true
+		}
+		return (len(in) == 0 || in[name]) && !ex[name]
+	})
+}
+
+// KeyPrefixFilter keeps the commands whose keys all start with one of the
+// include prefixes, all if it is empty, and none with an exclude prefix.
+// Commands without keys are kept.
+func KeyPrefixFilter(include, exclude []string) Filter {
+	hasPrefix := func(key string, prefixes []string) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(key, p) {
+				return true
+			}
+		}
+		return false
+	}
+	return FilterFunc(func(cmd *Command) bool {
+		for _, key := range cmd.Keys() {
+			if len(include) > 0 && !hasPrefix(key, include) {
+				return false
+			}
+			if hasPrefix(key, exclude) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// DBFilter keeps the commands run against one of dbs, following SELECT.
+// It is stateful, each chain needs its own.
+func DBFilter(dbs ...int) Filter {
+	keep := make(map[int]bool, len(dbs))
+	for _, db := range dbs {
+		keep[db] = true
+	}
+	db := 0
+	return FilterFunc(func(cmd *Command) bool {
+		name := cmd.Name()
+		if name == "SELECT" && len(cmd.D) > 1 {
+			if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+				db = n
+			}
+		}
+		return passThrough[name] || keep[db]
+	})
+}
+
+func upperSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[strings.ToUpper(name)] = true
+	}
+	return set
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterChain(t *testing.T) {
+	d := &nopCommander{}
+	chain := NewFilterChain(d,
+		CommandFilter(nil, []string{"flushall"}),
+		KeyPrefixFilter([]string{"user:"}, []string{"user:tmp:"}),
+		DBFilter(0),
+	)
+	for _, args := range [][]string{
+		{"SET", "user:1", "a"},
+		{"SET", "order:1", "a"},
+		{"MSET", "user:1", "a", "order:1", "b"},
+		{"DEL", "user:tmp:1"},
+		{"flushall"},
+		{"MULTI"},
+		{"SELECT", "1"},
+		{"SET", "user:2", "b"},
+		{"SELECT", "0"},
+		{"EXEC"},
+		{"PING"},
+	} {
+		cmd, _ := NewCommand(args...)
+		assert.Nil(t, chain.Command(cmd))
+	}
+	var got []string
+	for _, cmd := range d.cmds {
+		got = append(got, cmd.String())
+	}
+	assert.Equal(t, []string{"SET user:1 a", "MULTI", "SELECT 1", "SELECT 0", "EXEC", "PING"}, got)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RDBStats describes the transfer of an RDB snapshot.
+type RDBStats struct {
+	ReplId string
+	Offset int64
+	// Keys and Bytes are zero in OnRDBBegin. Bytes is read off the
+	// connection and may include some of the stream following the snapshot.
+	Keys  int64
+	Bytes int64
+	// Skipped counts the keys of Keys not passed on as commands: streams,
+	// whose entries the snapshot does not carry in full.
+	Skipped int64
+	// Duration is the time spent decoding, zero in OnRDBBegin.
+	Duration time.Duration
+}
+
+// Hooks are callbacks fired on the lifecycle transitions of a Canal.
+// They are called synchronously from the replication goroutine and must
+// not block. Any of them may be nil.
+type Hooks struct {
+	// OnFullResync is called when the master answers FULLRESYNC, before the snapshot.
+	OnFullResync func(replId string, offset int64)
+	// OnContinue is called when the master accepts a partial resync.
+	OnContinue func(replId string)
+	// OnRDBBegin and OnRDBEnd surround the decoding of the snapshot.
+	OnRDBBegin func(stats RDBStats)
+	OnRDBEnd   func(stats RDBStats)
+	// OnReconnect is called before every reconnection attempt, with the
+	// error that broke the link or made the previous attempt fail: those
+	// of a Canal following sentinels or forced into a full resync, and the
+	// restarts of a replica by a Manager or of a shard by a ClusterCanal.
+	OnReconnect func(err error, attempt int)
+	// OnMasterChange is called when the Canal moves to another master, or
+	// a Manager or ClusterCanal restarts it on another one.
+	OnMasterChange func(old, new string)
+}
+
+// SetHooks sets the Hooks of the Canal built on c.
+func (c *Config) SetHooks(h Hooks) { c.hooks = &h }
+
+func (h *Hooks) fullResync(replId string, offset int64) {
+	if h != nil && h.OnFullResync != nil {
+		h.OnFullResync(replId, offset)
+	}
+}
+
+func (h *Hooks) continued(replId string) {
+	if h != nil && h.OnContinue != nil {
+		h.OnContinue(replId)
+	}
+}
+
+func (h *Hooks) rdbBegin(stats RDBStats) {
+	if h != nil && h.OnRDBBegin != nil {
+		h.OnRDBBegin(stats)
+	}
+}
+
+func (h *Hooks) rdbEnd(stats RDBStats) {
+	if h != nil && h.OnRDBEnd != nil {
+		h.OnRDBEnd(stats)
+	}
+}
+
+func (h *Hooks) reconnect(err error, attempt int) {
+	if h != nil && h.OnReconnect != nil {
+		h.OnReconnect(err, attempt)
+	}
+}
+
+func (h *Hooks) masterChange(old, new string) {
+	if h != nil && h.OnMasterChange != nil && old != new {
+		h.OnMasterChange(old, new)
+	}
+}
+
+// rdbProgress tracks the snapshot being decoded.
+type rdbProgress struct {
+	start   time.Time
+	keys    int64
+	skipped int64
+	expiry  int64 // of the key being decoded
+	cr      *countReader
+	base    int64
+}
+
+func (c *Canal) rdbKey(typ string) {
+	c.rdb.keys++
+	c.cfg.metrics.addRDBKey(typ)
+}
+
+func (c *Canal) rdbStats() RDBStats {
+	stats := RDBStats{
+		ReplId:  c.GetReplId(),
+		Offset:  atomic.LoadInt64(&c.offset),
+		Keys:    c.rdb.keys,
+		Skipped: c.rdb.skipped,
+	}
+	if c.rdb.cr != nil {
+		stats.Bytes = c.rdb.cr.count() - c.rdb.base
+	}
+	if !c.rdb.start.IsZero() {
+		stats.Duration = time.Since(c.rdb.start)
+	}
+	return stats
+}
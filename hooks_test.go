@@ -0,0 +1,111 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks(t *testing.T) {
+	var events []string
+	var end RDBStats
+	cfg := &Config{}
+	cfg.SetHooks(Hooks{
+		OnFullResync: func(replId string, offset int64) {
+			events = append(events, fmt.Sprintf("fullresync %s %d", replId, offset))
+		},
+		OnContinue: func(replId string) { events = append(events, "continue "+replId) },
+		OnRDBBegin: func(stats RDBStats) { events = append(events, "rdb begin") },
+		OnRDBEnd: func(stats RDBStats) {
+			events = append(events, "rdb end")
+			end = stats
+		},
+		OnMasterChange: func(old, new string) { events = append(events, "master "+old+" "+new) },
+	})
+	d := &nopCommander{}
+	c := &Canal{cfg: cfg, cmder: d, closeReplica: make(chan struct{}), ackErrC: make(chan error, 1)}
+	c.wr = newWriter(ioutil.Discard)
+
+	rdb := "REDIS0009" + "\xfe\x00" + "\x00\x01k\x01v" + "\xff" + strings.Repeat("\x00", 8)
+	stream := "+FULLRESYNC abc 10\r\n$" + fmt.Sprint(len(rdb)) + "\r\n" + rdb +
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\nb\r\n"
+	stop := make(chan struct{})
+	err := c.handler(strings.NewReader(stream), stop)
+	close(stop)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"fullresync abc 10", "rdb begin", "rdb end"}, events)
+	assert.Equal(t, int64(1), end.Keys)
+	assert.Equal(t, "abc", end.ReplId)
+	assert.True(t, end.Bytes > int64(len(rdb)))
+	assert.Equal(t, 4, len(d.cmds)) // PING, SELECT, SET k, SET a
+	assert.Equal(t, []string{"PING"}, d.cmds[0].D)
+	assert.Equal(t, PhaseRDB, d.cmds[0].Phase)
+	assert.Equal(t, int64(10), d.cmds[0].Offset)
+
+	events = nil
+	stop = make(chan struct{})
+	_ = c.handler(strings.NewReader("+CONTINUE def\r\n"), stop)
+	close(stop)
+	cfg.hooks.masterChange("a:1", "a:1")
+	cfg.hooks.masterChange("a:1", "b:1")
+	assert.Equal(t, []string{"continue def", "master a:1 b:1"}, events)
+
+	var nilHooks *Hooks
+	nilHooks.reconnect(io.EOF, 1)
+}
+
+func TestHooksForceFullResync(t *testing.T) {
+	srv := newFakeRedis(t, func(d []string) Value {
+		switch strings.ToUpper(d[0]) {
+		case "INFO":
+			return StringValue("# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n")
+		case "PSYNC":
+			return SimpleStringValue("CONTINUE abc")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer srv.close()
+
+	reconnects := make(chan int, 10)
+	cfg, err := NewConfig(srv.addr())
+	assert.Nil(t, err)
+	cfg.SetHooks(Hooks{OnReconnect: func(err error, attempt int) { reconnects <- attempt }})
+	c, err := FromOffsetCanal(cfg, "abc", 100)
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() { done <- c.Run(&nopCommander{}) }()
+	for c.Phase() != PhaseStreaming {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	c.ForceFullResync()
+	select {
+	case attempt := <-reconnects:
+		assert.Equal(t, 1, attempt)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reconnect")
+	}
+	c.Close()
+	assert.Nil(t, <-done)
+}
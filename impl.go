@@ -20,10 +20,30 @@ import (
 	"fmt"
 	"strconv"
 	"sync/atomic"
+	"time"
 )
 
 func (c *Canal) Command(cmd *Command) error {
-	return c.cmder.Command(cmd)
+	if cmd.Offset == 0 {
+		cmd.Offset = atomic.LoadInt64(&c.offset)
+	}
+	cmd.ReplId, cmd.Phase = c.GetReplId(), c.Phase()
+	if cmd.Phase == PhaseRDB {
+		// the stream after a snapshot selects its database again
+		atomic.StoreInt64(&c.db, 0)
+	} else if db, ok := selectedDB(cmd); ok {
+		atomic.StoreInt64(&c.db, int64(db))
+	}
+	if c.lag != nil && c.lag.observe(cmd) {
+		return nil
+	}
+	start := time.Now()
+	err := c.cmder.Command(cmd)
+	c.cfg.metrics.observeCommand(cmd.Name(), time.Since(start))
+	if err != nil {
+		c.cmdErr = err
+	}
+	return err
 }
 
 func (c *Canal) set(n int64) {
@@ -38,10 +58,12 @@ func (c *Canal) Offset() string {
 	return fmt.Sprintf("%d", atomic.LoadInt64(&c.offset))
 }
 
-func (c *Canal) BeginRDB() {}
+func (c *Canal) BeginRDB() {
+	c.cfg.hooks.rdbBegin(c.rdbStats())
+	c.rdb.start = time.Now()
+}
 
 func (c *Canal) BeginDatabase(n int) {
-	c.db = n
 	cmd, _ := NewCommand("SELECT", fmt.Sprintf("%d", n))
 	if err := c.Command(cmd); err != nil {
 		panic(err)
@@ -56,7 +78,7 @@ func (c *Canal) Aux(key, value []byte) {
 		}
 		c.set(i)
 	} else if string(key) == "repl-id" {
-		c.replId = string(value)
+		c.setReplId(string(value))
 	}
 }
 
@@ -66,13 +88,30 @@ func (c *Canal) EndDatabase(n int) {}
 
 //todo: will return error
 func (c *Canal) Set(key, value []byte, expiry int64) {
+	c.rdbKey("string")
 	cmd, _ := NewCommand("SET", string(key), string(value))
 	if err := c.Command(cmd); err != nil {
 		panic(err)
 	}
+	c.expire(key, expiry)
 }
 
-func (c *Canal) BeginHash(key []byte, length, expiry int64) {}
+// expire sends the expiry of a snapshot key, a unix time in milliseconds,
+// if it has one.
+func (c *Canal) expire(key []byte, expiry int64) {
+	if expiry <= 0 {
+		return
+	}
+	cmd, _ := NewCommand("PEXPIREAT", string(key), strconv.FormatInt(expiry, 10))
+	if err := c.Command(cmd); err != nil {
+		panic(err)
+	}
+}
+
+func (c *Canal) BeginHash(key []byte, length, expiry int64) {
+	c.rdbKey("hash")
+	c.rdb.expiry = expiry
+}
 
 func (c *Canal) Hset(key, field, value []byte) {
 	cmd, _ := NewCommand("HSET", string(key), string(field), string(value))
@@ -80,9 +119,12 @@ func (c *Canal) Hset(key, field, value []byte) {
 		panic(err)
 	}
 }
-func (c *Canal) EndHash(key []byte) {}
+func (c *Canal) EndHash(key []byte) { c.expire(key, c.rdb.expiry) }
 
-func (c *Canal) BeginSet(key []byte, cardinality, expiry int64) {}
+func (c *Canal) BeginSet(key []byte, cardinality, expiry int64) {
+	c.rdbKey("set")
+	c.rdb.expiry = expiry
+}
 
 func (c *Canal) Sadd(key, member []byte) {
 	cmd, _ := NewCommand("SADD", string(key), string(member))
@@ -90,9 +132,12 @@ func (c *Canal) Sadd(key, member []byte) {
 		panic(err)
 	}
 }
-func (c *Canal) EndSet(key []byte) {}
+func (c *Canal) EndSet(key []byte) { c.expire(key, c.rdb.expiry) }
 
-func (c *Canal) BeginList(key []byte, length, expiry int64) {}
+func (c *Canal) BeginList(key []byte, length, expiry int64) {
+	c.rdbKey("list")
+	c.rdb.expiry = expiry
+}
 
 func (c *Canal) Rpush(key, value []byte) {
 	cmd, _ := NewCommand("RPUSH", string(key), string(value))
@@ -100,9 +145,12 @@ func (c *Canal) Rpush(key, value []byte) {
 		panic(err)
 	}
 }
-func (c *Canal) EndList(key []byte) {}
+func (c *Canal) EndList(key []byte) { c.expire(key, c.rdb.expiry) }
 
-func (c *Canal) BeginZSet(key []byte, cardinality, expiry int64) {}
+func (c *Canal) BeginZSet(key []byte, cardinality, expiry int64) {
+	c.rdbKey("zset")
+	c.rdb.expiry = expiry
+}
 
 func (c *Canal) Zadd(key []byte, score float64, member []byte) {
 	cmd, _ := NewCommand("ZADD", string(key), fmt.Sprintf("%f", score), string(member))
@@ -110,17 +158,20 @@ func (c *Canal) Zadd(key []byte, score float64, member []byte) {
 		panic(err)
 	}
 }
-func (c *Canal) EndZSet(key []byte) {}
-
-func (c *Canal) BeginStream(key []byte, cardinality, expiry int64) {}
-
-func (c *Canal) Xadd(key, id, listpack []byte) {
-	cmd, _ := NewCommand("XADD", string(key), string(id), string(listpack))
-	if err := c.Command(cmd); err != nil {
-		panic(err)
-	}
+func (c *Canal) EndZSet(key []byte) { c.expire(key, c.rdb.expiry) }
+
+// BeginStream skips the stream keys of the snapshot: the entries given to
+// Xadd have their fields and values joined by spaces, and the consumer
+// groups are missing. They are counted by RDBStats.Skipped.
+func (c *Canal) BeginStream(key []byte, cardinality, expiry int64) {
+	c.rdbKey("stream")
+	c.rdb.skipped++
+	c.logger().Debug("snapshot stream key skipped", "key", string(key))
 }
-func (c *Canal) EndStream(key []byte) {}
+
+func (c *Canal) Xadd(key, id, listpack []byte) {}
+func (c *Canal) EndStream(key []byte)          {}
 
 func (c *Canal) EndRDB() {
+	c.cfg.hooks.rdbEnd(c.rdbStats())
 }
@@ -0,0 +1,256 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LagTrackerOption specifies an option for a LagTracker.
+type LagTrackerOption struct {
+	f func(*LagTracker)
+}
+
+// LagInterval specifies how often the master is queried. Default is 5s.
+func LagInterval(d time.Duration) LagTrackerOption {
+	return LagTrackerOption{func(t *LagTracker) {
+		t.interval = d
+	}}
+}
+
+// LagHeartbeat enables the time lag measurement: a heartbeat key holding the
+// current time is written on the master at every interval, and the time lag
+// is the age of the oldest heartbeat not back through the replication
+// stream yet, or the delay of the last one when all are back. The commands
+// on the heartbeat key, its expiry included, are not passed to the
+// CommandDecoder.
+// The master must accept writes from the side connection.
+func LagHeartbeat(key string) LagTrackerOption {
+	return LagTrackerOption{func(t *LagTracker) {
+		t.heartbeatKey = key
+	}}
+}
+
+// Lag is a replication lag measurement.
+type Lag struct {
+	// Bytes is master_repl_offset minus the offset of the replica.
+	Bytes int64
+	// MasterOffset is the master_repl_offset of the last query.
+	MasterOffset int64
+	// Time is the age of the oldest heartbeat not received yet, else the
+	// delay of the last one; zero when heartbeats are disabled.
+	Time time.Duration
+	// Updated is the time of the last successful query.
+	Updated time.Time
+}
+
+// LagTracker measures how far a Canal is behind its master, through a side
+// connection dialed with the options of the Canal Config.
+type LagTracker struct {
+	c            *Canal
+	interval     time.Duration
+	heartbeatKey string
+
+	mu       sync.Mutex
+	lag      Lag
+	conn     net.Conn
+	connAddr string
+	rw       *RedisReaderWriter
+
+	hbMu      sync.Mutex
+	sent      []int64       // heartbeats not received yet, unix nano
+	delay     time.Duration // of the last heartbeat received
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLagTracker attaches a LagTracker to c. It starts measuring with Start.
+func NewLagTracker(c *Canal, opts ...LagTrackerOption) *LagTracker {
+	t := newLagTracker(c, opts...)
+	c.lag = t
+	return t
+}
+
+// newLagTracker returns a LagTracker not attached to c, which only feeds
+// the metrics of c.
+func newLagTracker(c *Canal, opts ...LagTrackerOption) *LagTracker {
+	t := &LagTracker{
+		c:        c,
+		interval: 5 * time.Second,
+		stop:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt.f(t)
+	}
+	return t
+}
+
+// Start queries the master periodically until Close is called.
+func (t *LagTracker) Start() {
+	go func() {
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			if err := t.poll(); err != nil {
+				t.c.logger().Warn("lag tracker query failed", "err", err)
+				t.reset()
+			}
+			select {
+			case <-t.stop:
+				t.reset()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the measurements.
+func (t *LagTracker) Close() {
+	t.closeOnce.Do(func() { close(t.stop) })
+}
+
+// Lag returns the last measurement.
+func (t *LagTracker) Lag() Lag {
+	t.mu.Lock()
+	lag := t.lag
+	t.mu.Unlock()
+	t.hbMu.Lock()
+	lag.Time = t.delay
+	if len(t.sent) > 0 {
+		lag.Time = time.Since(time.Unix(0, t.sent[0]))
+	}
+	t.hbMu.Unlock()
+	return lag
+}
+
+func (t *LagTracker) addr() string {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.c.cfg.addr
+}
+
+func (t *LagTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn, t.rw = nil, nil
+	}
+}
+
+// poll reads master_repl_offset and writes the heartbeat.
+func (t *LagTracker) poll() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// the master may have changed since the last poll, see NewSentinelConfig
+	if addr := t.addr(); t.conn == nil || t.connAddr != addr {
+		if t.conn != nil {
+			_ = t.conn.Close()
+		}
+		conn, err := dial("tcp", addr, t.c.cfg.opts...)
+		if err != nil {
+			return err
+		}
+		t.conn, t.connAddr, t.rw = conn, addr, NewRedisReaderWriter(conn)
+	}
+
+	if err := t.rw.writeMultiBulk("INFO", "replication"); err != nil {
+		return err
+	}
+	val, _, err := t.rw.readBulk()
+	if err != nil {
+		return err
+	}
+	if err := val.Error(); err != nil {
+		return err
+	}
+	var master int64
+	for _, line := range strings.Split(val.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "master_repl_offset:") {
+			master, _ = strconv.ParseInt(line[len("master_repl_offset:"):], 10, 64)
+		}
+	}
+	offset := atomic.LoadInt64(&t.c.offset)
+	t.lag.MasterOffset = master
+	t.lag.Bytes = 0
+	if master > offset && offset > 0 {
+		t.lag.Bytes = master - offset
+	}
+	t.lag.Updated = time.Now()
+	t.c.cfg.metrics.SetMasterOffset(master)
+
+	if t.heartbeatKey == "" {
+		return nil
+	}
+	// recorded before it is written, it may come back before the reply
+	sent := time.Now().UnixNano()
+	t.hbMu.Lock()
+	t.sent = append(t.sent, sent)
+	t.hbMu.Unlock()
+	ttl := 3 * t.interval / time.Millisecond
+	err = t.rw.writeMultiBulk("SET", t.heartbeatKey, sent, "PX", int64(ttl))
+	if err == nil {
+		val, _, err = t.rw.readBulk()
+	}
+	if err == nil {
+		err = val.Error()
+	}
+	if err != nil {
+		// most likely never written, it would hold the lag back forever
+		t.received(sent, false)
+	}
+	return err
+}
+
+// received forgets the heartbeats up to sent, recording the delay of sent.
+func (t *LagTracker) received(sent int64, record bool) {
+	t.hbMu.Lock()
+	defer t.hbMu.Unlock()
+	i := 0
+	for i < len(t.sent) && t.sent[i] <= sent {
+		i++
+	}
+	t.sent = t.sent[i:]
+	if record {
+		t.delay = time.Since(time.Unix(0, sent))
+	}
+}
+
+// observe swallows the commands on the heartbeat key, recording the delay
+// of the heartbeats.
+func (t *LagTracker) observe(cmd *Command) bool {
+	if t.heartbeatKey == "" || len(cmd.D) < 2 || cmd.D[1] != t.heartbeatKey {
+		return false
+	}
+	if keys := cmd.Keys(); len(keys) != 1 {
+		// a multi-key command, like DEL of the heartbeat and another key
+		return false
+	}
+	if cmd.Name() == "SET" && len(cmd.D) > 2 {
+		if sent, err := strconv.ParseInt(cmd.D[2], 10, 64); err == nil {
+			t.received(sent, true)
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type nopCommander struct{ cmds []*Command }
+
+func (d *nopCommander) Command(cmd *Command) error {
+	d.cmds = append(d.cmds, cmd)
+	return nil
+}
+
+func TestLagTracker(t *testing.T) {
+	master := newFakeRedis(t, func(d []string) Value {
+		if d[0] == "INFO" {
+			return StringValue("# Replication\r\nrole:master\r\nmaster_repl_offset:1500\r\n")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer master.close()
+
+	cfg, err := NewConfig(master.addr())
+	assert.Nil(t, err)
+	c, err := FromOffsetCanal(cfg, "8de1787ba490483314a4d30f1c628bc5025eb761", 1000)
+	assert.Nil(t, err)
+	d := &nopCommander{}
+	c.cmder = d
+
+	tracker := NewLagTracker(c, LagHeartbeat("__canal_heartbeat"))
+	assert.Nil(t, tracker.poll())
+	lag := tracker.Lag()
+	assert.Equal(t, int64(1500), lag.MasterOffset)
+	assert.Equal(t, int64(500), lag.Bytes)
+	heartbeat := strings.Fields(master.commands()[len(master.commands())-1])
+	assert.Equal(t, []string{"SET", "__canal_heartbeat"}, heartbeat[:2])
+
+	// the lag grows until the heartbeat comes back
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, tracker.Lag().Time >= 20*time.Millisecond)
+	sent, _ := strconv.ParseInt(heartbeat[2], 10, 64)
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, c.Command(&Command{D: []string{"SET", "__canal_heartbeat", heartbeat[2], "PX", "15000"}}))
+	delay := tracker.Lag().Time
+	assert.True(t, delay >= 40*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, delay, tracker.Lag().Time)
+	assert.True(t, time.Duration(time.Now().UnixNano()-sent) > delay)
+
+	// every command on the heartbeat key is swallowed
+	assert.Nil(t, c.Command(&Command{D: []string{"DEL", "__canal_heartbeat"}}))
+	assert.Nil(t, c.Command(&Command{D: []string{"PEXPIRE", "__canal_heartbeat", "10"}}))
+	assert.Nil(t, c.Command(&Command{D: []string{"DEL", "__canal_heartbeat", "b"}}))
+	assert.Nil(t, c.Command(&Command{D: []string{"SET", "a", "1"}}))
+	assert.Equal(t, 2, len(d.cmds))
+	tracker.reset()
+}
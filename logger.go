@@ -0,0 +1,111 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Logger is a leveled logger taking alternating key/value pairs after the message.
+// A Logger is set per Config with Config.SetLogger.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// StdLogger writes through the standard log package, as
+// "[LEVEL] msg key=value ...". Debug lines are dropped unless Verbose is set.
+type StdLogger struct {
+	Verbose bool
+}
+
+func (l StdLogger) Debug(msg string, keyvals ...interface{}) {
+	if l.Verbose {
+		l.output("DEBUG", msg, keyvals)
+	}
+}
+func (l StdLogger) Info(msg string, keyvals ...interface{})  { l.output("INFO", msg, keyvals) }
+func (l StdLogger) Warn(msg string, keyvals ...interface{})  { l.output("WARN", msg, keyvals) }
+func (l StdLogger) Error(msg string, keyvals ...interface{}) { l.output("ERROR", msg, keyvals) }
+
+func (l StdLogger) output(level, msg string, keyvals []interface{}) {
+	buf := bytes.NewBufferString("[" + level + "] " + msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(buf, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(buf, " %v=?", keyvals[i])
+		}
+	}
+	_ = log.Output(3, buf.String())
+}
+
+// NopLogger discards every log line.
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (NopLogger) Info(msg string, keyvals ...interface{})  {}
+func (NopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (NopLogger) Error(msg string, keyvals ...interface{}) {}
+
+var defaultLogger Logger = StdLogger{}
+
+// withFields prepends fields, evaluated at every call, to the key/values of a Logger.
+type withFields struct {
+	l      Logger
+	fields func() []interface{}
+}
+
+func (w withFields) Debug(msg string, keyvals ...interface{}) {
+	w.l.Debug(msg, append(w.fields(), keyvals...)...)
+}
+func (w withFields) Info(msg string, keyvals ...interface{}) {
+	w.l.Info(msg, append(w.fields(), keyvals...)...)
+}
+func (w withFields) Warn(msg string, keyvals ...interface{}) {
+	w.l.Warn(msg, append(w.fields(), keyvals...)...)
+}
+func (w withFields) Error(msg string, keyvals ...interface{}) {
+	w.l.Error(msg, append(w.fields(), keyvals...)...)
+}
+
+// SetLogger sets the Logger of the Canal built on c, the default writes
+// through the standard log package.
+func (c *Config) SetLogger(l Logger) { c.logger = l }
+
+func (c *Config) getLogger() Logger {
+	if c.logger == nil {
+		return defaultLogger
+	}
+	return c.logger
+}
+
+// logger returns the Logger of c, tagging every line with the instance
+// address, replId and offset.
+func (c *Canal) logger() Logger {
+	return withFields{c.cfg.getLogger(), func() []interface{} {
+		c.mu.Lock()
+		addr := c.cfg.addr
+		c.mu.Unlock()
+		return []interface{}{"addr", addr, "replId", c.GetReplId(), "offset", atomic.LoadInt64(&c.offset)}
+	}}
+}
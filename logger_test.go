@@ -0,0 +1,47 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	l := withFields{StdLogger{}, func() []interface{} { return []interface{}{"addr", "127.0.0.1:6379"} }}
+	l.Debug("dropped")
+	l.Warn("replication broken", "err", "EOF", "odd")
+	assert.Equal(t, "[WARN] replication broken addr=127.0.0.1:6379 err=EOF odd=?\n", buf.String())
+
+	buf.Reset()
+	StdLogger{Verbose: true}.Debug("kept")
+	assert.True(t, strings.HasPrefix(buf.String(), "[DEBUG] kept"))
+}
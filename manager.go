@@ -0,0 +1,473 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrManagerClosed = errors.New("manager is shut down")
+
+// ReplicaSpec declares a replica owned by a Manager.
+type ReplicaSpec struct {
+	// Name identifies the replica, it must be unique within a Manager.
+	Name string
+	// Addr is the address of the master, unless Sentinels is set.
+	Addr string
+	// MasterName and Sentinels resolve the master through the sentinels,
+	// see NewSentinelConfig.
+	MasterName string
+	Sentinels  []string
+	// DialOptions are used to dial the master.
+	DialOptions []DialOption
+	// ReplMaster replicates the master of Addr if it is itself a replica.
+	ReplMaster bool
+	// Checkpoint resumes the replica from a saved position, if set.
+	Checkpoint Checkpoint
+	// Decoder receives the commands of the replica.
+	Decoder CommandDecoder
+	// Configure, if set, is called on the Config of every (re)start, to
+	// set its logger, hooks or metrics.
+	Configure func(cfg *Config)
+}
+
+func (s ReplicaSpec) sameSource(o ReplicaSpec) bool {
+	return s.Addr == o.Addr && s.MasterName == o.MasterName &&
+		strings.Join(s.Sentinels, ",") == strings.Join(o.Sentinels, ",")
+}
+
+// ManagerOption specifies an option for a Manager.
+type ManagerOption struct {
+	f func(*Manager)
+}
+
+// ManagerMaxFullSyncs limits the replicas transferring an RDB at the same
+// time. A replica without checkpoint waits for a slot before sending PSYNC,
+// one whose PSYNC is answered by FULLRESYNC waits for a slot before reading
+// the RDB. Default is 4.
+func ManagerMaxFullSyncs(n int) ManagerOption {
+	return ManagerOption{func(m *Manager) {
+		m.fullSyncs = newFullSyncLimiter(n)
+	}}
+}
+
+// ManagerBackoff specifies the delay before restarting a failed replica,
+// doubling from min up to max. Default is 1s to 1m.
+func ManagerBackoff(min, max time.Duration) ManagerOption {
+	return ManagerOption{func(m *Manager) {
+		m.minBackoff, m.maxBackoff = min, max
+	}}
+}
+
+// ManagerLogger specifies the Logger of the Manager.
+func ManagerLogger(l Logger) ManagerOption {
+	return ManagerOption{func(m *Manager) {
+		m.logger = l
+	}}
+}
+
+// ManagerAdmin registers every Canal started by the Manager on a, under
+// the name of its replica.
+func ManagerAdmin(a *Admin) ManagerOption {
+	return ManagerOption{func(m *Manager) {
+		m.admin = a
+	}}
+}
+
+// Manager supervises many replicas: it starts the Canal of each one,
+// restarts it with backoff when it fails, resuming from its checkpoint,
+// and limits the concurrent full syncs.
+type Manager struct {
+	fullSyncs  *fullSyncLimiter
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	logger     Logger
+	admin      *Admin
+
+	mu       sync.Mutex
+	replicas map[string]*managedReplica
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type managedReplica struct {
+	spec ReplicaSpec
+	stop chan struct{}
+
+	// guarded by Manager.mu
+	canal      *Canal
+	checkpoint Checkpoint
+	master     string // address of the master of the last run
+	restarts   int
+	lastErr    error
+}
+
+// ManagedStatus is the status of a replica owned by a Manager.
+type ManagedStatus struct {
+	ReplicaStatus
+	Running  bool `json:"running"`
+	Restarts int  `json:"restarts"`
+}
+
+// NewManager returns a Manager without replicas.
+func NewManager(opts ...ManagerOption) *Manager {
+	m := &Manager{
+		fullSyncs:  newFullSyncLimiter(4),
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		logger:     defaultLogger,
+		replicas:   make(map[string]*managedReplica),
+	}
+	for _, opt := range opts {
+		opt.f(m)
+	}
+	return m
+}
+
+// Apply makes the replicas of m match specs: the new ones are started, the
+// missing ones stopped and the ones whose master changed restarted.
+func (m *Manager) Apply(specs []ReplicaSpec) error {
+	seen := make(map[string]bool, len(specs))
+	for i, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return fmt.Errorf("replica %d: %v", i, err)
+		}
+		if seen[spec.Name] {
+			return fmt.Errorf("replica %d: duplicate name %q", i, spec.Name)
+		}
+		seen[spec.Name] = true
+	}
+
+	m.mu.Lock()
+	var stale []string
+	for name, r := range m.replicas {
+		if !seen[name] {
+			stale = append(stale, name)
+		}
+		for _, spec := range specs {
+			if spec.Name == name && !spec.sameSource(r.spec) {
+				stale = append(stale, name)
+			}
+		}
+	}
+	m.mu.Unlock()
+	for _, name := range stale {
+		_ = m.Stop(name)
+	}
+
+	for _, spec := range specs {
+		m.mu.Lock()
+		_, running := m.replicas[spec.Name]
+		m.mu.Unlock()
+		if running {
+			continue
+		}
+		if err := m.Start(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s ReplicaSpec) validate() error {
+	switch {
+	case s.Name == "":
+		return errors.New("name is empty")
+	case s.Addr == "" && len(s.Sentinels) == 0:
+		return errors.New("neither address nor sentinels")
+	case len(s.Sentinels) > 0 && s.MasterName == "":
+		return errors.New("sentinels without master name")
+	case s.Decoder == nil:
+		return errors.New("command decode is nil")
+	}
+	return nil
+}
+
+// Start starts the replica spec.
+func (m *Manager) Start(spec ReplicaSpec) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrManagerClosed
+	}
+	if _, ok := m.replicas[spec.Name]; ok {
+		return fmt.Errorf("replica %q already started", spec.Name)
+	}
+	r := &managedReplica{spec: spec, stop: make(chan struct{}), checkpoint: spec.Checkpoint}
+	m.replicas[spec.Name] = r
+	m.wg.Add(1)
+	go m.supervise(r)
+	return nil
+}
+
+// Stop stops the replica name, its Canal is closed.
+func (m *Manager) Stop(name string) error {
+	m.mu.Lock()
+	r, ok := m.replicas[name]
+	if ok {
+		delete(m.replicas, name)
+		close(r.stop)
+		if r.canal != nil {
+			r.canal.Close()
+		}
+	}
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown replica %q", name)
+	}
+	if m.admin != nil {
+		m.admin.Unregister(name)
+	}
+	return nil
+}
+
+// Shutdown stops every replica and waits for them until ctx is done.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	var names []string
+	for name := range m.replicas {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+	for _, name := range names {
+		_ = m.Stop(name)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns the status of every replica, sorted by name.
+func (m *Manager) Status() []ManagedStatus {
+	m.mu.Lock()
+	sts := make([]ManagedStatus, 0, len(m.replicas))
+	canals := make([]*Canal, 0, len(m.replicas))
+	for name, r := range m.replicas {
+		st := ManagedStatus{
+			ReplicaStatus: ReplicaStatus{Name: name, Status: Status{
+				Addr:   r.spec.Addr,
+				ReplId: r.checkpoint.ReplId,
+				Offset: r.checkpoint.Offset,
+			}},
+			Running:  r.canal != nil,
+			Restarts: r.restarts,
+		}
+		if r.lastErr != nil {
+			st.LastError = r.lastErr.Error()
+		}
+		sts = append(sts, st)
+		canals = append(canals, r.canal)
+	}
+	m.mu.Unlock()
+
+	for i, c := range canals {
+		if c == nil {
+			continue
+		}
+		lastErr := sts[i].LastError
+		sts[i].Status = c.Status()
+		if sts[i].LastError == "" {
+			sts[i].LastError = lastErr
+		}
+	}
+	sort.Slice(sts, func(i, j int) bool { return sts[i].Name < sts[j].Name })
+	return sts
+}
+
+// Checkpoints returns the replication position of every replica.
+func (m *Manager) Checkpoints() map[string]Checkpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cps := make(map[string]Checkpoint, len(m.replicas))
+	for name, r := range m.replicas {
+		cps[name] = r.checkpoint
+		if r.canal != nil {
+			cps[name] = r.canal.Checkpoint()
+		}
+	}
+	return cps
+}
+
+// supervise runs r until it is stopped, restarting it with backoff.
+func (m *Manager) supervise(r *managedReplica) {
+	defer m.wg.Done()
+	backoff, attempt := m.minBackoff, 0
+	for {
+		start := time.Now()
+		err := m.runOnce(r, attempt)
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		if time.Since(start) > m.maxBackoff {
+			backoff, attempt = m.minBackoff, 0
+		}
+		attempt++
+
+		m.mu.Lock()
+		r.restarts++
+		r.lastErr = err
+		m.mu.Unlock()
+		m.logger.Warn("replica stopped, restarting", "name", r.spec.Name, "err", err, "backoff", backoff)
+
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > m.maxBackoff {
+			backoff = m.maxBackoff
+		}
+	}
+}
+
+// runOnce runs r once. A restart, attempt > 0, fires the OnReconnect hook
+// of the Config and OnMasterChange when the master is another one.
+func (m *Manager) runOnce(r *managedReplica, attempt int) error {
+	var cfg *Config
+	var err error
+	if len(r.spec.Sentinels) > 0 {
+		cfg, err = NewSentinelConfigWithOptions(r.spec.MasterName, r.spec.Sentinels, nil, r.spec.DialOptions...)
+	} else {
+		cfg, err = NewConfig(r.spec.Addr, r.spec.DialOptions...)
+	}
+	if err != nil {
+		return err
+	}
+	if r.spec.ReplMaster {
+		cfg.ReplMaster()
+	}
+	if r.spec.Configure != nil {
+		r.spec.Configure(cfg)
+	}
+	cfg.fullSyncs = m.fullSyncs
+
+	m.mu.Lock()
+	cp, master, lastErr := r.checkpoint, r.master, r.lastErr
+	m.mu.Unlock()
+	if attempt > 0 {
+		cfg.hooks.reconnect(lastErr, attempt)
+	}
+	var c *Canal
+	if cp.resumable() {
+		c, err = FromCheckpointCanal(cfg, cp)
+	} else {
+		c, err = NewCanal(cfg)
+	}
+	if err != nil {
+		_ = cfg.Connection().Close()
+		return err
+	}
+
+	m.mu.Lock()
+	select {
+	case <-r.stop:
+		m.mu.Unlock()
+		c.Close()
+		return nil
+	default:
+	}
+	r.canal = c
+	m.mu.Unlock()
+	if master != "" {
+		cfg.hooks.masterChange(master, c.Status().Addr)
+	}
+	if m.admin != nil {
+		m.admin.Register(r.spec.Name, c)
+	}
+
+	err = c.Run(r.spec.Decoder)
+
+	m.mu.Lock()
+	r.canal = nil
+	// no position to resume from is left by a snapshot cut short, the
+	// restart asks a full sync again
+	r.checkpoint = c.Checkpoint()
+	r.master = c.Status().Addr
+	m.mu.Unlock()
+	if err == nil {
+		err = errors.New("replication stopped")
+	}
+	return err
+}
+
+// fullSyncLimiter bounds the concurrent RDB transfers of many Canal instances.
+type fullSyncLimiter struct {
+	slots chan struct{}
+}
+
+func newFullSyncLimiter(n int) *fullSyncLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &fullSyncLimiter{slots: make(chan struct{}, n)}
+}
+
+// acquire waits for a slot until stop is closed.
+func (l *fullSyncLimiter) acquire(stop <-chan struct{}) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+func (l *fullSyncLimiter) release() { <-l.slots }
+
+// acquireFullSync waits for a full sync slot when c has no position to
+// resume from. It returns false if c is closed meanwhile.
+func (c *Canal) acquireFullSync() bool {
+	if c.cfg.fullSyncs == nil || c.fullSyncHeld {
+		return true
+	}
+	if replId := c.GetReplId(); replId != "" && replId != "?" {
+		return true
+	}
+	if !c.cfg.fullSyncs.acquire(c.closeReplica) {
+		return false
+	}
+	c.fullSyncHeld = true
+	return true
+}
+
+func (c *Canal) releaseFullSync() {
+	if c.fullSyncHeld {
+		c.fullSyncHeld = false
+		c.cfg.fullSyncs.release()
+	}
+}
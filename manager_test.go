@@ -0,0 +1,276 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager(t *testing.T) {
+	srv := newFakeRedis(t, func(d []string) Value {
+		switch strings.ToUpper(d[0]) {
+		case "INFO":
+			return StringValue("# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n")
+		case "PSYNC":
+			if d[1] == "?" {
+				// the RDB never comes, the replica stays in the rdb phase
+				return SimpleStringValue("FULLRESYNC abc 0")
+			}
+			return SimpleStringValue("CONTINUE abc")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer srv.close()
+
+	psyncs := func() int {
+		n := 0
+		for _, cmd := range srv.commands() {
+			if strings.HasPrefix(cmd, "psync") {
+				n++
+			}
+		}
+		return n
+	}
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("condition not met")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	m := NewManager(ManagerMaxFullSyncs(1), ManagerBackoff(10*time.Millisecond, 20*time.Millisecond), ManagerLogger(NopLogger{}))
+	err := m.Apply([]ReplicaSpec{
+		{Name: "a", Addr: srv.addr(), Decoder: &nopCommander{}},
+		{Name: "b", Addr: srv.addr(), Decoder: &nopCommander{}},
+		{Name: "c", Addr: srv.addr(), Decoder: &nopCommander{}, Checkpoint: Checkpoint{ReplId: "abc", Offset: 10}},
+		{Name: "down", Addr: "127.0.0.1:1", Decoder: &nopCommander{}},
+	})
+	assert.Nil(t, err)
+
+	// only one full sync at a time, c resumes without waiting
+	waitFor(func() bool { return psyncs() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, psyncs())
+	var rdb, waiting string
+	for _, st := range m.Status() {
+		switch st.Name {
+		case "a", "b":
+			if st.Phase == PhaseRDB {
+				rdb = st.Name
+			} else {
+				waiting = st.Name
+			}
+		case "c":
+			assert.Equal(t, PhaseStreaming, st.Phase)
+		case "down":
+			assert.False(t, st.Running)
+			assert.True(t, st.Restarts > 0)
+			assert.NotEqual(t, "", st.LastError)
+		}
+	}
+	assert.NotEqual(t, "", rdb)
+	assert.NotEqual(t, "", waiting)
+
+	// dropping the replica in full sync lets the other one go
+	assert.Nil(t, m.Apply([]ReplicaSpec{
+		{Name: waiting, Addr: srv.addr(), Decoder: &nopCommander{}},
+		{Name: "c", Addr: srv.addr(), Decoder: &nopCommander{}},
+	}))
+	waitFor(func() bool { return psyncs() == 3 })
+	assert.Equal(t, 2, len(m.Status()))
+	assert.Equal(t, "abc", m.Checkpoints()["c"].ReplId)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.Nil(t, m.Shutdown(ctx))
+	assert.Equal(t, 0, len(m.Status()))
+	assert.Equal(t, ErrManagerClosed, m.Start(ReplicaSpec{Name: "d", Addr: srv.addr(), Decoder: &nopCommander{}}))
+}
+
+func TestManagerCheckpointFullResync(t *testing.T) {
+	srv := newFakeRedis(t, func(d []string) Value {
+		switch strings.ToUpper(d[0]) {
+		case "INFO":
+			return StringValue("# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n")
+		case "PSYNC":
+			// the checkpoints are unknown to the master, the RDB never comes
+			return SimpleStringValue("FULLRESYNC def 0")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer srv.close()
+
+	psyncs := func() int {
+		n := 0
+		for _, cmd := range srv.commands() {
+			if strings.HasPrefix(cmd, "psync") {
+				n++
+			}
+		}
+		return n
+	}
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("condition not met")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	m := NewManager(ManagerMaxFullSyncs(1), ManagerBackoff(10*time.Millisecond, 20*time.Millisecond), ManagerLogger(NopLogger{}))
+	assert.Nil(t, m.Apply([]ReplicaSpec{
+		{Name: "a", Addr: srv.addr(), Decoder: &nopCommander{}, Checkpoint: Checkpoint{ReplId: "abc", Offset: 10}},
+		{Name: "b", Addr: srv.addr(), Decoder: &nopCommander{}, Checkpoint: Checkpoint{ReplId: "abc", Offset: 20}},
+	}))
+
+	// both send PSYNC, only one reads the RDB
+	waitFor(func() bool { return psyncs() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	var rdb, waiting string
+	for _, st := range m.Status() {
+		if st.Phase == PhaseRDB {
+			assert.Equal(t, "", rdb)
+			rdb = st.Name
+		} else {
+			waiting = st.Name
+		}
+	}
+	assert.NotEqual(t, "", rdb)
+	assert.NotEqual(t, "", waiting)
+
+	// dropping the replica in full sync lets the other one read its RDB
+	assert.Nil(t, m.Apply([]ReplicaSpec{
+		{Name: waiting, Addr: srv.addr(), Decoder: &nopCommander{}},
+	}))
+	waitFor(func() bool {
+		st := m.Status()
+		return len(st) == 1 && st[0].Phase == PhaseRDB
+	})
+	assert.Equal(t, 2, psyncs())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.Nil(t, m.Shutdown(ctx))
+}
+
+func TestManagerRestartCutSnapshot(t *testing.T) {
+	ln, psyncs := newCutSnapshotMaster(t)
+	defer ln.Close()
+
+	m := NewManager(ManagerBackoff(10*time.Millisecond, 20*time.Millisecond), ManagerLogger(NopLogger{}))
+	assert.Nil(t, m.Start(ReplicaSpec{Name: "a", Addr: ln.Addr().String(), Decoder: &nopCommander{}}))
+
+	// the replica restarted after its first snapshot broke does not
+	// continue from the position of that snapshot
+	var args []string
+	for len(args) < 2 {
+		select {
+		case a := <-psyncs:
+			args = append(args, a)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no second PSYNC")
+		}
+	}
+	assert.Equal(t, []string{"? -1", "? -1"}, args)
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Checkpoints()["a"].ReplId != "def" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, Checkpoint{ReplId: "def", Offset: 20}, m.Checkpoints()["a"])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.Nil(t, m.Shutdown(ctx))
+}
+
+func TestManagerHooks(t *testing.T) {
+	info := "# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n"
+	// every full sync fails, the decoder refusing the PING opening it
+	master := newFakeRedis(t, func(d []string) Value {
+		switch strings.ToUpper(d[0]) {
+		case "INFO":
+			return StringValue(info)
+		case "PSYNC":
+			return SimpleStringValue("FULLRESYNC abc 0")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer master.close()
+	host, port, _ := net.SplitHostPort(master.addr())
+	// the first master turns into a replica of the other one after a run
+	var psyncs int32
+	first := newFakeRedis(t, func(d []string) Value {
+		switch strings.ToUpper(d[0]) {
+		case "INFO":
+			if atomic.LoadInt32(&psyncs) > 0 {
+				return StringValue("# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:slave\r\n" +
+					"master_host:" + host + "\r\nmaster_port:" + port + "\r\nmaster_replid:abc\r\n")
+			}
+			return StringValue(info)
+		case "PSYNC":
+			atomic.AddInt32(&psyncs, 1)
+			return SimpleStringValue("FULLRESYNC abc 0")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer first.close()
+
+	events := make(chan string, 10)
+	m := NewManager(ManagerBackoff(10*time.Millisecond, time.Second), ManagerLogger(NopLogger{}))
+	assert.Nil(t, m.Start(ReplicaSpec{
+		Name:       "a",
+		Addr:       first.addr(),
+		ReplMaster: true,
+		Decoder:    &recordSink{err: errors.New("boom")},
+		Configure: func(cfg *Config) {
+			cfg.SetHooks(Hooks{
+				OnReconnect:    func(err error, attempt int) { events <- fmt.Sprintf("reconnect %v %d", err, attempt) },
+				OnMasterChange: func(old, new string) { events <- "master " + old + " " + new },
+			})
+		},
+	}))
+	for _, want := range []string{
+		"reconnect boom 1",
+		"master " + first.addr() + " " + master.addr(),
+		"reconnect boom 2",
+	} {
+		select {
+		case got := <-events:
+			assert.Equal(t, want, got)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no " + want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.Nil(t, m.Shutdown(ctx))
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the decoder latency histogram.
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics collects the replication health of one or more Canal instances
+// and exposes it in the Prometheus text exposition format.
+// A Metrics is attached to a Config with Config.SetMetrics.
+type Metrics struct {
+	mu        sync.Mutex
+	instances map[string]*InstanceMetrics
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{instances: make(map[string]*InstanceMetrics)}
+}
+
+// Instance returns the metrics of the instance labelled addr, creating them if needed.
+func (m *Metrics) Instance(addr string) *InstanceMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	im, ok := m.instances[addr]
+	if !ok {
+		im = &InstanceMetrics{
+			addr:     addr,
+			rdbKeys:  make(map[string]int64),
+			commands: make(map[string]int64),
+			buckets:  make([]uint64, len(latencyBuckets)),
+		}
+		m.instances[addr] = im
+	}
+	return im
+}
+
+// InstanceMetrics holds the metrics of one replica.
+// Every method is a no-op on a nil *InstanceMetrics.
+type InstanceMetrics struct {
+	addr string
+
+	receivedBytes int64
+	rdbBytes      int64
+	reconnects    int64
+	lastAck       int64 // unix nano
+	offset        int64
+	masterOffset  int64
+
+	mu       sync.Mutex
+	rdbKeys  map[string]int64
+	commands map[string]int64
+	buckets  []uint64
+	latSum   float64
+	latCount uint64
+}
+
+func (im *InstanceMetrics) addReceived(n int) {
+	if im == nil {
+		return
+	}
+	atomic.AddInt64(&im.receivedBytes, int64(n))
+}
+
+func (im *InstanceMetrics) addRDBBytes(n int64) {
+	if im == nil {
+		return
+	}
+	atomic.AddInt64(&im.rdbBytes, n)
+}
+
+func (im *InstanceMetrics) addRDBKey(typ string) {
+	if im == nil {
+		return
+	}
+	im.mu.Lock()
+	im.rdbKeys[typ]++
+	im.mu.Unlock()
+}
+
+func (im *InstanceMetrics) observeCommand(name string, d time.Duration) {
+	if im == nil {
+		return
+	}
+	sec := d.Seconds()
+	im.mu.Lock()
+	im.commands[name]++
+	for i, le := range latencyBuckets {
+		if sec <= le {
+			im.buckets[i]++
+		}
+	}
+	im.latSum += sec
+	im.latCount++
+	im.mu.Unlock()
+}
+
+func (im *InstanceMetrics) incReconnects() {
+	if im == nil {
+		return
+	}
+	atomic.AddInt64(&im.reconnects, 1)
+}
+
+func (im *InstanceMetrics) ack(offset int64) {
+	if im == nil {
+		return
+	}
+	atomic.StoreInt64(&im.lastAck, time.Now().UnixNano())
+	atomic.StoreInt64(&im.offset, offset)
+}
+
+// SetMasterOffset records the master_repl_offset of the master, the offset
+// lag is computed against it.
+func (im *InstanceMetrics) SetMasterOffset(offset int64) {
+	if im == nil {
+		return
+	}
+	atomic.StoreInt64(&im.masterOffset, offset)
+}
+
+// Lag returns the offset lag of the replica behind the master, in bytes.
+func (im *InstanceMetrics) Lag() int64 {
+	if im == nil {
+		return 0
+	}
+	master, offset := atomic.LoadInt64(&im.masterOffset), atomic.LoadInt64(&im.offset)
+	if master <= 0 || offset > master {
+		return 0
+	}
+	return master - offset
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	ims := make([]*InstanceMetrics, 0, len(m.instances))
+	for _, im := range m.instances {
+		ims = append(ims, im)
+	}
+	m.mu.Unlock()
+	sort.Slice(ims, func(i, j int) bool { return ims[i].addr < ims[j].addr })
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	gauge := func(name, typ, help string, value func(im *InstanceMetrics) int64) {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, im := range ims {
+			fmt.Fprintf(cw, "%s{addr=%s} %d\n", name, quoteLabel(im.addr), value(im))
+		}
+	}
+	gauge("canal_received_bytes_total", "counter", "Bytes received from the master.",
+		func(im *InstanceMetrics) int64 { return atomic.LoadInt64(&im.receivedBytes) })
+	gauge("canal_rdb_bytes_total", "counter", "Approximate bytes of RDB payload decoded.",
+		func(im *InstanceMetrics) int64 { return atomic.LoadInt64(&im.rdbBytes) })
+	gauge("canal_reconnects_total", "counter", "Reconnections to the master.",
+		func(im *InstanceMetrics) int64 { return atomic.LoadInt64(&im.reconnects) })
+	gauge("canal_offset", "gauge", "Replication offset acknowledged to the master.",
+		func(im *InstanceMetrics) int64 { return atomic.LoadInt64(&im.offset) })
+	gauge("canal_master_offset", "gauge", "Last known master_repl_offset of the master.",
+		func(im *InstanceMetrics) int64 { return atomic.LoadInt64(&im.masterOffset) })
+	gauge("canal_offset_lag_bytes", "gauge", "Replication offset lag behind the master.",
+		func(im *InstanceMetrics) int64 { return im.Lag() })
+
+	fmt.Fprintf(cw, "# HELP canal_last_ack_timestamp_seconds Time of the last REPLCONF ACK sent.\n# TYPE canal_last_ack_timestamp_seconds gauge\n")
+	for _, im := range ims {
+		sec := float64(atomic.LoadInt64(&im.lastAck)) / 1e9
+		fmt.Fprintf(cw, "canal_last_ack_timestamp_seconds{addr=%s} %s\n", quoteLabel(im.addr), formatFloat(sec))
+	}
+
+	fmt.Fprintf(cw, "# HELP canal_rdb_keys_total Keys decoded from the RDB snapshot, by type.\n# TYPE canal_rdb_keys_total counter\n")
+	for _, im := range ims {
+		im.mu.Lock()
+		for _, typ := range sortedKeys(im.rdbKeys) {
+			fmt.Fprintf(cw, "canal_rdb_keys_total{addr=%s,type=%s} %d\n", quoteLabel(im.addr), quoteLabel(typ), im.rdbKeys[typ])
+		}
+		im.mu.Unlock()
+	}
+
+	fmt.Fprintf(cw, "# HELP canal_commands_total Commands dispatched to the decoder, by command.\n# TYPE canal_commands_total counter\n")
+	for _, im := range ims {
+		im.mu.Lock()
+		for _, name := range sortedKeys(im.commands) {
+			fmt.Fprintf(cw, "canal_commands_total{addr=%s,command=%s} %d\n", quoteLabel(im.addr), quoteLabel(name), im.commands[name])
+		}
+		im.mu.Unlock()
+	}
+
+	fmt.Fprintf(cw, "# HELP canal_decoder_latency_seconds Time spent in the command decoder.\n# TYPE canal_decoder_latency_seconds histogram\n")
+	for _, im := range ims {
+		addr := quoteLabel(im.addr)
+		im.mu.Lock()
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(cw, "canal_decoder_latency_seconds_bucket{addr=%s,le=\"%s\"} %d\n", addr, formatFloat(le), im.buckets[i])
+		}
+		fmt.Fprintf(cw, "canal_decoder_latency_seconds_bucket{addr=%s,le=\"+Inf\"} %d\n", addr, im.latCount)
+		fmt.Fprintf(cw, "canal_decoder_latency_seconds_sum{addr=%s} %s\n", addr, formatFloat(im.latSum))
+		fmt.Fprintf(cw, "canal_decoder_latency_seconds_count{addr=%s} %d\n", addr, im.latCount)
+		im.mu.Unlock()
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// countReader counts the bytes read through it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+func (cr *countReader) count() int64 { return atomic.LoadInt64(&cr.n) }
+
+// meteredWriter reports the bytes written through it as received bytes.
+type meteredWriter struct {
+	w  io.Writer
+	im *InstanceMetrics
+}
+
+func (mw meteredWriter) Write(p []byte) (int, error) {
+	n, err := mw.w.Write(p)
+	mw.im.addReceived(n)
+	return n, err
+}
+
+func quoteLabel(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func formatFloat(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	im := m.Instance("127.0.0.1:6379")
+	im.addReceived(100)
+	im.addRDBKey("hash")
+	im.addRDBKey("hash")
+	im.observeCommand("SET", 2*time.Millisecond)
+	im.ack(40)
+	im.SetMasterOffset(100)
+	assert.Equal(t, int64(60), im.Lag())
+
+	var nilIm *InstanceMetrics
+	nilIm.addReceived(1)
+	nilIm.observeCommand("SET", time.Second)
+	assert.Equal(t, int64(0), nilIm.Lag())
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`canal_received_bytes_total{addr="127.0.0.1:6379"} 100`,
+		`canal_rdb_keys_total{addr="127.0.0.1:6379",type="hash"} 2`,
+		`canal_commands_total{addr="127.0.0.1:6379",command="SET"} 1`,
+		`canal_decoder_latency_seconds_bucket{addr="127.0.0.1:6379",le="0.001"} 0`,
+		`canal_decoder_latency_seconds_bucket{addr="127.0.0.1:6379",le="0.005"} 1`,
+		`canal_decoder_latency_seconds_count{addr="127.0.0.1:6379"} 1`,
+		`canal_offset_lag_bytes{addr="127.0.0.1:6379"} 60`,
+		`# TYPE canal_decoder_latency_seconds histogram`,
+	} {
+		assert.True(t, strings.Contains(body, line+"\n"), line)
+	}
+}
+
+func TestMetricsMasterOffset(t *testing.T) {
+	var infos int64
+	master := newFakeRedis(t, func(d []string) Value {
+		switch strings.ToUpper(d[0]) {
+		case "INFO":
+			offset := 1500
+			if atomic.AddInt64(&infos, 1) > 1 {
+				offset = 2500
+			}
+			return StringValue("# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\nmaster_repl_offset:" + strconv.Itoa(offset) + "\r\n")
+		case "PSYNC":
+			return SimpleStringValue("CONTINUE abc")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer master.close()
+
+	cfg, err := NewConfig(master.addr())
+	assert.Nil(t, err)
+	cfg.SetMetrics(nil)
+	m := NewMetrics()
+	cfg.SetMetrics(m)
+	c, err := FromOffsetCanal(cfg, "abc", 1000)
+	assert.Nil(t, err)
+	im := m.Instance(master.addr())
+	assert.Equal(t, int64(1500), atomic.LoadInt64(&im.masterOffset))
+
+	// Run polls master_repl_offset without a LagTracker
+	done := make(chan error, 1)
+	go func() { done <- c.Run(&nopCommander{}) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&im.masterOffset) != 2500 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, int64(2500), atomic.LoadInt64(&im.masterOffset))
+	c.Close()
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,1174 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorChange is a change of a Mirror, given to the functions watching it.
+type MirrorChange struct {
+	DB int
+	// Key is empty when the whole database changed, by a flush or a full sync.
+	Key     string
+	Command string
+	// Deleted is set when the key no longer exists.
+	Deleted bool
+}
+
+// ZMember is a member of a sorted set with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+type mirrorValue struct {
+	typ      ValueType
+	str      string
+	hash     map[string]string
+	set      map[string]struct{}
+	list     []string
+	zset     map[string]float64
+	expireAt int64 // unix milliseconds, 0 without expiry
+}
+
+type mirrorWatch struct {
+	db  int
+	key string
+}
+
+// Mirror is an in-memory copy of the replicated dataset, for reading it
+// without another Redis. It is a CommandDecoder applying the common write
+// commands of strings, hashes, sets, lists and sorted sets, expiries, DEL,
+// RENAME and flushes, and a Decoder loading an RDB. Other commands, and
+// streams, are skipped and counted by Skipped. A full sync replaces the
+// whole dataset. The read methods are safe for concurrent use and return
+// copies; expired keys read as missing, but stay until the master deletes
+// them.
+type Mirror struct {
+	mu      sync.RWMutex
+	dbs     map[int]map[string]*mirrorValue
+	db      int   // database selected by the stream
+	phase   Phase // phase of the last command
+	rdbDB   int   // database being loaded by the Decoder methods
+	loading *mirrorValue
+	skipped int64
+	applied int64
+
+	watchMu sync.Mutex
+	watches map[mirrorWatch]map[int]func(MirrorChange)
+	watchID int
+	changes []MirrorChange // to notify once the lock is released
+
+	now func() time.Time
+}
+
+// NewMirror returns an empty Mirror.
+func NewMirror() *Mirror {
+	return &Mirror{
+		dbs:     make(map[int]map[string]*mirrorValue),
+		applied: -1,
+		watches: make(map[mirrorWatch]map[int]func(MirrorChange)),
+		now:     time.Now,
+	}
+}
+
+// Applied returns the offset of the last command applied, -1 during a
+// snapshot.
+func (m *Mirror) Applied() int64 { return atomic.LoadInt64(&m.applied) }
+
+// Skipped returns the number of commands and RDB keys not applied.
+func (m *Mirror) Skipped() int64 { return atomic.LoadInt64(&m.skipped) }
+
+// Watch calls fn after each change of key in database db, or of any key of
+// db if key is empty, until the returned function is called. fn is called
+// by the goroutine applying the commands and must not block.
+func (m *Mirror) Watch(db int, key string, fn func(MirrorChange)) (unwatch func()) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	w := mirrorWatch{db, key}
+	if m.watches[w] == nil {
+		m.watches[w] = make(map[int]func(MirrorChange))
+	}
+	m.watchID++
+	id := m.watchID
+	m.watches[w][id] = fn
+	return func() {
+		m.watchMu.Lock()
+		defer m.watchMu.Unlock()
+		delete(m.watches[w], id)
+		if len(m.watches[w]) == 0 {
+			delete(m.watches, w)
+		}
+	}
+}
+
+// notify calls the watchers of the changes collected under the lock.
+func (m *Mirror) notify(changes []MirrorChange) {
+	if len(changes) == 0 {
+		return
+	}
+	m.watchMu.Lock()
+	var calls []func()
+	for _, c := range changes {
+		keys := []string{""}
+		if c.Key != "" {
+			keys = append(keys, c.Key)
+		} else {
+			// a database wide change concerns every key watched in it
+			for w := range m.watches {
+				if w.db == c.DB && w.key != "" {
+					keys = append(keys, w.key)
+				}
+			}
+		}
+		for _, key := range keys {
+			for _, fn := range m.watches[mirrorWatch{c.DB, key}] {
+				fn, c := fn, c
+				calls = append(calls, func() { fn(c) })
+			}
+		}
+	}
+	m.watchMu.Unlock()
+	for _, call := range calls {
+		call()
+	}
+}
+
+func (m *Mirror) changed(db int, key, cmd string, deleted bool) {
+	m.changes = append(m.changes, MirrorChange{DB: db, Key: key, Command: cmd, Deleted: deleted})
+}
+
+// unlock releases the write lock and notifies the changes made under it.
+func (m *Mirror) unlock() {
+	changes := m.changes
+	m.changes = nil
+	m.mu.Unlock()
+	m.notify(changes)
+}
+
+// lookup returns the value of key to write, even if it expired locally:
+// the master deletes its expired keys with a DEL of their own.
+func (m *Mirror) lookup(db int, key string) *mirrorValue {
+	return m.dbs[db][key]
+}
+
+// get returns the live value of key for reading.
+func (m *Mirror) get(db int, key string, typ ValueType) *mirrorValue {
+	v := m.dbs[db][key]
+	if v == nil || v.typ != typ || (v.expireAt > 0 && v.expireAt <= m.nowMS()) {
+		return nil
+	}
+	return v
+}
+
+func (m *Mirror) nowMS() int64 { return m.now().UnixNano() / int64(time.Millisecond) }
+
+func (m *Mirror) store(db int, key string, v *mirrorValue) {
+	if m.dbs[db] == nil {
+		m.dbs[db] = make(map[string]*mirrorValue)
+	}
+	m.dbs[db][key] = v
+}
+
+// clear empties the mirror for a full sync.
+func (m *Mirror) clear() {
+	for db := range m.dbs {
+		m.changed(db, "", "FLUSHALL", true)
+	}
+	m.dbs = make(map[int]map[string]*mirrorValue)
+}
+
+// Get returns the value of a string key.
+func (m *Mirror) Get(db int, key string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if v := m.get(db, key, TypeString); v != nil {
+		return v.str, true
+	}
+	return "", false
+}
+
+// HGet returns a field of a hash.
+func (m *Mirror) HGet(db int, key, field string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if v := m.get(db, key, TypeHash); v != nil {
+		value, ok := v.hash[field]
+		return value, ok
+	}
+	return "", false
+}
+
+// HGetAll returns the fields of a hash, nil if it does not exist.
+func (m *Mirror) HGetAll(db int, key string) map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v := m.get(db, key, TypeHash)
+	if v == nil {
+		return nil
+	}
+	out := make(map[string]string, len(v.hash))
+	for f, value := range v.hash {
+		out[f] = value
+	}
+	return out
+}
+
+// SMembers returns the sorted members of a set.
+func (m *Mirror) SMembers(db int, key string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v := m.get(db, key, TypeSet)
+	if v == nil {
+		return nil
+	}
+	out := make([]string, 0, len(v.set))
+	for member := range v.set {
+		out = append(out, member)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SIsMember reports whether member is in a set.
+func (m *Mirror) SIsMember(db int, key, member string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if v := m.get(db, key, TypeSet); v != nil {
+		_, ok := v.set[member]
+		return ok
+	}
+	return false
+}
+
+// LRange returns the elements of a list from start to stop included,
+// negative indexes counting from the end, like LRANGE.
+func (m *Mirror) LRange(db int, key string, start, stop int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v := m.get(db, key, TypeList)
+	if v == nil {
+		return nil
+	}
+	start, stop, ok := rangeIndexes(start, stop, len(v.list))
+	if !ok {
+		return []string{}
+	}
+	return append([]string(nil), v.list[start:stop+1]...)
+}
+
+// ZRange returns the members of a sorted set by ascending score from start
+// to stop included, negative indexes counting from the end, like ZRANGE.
+func (m *Mirror) ZRange(db int, key string, start, stop int) []ZMember {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v := m.get(db, key, TypeZSet)
+	if v == nil {
+		return nil
+	}
+	members := sortedZSet(v.zset)
+	start, stop, ok := rangeIndexes(start, stop, len(members))
+	if !ok {
+		return []ZMember{}
+	}
+	return members[start : stop+1]
+}
+
+// ZScore returns the score of a member of a sorted set.
+func (m *Mirror) ZScore(db int, key, member string) (float64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if v := m.get(db, key, TypeZSet); v != nil {
+		score, ok := v.zset[member]
+		return score, ok
+	}
+	return 0, false
+}
+
+// Type returns the type of a key: TypeString, TypeList, TypeSet, TypeZSet
+// or TypeHash.
+func (m *Mirror) Type(db int, key string) (ValueType, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v := m.dbs[db][key]
+	if v == nil || (v.expireAt > 0 && v.expireAt <= m.nowMS()) {
+		return 0, false
+	}
+	return v.typ, true
+}
+
+// TTL returns the time to live of a key, -1 without expiry, like the TTL
+// command but with millisecond precision.
+func (m *Mirror) TTL(db int, key string) (time.Duration, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v := m.dbs[db][key]
+	now := m.nowMS()
+	if v == nil || (v.expireAt > 0 && v.expireAt <= now) {
+		return 0, false
+	}
+	if v.expireAt == 0 {
+		return -1, true
+	}
+	return time.Duration(v.expireAt-now) * time.Millisecond, true
+}
+
+// Keys returns the sorted keys of database db.
+func (m *Mirror) Keys(db int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := m.nowMS()
+	keys := make([]string, 0, len(m.dbs[db]))
+	for key, v := range m.dbs[db] {
+		if v.expireAt == 0 || v.expireAt > now {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func rangeIndexes(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, start <= stop
+}
+
+func sortedZSet(zset map[string]float64) []ZMember {
+	members := make([]ZMember, 0, len(zset))
+	for member, score := range zset {
+		members = append(members, ZMember{member, score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score < members[j].Score
+		}
+		return members[i].Member < members[j].Member
+	})
+	return members
+}
+
+// Command implements CommandDecoder.
+func (m *Mirror) Command(cmd *Command) error {
+	m.mu.Lock()
+	defer m.unlock()
+	name := cmd.Name()
+	// every full sync opens with a PING, even that of an empty master or
+	// one interrupting a snapshot
+	if cmd.Phase == PhaseRDB && (m.phase != PhaseRDB || name == "PING") {
+		m.clear()
+	}
+	m.phase = cmd.Phase
+	if !m.apply(name, cmd.D[1:]) {
+		atomic.AddInt64(&m.skipped, 1)
+	}
+	switch {
+	case cmd.Phase == PhaseRDB:
+		atomic.StoreInt64(&m.applied, -1)
+	case cmd.Offset > 0:
+		atomic.StoreInt64(&m.applied, cmd.Offset)
+	}
+	return nil
+}
+
+// apply applies a command, reporting false if it is not supported or
+// invalid.
+func (m *Mirror) apply(name string, args []string) bool {
+	switch name {
+	case "", "PING", "REPLCONF", "MULTI", "EXEC":
+		return true
+	case "SELECT":
+		if len(args) != 1 {
+			return false
+		}
+		db, err := strconv.Atoi(args[0])
+		if err != nil {
+			return false
+		}
+		m.db = db
+		return true
+	case "FLUSHDB":
+		delete(m.dbs, m.db)
+		m.changed(m.db, "", name, true)
+		return true
+	case "FLUSHALL":
+		for db := range m.dbs {
+			m.changed(db, "", name, true)
+		}
+		m.dbs = make(map[int]map[string]*mirrorValue)
+		return true
+	}
+	if len(args) == 0 {
+		return false
+	}
+	switch name {
+	case "DEL", "UNLINK":
+		for _, key := range args {
+			if m.lookup(m.db, key) != nil {
+				delete(m.dbs[m.db], key)
+				m.changed(m.db, key, name, true)
+			}
+		}
+		return true
+	case "RENAME", "RENAMENX":
+		if len(args) != 2 {
+			return false
+		}
+		v := m.lookup(m.db, args[0])
+		if v == nil {
+			return false
+		}
+		delete(m.dbs[m.db], args[0])
+		m.store(m.db, args[1], v)
+		m.changed(m.db, args[0], name, true)
+		m.changed(m.db, args[1], name, false)
+		return true
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "PERSIST":
+		return m.expire(name, args)
+	case "SET", "SETNX", "SETEX", "PSETEX", "GETSET", "MSET", "MSETNX", "APPEND",
+		"INCR", "DECR", "INCRBY", "DECRBY", "INCRBYFLOAT":
+		return m.applyString(name, args)
+	case "HSET", "HMSET", "HSETNX", "HDEL", "HINCRBY", "HINCRBYFLOAT":
+		return m.applyHash(name, args)
+	case "SADD", "SREM", "SMOVE":
+		return m.applySet(name, args)
+	case "LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "LPOP", "RPOP", "LSET", "LTRIM", "LREM",
+		"LINSERT", "RPOPLPUSH", "LMOVE":
+		return m.applyList(name, args)
+	case "ZADD", "ZINCRBY", "ZREM", "ZPOPMIN", "ZPOPMAX", "ZREMRANGEBYRANK", "ZREMRANGEBYSCORE":
+		return m.applyZSet(name, args)
+	}
+	return false
+}
+
+// value returns the value of key to write, creating it if missing. It is
+// nil if key holds another type.
+func (m *Mirror) value(key string, typ ValueType, create bool) *mirrorValue {
+	v := m.lookup(m.db, key)
+	if v == nil {
+		if !create {
+			return nil
+		}
+		v = &mirrorValue{typ: typ}
+		switch typ {
+		case TypeHash:
+			v.hash = make(map[string]string)
+		case TypeSet:
+			v.set = make(map[string]struct{})
+		case TypeZSet:
+			v.zset = make(map[string]float64)
+		}
+		m.store(m.db, key, v)
+	}
+	if v.typ != typ {
+		return nil
+	}
+	return v
+}
+
+// done records the change of key by name, deleting key if it is empty.
+func (m *Mirror) done(key, name string, v *mirrorValue) {
+	empty := false
+	switch v.typ {
+	case TypeHash:
+		empty = len(v.hash) == 0
+	case TypeSet:
+		empty = len(v.set) == 0
+	case TypeList:
+		empty = len(v.list) == 0
+	case TypeZSet:
+		empty = len(v.zset) == 0
+	}
+	if empty {
+		delete(m.dbs[m.db], key)
+	}
+	m.changed(m.db, key, name, empty)
+}
+
+func (m *Mirror) expire(name string, args []string) bool {
+	v := m.lookup(m.db, args[0])
+	if v == nil {
+		return false
+	}
+	if name == "PERSIST" {
+		v.expireAt = 0
+		m.changed(m.db, args[0], name, false)
+		return true
+	}
+	if len(args) < 2 {
+		return false
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	switch name {
+	case "EXPIRE":
+		n = m.nowMS() + n*1000
+	case "PEXPIRE":
+		n = m.nowMS() + n
+	case "EXPIREAT":
+		n *= 1000
+	}
+	if n <= m.nowMS() {
+		delete(m.dbs[m.db], args[0])
+		m.changed(m.db, args[0], name, true)
+		return true
+	}
+	v.expireAt = n
+	m.changed(m.db, args[0], name, false)
+	return true
+}
+
+func (m *Mirror) setString(key, value string, expireAt int64, name string) {
+	m.store(m.db, key, &mirrorValue{typ: TypeString, str: value, expireAt: expireAt})
+	m.changed(m.db, key, name, false)
+}
+
+func (m *Mirror) applyString(name string, args []string) bool {
+	key := args[0]
+	switch name {
+	case "SET":
+		if len(args) < 2 {
+			return false
+		}
+		var expireAt int64
+		for i := 2; i < len(args); i++ {
+			opt := strings.ToUpper(args[i])
+			switch opt {
+			case "KEEPTTL":
+				if v := m.lookup(m.db, key); v != nil {
+					expireAt = v.expireAt
+				}
+			case "EX", "PX", "EXAT", "PXAT":
+				if i+1 >= len(args) {
+					return false
+				}
+				i++
+				n, err := strconv.ParseInt(args[i], 10, 64)
+				if err != nil {
+					return false
+				}
+				switch opt {
+				case "EX":
+					expireAt = m.nowMS() + n*1000
+				case "PX":
+					expireAt = m.nowMS() + n
+				case "EXAT":
+					expireAt = n * 1000
+				default:
+					expireAt = n
+				}
+			}
+		}
+		m.setString(key, args[1], expireAt, name)
+	case "SETNX", "GETSET":
+		if len(args) != 2 {
+			return false
+		}
+		m.setString(key, args[1], 0, name)
+	case "SETEX", "PSETEX":
+		if len(args) != 3 {
+			return false
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return false
+		}
+		if name == "SETEX" {
+			n *= 1000
+		}
+		m.setString(key, args[2], m.nowMS()+n, name)
+	case "MSET", "MSETNX":
+		if len(args)%2 != 0 {
+			return false
+		}
+		for i := 0; i < len(args); i += 2 {
+			m.setString(args[i], args[i+1], 0, name)
+		}
+	case "APPEND":
+		if len(args) != 2 {
+			return false
+		}
+		v := m.value(key, TypeString, true)
+		if v == nil {
+			return false
+		}
+		v.str += args[1]
+		m.changed(m.db, key, name, false)
+	default:
+		return m.incr(name, args)
+	}
+	return true
+}
+
+// incr applies INCR, DECR, INCRBY, DECRBY and INCRBYFLOAT.
+func (m *Mirror) incr(name string, args []string) bool {
+	key := args[0]
+	v := m.value(key, TypeString, true)
+	if v == nil {
+		return false
+	}
+	if name == "INCRBYFLOAT" {
+		if len(args) != 2 {
+			return false
+		}
+		cur, err1 := parseMirrorFloat(v.str)
+		by, err2 := strconv.ParseFloat(args[1], 64)
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		v.str = strconv.FormatFloat(cur+by, 'f', -1, 64)
+		m.changed(m.db, key, name, false)
+		return true
+	}
+	by := int64(1)
+	switch name {
+	case "DECR":
+		by = -1
+	case "INCRBY", "DECRBY":
+		if len(args) != 2 {
+			return false
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return false
+		}
+		if by = n; name == "DECRBY" {
+			by = -n
+		}
+	}
+	cur := int64(0)
+	if v.str != "" {
+		n, err := strconv.ParseInt(v.str, 10, 64)
+		if err != nil {
+			return false
+		}
+		cur = n
+	}
+	v.str = strconv.FormatInt(cur+by, 10)
+	m.changed(m.db, key, name, false)
+	return true
+}
+
+func parseMirrorFloat(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func (m *Mirror) applyHash(name string, args []string) bool {
+	key := args[0]
+	switch name {
+	case "HSET", "HMSET", "HSETNX":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return false
+		}
+		v := m.value(key, TypeHash, true)
+		if v == nil {
+			return false
+		}
+		for i := 1; i < len(args); i += 2 {
+			v.hash[args[i]] = args[i+1]
+		}
+		m.done(key, name, v)
+	case "HDEL":
+		v := m.value(key, TypeHash, false)
+		if v == nil {
+			return false
+		}
+		for _, f := range args[1:] {
+			delete(v.hash, f)
+		}
+		m.done(key, name, v)
+	case "HINCRBY", "HINCRBYFLOAT":
+		if len(args) != 3 {
+			return false
+		}
+		v := m.value(key, TypeHash, true)
+		if v == nil {
+			return false
+		}
+		if name == "HINCRBY" {
+			cur, err1 := strconv.ParseInt(stringOr(v.hash[args[1]], "0"), 10, 64)
+			by, err2 := strconv.ParseInt(args[2], 10, 64)
+			if err1 != nil || err2 != nil {
+				return false
+			}
+			v.hash[args[1]] = strconv.FormatInt(cur+by, 10)
+		} else {
+			cur, err1 := parseMirrorFloat(v.hash[args[1]])
+			by, err2 := strconv.ParseFloat(args[2], 64)
+			if err1 != nil || err2 != nil {
+				return false
+			}
+			v.hash[args[1]] = strconv.FormatFloat(cur+by, 'f', -1, 64)
+		}
+		m.done(key, name, v)
+	}
+	return true
+}
+
+func stringOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func (m *Mirror) applySet(name string, args []string) bool {
+	key := args[0]
+	switch name {
+	case "SADD":
+		if len(args) < 2 {
+			return false
+		}
+		v := m.value(key, TypeSet, true)
+		if v == nil {
+			return false
+		}
+		for _, member := range args[1:] {
+			v.set[member] = struct{}{}
+		}
+		m.done(key, name, v)
+	case "SREM":
+		v := m.value(key, TypeSet, false)
+		if v == nil {
+			return false
+		}
+		for _, member := range args[1:] {
+			delete(v.set, member)
+		}
+		m.done(key, name, v)
+	case "SMOVE":
+		if len(args) != 3 {
+			return false
+		}
+		src := m.value(key, TypeSet, false)
+		if src == nil {
+			return false
+		}
+		delete(src.set, args[2])
+		m.done(key, name, src)
+		dst := m.value(args[1], TypeSet, true)
+		if dst == nil {
+			return false
+		}
+		dst.set[args[2]] = struct{}{}
+		m.done(args[1], name, dst)
+	}
+	return true
+}
+
+func (m *Mirror) applyList(name string, args []string) bool {
+	key := args[0]
+	switch name {
+	case "LPUSH", "RPUSH", "LPUSHX", "RPUSHX":
+		if len(args) < 2 {
+			return false
+		}
+		v := m.value(key, TypeList, name == "LPUSH" || name == "RPUSH")
+		if v == nil {
+			return name == "LPUSHX" || name == "RPUSHX"
+		}
+		for _, e := range args[1:] {
+			if name[0] == 'L' {
+				v.list = append([]string{e}, v.list...)
+			} else {
+				v.list = append(v.list, e)
+			}
+		}
+		m.done(key, name, v)
+	case "LPOP", "RPOP":
+		v := m.value(key, TypeList, false)
+		if v == nil {
+			return false
+		}
+		n := 1
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+				return false
+			}
+		}
+		if n > len(v.list) {
+			n = len(v.list)
+		}
+		if name == "LPOP" {
+			v.list = v.list[n:]
+		} else {
+			v.list = v.list[:len(v.list)-n]
+		}
+		m.done(key, name, v)
+	case "LSET":
+		if len(args) != 3 {
+			return false
+		}
+		v := m.value(key, TypeList, false)
+		i, err := strconv.Atoi(args[1])
+		if v == nil || err != nil {
+			return false
+		}
+		if i < 0 {
+			i += len(v.list)
+		}
+		if i < 0 || i >= len(v.list) {
+			return false
+		}
+		v.list[i] = args[2]
+		m.done(key, name, v)
+	case "LTRIM":
+		if len(args) != 3 {
+			return false
+		}
+		v := m.value(key, TypeList, false)
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if v == nil || err1 != nil || err2 != nil {
+			return false
+		}
+		if start, stop, ok := rangeIndexes(start, stop, len(v.list)); ok {
+			v.list = append([]string(nil), v.list[start:stop+1]...)
+		} else {
+			v.list = nil
+		}
+		m.done(key, name, v)
+	case "LREM":
+		if len(args) != 3 {
+			return false
+		}
+		v := m.value(key, TypeList, false)
+		count, err := strconv.Atoi(args[1])
+		if v == nil || err != nil {
+			return false
+		}
+		v.list = listRemove(v.list, args[2], count)
+		m.done(key, name, v)
+	case "LINSERT":
+		if len(args) != 4 {
+			return false
+		}
+		v := m.value(key, TypeList, false)
+		if v == nil {
+			return false
+		}
+		where := strings.ToUpper(args[1])
+		for i, e := range v.list {
+			if e != args[2] {
+				continue
+			}
+			if where == "AFTER" {
+				i++
+			}
+			v.list = append(v.list[:i], append([]string{args[3]}, v.list[i:]...)...)
+			break
+		}
+		m.done(key, name, v)
+	case "RPOPLPUSH", "LMOVE":
+		if len(args) < 2 {
+			return false
+		}
+		from, to := "RIGHT", "LEFT"
+		if name == "LMOVE" {
+			if len(args) != 4 {
+				return false
+			}
+			from, to = strings.ToUpper(args[2]), strings.ToUpper(args[3])
+		}
+		src := m.value(key, TypeList, false)
+		if src == nil || len(src.list) == 0 {
+			return false
+		}
+		var e string
+		if from == "LEFT" {
+			e, src.list = src.list[0], src.list[1:]
+		} else {
+			e, src.list = src.list[len(src.list)-1], src.list[:len(src.list)-1]
+		}
+		m.done(key, name, src)
+		dst := m.value(args[1], TypeList, true)
+		if dst == nil {
+			return false
+		}
+		if to == "LEFT" {
+			dst.list = append([]string{e}, dst.list...)
+		} else {
+			dst.list = append(dst.list, e)
+		}
+		m.done(args[1], name, dst)
+	}
+	return true
+}
+
+// listRemove removes count occurrences of e from the head, from the tail if
+// count is negative, all of them if it is zero.
+func listRemove(list []string, e string, count int) []string {
+	out := make([]string, 0, len(list))
+	if count >= 0 {
+		removed := 0
+		for _, x := range list {
+			if x == e && (count == 0 || removed < count) {
+				removed++
+				continue
+			}
+			out = append(out, x)
+		}
+		return out
+	}
+	removed := 0
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i] == e && removed < -count {
+			removed++
+			continue
+		}
+		out = append(out, list[i])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// parseScore parses a score or a ZREMRANGEBYSCORE bound, exclusive with a
+// leading "(".
+func parseScore(s string) (score float64, exclusive bool, err error) {
+	if strings.HasPrefix(s, "(") {
+		s, exclusive = s[1:], true
+	}
+	switch strings.ToLower(s) {
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	}
+	score, err = strconv.ParseFloat(s, 64)
+	return score, exclusive, err
+}
+
+func (m *Mirror) applyZSet(name string, args []string) bool {
+	key := args[0]
+	switch name {
+	case "ZADD":
+		i := 1
+		var nx, xx, gt, lt, incr bool
+	flags:
+		for ; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			case "GT":
+				gt = true
+			case "LT":
+				lt = true
+			case "INCR":
+				incr = true
+			case "CH":
+			default:
+				break flags
+			}
+		}
+		if i >= len(args) || (len(args)-i)%2 != 0 {
+			return false
+		}
+		v := m.value(key, TypeZSet, !xx)
+		if v == nil {
+			return xx
+		}
+		for ; i < len(args); i += 2 {
+			score, _, err := parseScore(args[i])
+			if err != nil {
+				return false
+			}
+			member := args[i+1]
+			cur, exists := v.zset[member]
+			if (nx && exists) || (xx && !exists) {
+				continue
+			}
+			if incr {
+				score += cur
+			}
+			if exists && ((gt && score <= cur) || (lt && score >= cur)) {
+				continue
+			}
+			v.zset[member] = score
+		}
+		m.done(key, name, v)
+	case "ZINCRBY":
+		if len(args) != 3 {
+			return false
+		}
+		v := m.value(key, TypeZSet, true)
+		by, _, err := parseScore(args[1])
+		if v == nil || err != nil {
+			return false
+		}
+		v.zset[args[2]] += by
+		m.done(key, name, v)
+	case "ZREM":
+		v := m.value(key, TypeZSet, false)
+		if v == nil {
+			return false
+		}
+		for _, member := range args[1:] {
+			delete(v.zset, member)
+		}
+		m.done(key, name, v)
+	case "ZPOPMIN", "ZPOPMAX":
+		v := m.value(key, TypeZSet, false)
+		if v == nil {
+			return false
+		}
+		n := 1
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+				return false
+			}
+		}
+		members := sortedZSet(v.zset)
+		if n > len(members) {
+			n = len(members)
+		}
+		if name == "ZPOPMAX" {
+			members = members[len(members)-n:]
+		} else {
+			members = members[:n]
+		}
+		for _, zm := range members {
+			delete(v.zset, zm.Member)
+		}
+		m.done(key, name, v)
+	case "ZREMRANGEBYRANK":
+		if len(args) != 3 {
+			return false
+		}
+		v := m.value(key, TypeZSet, false)
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if v == nil || err1 != nil || err2 != nil {
+			return false
+		}
+		members := sortedZSet(v.zset)
+		if start, stop, ok := rangeIndexes(start, stop, len(members)); ok {
+			for _, zm := range members[start : stop+1] {
+				delete(v.zset, zm.Member)
+			}
+		}
+		m.done(key, name, v)
+	case "ZREMRANGEBYSCORE":
+		if len(args) != 3 {
+			return false
+		}
+		v := m.value(key, TypeZSet, false)
+		min, minEx, err1 := parseScore(args[1])
+		max, maxEx, err2 := parseScore(args[2])
+		if v == nil || err1 != nil || err2 != nil {
+			return false
+		}
+		for member, score := range v.zset {
+			if (score > min || (!minEx && score == min)) && (score < max || (!maxEx && score == max)) {
+				delete(v.zset, member)
+			}
+		}
+		m.done(key, name, v)
+	}
+	return true
+}
+
+// The Decoder methods load an RDB, replacing the dataset.
+
+func (m *Mirror) BeginRDB() {
+	m.mu.Lock()
+	defer m.unlock()
+	m.clear()
+}
+
+func (m *Mirror) BeginDatabase(n int)                       { m.rdbDB = n }
+func (m *Mirror) Aux(key, value []byte)                     {}
+func (m *Mirror) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (m *Mirror) EndDatabase(n int)                         {}
+func (m *Mirror) EndRDB()                                   {}
+
+// load stores v as key of the database being loaded.
+func (m *Mirror) load(key []byte, v *mirrorValue, cmd string) {
+	m.mu.Lock()
+	defer m.unlock()
+	m.store(m.rdbDB, string(key), v)
+	m.changed(m.rdbDB, string(key), cmd, false)
+}
+
+func (m *Mirror) Set(key, value []byte, expiry int64) {
+	m.load(key, &mirrorValue{typ: TypeString, str: string(value), expireAt: expiry}, "SET")
+}
+
+func (m *Mirror) BeginHash(key []byte, length, expiry int64) {
+	m.loading = &mirrorValue{typ: TypeHash, hash: make(map[string]string), expireAt: expiry}
+}
+
+func (m *Mirror) Hset(key, field, value []byte) { m.loading.hash[string(field)] = string(value) }
+func (m *Mirror) EndHash(key []byte)            { m.load(key, m.loading, "HSET") }
+
+func (m *Mirror) BeginSet(key []byte, cardinality, expiry int64) {
+	m.loading = &mirrorValue{typ: TypeSet, set: make(map[string]struct{}), expireAt: expiry}
+}
+
+func (m *Mirror) Sadd(key, member []byte) { m.loading.set[string(member)] = struct{}{} }
+func (m *Mirror) EndSet(key []byte)       { m.load(key, m.loading, "SADD") }
+
+func (m *Mirror) BeginList(key []byte, length, expiry int64) {
+	m.loading = &mirrorValue{typ: TypeList, expireAt: expiry}
+}
+
+func (m *Mirror) Rpush(key, value []byte) { m.loading.list = append(m.loading.list, string(value)) }
+func (m *Mirror) EndList(key []byte)      { m.load(key, m.loading, "RPUSH") }
+
+func (m *Mirror) BeginZSet(key []byte, cardinality, expiry int64) {
+	m.loading = &mirrorValue{typ: TypeZSet, zset: make(map[string]float64), expireAt: expiry}
+}
+
+func (m *Mirror) Zadd(key []byte, score float64, member []byte) {
+	m.loading.zset[string(member)] = score
+}
+
+func (m *Mirror) EndZSet(key []byte) { m.load(key, m.loading, "ZADD") }
+
+func (m *Mirror) BeginStream(key []byte, cardinality, expiry int64) {
+	atomic.AddInt64(&m.skipped, 1)
+}
+
+func (m *Mirror) Xadd(key, streamID, listpack []byte) {}
+func (m *Mirror) EndStream(key []byte)                {}
@@ -0,0 +1,200 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMirror() (*Mirror, *time.Time) {
+	m := NewMirror()
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+	return m, &now
+}
+
+func mirrorCommands(t *testing.T, m *Mirror, cmds ...string) {
+	for i, c := range cmds {
+		assert.Nil(t, m.Command(&Command{D: strings.Fields(c), Offset: int64(i + 1), Phase: PhaseStreaming}))
+	}
+}
+
+func TestMirrorStrings(t *testing.T) {
+	m, now := newTestMirror()
+	mirrorCommands(t, m,
+		"SET a 1",
+		"SET b x EX 10",
+		"MSET c 3 d 4",
+		"INCRBY c 5",
+		"APPEND a 2",
+		"PSETEX e 500 y",
+		"SELECT 1",
+		"SET a other",
+		"RENAME a z",
+	)
+	v, ok := m.Get(0, "a")
+	assert.True(t, ok)
+	assert.Equal(t, "12", v)
+	v, _ = m.Get(0, "c")
+	assert.Equal(t, "8", v)
+	ttl, _ := m.TTL(0, "b")
+	assert.Equal(t, 10*time.Second, ttl)
+	ttl, _ = m.TTL(0, "a")
+	assert.Equal(t, time.Duration(-1), ttl)
+	assert.Equal(t, []string{"z"}, m.Keys(1))
+	assert.Equal(t, int64(9), m.Applied())
+
+	*now = now.Add(time.Second)
+	_, ok = m.Get(0, "e")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, m.Keys(0))
+
+	mirrorCommands(t, m, "SELECT 0", "PERSIST b", "DEL a d", "EXPIRE c 0")
+	*now = now.Add(time.Minute)
+	assert.Equal(t, []string{"b"}, m.Keys(0))
+	assert.Equal(t, int64(0), m.Skipped())
+
+	// a key expired locally is still written until the master deletes it
+	mirrorCommands(t, m, "SET f 1 PX 100")
+	*now = now.Add(time.Second)
+	mirrorCommands(t, m, "APPEND f 2", "PERSIST f")
+	v, _ = m.Get(0, "f")
+	assert.Equal(t, "12", v)
+	assert.Equal(t, int64(0), m.Skipped())
+}
+
+func TestMirrorCollections(t *testing.T) {
+	m, _ := newTestMirror()
+	mirrorCommands(t, m,
+		"HSET h a 1 b 2",
+		"HINCRBY h a 10",
+		"HDEL h b",
+		"SADD s x y z",
+		"SREM s y",
+		"SMOVE s t z",
+		"RPUSH l a b c d",
+		"LPUSH l 0",
+		"LPOP l",
+		"LREM l -1 c",
+		"LINSERT l AFTER b bb",
+		"LMOVE l l2 RIGHT LEFT",
+		"ZADD z 1 a 2 b 3 c",
+		"ZADD z GT 0 a 5 b",
+		"ZINCRBY z 10 c",
+		"ZPOPMIN z",
+		"HDEL gone a",
+	)
+	assert.Equal(t, map[string]string{"a": "11"}, m.HGetAll(0, "h"))
+	assert.Equal(t, []string{"x"}, m.SMembers(0, "s"))
+	assert.True(t, m.SIsMember(0, "t", "z"))
+	assert.Equal(t, []string{"a", "b", "bb"}, m.LRange(0, "l", 0, -1))
+	assert.Equal(t, []string{"d"}, m.LRange(0, "l2", 0, -1))
+	assert.Equal(t, []ZMember{{"b", 5}, {"c", 13}}, m.ZRange(0, "z", 0, -1))
+	typ, _ := m.Type(0, "z")
+	assert.Equal(t, TypeZSet, typ)
+
+	// wrong type and missing keys are skipped
+	mirrorCommands(t, m, "SADD h x", "SREM gone x", "XADD st * f v")
+	assert.Equal(t, int64(4), m.Skipped())
+	assert.Equal(t, map[string]string{"a": "11"}, m.HGetAll(0, "h"))
+
+	mirrorCommands(t, m, "SREM s x", "FLUSHDB")
+	assert.Empty(t, m.Keys(0))
+}
+
+func TestMirrorRDB(t *testing.T) {
+	m, _ := newTestMirror()
+	mirrorCommands(t, m, "SET stale 1")
+
+	m.BeginRDB()
+	m.BeginDatabase(2)
+	m.Set([]byte("a"), []byte("1"), 0)
+	m.BeginHash([]byte("h"), 1, 0)
+	m.Hset([]byte("h"), []byte("f"), []byte("v"))
+	m.EndHash([]byte("h"))
+	m.BeginList([]byte("l"), 2, 0)
+	m.Rpush([]byte("l"), []byte("x"))
+	m.Rpush([]byte("l"), []byte("y"))
+	m.EndList([]byte("l"))
+	m.BeginZSet([]byte("z"), 1, 0)
+	m.Zadd([]byte("z"), 1.5, []byte("m"))
+	m.EndZSet([]byte("z"))
+	m.BeginStream([]byte("st"), 0, 0)
+	m.EndStream([]byte("st"))
+	m.EndDatabase(2)
+	m.EndRDB()
+
+	assert.Empty(t, m.Keys(0))
+	assert.Equal(t, []string{"a", "h", "l", "z"}, m.Keys(2))
+	v, _ := m.HGet(2, "h", "f")
+	assert.Equal(t, "v", v)
+	assert.Equal(t, []string{"x", "y"}, m.LRange(2, "l", 0, -1))
+	score, _ := m.ZScore(2, "z", "m")
+	assert.Equal(t, 1.5, score)
+	assert.Equal(t, int64(1), m.Skipped())
+
+	// a snapshot through commands replaces the dataset as well
+	assert.Nil(t, m.Command(&Command{D: []string{"SET", "b", "2"}, Phase: PhaseRDB}))
+	assert.Empty(t, m.Keys(2))
+	assert.Equal(t, []string{"b"}, m.Keys(0))
+}
+
+func TestMirrorFullSync(t *testing.T) {
+	m, _ := newTestMirror()
+	mirrorCommands(t, m, "SET stale 1")
+	assert.Equal(t, int64(1), m.Applied())
+
+	// the full sync of an empty master
+	assert.Nil(t, m.Command(&Command{D: []string{"PING"}, Offset: 100, Phase: PhaseRDB}))
+	assert.Empty(t, m.Keys(0))
+	assert.Equal(t, int64(-1), m.Applied())
+
+	// a full sync interrupting a snapshot
+	assert.Nil(t, m.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 100, Phase: PhaseRDB}))
+	assert.Nil(t, m.Command(&Command{D: []string{"PING"}, Offset: 200, Phase: PhaseRDB}))
+	assert.Nil(t, m.Command(&Command{D: []string{"SET", "b", "2"}, Offset: 200, Phase: PhaseRDB}))
+	assert.Equal(t, []string{"b"}, m.Keys(0))
+	assert.Equal(t, int64(-1), m.Applied())
+
+	assert.Nil(t, m.Command(&Command{D: []string{"SET", "c", "3"}, Offset: 210, Phase: PhaseStreaming}))
+	assert.Equal(t, []string{"b", "c"}, m.Keys(0))
+	assert.Equal(t, int64(210), m.Applied())
+}
+
+func TestMirrorWatch(t *testing.T) {
+	m, _ := newTestMirror()
+	var key, all []MirrorChange
+	unwatch := m.Watch(0, "a", func(c MirrorChange) { key = append(key, c) })
+	m.Watch(0, "", func(c MirrorChange) { all = append(all, c) })
+
+	mirrorCommands(t, m, "SET a 1", "SET b 2", "SELECT 1", "SET a 3", "SELECT 0", "DEL a", "FLUSHDB")
+	assert.Equal(t, []MirrorChange{
+		{DB: 0, Key: "a", Command: "SET"},
+		{DB: 0, Key: "a", Command: "DEL", Deleted: true},
+		{DB: 0, Command: "FLUSHDB", Deleted: true},
+	}, key)
+	assert.Len(t, all, 4)
+
+	unwatch()
+	mirrorCommands(t, m, "SET a 1")
+	assert.Len(t, key, 3)
+	assert.Len(t, all, 5)
+}
@@ -0,0 +1,469 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PipelineOption specifies an option for a Pipeline.
+type PipelineOption struct {
+	f func(*Pipeline)
+}
+
+// PipelineLogger specifies the Logger of the pipeline and its replicas.
+func PipelineLogger(l Logger) PipelineOption {
+	return PipelineOption{func(p *Pipeline) {
+		p.logger = l
+	}}
+}
+
+// Pipeline replicates a source into a sink as declared by a PipelineConfig.
+type Pipeline struct {
+	cfg     *PipelineConfig
+	sink    CommandDecoder
+	filters []Filter
+	store   CheckpointStore
+	metrics *Metrics
+	admin   *Admin
+	logger  Logger
+
+	mu      sync.Mutex
+	canal   *Canal
+	cluster *ClusterCanal
+	shards  *shardPositions
+	selects *selectPositions
+	loaded  Checkpoints
+	server  *http.Server
+	closed  bool
+}
+
+// NewPipeline builds the sink, checkpoint store and metrics of pc. The
+// source is dialed by Run.
+func NewPipeline(pc *PipelineConfig, opts ...PipelineOption) (*Pipeline, error) {
+	if err := pc.Validate(); err != nil {
+		return nil, err
+	}
+	p := &Pipeline{cfg: pc, logger: defaultLogger}
+	for _, opt := range opts {
+		opt.f(p)
+	}
+	for _, f := range pc.Filters {
+		p.filters = append(p.filters, f.filter())
+	}
+	if cp := pc.Checkpoint; cp != nil {
+		p.store = FileCheckpointStore{Path: cp.Path}
+	}
+	if pc.Metrics != nil {
+		p.metrics = NewMetrics()
+		if pc.Metrics.Admin {
+			p.admin = NewAdmin()
+		}
+	}
+	sink, err := pc.Sink.Params.Build()
+	if err != nil {
+		var es FieldErrors
+		es.addErr("sink", err)
+		return nil, es
+	}
+	p.sink = sink
+	if store, ok := sink.(CheckpointStore); ok && p.store == nil {
+		// the sink saves positions along with the data
+		p.store = store
+	}
+	return p, nil
+}
+
+// Run replicates until Close is called or the replication fails, then
+// saves the last checkpoint and closes the sink.
+func (p *Pipeline) Run() (err error) {
+	if p.store != nil {
+		if p.loaded, err = p.store.Load(); err != nil {
+			return err
+		}
+	}
+	if err := p.serve(); err != nil {
+		return err
+	}
+	defer func() {
+		p.mu.Lock()
+		if p.server != nil {
+			_ = p.server.Close()
+		}
+		p.mu.Unlock()
+		// the last commands count in the checkpoint once written out
+		if f, ok := p.sink.(interface{ Flush() error }); ok {
+			if ferr := f.Flush(); err == nil && ferr != ErrSinkClosed {
+				err = ferr
+			}
+		}
+		if serr := p.save(); err == nil {
+			err = serr
+		}
+		if closer, ok := p.sink.(io.Closer); ok {
+			if cerr := closer.Close(); err == nil && cerr != ErrSinkClosed {
+				err = cerr
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go p.saveLoop(done)
+
+	if p.cfg.Source.Cluster != nil {
+		return p.runCluster(NewFilterChain(p.sink, p.filters...))
+	}
+	return p.runSingle(NewFilterChain(p.sink, p.filters...))
+}
+
+func (p *Pipeline) runSingle(cmder CommandDecoder) error {
+	src := p.cfg.Source
+	var cfg *Config
+	var err error
+	if s := src.Sentinel; s != nil {
+		var sentinelOpts []DialOption
+		if s.Password != "" {
+			sentinelOpts = append(sentinelOpts, DialPassword(s.Password))
+		}
+		cfg, err = NewSentinelConfigWithOptions(s.MasterName, s.Addrs, sentinelOpts, src.dialOptions()...)
+	} else {
+		cfg, err = NewConfig(src.Addr, src.dialOptions()...)
+	}
+	if err != nil {
+		return err
+	}
+	if src.ReplMaster {
+		cfg.ReplMaster()
+	}
+	cfg.SetLogger(p.logger)
+	if p.metrics != nil {
+		cfg.SetMetrics(p.metrics)
+	}
+
+	var c *Canal
+	if cp := p.loaded.Checkpoint; cp.resumable() {
+		c, err = FromCheckpointCanal(cfg, cp)
+	} else {
+		c, err = NewCanal(cfg)
+	}
+	if err != nil {
+		_ = cfg.Connection().Close()
+		return err
+	}
+	selects := newSelectPositions(cmder, p.sink)
+	if selects != nil {
+		cmder = selects
+	}
+	if !p.attach(func() { p.canal, p.selects = c, selects }) {
+		c.Close()
+		return nil
+	}
+	if p.admin != nil {
+		p.admin.Register("source", c)
+	}
+	return c.Run(cmder)
+}
+
+func (p *Pipeline) runCluster(cmder CommandDecoder) error {
+	src := p.cfg.Source
+	opts := []ClusterCanalOption{
+		ClusterCanalDialOptions(src.dialOptions()...),
+		ClusterCanalCheckpoints(p.loaded.Shards),
+		ClusterCanalLogger(p.logger),
+	}
+	if src.Cluster.RefreshInterval > 0 {
+		opts = append(opts, ClusterCanalRefreshInterval(time.Duration(src.Cluster.RefreshInterval)))
+	}
+	if p.metrics != nil {
+		opts = append(opts, ClusterCanalMetrics(p.metrics))
+	}
+	cc, err := NewClusterCanal(src.Cluster.Seeds, opts...)
+	if err != nil {
+		return err
+	}
+	shards := newShardPositions(cmder, p.sink, p.loaded.Shards)
+	if shards != nil {
+		cmder = shards
+	}
+	if !p.attach(func() { p.cluster, p.shards = cc, shards }) {
+		return nil
+	}
+	return cc.Run(cmder)
+}
+
+// attach records the running source unless the pipeline is closed.
+func (p *Pipeline) attach(set func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	set()
+	return true
+}
+
+// Close stops the pipeline, Run returns once the sink is closed.
+func (p *Pipeline) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.canal != nil {
+		p.canal.Close()
+	}
+	if p.cluster != nil {
+		p.cluster.Close()
+	}
+}
+
+// Metrics returns the Metrics of the pipeline, nil without metrics config.
+func (p *Pipeline) Metrics() *Metrics { return p.metrics }
+
+// Checkpoints returns the position reached so far. With a sink reporting
+// an applied offset, the position of a single source is that offset, see
+// selectPositions, and that of every shard of a cluster the one of its last
+// command written out by a Flush of the sink, see shardPositions.
+func (p *Pipeline) Checkpoints() Checkpoints {
+	p.mu.Lock()
+	c, cc, shards, selects := p.canal, p.cluster, p.shards, p.selects
+	p.mu.Unlock()
+
+	cps := p.loaded
+	switch {
+	case shards != nil:
+		cps.Shards = shards.checkpoints()
+	case cc != nil:
+		cps.Shards = cc.Checkpoints()
+	case c != nil:
+		cp := c.Checkpoint()
+		if selects != nil {
+			if cp.Offset = selects.sink.Applied(); cp.Offset < 0 {
+				// nothing applied yet in this run
+				return cps
+			}
+			cp.DB = selects.dbAt(cp.Offset)
+		}
+		cps.Checkpoint = cp
+	}
+	return cps
+}
+
+// selectPositions sits in front of the filters and sink fed by a Canal,
+// as the database the stream selected at the Applied offset of the sink
+// may be an older one than that of the Canal. It records where the stream
+// selects a database until the sink applies past it.
+type selectPositions struct {
+	next CommandDecoder
+	sink interface{ Applied() int64 }
+
+	mu      sync.Mutex
+	db      int        // selected up to the first of selects
+	selects []dbSelect // not applied yet, oldest first
+}
+
+type dbSelect struct {
+	offset int64
+	db     int
+}
+
+// newSelectPositions returns nil unless sink reports an Applied offset.
+func newSelectPositions(next, sink CommandDecoder) *selectPositions {
+	s, ok := sink.(interface{ Applied() int64 })
+	if !ok {
+		return nil
+	}
+	return &selectPositions{next: next, sink: s}
+}
+
+func (t *selectPositions) Command(cmd *Command) error {
+	if cmd.Phase == PhaseRDB {
+		// a full sync starts the offsets over, and the stream after it
+		// selects its database again
+		t.mu.Lock()
+		t.db, t.selects = 0, nil
+		t.mu.Unlock()
+	} else if db, ok := selectedDB(cmd); ok {
+		t.mu.Lock()
+		t.selects = append(t.selects, dbSelect{cmd.Offset, db})
+		t.mu.Unlock()
+	}
+	return t.next.Command(cmd)
+}
+
+// dbAt returns the database selected at offset, forgetting the selects
+// before it.
+func (t *selectPositions) dbAt(offset int64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for ; n < len(t.selects) && t.selects[n].offset <= offset; n++ {
+		t.db = t.selects[n].db
+	}
+	t.selects = t.selects[n:]
+	return t.db
+}
+
+// shardPositions sits in front of the filters and sink fed by a
+// ClusterCanal, as the Applied offset of the sink cannot tell the shards
+// apart. It records the last command of every shard handed to next; once a
+// Flush of the sink has written them all out, these are the positions of
+// the shards. A shard in the middle of a
+// snapshot, or a sink applying nothing yet, keeps its previous position.
+type shardPositions struct {
+	next CommandDecoder
+	sink interface {
+		CommandDecoder
+		Flush() error
+		Applied() int64
+	}
+
+	mu       sync.Mutex
+	handed   map[string]Checkpoint // last command of every shard
+	snapshot map[string]bool       // shards whose last command is of a snapshot
+	dbs      map[string]int        // database selected by every shard
+	applied  map[string]Checkpoint
+}
+
+// newShardPositions returns nil unless sink can Flush and reports an
+// Applied offset, the positions start at loaded.
+func newShardPositions(next, sink CommandDecoder, loaded map[string]Checkpoint) *shardPositions {
+	s, ok := sink.(interface {
+		CommandDecoder
+		Flush() error
+		Applied() int64
+	})
+	if !ok {
+		return nil
+	}
+	t := &shardPositions{
+		next:     next,
+		sink:     s,
+		handed:   make(map[string]Checkpoint),
+		snapshot: make(map[string]bool),
+		dbs:      make(map[string]int),
+		applied:  make(map[string]Checkpoint, len(loaded)),
+	}
+	for id, cp := range loaded {
+		t.applied[id] = cp
+	}
+	return t
+}
+
+func (t *shardPositions) Command(cmd *Command) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.next.Command(cmd); err != nil {
+		return err
+	}
+	if cmd.Phase == PhaseRDB {
+		delete(t.dbs, cmd.Shard)
+		t.snapshot[cmd.Shard] = true
+	} else {
+		delete(t.snapshot, cmd.Shard)
+		if db, ok := selectedDB(cmd); ok {
+			t.dbs[cmd.Shard] = db
+		}
+		t.handed[cmd.Shard] = Checkpoint{ReplId: cmd.ReplId, Offset: cmd.Offset, DB: t.dbs[cmd.Shard]}
+	}
+	return nil
+}
+
+// checkpoints flushes the sink, holding back the commands meanwhile, and
+// returns the position of every shard.
+func (t *shardPositions) checkpoints() map[string]Checkpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sink.Flush() == nil && t.sink.Applied() >= 0 {
+		for id, cp := range t.handed {
+			if !t.snapshot[id] {
+				t.applied[id] = cp
+			}
+		}
+	}
+	cps := make(map[string]Checkpoint, len(t.applied))
+	for id, cp := range t.applied {
+		cps[id] = cp
+	}
+	return cps
+}
+
+func (p *Pipeline) save() error {
+	if p.store == nil {
+		return nil
+	}
+	cps := p.Checkpoints()
+	if !cps.resumable() && len(cps.Shards) == 0 {
+		return nil
+	}
+	return p.store.Save(cps)
+}
+
+func (p *Pipeline) saveLoop(done <-chan struct{}) {
+	if p.store == nil {
+		return
+	}
+	interval := time.Second
+	if cp := p.cfg.Checkpoint; cp != nil && cp.Interval > 0 {
+		interval = time.Duration(cp.Interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := p.save(); err != nil {
+			p.logger.Warn("pipeline checkpoint failed", "err", err)
+		}
+	}
+}
+
+// serve starts the metrics and admin endpoint.
+func (p *Pipeline) serve() error {
+	if p.cfg.Metrics == nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", p.cfg.Metrics.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.metrics)
+	if p.admin != nil {
+		mux.Handle("/replicas", p.admin)
+		mux.Handle("/replicas/", p.admin)
+	}
+	srv := &http.Server{Handler: mux}
+	p.mu.Lock()
+	p.server = srv
+	p.mu.Unlock()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			p.logger.Error("pipeline metrics server failed", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,988 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PipelineConfig declares a pipeline: where to replicate from, which
+// commands to keep, where to send them and how to checkpoint. It is read
+// from JSON by ParsePipelineConfig:
+//
+//	{
+//	  "source": {"addr": "127.0.0.1:6379", "password": "secret", "keep_alive": "5m"},
+//	  "filters": [{"type": "key_prefix", "include": ["user:"]}],
+//	  "sink": {"type": "redis", "addr": "127.0.0.1:6380"},
+//	  "checkpoint": {"type": "file", "path": "checkpoint.json", "interval": "1s"},
+//	  "metrics": {"listen": ":9121", "admin": true}
+//	}
+type PipelineConfig struct {
+	Source     SourceConfig      `json:"source"`
+	Filters    []FilterConfig    `json:"filters,omitempty"`
+	Sink       SinkConfig        `json:"sink"`
+	Checkpoint *CheckpointConfig `json:"checkpoint,omitempty"`
+	Metrics    *MetricsConfig    `json:"metrics,omitempty"`
+}
+
+// SourceConfig is the master replicated. Sentinel and Cluster select the
+// failover mode, at most one of them is set; Addr is used otherwise.
+type SourceConfig struct {
+	Addr           string          `json:"addr,omitempty"`
+	Password       string          `json:"password,omitempty"`
+	TLS            *TLSConfig      `json:"tls,omitempty"`
+	KeepAlive      Duration        `json:"keep_alive,omitempty"`
+	ConnectTimeout Duration        `json:"connect_timeout,omitempty"`
+	ReadTimeout    Duration        `json:"read_timeout,omitempty"`
+	WriteTimeout   Duration        `json:"write_timeout,omitempty"`
+	ReplMaster     bool            `json:"repl_master,omitempty"`
+	Sentinel       *SentinelConfig `json:"sentinel,omitempty"`
+	Cluster        *ClusterConfig  `json:"cluster,omitempty"`
+}
+
+// TLSConfig enables TLS.
+type TLSConfig struct {
+	SkipVerify bool `json:"skip_verify,omitempty"`
+}
+
+// SentinelConfig follows the master elected by sentinels, see NewSentinelConfig.
+type SentinelConfig struct {
+	MasterName string   `json:"master_name"`
+	Addrs      []string `json:"addrs"`
+	Password   string   `json:"password,omitempty"`
+}
+
+// ClusterConfig replicates every shard of a cluster, see NewClusterCanal.
+type ClusterConfig struct {
+	Seeds           []string `json:"seeds"`
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+}
+
+// FilterConfig is a Filter: "command" and "key_prefix" use Include and
+// Exclude, see CommandFilter and KeyPrefixFilter, "db" uses DBs.
+type FilterConfig struct {
+	Type    string   `json:"type"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	DBs     []int    `json:"dbs,omitempty"`
+}
+
+// SinkConfig is the sink of a pipeline, its fields but "type" are decoded
+// by the SinkParams registered for the type, see RegisterSink.
+type SinkConfig struct {
+	Type   string
+	Params SinkParams
+	raw    json.RawMessage
+}
+
+// CheckpointConfig is where positions are saved: "file" saves them at Path,
+// see FileCheckpointStore. Default interval is 1s. Without it, a sink that
+// is a CheckpointStore, like the sql sink, stores them.
+type CheckpointConfig struct {
+	Type     string   `json:"type"`
+	Path     string   `json:"path,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// MetricsConfig serves the Metrics on Listen at /metrics and, with Admin,
+// the Admin endpoint at /replicas.
+type MetricsConfig struct {
+	Listen string `json:"listen"`
+	Admin  bool   `json:"admin,omitempty"`
+}
+
+// Duration is a time.Duration read from a string like "1m30s" or a number
+// of nanoseconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(time.Duration(d).String()) }
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(v)
+		return nil
+	}
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	*d = Duration(n)
+	return nil
+}
+
+// FieldError is a configuration error on the field at Field, a path like
+// "sink.addr" or "filters[1].type".
+type FieldError struct {
+	Field string
+	Msg   string
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return e.Msg
+	}
+	return e.Field + ": " + e.Msg
+}
+
+// FieldErrors are all the errors found in a configuration.
+type FieldErrors []*FieldError
+
+func (es FieldErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (es *FieldErrors) add(field, format string, args ...interface{}) {
+	*es = append(*es, &FieldError{Field: field, Msg: fmt.Sprintf(format, args...)})
+}
+
+// addErr adds err, a FieldError or FieldErrors relative to field, or any error.
+func (es *FieldErrors) addErr(field string, err error) {
+	switch e := err.(type) {
+	case nil:
+	case *FieldError:
+		*es = append(*es, &FieldError{Field: joinField(field, e.Field), Msg: e.Msg})
+	case FieldErrors:
+		for _, fe := range e {
+			es.addErr(field, fe)
+		}
+	default:
+		*es = append(*es, &FieldError{Field: field, Msg: err.Error()})
+	}
+}
+
+func (es FieldErrors) err() error {
+	if len(es) == 0 {
+		return nil
+	}
+	return es
+}
+
+func joinField(parent, field string) string {
+	switch {
+	case parent == "":
+		return field
+	case field == "":
+		return parent
+	case field[0] == '[':
+		return parent + field
+	}
+	return parent + "." + field
+}
+
+// SinkParams are the parameters of a sink type. They are decoded from the
+// sink object of a PipelineConfig, unknown fields are errors.
+type SinkParams interface {
+	// Validate reports errors without side effects, a FieldError or
+	// FieldErrors relative to the sink object points at the field.
+	Validate() error
+	// Build returns the sink. If it implements io.Closer it is closed when
+	// the pipeline stops; if it implements Applied() int64 its applied
+	// offset is the one checkpointed.
+	Build() (CommandDecoder, error)
+}
+
+var (
+	sinkTypesMu sync.Mutex
+	sinkTypes   = make(map[string]func() SinkParams)
+)
+
+// RegisterSink makes the sink type typ available to pipelines, newParams
+// returns a pointer to decode its parameters into.
+func RegisterSink(typ string, newParams func() SinkParams) {
+	sinkTypesMu.Lock()
+	defer sinkTypesMu.Unlock()
+	sinkTypes[typ] = newParams
+}
+
+func sinkTypeNames() []string {
+	sinkTypesMu.Lock()
+	defer sinkTypesMu.Unlock()
+	names := make([]string, 0, len(sinkTypes))
+	for name := range sinkTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *SinkConfig) UnmarshalJSON(b []byte) error {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b, &head); err != nil {
+		return err
+	}
+	s.Type, s.raw = head.Type, append(json.RawMessage(nil), b...)
+	return nil
+}
+
+func (s SinkConfig) MarshalJSON() ([]byte, error) {
+	if s.Params == nil {
+		return s.raw, nil
+	}
+	b, err := json.Marshal(s.Params)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	fields["type"], _ = json.Marshal(s.Type)
+	return json.Marshal(fields)
+}
+
+// decodeParams decodes the sink object into the SinkParams of its type.
+func (s *SinkConfig) decodeParams() error {
+	if s.Type == "" {
+		return &FieldError{Field: "type", Msg: "required"}
+	}
+	sinkTypesMu.Lock()
+	newParams, ok := sinkTypes[s.Type]
+	sinkTypesMu.Unlock()
+	if !ok {
+		return &FieldError{Field: "type", Msg: fmt.Sprintf("unknown sink type %q, one of %s", s.Type, strings.Join(sinkTypeNames(), ", "))}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(s.raw, &fields); err != nil {
+		return err
+	}
+	delete(fields, "type")
+	b, _ := json.Marshal(fields)
+	params := newParams()
+	if err := strictUnmarshal(b, params); err != nil {
+		return err
+	}
+	s.Params = params
+	return nil
+}
+
+// LoadPipelineConfig reads the PipelineConfig in the JSON file at path.
+func LoadPipelineConfig(path string) (*PipelineConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := ParsePipelineConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return pc, nil
+}
+
+// ParsePipelineConfig decodes and validates a PipelineConfig, see Validate.
+func ParsePipelineConfig(data []byte) (*PipelineConfig, error) {
+	pc := new(PipelineConfig)
+	if err := strictUnmarshal(data, pc); err != nil {
+		return nil, err
+	}
+	if pc.Sink.raw != nil {
+		if err := pc.Sink.decodeParams(); err != nil {
+			var es FieldErrors
+			es.addErr("sink", err)
+			return nil, es
+		}
+	}
+	if err := pc.Validate(); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// strictUnmarshal rejects unknown fields and reports decoding errors with
+// the field or position they occur at.
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *json.SyntaxError:
+		line, col := position(data, e.Offset)
+		return &FieldError{Msg: fmt.Sprintf("line %d column %d: %v", line, col, e)}
+	case *json.UnmarshalTypeError:
+		return &FieldError{Field: e.Field, Msg: fmt.Sprintf("expected %s, got %s", e.Type, e.Value)}
+	case *FieldError, FieldErrors:
+		// from a nested strictUnmarshal
+		return err
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		return &FieldError{Field: strings.Trim(msg[len("json: unknown field "):], `"`), Msg: "unknown field"}
+	}
+	return &FieldError{Msg: err.Error()}
+}
+
+func position(data []byte, offset int64) (line, col int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line = 1 + bytes.Count(data[:offset], []byte("\n"))
+	col = int(offset) - bytes.LastIndexByte(data[:offset], '\n') - 1
+	return line, col
+}
+
+// Validate returns the FieldErrors of pc.
+func (pc *PipelineConfig) Validate() error {
+	var es FieldErrors
+	src := pc.Source
+	switch {
+	case src.Sentinel != nil && src.Cluster != nil:
+		es.add("source", "sentinel and cluster are exclusive")
+	case src.Sentinel != nil:
+		if src.Sentinel.MasterName == "" {
+			es.add("source.sentinel.master_name", "required")
+		}
+		if len(src.Sentinel.Addrs) == 0 {
+			es.add("source.sentinel.addrs", "required")
+		}
+	case src.Cluster != nil:
+		if len(src.Cluster.Seeds) == 0 {
+			es.add("source.cluster.seeds", "required")
+		}
+		if src.ReplMaster {
+			es.add("source.repl_master", "not supported with cluster")
+		}
+	case src.Addr == "":
+		es.add("source.addr", "required")
+	}
+	for _, d := range []struct {
+		name string
+		d    Duration
+	}{
+		{"keep_alive", src.KeepAlive}, {"connect_timeout", src.ConnectTimeout},
+		{"read_timeout", src.ReadTimeout}, {"write_timeout", src.WriteTimeout},
+	} {
+		if d.d < 0 {
+			es.add("source."+d.name, "negative duration")
+		}
+	}
+
+	for i, f := range pc.Filters {
+		field := fmt.Sprintf("filters[%d]", i)
+		switch f.Type {
+		case "command", "key_prefix":
+			if len(f.DBs) > 0 {
+				es.add(field+".dbs", "only for db filters")
+			}
+		case "db":
+			if len(f.Include) > 0 || len(f.Exclude) > 0 {
+				es.add(field, "include and exclude are not for db filters, use dbs")
+			}
+			if len(f.DBs) == 0 {
+				es.add(field+".dbs", "required")
+			}
+		case "":
+			es.add(field+".type", "required")
+		default:
+			es.add(field+".type", "unknown filter type %q, one of command, key_prefix, db", f.Type)
+		}
+	}
+
+	if pc.Sink.Params == nil {
+		es.add("sink", "required")
+	} else {
+		es.addErr("sink", pc.Sink.Params.Validate())
+	}
+
+	if cp := pc.Checkpoint; cp != nil {
+		switch cp.Type {
+		case "file":
+			if cp.Path == "" {
+				es.add("checkpoint.path", "required")
+			}
+		case "":
+			es.add("checkpoint.type", "required")
+		default:
+			es.add("checkpoint.type", "unknown checkpoint type %q, one of file", cp.Type)
+		}
+		if cp.Interval < 0 {
+			es.add("checkpoint.interval", "negative duration")
+		}
+	}
+	if m := pc.Metrics; m != nil && m.Listen == "" {
+		es.add("metrics.listen", "required")
+	}
+	return es.err()
+}
+
+// dialOptions returns the options to dial the master.
+func (src SourceConfig) dialOptions() []DialOption {
+	var opts []DialOption
+	if src.Password != "" {
+		opts = append(opts, DialPassword(src.Password))
+	}
+	if src.TLS != nil {
+		opts = append(opts, DialUseTLS(true), DialTLSSkipVerify(src.TLS.SkipVerify))
+	}
+	if src.KeepAlive > 0 {
+		opts = append(opts, DialKeepAlive(time.Duration(src.KeepAlive)))
+	}
+	if src.ConnectTimeout > 0 {
+		opts = append(opts, DialConnectTimeout(time.Duration(src.ConnectTimeout)))
+	}
+	if src.ReadTimeout > 0 {
+		opts = append(opts, DialReadTimeout(time.Duration(src.ReadTimeout)))
+	}
+	if src.WriteTimeout > 0 {
+		opts = append(opts, DialWriteTimeout(time.Duration(src.WriteTimeout)))
+	}
+	return opts
+}
+
+func (f FilterConfig) filter() Filter {
+	switch f.Type {
+	case "command":
+		return CommandFilter(f.Include, f.Exclude)
+	case "key_prefix":
+		return KeyPrefixFilter(f.Include, f.Exclude)
+	}
+	return DBFilter(f.DBs...)
+}
+
+// redisSinkParams are the parameters of the "redis" sink, see NewRedisSink.
+type redisSinkParams struct {
+	Addr          string     `json:"addr"`
+	Password      string     `json:"password,omitempty"`
+	TLS           *TLSConfig `json:"tls,omitempty"`
+	Window        int        `json:"window,omitempty"`
+	FlushInterval Duration   `json:"flush_interval,omitempty"`
+}
+
+func (p *redisSinkParams) Validate() error {
+	var es FieldErrors
+	if p.Addr == "" {
+		es.add("addr", "required")
+	}
+	if p.Window < 0 {
+		es.add("window", "negative")
+	}
+	return es.err()
+}
+
+func (p *redisSinkParams) dialOptions() []DialOption {
+	return SourceConfig{Password: p.Password, TLS: p.TLS}.dialOptions()
+}
+
+func (p *redisSinkParams) Build() (CommandDecoder, error) {
+	opts := []RedisSinkOption{RedisSinkDialOptions(p.dialOptions()...)}
+	if p.Window > 0 {
+		opts = append(opts, RedisSinkWindow(p.Window))
+	}
+	if p.FlushInterval > 0 {
+		opts = append(opts, RedisSinkFlushInterval(time.Duration(p.FlushInterval)))
+	}
+	return NewRedisSink(p.Addr, opts...)
+}
+
+// clusterSinkParams are the parameters of the "cluster" sink, see NewClusterSink.
+type clusterSinkParams struct {
+	Seeds         []string   `json:"seeds"`
+	Password      string     `json:"password,omitempty"`
+	TLS           *TLSConfig `json:"tls,omitempty"`
+	Window        int        `json:"window,omitempty"`
+	FlushInterval Duration   `json:"flush_interval,omitempty"`
+}
+
+func (p *clusterSinkParams) Validate() error {
+	var es FieldErrors
+	if len(p.Seeds) == 0 {
+		es.add("seeds", "required")
+	}
+	if p.Window < 0 {
+		es.add("window", "negative")
+	}
+	return es.err()
+}
+
+func (p *clusterSinkParams) Build() (CommandDecoder, error) {
+	opts := []ClusterSinkOption{ClusterSinkDialOptions(SourceConfig{Password: p.Password, TLS: p.TLS}.dialOptions()...)}
+	if p.Window > 0 {
+		opts = append(opts, ClusterSinkWindow(p.Window))
+	}
+	if p.FlushInterval > 0 {
+		opts = append(opts, ClusterSinkFlushInterval(time.Duration(p.FlushInterval)))
+	}
+	return NewClusterSink(p.Seeds, opts...)
+}
+
+// fileSinkParams are the parameters of the "file" sink, see NewFileSink.
+type fileSinkParams struct {
+	Dir           string   `json:"dir"`
+	MaxSize       int64    `json:"max_size,omitempty"`
+	MaxAge        Duration `json:"max_age,omitempty"`
+	Fsync         string   `json:"fsync,omitempty"`
+	Compress      bool     `json:"compress,omitempty"`
+	IndexInterval int64    `json:"index_interval,omitempty"`
+}
+
+func (p *fileSinkParams) Validate() error {
+	var es FieldErrors
+	if p.Dir == "" {
+		es.add("dir", "required")
+	}
+	if p.MaxSize < 0 {
+		es.add("max_size", "negative")
+	}
+	if p.MaxAge < 0 {
+		es.add("max_age", "negative duration")
+	}
+	if p.Fsync != "" {
+		if _, err := ParseFsyncPolicy(p.Fsync); err != nil {
+			es.add("fsync", "%v", err)
+		}
+	}
+	if p.IndexInterval < 0 {
+		es.add("index_interval", "negative")
+	}
+	return es.err()
+}
+
+func (p *fileSinkParams) Build() (CommandDecoder, error) {
+	opts := []FileSinkOption{FileSinkCompress(p.Compress), FileSinkMaxAge(time.Duration(p.MaxAge))}
+	if p.MaxSize > 0 {
+		opts = append(opts, FileSinkMaxSize(p.MaxSize))
+	}
+	if p.IndexInterval > 0 {
+		opts = append(opts, FileSinkIndexInterval(p.IndexInterval))
+	}
+	if p.Fsync != "" {
+		policy, _ := ParseFsyncPolicy(p.Fsync)
+		opts = append(opts, FileSinkFsync(policy))
+	}
+	return NewFileSink(p.Dir, opts...)
+}
+
+// aofSinkParams are the parameters of the "aof" sink, see NewAOFSink.
+type aofSinkParams struct {
+	Dir       string `json:"dir"`
+	Filename  string `json:"filename,omitempty"`
+	MultiPart bool   `json:"multi_part,omitempty"`
+	Fsync     string `json:"fsync,omitempty"`
+}
+
+func (p *aofSinkParams) Validate() error {
+	var es FieldErrors
+	if p.Dir == "" {
+		es.add("dir", "required")
+	}
+	if strings.ContainsRune(p.Filename, filepath.Separator) {
+		es.add("filename", "must be a file name, not a path")
+	}
+	if p.Fsync != "" {
+		if _, err := ParseFsyncPolicy(p.Fsync); err != nil {
+			es.add("fsync", "%v", err)
+		}
+	}
+	return es.err()
+}
+
+func (p *aofSinkParams) Build() (CommandDecoder, error) {
+	opts := []AOFSinkOption{AOFSinkMultiPart(p.MultiPart)}
+	if p.Filename != "" {
+		opts = append(opts, AOFSinkFilename(p.Filename))
+	}
+	if p.Fsync != "" {
+		policy, _ := ParseFsyncPolicy(p.Fsync)
+		opts = append(opts, AOFSinkFsync(policy))
+	}
+	return NewAOFSink(p.Dir, opts...)
+}
+
+// streamSinkParams are the parameters of the "stream" sink, see
+// NewStreamSink. Routes maps key prefixes to streams.
+type streamSinkParams struct {
+	redisSinkParams
+	Stream string            `json:"stream"`
+	MaxLen int64             `json:"max_len,omitempty"`
+	DB     int               `json:"db,omitempty"`
+	Routes map[string]string `json:"routes,omitempty"`
+}
+
+func (p *streamSinkParams) Validate() error {
+	var es FieldErrors
+	es.addErr("", p.redisSinkParams.Validate())
+	if p.Stream == "" {
+		es.add("stream", "required")
+	}
+	if p.MaxLen < 0 {
+		es.add("max_len", "negative")
+	}
+	if p.DB < 0 {
+		es.add("db", "negative")
+	}
+	for prefix, stream := range p.Routes {
+		if stream == "" {
+			es.add("routes."+prefix, "empty stream name")
+		}
+	}
+	return es.err()
+}
+
+func (p *streamSinkParams) Build() (CommandDecoder, error) {
+	redisOpts := []RedisSinkOption{RedisSinkDialOptions(p.dialOptions()...)}
+	if p.Window > 0 {
+		redisOpts = append(redisOpts, RedisSinkWindow(p.Window))
+	}
+	if p.FlushInterval > 0 {
+		redisOpts = append(redisOpts, RedisSinkFlushInterval(time.Duration(p.FlushInterval)))
+	}
+	opts := []StreamSinkOption{StreamSinkRedisOptions(redisOpts...), StreamSinkMaxLen(p.MaxLen), StreamSinkDB(p.DB)}
+	for prefix, stream := range p.Routes {
+		opts = append(opts, StreamSinkRoute(prefix, stream))
+	}
+	return NewStreamSink(p.Addr, p.Stream, opts...)
+}
+
+// webhookSinkParams are the parameters of the "webhook" sink, see
+// NewWebhookSink.
+type webhookSinkParams struct {
+	URL           string            `json:"url"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	BatchSize     int               `json:"batch_size,omitempty"`
+	BatchInterval Duration          `json:"batch_interval,omitempty"`
+	MaxRetries    *int              `json:"max_retries,omitempty"`
+	DeadLetter    string            `json:"dead_letter,omitempty"`
+}
+
+func (p *webhookSinkParams) Validate() error {
+	var es FieldErrors
+	if p.URL == "" {
+		es.add("url", "required")
+	} else if u, err := url.Parse(p.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		es.add("url", "not an http or https URL: %q", p.URL)
+	}
+	if p.BatchSize < 0 {
+		es.add("batch_size", "negative")
+	}
+	if p.BatchInterval < 0 {
+		es.add("batch_interval", "negative duration")
+	}
+	if p.MaxRetries != nil && *p.MaxRetries < 0 {
+		es.add("max_retries", "negative")
+	}
+	return es.err()
+}
+
+func (p *webhookSinkParams) Build() (CommandDecoder, error) {
+	var opts []WebhookSinkOption
+	for k, v := range p.Headers {
+		opts = append(opts, WebhookSinkHeader(k, v))
+	}
+	if p.BatchSize > 0 || p.BatchInterval > 0 {
+		size, interval := p.BatchSize, time.Duration(p.BatchInterval)
+		if size == 0 {
+			size = 100
+		}
+		if interval == 0 {
+			interval = time.Second
+		}
+		opts = append(opts, WebhookSinkBatch(size, interval))
+	}
+	if p.MaxRetries != nil {
+		opts = append(opts, WebhookSinkRetry(*p.MaxRetries, 100*time.Millisecond, 10*time.Second))
+	}
+	if p.DeadLetter != "" {
+		opts = append(opts, WebhookSinkDeadLetter(p.DeadLetter))
+	}
+	return NewWebhookSink(p.URL, opts...)
+}
+
+// elasticsearchSinkParams are the parameters of the "elasticsearch" sink,
+// see NewElasticsearchSink. Indices maps key prefixes to indices.
+type elasticsearchSinkParams struct {
+	URL           string            `json:"url"`
+	Index         string            `json:"index"`
+	Indices       map[string]string `json:"indices,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	BatchSize     int               `json:"batch_size,omitempty"`
+	BatchInterval Duration          `json:"batch_interval,omitempty"`
+	MaxRetries    *int              `json:"max_retries,omitempty"`
+}
+
+func (p *elasticsearchSinkParams) Validate() error {
+	var es FieldErrors
+	if p.URL == "" {
+		es.add("url", "required")
+	} else if u, err := url.Parse(p.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		es.add("url", "not an http or https URL: %q", p.URL)
+	}
+	if p.Index == "" {
+		es.add("index", "required")
+	}
+	for prefix, index := range p.Indices {
+		if index == "" {
+			es.add("indices."+prefix, "empty index name")
+		}
+	}
+	if p.BatchSize < 0 {
+		es.add("batch_size", "negative")
+	}
+	if p.BatchInterval < 0 {
+		es.add("batch_interval", "negative duration")
+	}
+	if p.MaxRetries != nil && *p.MaxRetries < 0 {
+		es.add("max_retries", "negative")
+	}
+	return es.err()
+}
+
+func (p *elasticsearchSinkParams) Build() (CommandDecoder, error) {
+	var opts []ElasticsearchSinkOption
+	for prefix, index := range p.Indices {
+		opts = append(opts, ElasticsearchSinkIndex(prefix, index))
+	}
+	for k, v := range p.Headers {
+		opts = append(opts, ElasticsearchSinkHeader(k, v))
+	}
+	if p.BatchSize > 0 || p.BatchInterval > 0 {
+		size, interval := p.BatchSize, time.Duration(p.BatchInterval)
+		if size == 0 {
+			size = 500
+		}
+		if interval == 0 {
+			interval = time.Second
+		}
+		opts = append(opts, ElasticsearchSinkBatch(size, interval))
+	}
+	if p.MaxRetries != nil {
+		opts = append(opts, ElasticsearchSinkRetry(*p.MaxRetries, 100*time.Millisecond, 10*time.Second))
+	}
+	return NewElasticsearchSink(p.URL, p.Index, opts...), nil
+}
+
+// sqlSinkParams are the parameters of the "sql" sink, see NewSQLSink. The
+// driver must be registered with database/sql by the program.
+type sqlSinkParams struct {
+	Driver          string              `json:"driver"`
+	DSN             string              `json:"dsn"`
+	Dialect         string              `json:"dialect,omitempty"`
+	StringTable     *string             `json:"string_table,omitempty"`
+	HashTables      []sqlHashTableParam `json:"hash_tables,omitempty"`
+	CheckpointTable string              `json:"checkpoint_table,omitempty"`
+	Name            string              `json:"name,omitempty"`
+	BatchSize       int                 `json:"batch_size,omitempty"`
+	BatchInterval   Duration            `json:"batch_interval,omitempty"`
+	CreateTables    bool                `json:"create_tables,omitempty"`
+}
+
+type sqlHashTableParam struct {
+	Pattern string   `json:"pattern"`
+	Table   string   `json:"table"`
+	Columns []string `json:"columns,omitempty"`
+}
+
+func (p *sqlSinkParams) Validate() error {
+	var es FieldErrors
+	if p.Driver == "" {
+		es.add("driver", "required")
+	} else if !sqlDriverRegistered(p.Driver) {
+		es.add("driver", "driver %q not registered, one of %s", p.Driver, strings.Join(sql.Drivers(), ", "))
+	}
+	if p.DSN == "" {
+		es.add("dsn", "required")
+	}
+	if p.Dialect != "" {
+		if _, err := ParseSQLDialect(p.Dialect); err != nil {
+			es.add("dialect", "%v", err)
+		}
+	}
+	for i, h := range p.HashTables {
+		field := fmt.Sprintf("hash_tables[%d]", i)
+		if h.Pattern == "" {
+			es.add(field+".pattern", "required")
+		} else if _, err := path.Match(h.Pattern, ""); err != nil {
+			es.add(field+".pattern", "%v", err)
+		}
+		if h.Table == "" {
+			es.add(field+".table", "required")
+		}
+	}
+	if p.BatchSize < 0 {
+		es.add("batch_size", "negative")
+	}
+	if p.BatchInterval < 0 {
+		es.add("batch_interval", "negative duration")
+	}
+	return es.err()
+}
+
+func sqlDriverRegistered(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *sqlSinkParams) Build() (CommandDecoder, error) {
+	var opts []SQLSinkOption
+	if p.Dialect != "" {
+		d, _ := ParseSQLDialect(p.Dialect)
+		opts = append(opts, SQLSinkDialect(d))
+	}
+	if p.StringTable != nil {
+		opts = append(opts, SQLSinkStringTable(*p.StringTable))
+	}
+	for _, h := range p.HashTables {
+		opts = append(opts, SQLSinkHashTable(h.Pattern, h.Table, h.Columns...))
+	}
+	if p.CheckpointTable != "" || p.Name != "" {
+		table, name := p.CheckpointTable, p.Name
+		if table == "" {
+			table = "canal_checkpoints"
+		}
+		if name == "" {
+			name = "default"
+		}
+		opts = append(opts, SQLSinkCheckpoint(table, name))
+	}
+	if p.BatchSize > 0 || p.BatchInterval > 0 {
+		size, interval := p.BatchSize, time.Duration(p.BatchInterval)
+		if size == 0 {
+			size = 500
+		}
+		if interval == 0 {
+			interval = time.Second
+		}
+		opts = append(opts, SQLSinkBatch(size, interval))
+	}
+	opts = append(opts, SQLSinkCreateTables(p.CreateTables))
+	db, err := sql.Open(p.Driver, p.DSN)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSQLSink(db, opts...)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s.ownDB = true
+	return s, nil
+}
+
+// fanOutSinkParams are the parameters of the "fanout" sink, see NewFanOut.
+// Sinks are sink objects of any other type.
+type fanOutSinkParams struct {
+	Sinks       []SinkConfig `json:"sinks"`
+	QueueSize   int          `json:"queue_size,omitempty"`
+	SlowSink    string       `json:"slow_sink,omitempty"`
+	SlowTimeout Duration     `json:"slow_timeout,omitempty"`
+}
+
+func (p *fanOutSinkParams) UnmarshalJSON(b []byte) error {
+	type params fanOutSinkParams
+	if err := strictUnmarshal(b, (*params)(p)); err != nil {
+		return err
+	}
+	var es FieldErrors
+	for i := range p.Sinks {
+		es.addErr(fmt.Sprintf("sinks[%d]", i), p.Sinks[i].decodeParams())
+	}
+	return es.err()
+}
+
+func (p *fanOutSinkParams) Validate() error {
+	var es FieldErrors
+	if len(p.Sinks) == 0 {
+		es.add("sinks", "required")
+	}
+	for i, s := range p.Sinks {
+		field := fmt.Sprintf("sinks[%d]", i)
+		if s.Params == nil {
+			es.add(field, "required")
+		} else {
+			es.addErr(field, s.Params.Validate())
+		}
+	}
+	if p.QueueSize < 0 {
+		es.add("queue_size", "negative")
+	}
+	if p.SlowSink != "" {
+		if _, err := ParseSlowSinkPolicy(p.SlowSink); err != nil {
+			es.add("slow_sink", "%v", err)
+		}
+	}
+	if p.SlowTimeout < 0 {
+		es.add("slow_timeout", "negative duration")
+	}
+	return es.err()
+}
+
+func (p *fanOutSinkParams) Build() (CommandDecoder, error) {
+	var sinks []CommandDecoder
+	for i, s := range p.Sinks {
+		sink, err := s.Params.Build()
+		if err != nil {
+			for _, built := range sinks {
+				if closer, ok := built.(io.Closer); ok {
+					_ = closer.Close()
+				}
+			}
+			var es FieldErrors
+			es.addErr(fmt.Sprintf("sinks[%d]", i), err)
+			return nil, es
+		}
+		sinks = append(sinks, sink)
+	}
+	var opts []FanOutOption
+	if p.QueueSize > 0 {
+		opts = append(opts, FanOutQueueSize(p.QueueSize))
+	}
+	if p.SlowSink != "" {
+		policy, _ := ParseSlowSinkPolicy(p.SlowSink)
+		opts = append(opts, FanOutSlowSink(policy, time.Duration(p.SlowTimeout)))
+	}
+	return NewFanOut(sinks, opts...), nil
+}
+
+func init() {
+	RegisterSink("redis", func() SinkParams { return new(redisSinkParams) })
+	RegisterSink("cluster", func() SinkParams { return new(clusterSinkParams) })
+	RegisterSink("file", func() SinkParams { return new(fileSinkParams) })
+	RegisterSink("aof", func() SinkParams { return new(aofSinkParams) })
+	RegisterSink("elasticsearch", func() SinkParams { return new(elasticsearchSinkParams) })
+	RegisterSink("sql", func() SinkParams { return new(sqlSinkParams) })
+	RegisterSink("stream", func() SinkParams { return new(streamSinkParams) })
+	RegisterSink("webhook", func() SinkParams { return new(webhookSinkParams) })
+	RegisterSink("fanout", func() SinkParams { return new(fanOutSinkParams) })
+}
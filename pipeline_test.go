@@ -0,0 +1,262 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"database/sql/driver"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePipelineConfig(t *testing.T) {
+	pc, err := ParsePipelineConfig([]byte(`{
+		"source": {"addr": "127.0.0.1:6379", "read_timeout": "5s", "keep_alive": 1000},
+		"filters": [{"type": "command", "exclude": ["flushall"]}, {"type": "db", "dbs": [0]}],
+		"sink": {"type": "redis", "addr": "127.0.0.1:6380", "window": 64},
+		"checkpoint": {"type": "file", "path": "cp.json", "interval": "2s"}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Duration(5*time.Second), pc.Source.ReadTimeout)
+	assert.Equal(t, Duration(1000), pc.Source.KeepAlive)
+	assert.Len(t, pc.Filters, 2)
+	assert.Equal(t, &redisSinkParams{Addr: "127.0.0.1:6380", Window: 64}, pc.Sink.Params)
+	assert.Equal(t, Duration(2*time.Second), pc.Checkpoint.Interval)
+
+	for _, test := range []struct {
+		doc string
+		err string
+	}{
+		{`{"source": {"addr": "a"},` + "\n" + `"sink": {"type": "redis", "addr": "b"},}`,
+			"line 2 column 40: invalid character '}' looking for beginning of object key string"},
+		{`{"source": {"addr": "a", "port": 1}, "sink": {"type": "redis", "addr": "b"}}`,
+			"port: unknown field"},
+		{`{"source": {"addr": "a", "read_timeout": "soon"}, "sink": {"type": "redis", "addr": "b"}}`,
+			"invalid duration \"soon\""},
+		{`{"source": {"addr": "a"}, "sink": {"type": "redis", "addr": "b", "window": "x"}}`,
+			"sink.window: expected int, got string"},
+		{`{"source": {"addr": "a"}, "sink": {"type": "redis", "addr": "b", "db": 1}}`,
+			"sink.db: unknown field"},
+		{`{"source": {"addr": "a"}, "sink": {"type": "kafka"}}`,
+			`sink.type: unknown sink type "kafka", one of aof, cluster, elasticsearch, fanout, file, redis, sql, stream, webhook`},
+		{`{"source": {"addr": "a"}, "sink": {"type": "stream", "addr": "b", "max_len": -1}}`,
+			"sink.stream: required\nsink.max_len: negative"},
+		{`{"source": {"addr": "a"}, "sink": {"type": "webhook", "url": "ftp://b"}}`,
+			`sink.url: not an http or https URL: "ftp://b"`},
+		{`{"source": {"addr": "a"}, "sink": {"type": "elasticsearch", "url": "http://b", "indices": {"u:": ""}}}`,
+			"sink.index: required\nsink.indices.u:: empty index name"},
+		{`{"source": {"addr": "a"}, "sink": {"type": "sql", "driver": "nodriver", "dsn": "x", "hash_tables": [{"table": "t"}]}}`,
+			"sink.driver: driver \"nodriver\" not registered, one of canalfake\nsink.hash_tables[0].pattern: required"},
+		{`{"source": {"addr": "a"}, "sink": {"type": "fanout", "sinks": [{"type": "redis", "addr": "b"}, {"type": "kafka"}]}}`,
+			`sink.sinks[1].type: unknown sink type "kafka"`},
+		{`{"source": {"addr": "a"}, "sink": {"type": "fanout", "sinks": [{"type": "redis", "window": -1}], "slow_sink": "wait"}}`,
+			"sink.sinks[0].addr: required\nsink.sinks[0].window: negative\nsink.slow_sink: unknown slow sink policy \"wait\", one of block, drop, detach"},
+		{`{"source": {"addr": "a"}, "sink": {}}`,
+			"sink.type: required"},
+		{`{"source": {}, "filters": [{"type": "db"}, {"type": "regex"}], "sink": {"type": "redis"},
+		  "checkpoint": {"type": "file"}, "metrics": {}}`,
+			strings.Join([]string{
+				"source.addr: required",
+				"filters[0].dbs: required",
+				`filters[1].type: unknown filter type "regex", one of command, key_prefix, db`,
+				"sink.addr: required",
+				"checkpoint.path: required",
+				"metrics.listen: required",
+			}, "\n")},
+	} {
+		_, err := ParsePipelineConfig([]byte(test.doc))
+		if assert.NotNil(t, err, test.doc) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	source := newFakeRedis(t, func(d []string) Value {
+		switch strings.ToUpper(d[0]) {
+		case "INFO":
+			return StringValue("# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n")
+		case "PSYNC":
+			return SimpleStringValue("CONTINUE abc")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer source.close()
+	target := newFakeRedis(t, func(d []string) Value { return SimpleStringValue("OK") })
+	defer target.close()
+
+	dir, err := ioutil.TempDir("", "pipeline")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := FileCheckpointStore{Path: filepath.Join(dir, "cp.json")}
+	assert.Nil(t, store.Save(Checkpoints{Checkpoint: Checkpoint{ReplId: "abc", Offset: 10}}))
+
+	pc, err := ParsePipelineConfig([]byte(`{
+		"source": {"addr": "` + source.addr() + `"},
+		"sink": {"type": "redis", "addr": "` + target.addr() + `"},
+		"checkpoint": {"type": "file", "path": "` + store.Path + `"}
+	}`))
+	assert.Nil(t, err)
+	p, err := NewPipeline(pc, PipelineLogger(NopLogger{}))
+	assert.Nil(t, err)
+
+	errC := make(chan error, 1)
+	go func() { errC <- p.Run() }()
+	deadline := time.Now().Add(2 * time.Second)
+	for !containsCommand(source.commands(), "psync abc 11") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Contains(t, source.commands(), "psync abc 11")
+	p.Close()
+	assert.Nil(t, <-errC)
+
+	// nothing was applied, the loaded position is kept
+	cps, err := store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, Checkpoint{ReplId: "abc", Offset: 10}, cps.Checkpoint)
+}
+
+func containsCommand(cmds []string, cmd string) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPipelineSinkCheckpoints(t *testing.T) {
+	source := newFakeRedis(t, func(d []string) Value {
+		switch strings.ToUpper(d[0]) {
+		case "INFO":
+			return StringValue("# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n")
+		case "PSYNC":
+			return SimpleStringValue("CONTINUE abc")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer source.close()
+	f, db := newFakeSQL(t)
+	db.Close()
+	f.rows = [][]driver.Value{{"", "abc", int64(42), int64(0)}}
+
+	// the sql sink saves positions with the data, no checkpoint needed
+	pc, err := ParsePipelineConfig([]byte(`{
+		"source": {"addr": "` + source.addr() + `"},
+		"sink": {"type": "sql", "driver": "canalfake", "dsn": "` + t.Name() + `"}
+	}`))
+	assert.Nil(t, err)
+	p, err := NewPipeline(pc, PipelineLogger(NopLogger{}))
+	assert.Nil(t, err)
+
+	errC := make(chan error, 1)
+	go func() { errC <- p.Run() }()
+	deadline := time.Now().Add(2 * time.Second)
+	for !containsCommand(source.commands(), "psync abc 43") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Contains(t, source.commands(), "psync abc 43")
+	p.Close()
+	assert.Nil(t, <-errC)
+}
+
+// flushSink applies the commands it receives on Flush, none while held.
+type flushSink struct {
+	last, applied int64
+	held          bool
+}
+
+func (s *flushSink) Command(cmd *Command) error {
+	if cmd.Phase == PhaseRDB {
+		s.applied = -1
+	}
+	s.last = cmd.Offset
+	return nil
+}
+
+func (s *flushSink) Flush() error {
+	if !s.held {
+		s.applied = s.last
+	}
+	return nil
+}
+
+func (s *flushSink) Applied() int64 { return s.applied }
+
+func TestPipelineShardPositions(t *testing.T) {
+	sink := &flushSink{applied: -1}
+	loaded := map[string]Checkpoint{"a": {ReplId: "ra", Offset: 5}, "gone": {ReplId: "rg", Offset: 7}}
+	shards := newShardPositions(NewFilterChain(sink, DBFilter(0)), sink, loaded)
+	command := func(shard, replId string, offset int64, phase Phase, args ...string) {
+		cmd, _ := NewCommand(args...)
+		cmd.Shard, cmd.ReplId, cmd.Offset, cmd.Phase = shard, replId, offset, phase
+		assert.Nil(t, shards.Command(cmd))
+	}
+
+	command("a", "ra", 10, PhaseStreaming, "SET", "k", "v")
+	command("b", "rb", 500, PhaseStreaming, "SET", "k", "v")
+	sink.held = true
+	assert.Equal(t, loaded, shards.checkpoints())
+
+	// filtered commands count as handled and the database selected is
+	// kept, a shard in a snapshot stays put, b has no position yet
+	sink.held = false
+	command("a", "ra", 20, PhaseStreaming, "SELECT", "1")
+	command("b", "rb2", 0, PhaseRDB, "PING")
+	command("b", "rb2", 0, PhaseRDB, "SET", "k", "v")
+	command("a", "ra", 30, PhaseStreaming, "SET", "k", "v")
+	assert.Equal(t, map[string]Checkpoint{
+		"a":    {ReplId: "ra", Offset: 30, DB: 1},
+		"gone": {ReplId: "rg", Offset: 7},
+	}, shards.checkpoints())
+
+	command("b", "rb2", 600, PhaseStreaming, "SET", "k", "v")
+	assert.Equal(t, Checkpoint{ReplId: "rb2", Offset: 600}, shards.checkpoints()["b"])
+
+	assert.Nil(t, newShardPositions(sink, &recordSink{}, nil))
+}
+
+func TestPipelineSelectPositions(t *testing.T) {
+	sink := &flushSink{applied: -1}
+	selects := newSelectPositions(sink, sink)
+	command := func(offset int64, phase Phase, args ...string) {
+		cmd, _ := NewCommand(args...)
+		cmd.Offset, cmd.Phase = offset, phase
+		assert.Nil(t, selects.Command(cmd))
+	}
+
+	// the database is that selected at the offset applied, not the last
+	command(10, PhaseStreaming, "SELECT", "1")
+	command(20, PhaseStreaming, "SET", "k", "v")
+	command(30, PhaseStreaming, "SELECT", "2")
+	assert.Equal(t, 0, selects.dbAt(5))
+	assert.Equal(t, 1, selects.dbAt(20))
+	assert.Equal(t, 2, selects.dbAt(30))
+
+	// a snapshot starts over, its own selects are not the stream's
+	command(0, PhaseRDB, "PING")
+	command(0, PhaseRDB, "SELECT", "3")
+	command(5, PhaseStreaming, "SET", "k", "v")
+	assert.Equal(t, 0, selects.dbAt(5))
+
+	assert.Nil(t, newSelectPositions(sink, &recordSink{}))
+}
@@ -21,6 +21,34 @@ func decodeStream(r io.Reader, d Decoder) (*reader, error) {
 	return decoder.decode(false)
 }
 
+// DecodeRDB decodes the RDB file read from r into d.
+func DecodeRDB(r io.Reader, d Decoder) error {
+	decoder := &rdbDecode{
+		d,
+		make([]byte, 8),
+		bufio.NewReader(r),
+	}
+	_, err := decoder.decode(true)
+	return err
+}
+
+// DecodeRDBCommands decodes the RDB file read from r into the commands
+// rebuilding its dataset, as a Canal does for the snapshot of a full sync.
+func DecodeRDBCommands(r io.Reader, cmder CommandDecoder) (err error) {
+	c := &Canal{cfg: &Config{}, cmder: cmder}
+	c.setPhase(PhaseRDB)
+	defer func() {
+		// the Decoder callbacks of Canal panic on a decoder error
+		if r := recover(); r != nil {
+			if c.cmdErr == nil {
+				panic(r)
+			}
+			err = c.cmdErr
+		}
+	}()
+	return DecodeRDB(r, c)
+}
+
 type rdbDecode struct {
 	event  Decoder
 	intBuf []byte
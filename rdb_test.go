@@ -0,0 +1,40 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingCommander struct{ err error }
+
+func (d failingCommander) Command(cmd *Command) error { return d.err }
+
+func TestDecodeRDBCommands(t *testing.T) {
+	rdb := "REDIS0009" + "\xfe\x00" + "\x00\x01k\x01v" + "\xff" + strings.Repeat("\x00", 8)
+	d := &nopCommander{}
+	assert.Nil(t, DecodeRDBCommands(strings.NewReader(rdb), d))
+	assert.Equal(t, 2, len(d.cmds))
+	assert.Equal(t, []string{"SET", "k", "v"}, d.cmds[1].D)
+
+	err := errors.New("downstream")
+	assert.Equal(t, err, DecodeRDBCommands(strings.NewReader(rdb), failingCommander{err}))
+}
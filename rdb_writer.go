@@ -0,0 +1,342 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// RDBWriterOption specifies an option for an RDBWriter.
+type RDBWriterOption struct {
+	f func(*RDBWriter)
+}
+
+// RDBWriterVersion specifies the RDB version written, from 1 to 9. Older
+// versions let older servers load the file: version 8 and later save sorted
+// set scores as binary doubles, 7 and later keep the AUX and RESIZEDB
+// fields, 5 and later end with a checksum. Default is 9.
+func RDBWriterVersion(v int) RDBWriterOption {
+	return RDBWriterOption{func(w *RDBWriter) {
+		w.version = v
+	}}
+}
+
+// RDBWriterCompress specifies whether strings longer than 20 bytes are LZF
+// compressed, as rdbcompression of Redis. Default is true.
+func RDBWriterCompress(compress bool) RDBWriterOption {
+	return RDBWriterOption{func(w *RDBWriter) {
+		w.compress = compress
+	}}
+}
+
+// RDBWriter is a Decoder writing the keys it is given as an RDB file, so
+// that decoding an RDB into it copies, downgrades or, through a filtering
+// Decoder, filters it. The Decoder methods do not return errors: the first
+// one is reported by Err. Stream keys are skipped, the Decoder callbacks do
+// not carry enough of them to write them back, see Skipped.
+type RDBWriter struct {
+	w        *bufio.Writer
+	crc      uint64
+	version  int
+	compress bool
+	err      error
+	skipped  int
+
+	// the collection being written, values are written on End
+	key    []byte
+	expiry int64
+	items  [][]byte
+	scores []float64
+	buf    []byte
+}
+
+// NewRDBWriter returns an RDBWriter writing to w.
+func NewRDBWriter(w io.Writer, opts ...RDBWriterOption) *RDBWriter {
+	rw := &RDBWriter{version: rdbVersion, compress: true}
+	for _, opt := range opts {
+		opt.f(rw)
+	}
+	rw.w = bufio.NewWriter(w)
+	if rw.version < 1 || rw.version > rdbVersion {
+		rw.err = fmt.Errorf("rdb: unsupported RDB version %d", rw.version)
+	}
+	return rw
+}
+
+// Err returns the first error writing the RDB.
+func (w *RDBWriter) Err() error { return w.err }
+
+// Skipped returns the number of keys that were not written.
+func (w *RDBWriter) Skipped() int { return w.skipped }
+
+func (w *RDBWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	if w.version >= 5 {
+		w.crc = crc64(w.crc, b)
+	}
+	_, w.err = w.w.Write(b)
+}
+
+func (w *RDBWriter) writeByte(b byte) { w.write([]byte{b}) }
+
+func (w *RDBWriter) writeLength(n uint64) {
+	var b [9]byte
+	switch {
+	case n < 1<<6:
+		w.writeByte(byte(n))
+	case n < 1<<14:
+		w.write([]byte{byte(n>>8) | rdb14bitLen<<6, byte(n)})
+	case n <= math.MaxUint32:
+		b[0] = rdb32bitLen
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		w.write(b[:5])
+	default:
+		b[0] = rdb64bitLen
+		binary.BigEndian.PutUint64(b[1:], n)
+		w.write(b[:9])
+	}
+}
+
+// writeString writes s as an integer if it reads back the same, LZF
+// compressed if that saves space, as is otherwise.
+func (w *RDBWriter) writeString(s []byte) {
+	if len(s) <= 11 {
+		if i, err := strconv.ParseInt(string(s), 10, 32); err == nil && strconv.FormatInt(i, 10) == string(s) {
+			switch {
+			case i >= math.MinInt8 && i <= math.MaxInt8:
+				w.write([]byte{rdbEncVal<<6 | rdbEncInt8, byte(i)})
+			case i >= math.MinInt16 && i <= math.MaxInt16:
+				w.write([]byte{rdbEncVal<<6 | rdbEncInt16, byte(i), byte(i >> 8)})
+			default:
+				w.write([]byte{rdbEncVal<<6 | rdbEncInt32, byte(i), byte(i >> 8), byte(i >> 16), byte(i >> 24)})
+			}
+			return
+		}
+	}
+	if w.compress && len(s) > 20 {
+		if c := lzfCompress(s); c != nil && len(c) < len(s)-4 {
+			w.writeByte(rdbEncVal<<6 | rdbEncLZF)
+			w.writeLength(uint64(len(c)))
+			w.writeLength(uint64(len(s)))
+			w.write(c)
+			return
+		}
+	}
+	w.writeLength(uint64(len(s)))
+	w.write(s)
+}
+
+func (w *RDBWriter) writeKey(typ ValueType, key []byte, expiry int64) {
+	if expiry > 0 {
+		if w.version >= 3 {
+			w.writeByte(rdbOpCodeExpiryMS)
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], uint64(expiry))
+			w.write(b[:])
+		} else {
+			w.writeByte(rdbOpCodeExpiry)
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], uint32(expiry/1000))
+			w.write(b[:])
+		}
+	}
+	w.writeByte(byte(typ))
+	w.writeString(key)
+}
+
+func (w *RDBWriter) begin(key []byte, expiry int64) {
+	w.key, w.expiry = append(w.key[:0], key...), expiry
+	w.items, w.scores = w.items[:0], w.scores[:0]
+}
+
+func (w *RDBWriter) add(items ...[]byte) {
+	for _, item := range items {
+		w.items = append(w.items, append([]byte(nil), item...))
+	}
+}
+
+func (w *RDBWriter) BeginRDB() {
+	w.write([]byte(fmt.Sprintf("REDIS%04d", w.version)))
+}
+
+func (w *RDBWriter) Aux(key, value []byte) {
+	if w.version >= 7 {
+		w.writeByte(rdbOpCodeAux)
+		w.writeString(key)
+		w.writeString(value)
+	}
+}
+
+func (w *RDBWriter) BeginDatabase(n int) {
+	w.writeByte(rdbOpCodeSelectDB)
+	w.writeLength(uint64(n))
+}
+
+func (w *RDBWriter) ResizeDatabase(dbSize, expiresSize uint32) {
+	if w.version >= 7 {
+		w.writeByte(rdbOpCodeResizeDB)
+		w.writeLength(uint64(dbSize))
+		w.writeLength(uint64(expiresSize))
+	}
+}
+
+func (w *RDBWriter) EndDatabase(n int) {}
+
+// EndRDB writes the end of the file and flushes it.
+func (w *RDBWriter) EndRDB() {
+	w.writeByte(rdbOpCodeEOF)
+	if w.version >= 5 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], w.crc)
+		w.write(b[:])
+	}
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+}
+
+func (w *RDBWriter) Set(key, value []byte, expiry int64) {
+	w.writeKey(TypeString, key, expiry)
+	w.writeString(value)
+}
+
+func (w *RDBWriter) BeginHash(key []byte, length, expiry int64) { w.begin(key, expiry) }
+func (w *RDBWriter) Hset(key, field, value []byte)              { w.add(field, value) }
+
+func (w *RDBWriter) EndHash(key []byte) {
+	w.writeKey(TypeHash, w.key, w.expiry)
+	w.writeLength(uint64(len(w.items) / 2))
+	for _, item := range w.items {
+		w.writeString(item)
+	}
+}
+
+func (w *RDBWriter) BeginSet(key []byte, cardinality, expiry int64) { w.begin(key, expiry) }
+func (w *RDBWriter) Sadd(key, member []byte)                        { w.add(member) }
+func (w *RDBWriter) EndSet(key []byte)                              { w.writeItems(TypeSet) }
+
+func (w *RDBWriter) BeginList(key []byte, length, expiry int64) { w.begin(key, expiry) }
+func (w *RDBWriter) Rpush(key, value []byte)                    { w.add(value) }
+func (w *RDBWriter) EndList(key []byte)                         { w.writeItems(TypeList) }
+
+func (w *RDBWriter) writeItems(typ ValueType) {
+	w.writeKey(typ, w.key, w.expiry)
+	w.writeLength(uint64(len(w.items)))
+	for _, item := range w.items {
+		w.writeString(item)
+	}
+}
+
+func (w *RDBWriter) BeginZSet(key []byte, cardinality, expiry int64) { w.begin(key, expiry) }
+
+func (w *RDBWriter) Zadd(key []byte, score float64, member []byte) {
+	w.add(member)
+	w.scores = append(w.scores, score)
+}
+
+func (w *RDBWriter) EndZSet(key []byte) {
+	typ := TypeZSet
+	if w.version >= 8 {
+		typ = TypeZSet2
+	}
+	w.writeKey(typ, w.key, w.expiry)
+	w.writeLength(uint64(len(w.items)))
+	for i, member := range w.items {
+		w.writeString(member)
+		if typ == TypeZSet2 {
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(w.scores[i]))
+			w.write(b[:])
+			continue
+		}
+		// a length byte, with special values for NaN and infinities
+		switch score := w.scores[i]; {
+		case math.IsNaN(score):
+			w.writeByte(253)
+		case math.IsInf(score, 1):
+			w.writeByte(254)
+		case math.IsInf(score, -1):
+			w.writeByte(255)
+		default:
+			s := strconv.FormatFloat(score, 'g', 17, 64)
+			w.writeByte(byte(len(s)))
+			w.write([]byte(s))
+		}
+	}
+}
+
+func (w *RDBWriter) BeginStream(key []byte, cardinality, expiry int64) { w.skipped++ }
+func (w *RDBWriter) Xadd(key, streamID, listpack []byte)               {}
+func (w *RDBWriter) EndStream(key []byte)                              {}
+
+// lzfCompress compresses in to the LZF format read by lzfDecompress: runs
+// of up to 32 literals after a control byte below 32, and back references
+// of 3 to 264 bytes within the previous 8KB.
+func lzfCompress(in []byte) []byte {
+	const (
+		hashLog = 14
+		maxOff  = 1 << 13
+		maxLen  = 264
+		maxLit  = 32
+	)
+	var htab [1 << hashLog]int32 // positions + 1
+	out := make([]byte, 0, len(in))
+	lit := 0 // start of the pending literals
+	flushLiterals := func(end int) {
+		for lit < end {
+			n := end - lit
+			if n > maxLit {
+				n = maxLit
+			}
+			out = append(out, byte(n-1))
+			out = append(out, in[lit:lit+n]...)
+			lit += n
+		}
+	}
+	for ip := 0; ip+2 < len(in); {
+		h := (uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])) * 2654435761 >> (32 - hashLog)
+		ref := int(htab[h]) - 1
+		htab[h] = int32(ip + 1)
+		if ref < 0 || ip-ref-1 >= maxOff || in[ref] != in[ip] || in[ref+1] != in[ip+1] || in[ref+2] != in[ip+2] {
+			ip++
+			continue
+		}
+		n := 3
+		for ip+n < len(in) && n < maxLen && in[ref+n] == in[ip+n] {
+			n++
+		}
+		flushLiterals(ip)
+		l, off := n-2, ip-ref-1
+		if l < 7 {
+			out = append(out, byte(l<<5|off>>8))
+		} else {
+			out = append(out, byte(7<<5|off>>8), byte(l-7))
+		}
+		out = append(out, byte(off))
+		ip += n
+		lit = ip
+	}
+	flushLiterals(len(in))
+	return out
+}
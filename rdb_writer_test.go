@@ -0,0 +1,133 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rdbRecorder records the calls of a Decoder.
+type rdbRecorder struct {
+	Nop
+	calls []string
+}
+
+func (r *rdbRecorder) rec(format string, args ...interface{}) {
+	r.calls = append(r.calls, fmt.Sprintf(format, args...))
+}
+
+func (r *rdbRecorder) Aux(key, value []byte)                { r.rec("aux %s %s", key, value) }
+func (r *rdbRecorder) BeginDatabase(n int)                  { r.rec("db %d", n) }
+func (r *rdbRecorder) Set(key, value []byte, exp int64)     { r.rec("set %s %s %d", key, value, exp) }
+func (r *rdbRecorder) BeginHash(key []byte, n, e int64)     { r.rec("hash %s %d", key, e) }
+func (r *rdbRecorder) Hset(key, field, value []byte)        { r.rec("hset %s %s", field, value) }
+func (r *rdbRecorder) BeginSet(key []byte, n, e int64)      { r.rec("set %s %d", key, n) }
+func (r *rdbRecorder) Sadd(key, member []byte)              { r.rec("sadd %s", member) }
+func (r *rdbRecorder) BeginList(key []byte, n, e int64)     { r.rec("list %s", key) }
+func (r *rdbRecorder) Rpush(key, value []byte)              { r.rec("rpush %s", value) }
+func (r *rdbRecorder) BeginZSet(key []byte, n, e int64)     { r.rec("zset %s %d", key, n) }
+func (r *rdbRecorder) Zadd(key []byte, s float64, m []byte) { r.rec("zadd %v %s", s, m) }
+
+func writeRDB(w *RDBWriter, long string) {
+	w.BeginRDB()
+	w.Aux([]byte("redis-ver"), []byte("6.2.0"))
+	w.BeginDatabase(0)
+	w.ResizeDatabase(4, 1)
+	w.Set([]byte("int"), []byte("-70000"), 0)
+	w.Set([]byte("long"), []byte(long), 1700000000000)
+	w.BeginHash([]byte("h"), 2, 0)
+	w.Hset([]byte("h"), []byte("f"), []byte("1"))
+	w.Hset([]byte("h"), []byte("g"), []byte("0042"))
+	w.EndHash([]byte("h"))
+	w.BeginStream([]byte("s"), 1, 0)
+	w.Xadd([]byte("s"), []byte("1-1"), []byte("a b"))
+	w.EndStream([]byte("s"))
+	w.EndDatabase(0)
+	w.BeginDatabase(3)
+	w.BeginList([]byte("l"), -1, 0)
+	w.Rpush([]byte("l"), []byte("x"))
+	w.Rpush([]byte("l"), []byte("y"))
+	w.EndList([]byte("l"))
+	w.BeginSet([]byte("st"), 1, 0)
+	w.Sadd([]byte("st"), []byte("m"))
+	w.EndSet([]byte("st"))
+	w.BeginZSet([]byte("z"), 3, 0)
+	w.Zadd([]byte("z"), 1.5, []byte("a"))
+	w.Zadd([]byte("z"), math.Inf(-1), []byte("b"))
+	w.Zadd([]byte("z"), 0.1, []byte("c"))
+	w.EndZSet([]byte("z"))
+	w.EndDatabase(3)
+	w.EndRDB()
+}
+
+func TestRDBWriter(t *testing.T) {
+	long := strings.Repeat("canal replicates redis ", 50)
+	for _, version := range []int{9, 7, 6} {
+		var buf bytes.Buffer
+		w := NewRDBWriter(&buf, RDBWriterVersion(version))
+		writeRDB(w, long)
+		assert.Nil(t, w.Err())
+		assert.Equal(t, 1, w.Skipped())
+		b := buf.Bytes()
+		assert.Equal(t, fmt.Sprintf("REDIS%04d", version), string(b[:9]))
+		assert.True(t, len(b) < len(long), "long string is compressed")
+		assert.Equal(t, Digest(b[:len(b)-8]), binary.LittleEndian.Uint64(b[len(b)-8:]))
+
+		r := &rdbRecorder{}
+		assert.Nil(t, DecodeRDB(bytes.NewReader(b), r))
+		want := []string{
+			"db 0",
+			"set int -70000 0",
+			"set long " + long + " 1700000000000",
+			"hash h 0", "hset f 1", "hset g 0042",
+			"db 3",
+			"list l", "rpush x", "rpush y",
+			"set st 1", "sadd m",
+			"zset z 3", "zadd 1.5 a", "zadd -Inf b", "zadd 0.1 c",
+		}
+		if version >= 7 {
+			want = append([]string{"aux redis-ver 6.2.0"}, want...)
+		}
+		assert.Equal(t, want, r.calls, version)
+	}
+
+	w := NewRDBWriter(&bytes.Buffer{}, RDBWriterVersion(10))
+	assert.NotNil(t, w.Err())
+}
+
+func TestLZF(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 5000)
+	rnd.Read(random)
+	for _, in := range [][]byte{
+		[]byte(strings.Repeat("a", 1000)),
+		[]byte(strings.Repeat("abcdefgh", 300) + "tail"),
+		random,
+		append([]byte(strings.Repeat("xyz", 3000)), random[:100]...),
+	} {
+		c := lzfCompress(in)
+		assert.Equal(t, in, lzfDecompress(c, len(in)))
+	}
+}
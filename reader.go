@@ -19,18 +19,18 @@ package canal
 import (
 	"bufio"
 	"io"
-	"log"
 	"strconv"
 )
 
 // reader is a specialized RESP Value type reader.
 type reader struct {
 	*bufio.Reader
+	logger Logger
 }
 
 // newReader returns a Reader for reading Value types.
 func newReader(rd io.Reader) *reader {
-	return &reader{bufio.NewReader(rd)}
+	return &reader{bufio.NewReader(rd), defaultLogger}
 }
 
 // readBulk reads the next Value from Reader.
@@ -68,7 +68,7 @@ func (rd *reader) readValue(multibulk, child bool) (val Value, n int, err error)
 	case '0':
 		return Value{Null: true, Size: 1}, n, nil
 	default:
-		log.Printf("opcode error %s", val)
+		rd.logger.Warn("opcode error", "opcode", strconv.Quote(string(c)))
 		return Value{}, n, nil
 	}
 	n += rn
@@ -0,0 +1,380 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSinkClosed = errors.New("sink is closed")
+
+// RedisSinkOption specifies an option for a RedisSink.
+type RedisSinkOption struct {
+	f func(*redisSinkOptions)
+}
+
+type redisSinkOptions struct {
+	dialOpts      []DialOption
+	window        int
+	flushInterval time.Duration
+	maxRetries    int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	onApplied     func(offset int64)
+}
+
+// RedisSinkDialOptions specifies the options used to dial the target server.
+func RedisSinkDialOptions(opts ...DialOption) RedisSinkOption {
+	return RedisSinkOption{func(o *redisSinkOptions) {
+		o.dialOpts = opts
+	}}
+}
+
+// RedisSinkWindow specifies how many commands may be in flight before
+// the sink waits for their replies. Default is 128.
+func RedisSinkWindow(n int) RedisSinkOption {
+	return RedisSinkOption{func(o *redisSinkOptions) {
+		o.window = n
+	}}
+}
+
+// RedisSinkFlushInterval specifies how long a partially filled window
+// may wait before it is flushed. Default is 100ms.
+func RedisSinkFlushInterval(d time.Duration) RedisSinkOption {
+	return RedisSinkOption{func(o *redisSinkOptions) {
+		o.flushInterval = d
+	}}
+}
+
+// RedisSinkRetry specifies how many times a window is replayed after a
+// transient error, waiting from min to max, doubling each time. Default is
+// 3 retries from 1s to 10s.
+func RedisSinkRetry(maxRetries int, min, max time.Duration) RedisSinkOption {
+	return RedisSinkOption{func(o *redisSinkOptions) {
+		o.maxRetries = maxRetries
+		o.minBackoff = min
+		o.maxBackoff = max
+	}}
+}
+
+// RedisSinkOnApplied registers a callback receiving the replication offset
+// of the last command acknowledged by the target, for checkpointing.
+func RedisSinkOnApplied(fn func(offset int64)) RedisSinkOption {
+	return RedisSinkOption{func(o *redisSinkOptions) {
+		o.onApplied = fn
+	}}
+}
+
+// RedisSink is a CommandDecoder replaying the replication stream into
+// another Redis server.
+// Commands are pipelined; a replayed window may apply a command twice,
+// so non idempotent commands can drift after a transient error.
+type RedisSink struct {
+	addr string
+	opts redisSinkOptions
+
+	sinkCore
+	conn    net.Conn
+	wr      *writer
+	rd      *reader
+	db      int // database selected by the source stream
+	connDB  int // database selected on the target connection
+	pending []pendingCommand
+	multi   []pendingCommand // acknowledged commands of an open MULTI
+
+	applied int64
+}
+
+// NewRedisSink connects to the target server at addr.
+func NewRedisSink(addr string, opts ...RedisSinkOption) (*RedisSink, error) {
+	s := &RedisSink{
+		addr: addr,
+		opts: redisSinkOptions{
+			window:        128,
+			flushInterval: 100 * time.Millisecond,
+			maxRetries:    3,
+			minBackoff:    time.Second,
+			maxBackoff:    10 * time.Second,
+		},
+		applied: -1,
+	}
+	for _, opt := range opts {
+		opt.f(&s.opts)
+	}
+	if s.opts.window < 1 {
+		s.opts.window = 1
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	s.startFlusher(s.opts.flushInterval, s.sync)
+	return s, nil
+}
+
+// Applied returns the offset of the last command acknowledged by the target.
+func (s *RedisSink) Applied() int64 { return atomic.LoadInt64(&s.applied) }
+
+// Command implements CommandDecoder.
+func (s *RedisSink) Command(cmd *Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	switch cmd.Name() {
+	case "":
+		return nil
+	case "PING", "REPLCONF":
+		// replication heartbeats, meaningless for the target; with
+		// nothing pending everything before them is acknowledged
+		if cmd.Phase == PhaseRDB {
+			// the start of a snapshot, possibly an empty one
+			if err := s.fail(s.sync()); err != nil {
+				return err
+			}
+			atomic.StoreInt64(&s.applied, -1)
+		} else if len(s.pending) == 0 && len(s.multi) == 0 && cmd.Offset > 0 {
+			atomic.StoreInt64(&s.applied, cmd.Offset)
+		}
+		return nil
+	case "SELECT":
+		if len(cmd.D) != 2 {
+			return fmt.Errorf("invalid command %q", cmd.String())
+		}
+		db, err := strconv.Atoi(cmd.D[1])
+		if err != nil {
+			return fmt.Errorf("invalid command %q", cmd.String())
+		}
+		s.db = db
+		return nil
+	}
+
+	if err := s.send(pendingCommand{cmd, s.db}); err != nil {
+		return s.fail(err)
+	}
+	if len(s.pending) >= s.opts.window {
+		return s.fail(s.sync())
+	}
+	return nil
+}
+
+// Flush sends the buffered commands and waits for their replies.
+func (s *RedisSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.fail(s.sync())
+}
+
+// Close flushes the pending commands and closes the target connection.
+func (s *RedisSink) Close() error {
+	s.stopFlusher()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var err error
+	if s.err == nil {
+		err = s.sync()
+	}
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *RedisSink) connect() error {
+	conn, err := dial("tcp", s.addr, s.opts.dialOpts...)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.wr = newWriter(conn)
+	s.rd = newReader(conn)
+	s.connDB = 0
+	return nil
+}
+
+type pendingCommand struct {
+	cmd *Command
+	db  int
+}
+
+// send writes p to the pipeline, selecting its database first if needed.
+func (s *RedisSink) send(p pendingCommand) error {
+	if s.connDB != p.db {
+		sel, _ := NewCommand("SELECT", strconv.Itoa(p.db))
+		s.pending = append(s.pending, pendingCommand{sel, p.db})
+		if err := s.wr.writeValue(MultiBulkValue(sel.D[0], sel.Args()...)); err != nil {
+			return err
+		}
+		s.connDB = p.db
+	}
+	s.pending = append(s.pending, p)
+	return s.wr.writeValue(MultiBulkValue(p.cmd.D[0], p.cmd.Args()...))
+}
+
+// sync flushes the pipeline and checks one reply per pending command,
+// replaying the unacknowledged tail on transient errors. The backoff is cut
+// short by Close.
+func (s *RedisSink) sync() error {
+	var err error
+	b := newBackoff(s.opts.minBackoff, s.opts.maxBackoff)
+	for attempt := 0; ; attempt++ {
+		if err = s.drain(); err == nil || !isTransient(err) || attempt >= s.opts.maxRetries {
+			return err
+		}
+		if !b.wait(s.stop) {
+			return err
+		}
+		if err = s.replay(); err != nil && !isTransient(err) {
+			return err
+		}
+	}
+}
+
+func (s *RedisSink) drain() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	if err := s.wr.Flush(); err != nil {
+		return transient(err)
+	}
+	var err error
+	n := 0
+	for ; n < len(s.pending); n++ {
+		var val Value
+		val, _, err = s.rd.readBulk()
+		if err != nil {
+			err = transient(err)
+			break
+		}
+		if rerr := replyError(val); rerr != nil {
+			err = fmt.Errorf("%q: %v", s.pending[n].cmd.String(), rerr)
+			if isTransientReply(rerr) {
+				err = &transientError{err}
+			}
+			break
+		}
+		// the commands of a transaction are only applied by its EXEC,
+		// a replay sends them again from the MULTI
+		switch p := s.pending[n]; p.cmd.Name() {
+		case "MULTI":
+			s.multi = append(s.multi[:0], p)
+			continue
+		case "EXEC", "DISCARD":
+			s.multi = s.multi[:0]
+		default:
+			if len(s.multi) > 0 {
+				s.multi = append(s.multi, p)
+				continue
+			}
+		}
+		// the snapshot commands all carry the offset of the full sync,
+		// which is only reached once the whole snapshot is applied: there
+		// is no position to resume from until then
+		switch cmd := s.pending[n].cmd; {
+		case cmd.Phase == PhaseRDB:
+			atomic.StoreInt64(&s.applied, -1)
+		case cmd.Offset > 0:
+			atomic.StoreInt64(&s.applied, cmd.Offset)
+		}
+	}
+	if n > 0 && s.opts.onApplied != nil && s.Applied() >= 0 {
+		s.opts.onApplied(s.Applied())
+	}
+	s.pending = s.pending[n:]
+	return err
+}
+
+// replay dials a fresh connection and resends the unacknowledged commands,
+// from the MULTI of an open transaction. Those not sent yet are kept for
+// the next replay.
+func (s *RedisSink) replay() error {
+	_ = s.conn.Close()
+	if err := s.connect(); err != nil {
+		return transient(err)
+	}
+	pending := append(append([]pendingCommand(nil), s.multi...), s.pending...)
+	s.multi, s.pending = s.multi[:0], nil
+	for i, p := range pending {
+		if p.cmd.Name() == "SELECT" {
+			continue
+		}
+		if err := s.send(p); err != nil {
+			s.pending = append(s.pending, pending[i+1:]...)
+			return transient(err)
+		}
+	}
+	return nil
+}
+
+// replyError returns the error carried by a reply, looking into the
+// replies of EXEC.
+func replyError(val Value) error {
+	if err := val.Error(); err != nil {
+		return err
+	}
+	for _, v := range val.Array() {
+		if err := replyError(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type transientError struct{ err error }
+
+func (e *transientError) Error() string { return e.err.Error() }
+
+// transient marks network failures as worth a retry.
+func transient(err error) error {
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &transientError{err}
+	}
+	return err
+}
+
+func isTransient(err error) bool {
+	_, ok := err.(*transientError)
+	return ok
+}
+
+var transientReplies = []string{"LOADING", "BUSY", "TRYAGAIN", "MASTERDOWN", "CLUSTERDOWN"}
+
+// isTransientReply reports whether an error reply is one a healthy server
+// stops sending after a while.
+func isTransientReply(err error) bool {
+	for _, prefix := range transientReplies {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
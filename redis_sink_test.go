@@ -0,0 +1,226 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis is a minimal RESP server recording the commands it receives.
+// reply may be nil, in which case every command but PING gets +OK.
+type fakeRedis struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	cmds  []string
+	reply func(d []string) Value
+}
+
+func newFakeRedis(t *testing.T, reply func(d []string) Value) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, reply: reply}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) close() { _ = f.ln.Close() }
+
+func (f *fakeRedis) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.cmds...)
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	rd, wr := newReader(conn), newWriter(conn)
+	for {
+		val, _, err := rd.readBulk()
+		if err != nil {
+			return
+		}
+		var d []string
+		for _, v := range val.Array() {
+			d = append(d, v.String())
+		}
+		if len(d) == 0 {
+			continue
+		}
+		reply := SimpleStringValue("OK")
+		if strings.EqualFold(d[0], "PING") {
+			reply = SimpleStringValue("PONG")
+		} else {
+			f.mu.Lock()
+			f.cmds = append(f.cmds, strings.Join(d, " "))
+			f.mu.Unlock()
+			if f.reply != nil {
+				reply = f.reply(d)
+			}
+		}
+		if err := wr.writeValue(reply); err != nil {
+			return
+		}
+		if err := wr.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisSink(t *testing.T) {
+	srv := newFakeRedis(t, nil)
+	defer srv.close()
+
+	var applied int64
+	sink, err := NewRedisSink(srv.addr(),
+		RedisSinkWindow(2),
+		RedisSinkFlushInterval(time.Hour),
+		RedisSinkOnApplied(func(offset int64) { applied = offset }),
+	)
+	assert.Nil(t, err)
+
+	for i, d := range [][]string{
+		{"SET", "a", "1"},
+		{"SELECT", "2"},
+		{"PING"},
+		{"SET", "b", "2"},
+		{"DEL", "a"},
+	} {
+		assert.Nil(t, sink.Command(&Command{D: d, Offset: int64(10 * (i + 1))}))
+	}
+	assert.Nil(t, sink.Close())
+
+	assert.Equal(t, []string{"SET a 1", "SELECT 2", "SET b 2", "DEL a"}, srv.commands())
+	assert.Equal(t, int64(50), applied)
+	assert.Equal(t, int64(50), sink.Applied())
+}
+
+func TestRedisSinkSnapshot(t *testing.T) {
+	srv := newFakeRedis(t, nil)
+	defer srv.close()
+
+	sink, err := NewRedisSink(srv.addr(), RedisSinkWindow(1), RedisSinkFlushInterval(time.Hour))
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "old", "1"}, Offset: 50, Phase: PhaseStreaming}))
+	assert.Equal(t, int64(50), sink.Applied())
+	for _, key := range []string{"a", "b"} {
+		assert.Nil(t, sink.Command(&Command{D: []string{"SET", key, "1"}, Offset: 100, Phase: PhaseRDB}))
+	}
+	assert.Nil(t, sink.Flush())
+	// the snapshot is applied but a restart could not resume from it yet
+	assert.Equal(t, int64(-1), sink.Applied())
+
+	assert.Nil(t, sink.Command(&Command{D: []string{"PING"}, Offset: 114, Phase: PhaseStreaming}))
+	assert.Equal(t, int64(114), sink.Applied())
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "c", "1"}, Offset: 140, Phase: PhaseStreaming}))
+	assert.Equal(t, int64(140), sink.Applied())
+
+	// an empty snapshot is only a PING
+	assert.Nil(t, sink.Command(&Command{D: []string{"PING"}, Offset: 200, Phase: PhaseRDB}))
+	assert.Equal(t, int64(-1), sink.Applied())
+	assert.Nil(t, sink.Command(&Command{D: []string{"PING"}, Offset: 214, Phase: PhaseStreaming}))
+	assert.Equal(t, int64(214), sink.Applied())
+	assert.Nil(t, sink.Close())
+}
+
+func TestRedisSinkErrorReply(t *testing.T) {
+	srv := newFakeRedis(t, func(d []string) Value {
+		if d[0] == "INCR" {
+			return ErrorValue(errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"))
+		}
+		return SimpleStringValue("OK")
+	})
+	defer srv.close()
+
+	sink, err := NewRedisSink(srv.addr(), RedisSinkFlushInterval(time.Hour))
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "a", "x"}, Offset: 1}))
+	assert.Nil(t, sink.Command(&Command{D: []string{"INCR", "a"}, Offset: 2}))
+	assert.NotNil(t, sink.Flush())
+	assert.Equal(t, int64(1), sink.Applied())
+	assert.NotNil(t, sink.Command(&Command{D: []string{"SET", "b", "y"}, Offset: 3}))
+	_ = sink.Close()
+}
+
+func TestRedisSinkReplayMulti(t *testing.T) {
+	var once sync.Once
+	srv := newFakeRedis(t, func(d []string) Value {
+		reply := SimpleStringValue("OK")
+		if d[0] == "SET" && d[1] == "b" {
+			once.Do(func() { reply = ErrorValue(errors.New("LOADING Redis is loading the dataset in memory")) })
+		}
+		return reply
+	})
+	defer srv.close()
+
+	sink, err := NewRedisSink(srv.addr(), RedisSinkFlushInterval(time.Hour), RedisSinkRetry(1, time.Millisecond, time.Millisecond))
+	assert.Nil(t, err)
+	for i, d := range [][]string{{"SET", "x", "0"}, {"MULTI"}, {"SET", "a", "1"}, {"SET", "b", "2"}, {"EXEC"}} {
+		assert.Nil(t, sink.Command(&Command{D: d, Offset: int64(i + 1)}))
+	}
+	assert.Nil(t, sink.Flush())
+	assert.Equal(t, int64(5), sink.Applied())
+	assert.Nil(t, sink.Close())
+
+	// the transaction is sent again whole
+	assert.Equal(t, []string{"SET x 0", "MULTI", "SET a 1", "SET b 2", "EXEC", "MULTI", "SET a 1", "SET b 2", "EXEC"}, srv.commands())
+}
+
+func TestRedisSinkCloseInBackoff(t *testing.T) {
+	srv := newFakeRedis(t, func(d []string) Value {
+		return ErrorValue(errors.New("LOADING Redis is loading the dataset in memory"))
+	})
+	defer srv.close()
+
+	sink, err := NewRedisSink(srv.addr(), RedisSinkFlushInterval(time.Hour), RedisSinkRetry(3, time.Hour, time.Hour))
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 1}))
+	flushed := make(chan error, 1)
+	go func() { flushed <- sink.Flush() }()
+	time.Sleep(50 * time.Millisecond)
+
+	// Close interrupts the backoff of the Flush holding the sink
+	closed := make(chan error, 1)
+	go func() { closed <- sink.Close() }()
+	select {
+	case err := <-flushed:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("backoff not interrupted")
+	}
+	<-closed
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayerOption specifies an option for a Replayer.
+type ReplayerOption struct {
+	f func(*Replayer)
+}
+
+// ReplayFromOffset specifies the offset the replay starts at.
+func ReplayFromOffset(offset int64) ReplayerOption {
+	return ReplayerOption{func(r *Replayer) {
+		r.fromOffset, r.hasOffset = offset, true
+	}}
+}
+
+// ReplaySince specifies the time of the first command replayed.
+func ReplaySince(t time.Time) ReplayerOption {
+	return ReplayerOption{func(r *Replayer) {
+		r.since = t
+	}}
+}
+
+// ReplaySpeed specifies the pace of the replay relative to the recording:
+// 1 waits between commands as long as the master did, 2 twice less. Default
+// is 0, replaying at full speed.
+func ReplaySpeed(speed float64) ReplayerOption {
+	return ReplayerOption{func(r *Replayer) {
+		r.speed = speed
+	}}
+}
+
+// Replayer replays the commands recorded by a FileSink, snapshot and
+// stream, into a CommandDecoder.
+type Replayer struct {
+	dir        string
+	fromOffset int64
+	hasOffset  bool
+	since      time.Time
+	speed      float64
+
+	offset    int64
+	closeOnce sync.Once
+	closeC    chan struct{}
+}
+
+// NewReplayer returns a Replayer of the segments in dir.
+func NewReplayer(dir string, opts ...ReplayerOption) *Replayer {
+	r := &Replayer{dir: dir, offset: -1, closeC: make(chan struct{})}
+	for _, opt := range opts {
+		opt.f(r)
+	}
+	return r
+}
+
+// Offset returns the offset of the last command replayed.
+func (r *Replayer) Offset() int64 { return atomic.LoadInt64(&r.offset) }
+
+// Close stops the replay, Run returns nil.
+func (r *Replayer) Close() {
+	r.closeOnce.Do(func() { close(r.closeC) })
+}
+
+// Run replays the segments into cmder until the last recorded command, an
+// error of cmder or Close. A SELECT is replayed before the first command
+// out of database 0, so that a replay starting in the middle of the stream
+// goes to the right database.
+func (r *Replayer) Run(cmder CommandDecoder) error {
+	sr, err := OpenSegments(r.dir)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	switch {
+	case r.hasOffset:
+		err = sr.SeekOffset(r.fromOffset)
+	case !r.since.IsZero():
+		err = sr.SeekTime(r.since)
+	}
+	if err != nil {
+		return err
+	}
+
+	var start, first time.Time
+	db := 0
+	for {
+		select {
+		case <-r.closeC:
+			return nil
+		default:
+		}
+		rec, err := sr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if r.speed > 0 {
+			if first.IsZero() {
+				start, first = time.Now(), rec.Time
+			}
+			due := start.Add(time.Duration(float64(rec.Time.Sub(first)) / r.speed))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-r.closeC:
+					timer.Stop()
+					return nil
+				case <-timer.C:
+				}
+			}
+		}
+
+		e := rec.Event
+		if e.Command == "SELECT" {
+			db = e.DB
+		} else if e.DB != db {
+			sel := &Command{D: []string{"SELECT", strconv.Itoa(e.DB)}, Offset: e.Offset, Shard: e.Shard, ReplId: e.ReplId, Phase: e.Phase}
+			if err := cmder.Command(sel); err != nil {
+				return err
+			}
+			db = e.DB
+		}
+		if err := cmder.Command(e.Cmd()); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&r.offset, e.Offset)
+	}
+}
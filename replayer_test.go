@@ -0,0 +1,79 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSink(dir, FileSinkMaxSize(128))
+	assert.Nil(t, err)
+	record := func(offset int64, phase Phase, args ...string) {
+		assert.Nil(t, s.Command(&Command{D: args, Offset: offset, ReplId: "abc", Phase: phase}))
+	}
+	record(100, PhaseRDB, "SET", "a", "1")
+	record(100, PhaseRDB, "SELECT", "2")
+	record(100, PhaseRDB, "SET", "b", "2")
+	record(110, PhaseStreaming, "INCR", "b")
+	record(120, PhaseStreaming, "SELECT", "0")
+	record(130, PhaseStreaming, "DEL", "a")
+	time.Sleep(100 * time.Millisecond)
+	mark := time.Now()
+	record(140, PhaseStreaming, "SET", "c", "3")
+	assert.Nil(t, s.Close())
+
+	replay := func(opts ...ReplayerOption) []string {
+		d := &nopCommander{}
+		r := NewReplayer(dir, opts...)
+		assert.Nil(t, r.Run(d))
+		var cmds []string
+		for _, cmd := range d.cmds {
+			cmds = append(cmds, cmd.String())
+		}
+		assert.Equal(t, int64(140), r.Offset())
+		return cmds
+	}
+
+	assert.Equal(t, []string{"SET a 1", "SELECT 2", "SET b 2", "INCR b", "SELECT 0", "DEL a", "SET c 3"}, replay())
+	// the database of the first command is selected
+	assert.Equal(t, []string{"SELECT 2", "INCR b", "SELECT 0", "DEL a", "SET c 3"}, replay(ReplayFromOffset(110)))
+	assert.Equal(t, []string{"SET c 3"}, replay(ReplaySince(mark)))
+
+	start := time.Now()
+	cmds := replay(ReplaySpeed(1))
+	assert.Equal(t, "SET c 3", cmds[len(cmds)-1])
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+
+	r := NewReplayer(dir, ReplaySpeed(0.01))
+	d := &nopCommander{}
+	done := make(chan error)
+	go func() { done <- r.Run(d) }()
+	time.Sleep(20 * time.Millisecond)
+	r.Close()
+	assert.Nil(t, <-done)
+	assert.True(t, len(d.cmds) < 7, "replay not stopped")
+}
@@ -20,9 +20,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,46 +40,80 @@ var (
 
 func (c *Canal) dump(w io.Writer) error {
 	conn := c.getNetConn()
-	for {
-		buf := xmit.Get()
-		_, err := io.CopyBuffer(w, conn, buf)
-		if err != nil {
-			return err
-		}
-		xmit.Put(buf)
+	defer conn.Close()
+	buf := xmit.Get()
+	defer xmit.Put(buf)
+	if _, err := io.CopyBuffer(meteredWriter{w, c.cfg.metrics}, conn, buf); err != nil {
+		return err
 	}
+	// the master closed the connection
+	return io.EOF
 }
 
 func (c *Canal) dumpAndParse() (err error) {
+	r, w, release, err := c.pipe()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	c.setPhase(PhaseHandshake)
+	if !c.acquireFullSync() {
+		return nil
+	}
+	defer c.releaseFullSync()
 	err = c.replconf()
 	if err != nil {
 		return err
 	}
-	r, w := io.Pipe()
+
+	// a previous run may have left an ack error behind
+	select {
+	case <-c.ackErrC:
+	default:
+	}
+	stop := make(chan struct{})
 
 	done := make(chan error, 1)
 	go func() {
-		err := c.handler(r)
+		err := c.handler(r, stop)
 		_ = w.CloseWithError(err)
+		// dump may be waiting for the next bytes of the master
+		_ = c.getNetConn().Close()
 		done <- err
 	}()
 
-	err = c.dump(w)
-	_ = w.CloseWithError(err)
-	err = <-done
-
+	derr := c.dump(w)
+	_ = w.CloseWithError(derr)
+	close(stop)
+	if err = <-done; err == errPausedLinkDown {
+		err = derr
+	}
 	return err
 }
 
-func (c *Canal) handler(rd io.Reader) error {
-	resp := newReader(rd)
+func (c *Canal) handler(rd io.Reader, stop <-chan struct{}) error {
+	cr := &countReader{r: rd}
+	resp := newReader(cr)
+	resp.logger = c.logger()
 	one := sync.Once{}
+	defer func() {
+		// a snapshot cut short cannot be continued, the next PSYNC asks
+		// for a full one again
+		if c.Phase() == PhaseRDB {
+			c.setReplId("?")
+			c.set(-1)
+		}
+	}()
 	for {
 		select {
 		case aerr := <-c.ackErrC:
 			return aerr
 		default:
 		}
+		if err := c.waitResume(stop); err != nil {
+			return err
+		}
 
 		val, n, err := resp.readBulk()
 		if err != nil {
@@ -89,22 +124,63 @@ func (c *Canal) handler(rd io.Reader) error {
 		case '-', ':', '$':
 		case '+':
 			if bytes.HasPrefix(val.Str, []byte(`FULLRESYNC`)) {
+				// a replica resuming from a checkpoint learns only now
+				// that it needs a slot, the master buffers the RDB meanwhile
+				if c.cfg.fullSyncs != nil && !c.fullSyncHeld {
+					if !c.cfg.fullSyncs.acquire(c.closeReplica) {
+						return nil
+					}
+					c.fullSyncHeld = true
+				}
+				ss := strings.Split(val.String(), " ")
+				if len(ss) == 3 {
+					offset, err := strconv.ParseInt(ss[2], 10, 64)
+					if err != nil {
+						return fmt.Errorf("%s(%s)", "error FULLRESYNC resp", val.String())
+					}
+					c.setReplId(ss[1])
+					c.set(offset)
+					c.cfg.hooks.fullResync(ss[1], offset)
+				}
+				c.setPhase(PhaseRDB)
+				c.rdb = rdbProgress{cr: cr, base: cr.count() - int64(resp.Buffered())}
+				// marks the start of the snapshot, which may hold no key at all
+				ping, _ := NewCommand("PING")
+				if err := c.Command(ping); err != nil {
+					return err
+				}
 				resp, err = decodeStream(resp, c)
 				if err != nil {
 					return err
 				}
+				resp.logger = c.logger()
+				c.cfg.metrics.addRDBBytes(cr.count() - c.rdb.base)
+				c.releaseFullSync()
+				c.setPhase(PhaseStreaming)
 
 			} else if bytes.HasPrefix(val.Str, []byte(`CONTINUE`)) {
 				ss := strings.Split(val.String(), " ")
 				if len(ss) != 2 {
 					return fmt.Errorf("%s(%s)", "error CONTINUE resp", val.String())
 				}
-				c.replId = ss[1]
+				c.setReplId(ss[1])
+				c.releaseFullSync()
+				c.setPhase(PhaseStreaming)
+				c.cfg.hooks.continued(ss[1])
+				// the master selects the database again only once it
+				// changes
+				if db := atomic.LoadInt64(&c.db); db != 0 {
+					sel, _ := NewCommand("SELECT", strconv.FormatInt(db, 10))
+					if err := c.Command(sel); err != nil {
+						return err
+					}
+				}
 			}
 		case '*':
 			// cmd := lazyCmdPool.Get().(*Command)
 			cmd := &Command{}
-			cmd.Set(buildStrCommand(val.String())...)
+			cmd.Set(buildStrCommand(val)...)
+			cmd.Offset = atomic.LoadInt64(&c.offset) + int64(n)
 			err = c.Command(cmd)
 			if err != nil {
 				return err
@@ -112,28 +188,57 @@ func (c *Canal) handler(rd io.Reader) error {
 			// lazyCmdPool.Put(cmd)
 			c.Increment(int64(n))
 		default:
-			log.Printf("address %s replId %s unknown opcode %v size %d", c.ip, c.replId, val, val.Size)
+			c.logger().Warn("unknown opcode", "value", val, "size", val.Size)
 		}
 
 		one.Do(func() {
-			go c.replack()
+			go c.replack(c.wr, stop)
 		})
 	}
 }
 
-func (c *Canal) replack() {
+func (c *Canal) replack(wr *writer, stop <-chan struct{}) {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-c.closeReplica:
 			return
+		case <-stop:
+			return
 		default:
 		}
-		err := c.wr.writeMultiBulk("replconf", "ack", c.Offset())
+		offset := c.ackOffset()
+		err := wr.writeMultiBulk("replconf", "ack", offset)
 		if err != nil {
-			c.ackErrC <- err
+			select {
+			case c.ackErrC <- err:
+			default:
+			}
+			return
 		}
-		<-ticker.C
+		c.cfg.metrics.ack(offset)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ackOffset is the offset acknowledged to the master: the offset received,
+// or less when the CommandDecoder reports a lower applied offset, as a
+// FanOut does with that of its slowest sink. Nothing is applied during a
+// snapshot, the ack then only keeps the link alive.
+func (c *Canal) ackOffset() int64 {
+	offset := atomic.LoadInt64(&c.offset)
+	if a, ok := c.cmder.(interface{ Applied() int64 }); ok {
+		if applied := a.Applied(); applied < offset {
+			offset = applied
+		}
+	}
+	if offset < 0 {
+		offset = 0
 	}
+	return offset
 }
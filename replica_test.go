@@ -0,0 +1,134 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerCommands(t *testing.T) {
+	d := &nopCommander{}
+	c := &Canal{cfg: &Config{}, cmder: d, closeReplica: make(chan struct{}), ackErrC: make(chan error, 1)}
+	c.wr = newWriter(ioutil.Discard)
+
+	set, _ := MultiBulkBytes(MultiBulkValue("SET", "k", "a\r\nb", ""))
+	del, _ := MultiBulkBytes(MultiBulkValue("DEL", "k"))
+	stream := "+CONTINUE abc\r\n" + string(set) + string(del)
+	stop := make(chan struct{})
+	err := c.handler(strings.NewReader(stream), stop)
+	close(stop)
+	assert.Equal(t, io.EOF, err)
+	if assert.Equal(t, 2, len(d.cmds)) {
+		assert.Equal(t, []string{"SET", "k", "a\r\nb", ""}, d.cmds[0].D)
+		assert.Equal(t, []string{"DEL", "k"}, d.cmds[1].D)
+		assert.Equal(t, PhaseStreaming, d.cmds[1].Phase)
+	}
+}
+
+func TestHandlerContinueSelect(t *testing.T) {
+	d := &nopCommander{}
+	c := &Canal{cfg: &Config{}, cmder: d, closeReplica: make(chan struct{}), ackErrC: make(chan error, 1)}
+	c.wr = newWriter(ioutil.Discard)
+	c.replId, c.offset, c.db = "abc", 10, 3
+
+	set, _ := MultiBulkBytes(MultiBulkValue("SET", "k", "v"))
+	stream := "+CONTINUE abc\r\n" + string(set)
+	stop := make(chan struct{})
+	err := c.handler(strings.NewReader(stream), stop)
+	close(stop)
+	assert.Equal(t, io.EOF, err)
+	if assert.Equal(t, 2, len(d.cmds)) {
+		assert.Equal(t, []string{"SELECT", "3"}, d.cmds[0].D)
+		assert.Equal(t, []string{"SET", "k", "v"}, d.cmds[1].D)
+	}
+	assert.Equal(t, 3, c.Checkpoint().DB)
+}
+
+func TestHandlerCutSnapshot(t *testing.T) {
+	c := &Canal{cfg: &Config{}, cmder: &nopCommander{}, closeReplica: make(chan struct{}), ackErrC: make(chan error, 1)}
+	c.wr = newWriter(ioutil.Discard)
+
+	stream := "+FULLRESYNC abc 10\r\n$40\r\nREDIS0009\xfe\x00"
+	stop := make(chan struct{})
+	err := c.handler(strings.NewReader(stream), stop)
+	close(stop)
+	assert.NotNil(t, err)
+	assert.Equal(t, PhaseRDB, c.Phase())
+	assert.Equal(t, Checkpoint{Offset: -1}, c.Checkpoint())
+	assert.Equal(t, "?", c.GetReplId())
+}
+
+// newCutSnapshotMaster serves a master breaking the link in the middle of
+// its first snapshot and sending the next ones whole. The arguments of
+// every PSYNC are sent to the channel.
+func newCutSnapshotMaster(t *testing.T) (net.Listener, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	psyncs := make(chan string, 10)
+	var n int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := newReader(conn)
+				for {
+					val, _, err := rd.readBulk()
+					if err != nil {
+						return
+					}
+					var d []string
+					for _, v := range val.Array() {
+						d = append(d, v.String())
+					}
+					switch strings.ToUpper(d[0]) {
+					case "PING":
+						_, _ = conn.Write([]byte("+PONG\r\n"))
+					case "INFO":
+						info := "# Server\r\nredis_version:6.2.0\r\n# Replication\r\nrole:master\r\n"
+						_, _ = fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(info), info)
+					case "PSYNC":
+						psyncs <- strings.Join(d[1:], " ")
+						rdb := "REDIS0009" + "\xfe\x00" + "\x00\x01k\x01v" + "\xff" + strings.Repeat("\x00", 8)
+						if atomic.AddInt32(&n, 1) == 1 {
+							// the link breaks in the middle of the snapshot
+							_, _ = fmt.Fprintf(conn, "+FULLRESYNC abc 10\r\n$%d\r\n%s", len(rdb), rdb[:12])
+							return
+						}
+						_, _ = fmt.Fprintf(conn, "+FULLRESYNC def 20\r\n$%d\r\n%s", len(rdb), rdb)
+					default:
+						_, _ = conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln, psyncs
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A segment file starts with segmentMagic followed by records, each a
+// uvarint length and the record: the varint unix nanoseconds it was
+// written at and the binary Event. Closed segments may be gzipped.
+//
+// The index file of a segment holds entries of two big-endian int64, the
+// offset of a record and its position in the uncompressed segment. The
+// first record of a segment is always indexed.
+const (
+	segmentMagic     = "CNLSEG1\n"
+	segmentExt       = ".seg"
+	segmentIndexExt  = ".idx"
+	segmentGzipExt   = ".gz"
+	segmentIndexSize = 16
+)
+
+var errSegmentMagic = errors.New("canal: not a segment file")
+
+// Record is a command recorded by a FileSink.
+type Record struct {
+	Time  time.Time
+	Event *Event
+}
+
+func appendRecord(b []byte, t time.Time, e *Event) ([]byte, error) {
+	eb, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var ts [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(ts[:], t.UnixNano())
+	b = appendUvarint(b, uint64(n+len(eb)))
+	b = append(b, ts[:n]...)
+	return append(b, eb...), nil
+}
+
+// readRecord returns the next record of r.
+func readRecord(r *bufio.Reader) (*Record, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err != io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if n > maxEventSize {
+		return nil, ErrEventCorrupt
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	ts, m := binary.Varint(b)
+	if m <= 0 {
+		return nil, ErrEventCorrupt
+	}
+	e := new(Event)
+	if err := e.UnmarshalBinary(b[m:]); err != nil {
+		return nil, err
+	}
+	return &Record{Time: time.Unix(0, ts), Event: e}, nil
+}
+
+func segmentName(seq int64) string { return fmt.Sprintf("%010d", seq) }
+
+type segmentFile struct {
+	seq  int64
+	path string // without the gzip extension
+	gz   bool
+}
+
+func (s segmentFile) indexPath() string {
+	return strings.TrimSuffix(s.path, segmentExt) + segmentIndexExt
+}
+
+// listSegments returns the segments in dir by sequence number.
+func listSegments(dir string) ([]segmentFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bySeq := make(map[int64]segmentFile)
+	for _, info := range infos {
+		name := info.Name()
+		gz := strings.HasSuffix(name, segmentExt+segmentGzipExt)
+		if gz {
+			name = strings.TrimSuffix(name, segmentGzipExt)
+		}
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		// a segment being compressed exists in both forms, prefer the plain one
+		if s, ok := bySeq[seq]; ok && !s.gz {
+			continue
+		}
+		bySeq[seq] = segmentFile{seq: seq, path: filepath.Join(dir, name), gz: gz}
+	}
+	segs := make([]segmentFile, 0, len(bySeq))
+	for _, s := range bySeq {
+		segs = append(segs, s)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+	return segs, nil
+}
+
+type indexEntry struct {
+	offset int64
+	pos    int64
+}
+
+// readIndex returns the entries of the index of s, a truncated last entry
+// is ignored.
+func readIndex(s segmentFile) ([]indexEntry, error) {
+	b, err := ioutil.ReadFile(s.indexPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries := make([]indexEntry, len(b)/segmentIndexSize)
+	for i := range entries {
+		e := b[i*segmentIndexSize:]
+		entries[i] = indexEntry{
+			offset: int64(binary.BigEndian.Uint64(e)),
+			pos:    int64(binary.BigEndian.Uint64(e[8:])),
+		}
+	}
+	return entries, nil
+}
+
+type segmentCursor struct {
+	f  *os.File
+	gz *gzip.Reader
+	r  *bufio.Reader
+}
+
+// openSegment opens s positioned at pos, the start of a record.
+func openSegment(s segmentFile, pos int64) (*segmentCursor, error) {
+	path := s.path
+	if s.gz {
+		path += segmentGzipExt
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !s.gz {
+		// compressed since it was listed
+		s.gz = true
+		f, err = os.Open(path + segmentGzipExt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &segmentCursor{f: f}
+	var r io.Reader = f
+	if s.gz {
+		if c.gz, err = gzip.NewReader(f); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		r = c.gz
+	}
+	c.r = bufio.NewReader(r)
+	magic := make([]byte, len(segmentMagic))
+	if _, err := io.ReadFull(c.r, magic); err != nil || string(magic) != segmentMagic {
+		_ = c.close()
+		return nil, fmt.Errorf("%s: %v", path, errSegmentMagic)
+	}
+	if pos > int64(len(segmentMagic)) {
+		if s.gz {
+			_, err = c.r.Discard(int(pos) - len(segmentMagic))
+		} else {
+			_, err = f.Seek(pos, io.SeekStart)
+			c.r.Reset(f)
+		}
+		if err != nil {
+			_ = c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *segmentCursor) close() error {
+	if c.gz != nil {
+		_ = c.gz.Close()
+	}
+	return c.f.Close()
+}
+
+// SegmentReader reads the records of the segments written by a FileSink,
+// in order. The segments are listed when it is opened.
+type SegmentReader struct {
+	segs []segmentFile
+	i    int
+	cur  *segmentCursor
+	pos  int64
+	skip func(rec *Record) bool // skips records until it returns false
+}
+
+// OpenSegments returns a SegmentReader positioned at the first record of
+// the segments in dir.
+func OpenSegments(dir string) (*SegmentReader, error) {
+	segs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &SegmentReader{segs: segs}, nil
+}
+
+// SeekOffset positions r at the first record whose offset is at least offset,
+// using the indexes to skip the records before. Offsets are assumed not
+// to decrease along the segments.
+func (r *SegmentReader) SeekOffset(offset int64) error {
+	r.closeCursor()
+	r.i, r.pos = 0, 0
+	for i, s := range r.segs {
+		first, err := r.firstOffset(s)
+		if err != nil {
+			return err
+		}
+		if first == math.MaxInt64 {
+			continue
+		}
+		// commands of the snapshot share an offset, earlier segments may end with it
+		if first >= offset {
+			break
+		}
+		r.i = i
+	}
+	if r.i < len(r.segs) {
+		entries, err := readIndex(r.segs[r.i])
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.offset >= offset {
+				break
+			}
+			r.pos = e.pos
+		}
+	}
+	r.skip = func(rec *Record) bool { return rec.Event.Offset < offset }
+	return nil
+}
+
+// SeekTime positions r at the first record written at t or later. Times
+// are assumed not to decrease along the segments.
+func (r *SegmentReader) SeekTime(t time.Time) error {
+	r.closeCursor()
+	r.i, r.pos = 0, 0
+	for i, s := range r.segs {
+		c, err := openSegment(s, 0)
+		if err != nil {
+			return err
+		}
+		rec, err := readRecord(c.r)
+		_ = c.close()
+		if err != nil {
+			continue
+		}
+		if !rec.Time.Before(t) {
+			break
+		}
+		r.i = i
+	}
+	r.skip = func(rec *Record) bool { return rec.Time.Before(t) }
+	return nil
+}
+
+// firstOffset returns the offset of the first record of s, MaxInt64 for
+// an empty segment.
+func (r *SegmentReader) firstOffset(s segmentFile) (int64, error) {
+	entries, err := readIndex(s)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) > 0 {
+		return entries[0].offset, nil
+	}
+	// the index was not flushed before a crash
+	c, err := openSegment(s, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer c.close()
+	rec, err := readRecord(c.r)
+	if err != nil {
+		return math.MaxInt64, nil
+	}
+	return rec.Event.Offset, nil
+}
+
+// Next returns the next record, io.EOF after the last one. A segment
+// truncated by a crash ends at its last complete record.
+func (r *SegmentReader) Next() (*Record, error) {
+	for {
+		if r.cur == nil {
+			if r.i >= len(r.segs) {
+				return nil, io.EOF
+			}
+			c, err := openSegment(r.segs[r.i], r.pos)
+			if err != nil {
+				return nil, err
+			}
+			r.cur = c
+		}
+		rec, err := readRecord(r.cur.r)
+		switch err {
+		case nil:
+			if r.skip != nil {
+				if r.skip(rec) {
+					continue
+				}
+				r.skip = nil
+			}
+			return rec, nil
+		case io.EOF, io.ErrUnexpectedEOF:
+			r.closeCursor()
+			r.i, r.pos = r.i+1, 0
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (r *SegmentReader) closeCursor() {
+	if r.cur != nil {
+		_ = r.cur.close()
+		r.cur = nil
+	}
+}
+
+// Close closes the segment being read.
+func (r *SegmentReader) Close() error {
+	r.closeCursor()
+	return nil
+}
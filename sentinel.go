@@ -0,0 +1,244 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var ErrNoSentinel = errors.New("unable to reach any sentinel")
+
+// sentinel resolves and watches the master of a monitored group.
+type sentinel struct {
+	masterName string
+	addrs      []string
+	opts       []DialOption
+}
+
+// NewSentinelConfig returns a Config for the master currently elected by the
+// sentinels for masterName. A Canal built on it follows failovers: when the
+// sentinels switch masters it redials the new one and attempts PSYNC with the
+// previous replId, falling back to a full resync when PSYNC2 can't continue.
+// The sentinels are dialed without password, see NewSentinelConfigWithOptions.
+func NewSentinelConfig(masterName string, sentinelAddrs ...string) (*Config, error) {
+	return NewSentinelConfigWithOptions(masterName, sentinelAddrs, nil)
+}
+
+// NewSentinelConfigWithOptions is like NewSentinelConfig, dialing the sentinels
+// with sentinelOpts and the master with opts.
+func NewSentinelConfigWithOptions(masterName string, sentinelAddrs []string, sentinelOpts []DialOption, opts ...DialOption) (*Config, error) {
+	if len(sentinelAddrs) == 0 {
+		return nil, ErrNoSentinel
+	}
+	s := &sentinel{masterName: masterName, addrs: sentinelAddrs, opts: sentinelOpts}
+	addr, err := s.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := NewConfig(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	cfg.sentinel = s
+	return cfg, nil
+}
+
+// masterAddr asks the sentinels, in order, for the current master address.
+func (s *sentinel) masterAddr() (string, error) {
+	var lastErr error = ErrNoSentinel
+	for _, addr := range s.addrs {
+		master, err := s.query(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return master, nil
+	}
+	return "", lastErr
+}
+
+func (s *sentinel) query(addr string) (string, error) {
+	conn, err := dial("tcp", addr, s.opts...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	rw := NewRedisReaderWriter(conn)
+	if err := rw.writeMultiBulk("SENTINEL", "get-master-addr-by-name", s.masterName); err != nil {
+		return "", err
+	}
+	val, _, err := rw.readBulk()
+	if err != nil {
+		return "", err
+	}
+	if err := val.Error(); err != nil {
+		return "", err
+	}
+	hp := val.Array()
+	if len(hp) != 2 {
+		return "", fmt.Errorf("sentinel %s does not know master %q", addr, s.masterName)
+	}
+	return net.JoinHostPort(hp[0].String(), hp[1].String()), nil
+}
+
+// watch subscribes to +switch-master on the sentinels and sends the new
+// master address of the group on switched, until stop is closed.
+func (s *sentinel) watch(switched chan<- string, stop <-chan struct{}, logger Logger) {
+	for i := 0; ; i++ {
+		addr := s.addrs[i%len(s.addrs)]
+		err := s.subscribe(addr, switched, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		logger.Warn("sentinel subscription lost", "sentinel", addr, "err", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *sentinel) subscribe(addr string, switched chan<- string, stop <-chan struct{}) error {
+	conn, err := dial("tcp", addr, s.opts...)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+
+	rw := NewRedisReaderWriter(conn)
+	if err := rw.writeMultiBulk("SUBSCRIBE", "+switch-master"); err != nil {
+		return err
+	}
+	for {
+		val, _, err := rw.readBulk()
+		if err != nil {
+			return err
+		}
+		msg := val.Array()
+		if len(msg) != 3 || msg[0].String() != "message" {
+			continue
+		}
+		// <master name> <oldip> <oldport> <newip> <newport>
+		ss := strings.Fields(msg[2].String())
+		if len(ss) != 5 || ss[0] != s.masterName {
+			continue
+		}
+		select {
+		case switched <- net.JoinHostPort(ss[3], ss[4]):
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// followMaster runs the replication, moving to the master elected by the
+// sentinels whenever the link breaks or a +switch-master is announced.
+func (c *Canal) followMaster() error {
+	switched := make(chan string, 1)
+	go c.cfg.sentinel.watch(switched, c.closeReplica, c.logger())
+
+	for {
+		errC := make(chan error, 1)
+		go func() { errC <- c.dumpAndParse() }()
+
+		var err error
+	wait:
+		for {
+			select {
+			case err = <-errC:
+				break wait
+			case addr := <-switched:
+				if addr != c.cfg.addr {
+					c.logger().Info("sentinel switched master", "master", c.cfg.sentinel.masterName, "new", addr)
+					_ = c.getNetConn().Close()
+				}
+			}
+		}
+		if c.closed() {
+			return nil
+		}
+		c.setLastErr(err)
+		if c.cmdErr != nil {
+			return err
+		}
+		if c.takeResync() {
+			c.logger().Info("full resync requested")
+		} else {
+			c.logger().Warn("replication broken", "err", err)
+		}
+
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-c.closeReplica:
+				return nil
+			case <-time.After(time.Second):
+			}
+			c.cfg.hooks.reconnect(err, attempt)
+			if err = c.redial(); err != nil {
+				c.setLastErr(err)
+				c.logger().Warn("sentinel redial failed", "master", c.cfg.sentinel.masterName, "err", err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// redial connects to the current master, PSYNC then goes on with the
+// replId and offset reached so far, or asks a full sync again if the link
+// broke during the snapshot.
+func (c *Canal) redial() error {
+	addr, err := c.cfg.sentinel.masterAddr()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	old := c.cfg.addr
+	c.cfg.addr = addr
+	err = c.cfg.reconfig()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	c.cfg.hooks.masterChange(old, addr)
+	if c.closed() {
+		_ = c.getNetConn().Close()
+		return nil
+	}
+	c.redisInfo = make(map[string]map[string]string)
+	if err := c.info(); err != nil {
+		return err
+	}
+	c.cfg.metrics.incReconnects()
+	c.cfg.metrics.SetMasterOffset(c.masterReplOffset())
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSentinelMasterAddr(t *testing.T) {
+	master := newFakeRedis(t, nil)
+	defer master.close()
+	host, port, _ := net.SplitHostPort(master.addr())
+
+	sent := newFakeRedis(t, func(d []string) Value {
+		if len(d) == 3 && d[0] == "SENTINEL" && d[2] == "mymaster" {
+			return ArrayValue([]Value{StringValue(host), StringValue(port)})
+		}
+		return NullValue()
+	})
+	defer sent.close()
+
+	cfg, err := NewSentinelConfig("mymaster", "127.0.0.1:1", sent.addr())
+	assert.Nil(t, err)
+	assert.Equal(t, master.addr(), cfg.addr)
+	assert.NotNil(t, cfg.sentinel)
+	_ = cfg.Connection().Close()
+
+	_, err = NewSentinelConfig("unknown", sent.addr())
+	assert.NotNil(t, err)
+
+	_, err = NewSentinelConfig("mymaster")
+	assert.Equal(t, ErrNoSentinel, err)
+}
+
+func TestSentinelRedialAfterCutSnapshot(t *testing.T) {
+	ln, psyncs := newCutSnapshotMaster(t)
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	sent := newFakeRedis(t, func(d []string) Value {
+		return ArrayValue([]Value{StringValue(host), StringValue(port)})
+	})
+	defer sent.close()
+
+	cfg, err := NewSentinelConfig("mymaster", sent.addr())
+	assert.Nil(t, err)
+	c, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() { done <- c.Run(&nopCommander{}) }()
+
+	var args []string
+	for len(args) < 2 {
+		select {
+		case a := <-psyncs:
+			args = append(args, a)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no second PSYNC")
+		}
+	}
+	assert.Equal(t, []string{"? -1", "? -1"}, args)
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Phase() != PhaseStreaming && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, Checkpoint{ReplId: "def", Offset: 20}, c.Checkpoint())
+	c.Close()
+	assert.Nil(t, <-done)
+}
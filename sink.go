@@ -0,0 +1,109 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"sync"
+	"time"
+)
+
+// sinkCore is what the sinks share: the mutex serializing the commands
+// with the periodic flush, the error stopping the sink and the goroutine
+// flushing it.
+type sinkCore struct {
+	mu     sync.Mutex
+	err    error
+	closed bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// startFlusher calls flush every interval with mu held, until stopFlusher,
+// an error of it stopping the sink. No goroutine is started for a zero
+// interval.
+func (c *sinkCore) startFlusher(interval time.Duration, flush func() error) {
+	c.stop, c.done = make(chan struct{}), make(chan struct{})
+	if interval <= 0 {
+		close(c.done)
+		return
+	}
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+			c.mu.Lock()
+			if c.err == nil && !c.closed {
+				_ = c.fail(flush())
+			}
+			c.mu.Unlock()
+		}
+	}()
+}
+
+// stopFlusher stops the flush goroutine and waits for it, interrupting the
+// backoffs waiting on stop. It is called without mu held.
+func (c *sinkCore) stopFlusher() {
+	c.stopOnce.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+// check returns the error commands are refused with, if any.
+func (c *sinkCore) check() error {
+	if c.closed {
+		return ErrSinkClosed
+	}
+	return c.err
+}
+
+// fail makes err sticky, the sink refuses commands afterwards. An
+// ErrSinkClosed of an interrupted backoff is not.
+func (c *sinkCore) fail(err error) error {
+	if err != nil && c.err == nil && err != ErrSinkClosed {
+		c.err = err
+	}
+	return err
+}
+
+// backoff is a delay doubling from min to max.
+type backoff struct {
+	delay, max time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{delay: min, max: max}
+}
+
+// wait sleeps for the delay and doubles it, false if stop is closed first.
+func (b *backoff) wait(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(b.delay):
+	}
+	if b.delay *= 2; b.delay > b.max {
+		b.delay = b.max
+	}
+	return true
+}
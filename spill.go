@@ -0,0 +1,192 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// SetPauseSpill makes the Canal built on c keep reading the replication
+// stream while paused or while its CommandDecoder falls behind: once an
+// in-memory queue of the stream is full, up to maxBytes of it are spilled
+// into a file created in dir. The socket is no longer read once the file is
+// full. Without it a paused Canal stops reading the socket at once, leaving
+// the stream in the output buffer of the master.
+func (c *Config) SetPauseSpill(dir string, maxBytes int64) {
+	c.spillDir, c.spillMax = dir, maxBytes
+}
+
+// spillQueueSize is the size of the in-memory queue in front of the spool.
+const spillQueueSize = 1 << 20
+
+type pipeWriter interface {
+	io.Writer
+	CloseWithError(err error) error
+}
+
+// pipe returns the link between the connection and the handler.
+func (c *Canal) pipe() (io.Reader, pipeWriter, func(), error) {
+	if c.cfg.spillMax <= 0 {
+		r, w := io.Pipe()
+		return r, w, func() {}, nil
+	}
+	s := newSpool(c.cfg.spillDir, spillQueueSize, c.cfg.spillMax)
+	return s, s, s.remove, nil
+}
+
+// spool is a FIFO of bounded size: an in-memory queue, then a file used as
+// a ring buffer once the queue is full. The file is created on the first
+// spill. Writes block while both are full, reads while both are empty.
+type spool struct {
+	dir   string
+	queue int
+	size  int64
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	mem        bytes.Buffer // older than the bytes in f
+	f          *os.File
+	head, tail int64 // bytes read from and written to f so far
+	err        error
+}
+
+func newSpool(dir string, queue int, size int64) *spool {
+	s := &spool{dir: dir, queue: queue, size: size}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *spool) Write(p []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(p) > 0 {
+		if s.err != nil {
+			return n, s.err
+		}
+		switch {
+		case s.tail == s.head && s.mem.Len() < s.queue:
+			// nothing spilled, the queue keeps the order
+			chunk := minInt64(int64(len(p)), int64(s.queue-s.mem.Len()))
+			s.mem.Write(p[:chunk])
+			n += int(chunk)
+			p = p[chunk:]
+			s.cond.Broadcast()
+		case s.tail-s.head < s.size:
+			wn, werr := s.spill(p)
+			n += wn
+			p = p[wn:]
+			if werr != nil {
+				return n, werr
+			}
+		default:
+			s.cond.Wait()
+		}
+	}
+	return n, nil
+}
+
+// spill writes the head of p to f, up to its free space. s.mu is held.
+func (s *spool) spill(p []byte) (int, error) {
+	if s.f == nil {
+		f, err := ioutil.TempFile(s.dir, "canal-spill-")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+	}
+	chunk := minInt64(int64(len(p)), s.size-(s.tail-s.head), s.size-s.tail%s.size)
+	// only the writer moves tail and only the reader moves head, the
+	// region written can't be read before tail is updated
+	s.mu.Unlock()
+	n, err := s.f.WriteAt(p[:chunk], s.tail%s.size)
+	s.mu.Lock()
+	s.tail += int64(n)
+	s.cond.Broadcast()
+	return n, err
+}
+
+// Read returns the buffered bytes, then the error the spool was closed with.
+func (s *spool) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.err == nil && s.mem.Len() == 0 && s.head == s.tail {
+		s.cond.Wait()
+	}
+	if s.mem.Len() > 0 {
+		n, _ := s.mem.Read(p)
+		s.cond.Broadcast()
+		return n, nil
+	}
+	if s.head == s.tail {
+		return 0, s.err
+	}
+	chunk := minInt64(int64(len(p)), s.tail-s.head, s.size-s.head%s.size)
+	s.mu.Unlock()
+	n, err := s.f.ReadAt(p[:chunk], s.head%s.size)
+	s.mu.Lock()
+	s.head += int64(n)
+	s.cond.Broadcast()
+	if err == io.EOF && int64(n) == chunk {
+		err = nil
+	}
+	return n, err
+}
+
+// CloseWithError fails the pending and future writes with err, reads get
+// err once the buffered bytes are consumed. A nil err is io.EOF.
+func (s *spool) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
+
+// buffered returns the number of bytes written and not read yet.
+func (s *spool) buffered() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(s.mem.Len()) + s.tail - s.head
+}
+
+func (s *spool) remove() {
+	_ = s.CloseWithError(nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		_ = s.f.Close()
+		_ = os.Remove(s.f.Name())
+	}
+}
+
+func minInt64(a int64, bs ...int64) int64 {
+	for _, b := range bs {
+		if b < a {
+			a = b
+		}
+	}
+	return a
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := newSpool(dir, 4, 8)
+
+	// a reader keeping up never spills
+	n, err := s.Write([]byte("xyz"))
+	assert.Equal(t, 3, n)
+	assert.Nil(t, err)
+	buf := make([]byte, 4)
+	n, _ = s.Read(buf)
+	assert.Equal(t, "xyz", string(buf[:n]))
+	assert.Nil(t, s.f)
+
+	n, err = s.Write([]byte("abcdef"))
+	assert.Equal(t, 6, n)
+	assert.Nil(t, err)
+	assert.NotNil(t, s.f)
+	n, _ = s.Read(buf)
+	assert.Equal(t, "abcd", string(buf[:n]))
+
+	// ef are still spilled: the queue waits until the file is drained; the
+	// file wraps around its end, then blocks once full
+	written := make(chan struct{})
+	go func() {
+		_, _ = s.Write([]byte("ghijklmn"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write beyond the spool size")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, int64(8), s.buffered())
+
+	_ = s.CloseWithError(errors.New("link down"))
+	got, err := ioutil.ReadAll(s)
+	<-written
+	assert.Equal(t, "link down", err.Error())
+	assert.Equal(t, "efghijkl", string(got))
+
+	_, err = s.Write([]byte("x"))
+	assert.NotNil(t, err)
+	s.remove()
+	_, err = os.Stat(s.f.Name())
+	assert.True(t, os.IsNotExist(err))
+}
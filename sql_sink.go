@@ -0,0 +1,681 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SQLDialect is the SQL flavor of a database: quoting, placeholders and
+// upserts differ.
+type SQLDialect int
+
+const (
+	// SQLDialectMySQL is MySQL and MariaDB.
+	SQLDialectMySQL SQLDialect = iota
+	// SQLDialectPostgres is PostgreSQL.
+	SQLDialectPostgres
+	// SQLDialectSQLite is SQLite 3.24 and later.
+	SQLDialectSQLite
+)
+
+func (d SQLDialect) String() string {
+	switch d {
+	case SQLDialectMySQL:
+		return "mysql"
+	case SQLDialectPostgres:
+		return "postgres"
+	case SQLDialectSQLite:
+		return "sqlite"
+	}
+	return fmt.Sprintf("dialect(%d)", int(d))
+}
+
+// ParseSQLDialect returns the SQLDialect named "mysql", "postgres" or "sqlite".
+func ParseSQLDialect(name string) (SQLDialect, error) {
+	for _, d := range []SQLDialect{SQLDialectMySQL, SQLDialectPostgres, SQLDialectSQLite} {
+		if d.String() == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown SQL dialect %q, one of mysql, postgres, sqlite", name)
+}
+
+func (d SQLDialect) quote(ident string) string {
+	if d == SQLDialectMySQL {
+		return "`" + strings.Replace(ident, "`", "``", -1) + "`"
+	}
+	return `"` + strings.Replace(ident, `"`, `""`, -1) + `"`
+}
+
+func (d SQLDialect) quoteAll(idents []string) []string {
+	out := make([]string, len(idents))
+	for i, id := range idents {
+		out[i] = d.quote(id)
+	}
+	return out
+}
+
+// placeholders returns n placeholders, numbered from from for Postgres.
+func (d SQLDialect) placeholders(n, from int) []string {
+	out := make([]string, n)
+	for i := range out {
+		if d == SQLDialectPostgres {
+			out[i] = "$" + strconv.Itoa(from+i)
+		} else {
+			out[i] = "?"
+		}
+	}
+	return out
+}
+
+// upsert returns an INSERT of cols replacing the row with the same first
+// keys columns, its primary key.
+func (d SQLDialect) upsert(table string, cols []string, keys int) string {
+	q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", d.quote(table),
+		strings.Join(d.quoteAll(cols), ", "), strings.Join(d.placeholders(len(cols), 1), ", "))
+	var sets []string
+	for _, c := range cols[keys:] {
+		c = d.quote(c)
+		if d == SQLDialectMySQL {
+			sets = append(sets, c+" = VALUES("+c+")")
+		} else {
+			sets = append(sets, c+" = excluded."+c)
+		}
+	}
+	if d == SQLDialectMySQL {
+		return q + " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	}
+	return q + " ON CONFLICT (" + strings.Join(d.quoteAll(cols[:keys]), ", ") + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// createTable returns a CREATE TABLE IF NOT EXISTS of text columns, the
+// first keys of them being the primary key. Typed columns are "name type".
+func (d SQLDialect) createTable(table string, cols []string, keys int) string {
+	defs := make([]string, len(cols))
+	for i, c := range cols {
+		typ := "TEXT"
+		if f := strings.Fields(c); len(f) == 2 {
+			c, typ = f[0], f[1]
+		} else if i < keys && d == SQLDialectMySQL {
+			typ = "VARCHAR(255)"
+		} else if d == SQLDialectMySQL {
+			typ = "LONGTEXT"
+		}
+		if i < keys {
+			typ += " NOT NULL"
+		}
+		cols[i] = c
+		defs[i] = d.quote(c) + " " + typ
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s, PRIMARY KEY (%s))", d.quote(table),
+		strings.Join(defs, ", "), strings.Join(d.quoteAll(cols[:keys]), ", "))
+}
+
+// SQLSinkOption specifies an option for an SQLSink.
+type SQLSinkOption struct {
+	f func(*sqlSinkOptions)
+}
+
+type sqlSinkOptions struct {
+	dialect         SQLDialect
+	stringTable     string
+	hashTables      []sqlHashTable
+	checkpointTable string
+	name            string
+	batchSize       int
+	batchInterval   time.Duration
+	createTables    bool
+	logger          Logger
+}
+
+// sqlHashTable holds the hashes whose key matches pattern, one row per key
+// with a column per field, or one row per field without columns.
+type sqlHashTable struct {
+	pattern string
+	table   string
+	columns []string
+}
+
+// SQLSinkDialect specifies the dialect of the database. Default is MySQL.
+func SQLSinkDialect(d SQLDialect) SQLSinkOption {
+	return SQLSinkOption{func(o *sqlSinkOptions) {
+		o.dialect = d
+	}}
+}
+
+// SQLSinkStringTable specifies the table of string keys, (id, value), an
+// empty name ignoring strings. Default is "redis_strings".
+func SQLSinkStringTable(table string) SQLSinkOption {
+	return SQLSinkOption{func(o *sqlSinkOptions) {
+		o.stringTable = table
+	}}
+}
+
+// SQLSinkHashTable writes the hashes whose key matches pattern, a
+// path.Match pattern like "user:*", to table. With columns the table is
+// wide, (id, columns...), and the other fields are dropped; without it is
+// entity-attribute-value, (id, field, value). The first matching pattern
+// wins, hashes matching none are ignored.
+func SQLSinkHashTable(pattern, table string, columns ...string) SQLSinkOption {
+	return SQLSinkOption{func(o *sqlSinkOptions) {
+		o.hashTables = append(o.hashTables, sqlHashTable{pattern, table, columns})
+	}}
+}
+
+// SQLSinkCheckpoint specifies the table of the checkpoints, (name, shard,
+// repl_id, offset, db), and the name of the rows of this sink. Default is
+// "canal_checkpoints" and "default".
+func SQLSinkCheckpoint(table, name string) SQLSinkOption {
+	return SQLSinkOption{func(o *sqlSinkOptions) {
+		o.checkpointTable = table
+		o.name = name
+	}}
+}
+
+// SQLSinkBatch specifies how many statements a transaction holds at most
+// and how long a partial one waits before it is committed, zero waiting
+// for Flush or Close. Default is 500 and 1s.
+func SQLSinkBatch(size int, interval time.Duration) SQLSinkOption {
+	return SQLSinkOption{func(o *sqlSinkOptions) {
+		o.batchSize = size
+		o.batchInterval = interval
+	}}
+}
+
+// SQLSinkCreateTables specifies whether NewSQLSink creates the missing
+// tables, with text columns. With MySQL the key columns are VARCHAR(255):
+// a longer key fails its transaction and stops the sink, create the tables
+// beforehand to hold them.
+func SQLSinkCreateTables(create bool) SQLSinkOption {
+	return SQLSinkOption{func(o *sqlSinkOptions) {
+		o.createTables = create
+	}}
+}
+
+// SQLSinkLogger specifies the Logger of the skipped commands.
+func SQLSinkLogger(l Logger) SQLSinkOption {
+	return SQLSinkOption{func(o *sqlSinkOptions) {
+		o.logger = l
+	}}
+}
+
+type sqlStmt struct {
+	query string
+	args  []interface{}
+}
+
+// SQLSink is a CommandDecoder materializing Redis keys into tables through
+// database/sql. The id column holds the key:
+//
+//	SET, SETNX, SETEX, PSETEX, GETSET, MSET, MSETNX  upsert the string row
+//	HSET, HSETNX, HMSET                              upsert the hash rows
+//	HDEL                                             null or delete fields
+//	DEL, UNLINK, expiring EXPIRE and alike           delete the rows
+//	RENAME, RENAMENX, COPY                           copy the rows
+//	FLUSHDB, FLUSHALL                                empty the tables
+//
+// Databases are ignored: keys of every database share the tables, filter
+// them with a DBFilter. Other write commands, like INCR or APPEND, and
+// hashes renamed to a key of another table are skipped and counted by
+// Skipped, their rows no longer matching the dataset. Statements are
+// applied in transactions together with the checkpoint of the last
+// command, so that resuming from Load applies every command mapped exactly
+// once. A full sync empties the tables and removes the checkpoint in the
+// transaction of the first rows of its snapshot; the checkpoint is back
+// once the snapshot is applied. The shards of a cluster share the tables,
+// their full syncs keep the rows of the keys deleted while disconnected.
+type SQLSink struct {
+	db   *sql.DB
+	opts sqlSinkOptions
+
+	sinkCore
+	batch   []sqlStmt
+	cps     map[string]Checkpoint // checkpoints by shard, to save
+	dbs     map[string]int        // database selected by every shard
+	last    int64                 // offset of the last command out of a snapshot
+	dirty   bool
+	applied int64
+	skipped int64
+	ownDB   bool // db is closed by Close
+}
+
+// NewSQLSink returns an SQLSink writing to db.
+func NewSQLSink(db *sql.DB, opts ...SQLSinkOption) (*SQLSink, error) {
+	s := &SQLSink{
+		db: db,
+		opts: sqlSinkOptions{
+			stringTable:     "redis_strings",
+			checkpointTable: "canal_checkpoints",
+			name:            "default",
+			batchSize:       500,
+			batchInterval:   time.Second,
+			logger:          defaultLogger,
+		},
+		cps:     make(map[string]Checkpoint),
+		dbs:     make(map[string]int),
+		last:    -1,
+		applied: -1,
+	}
+	for _, opt := range opts {
+		opt.f(&s.opts)
+	}
+	if s.opts.batchSize < 1 {
+		s.opts.batchSize = 1
+	}
+	if s.opts.createTables {
+		if err := s.createTables(); err != nil {
+			return nil, err
+		}
+	}
+	s.startFlusher(s.opts.batchInterval, s.commit)
+	return s, nil
+}
+
+func (s *SQLSink) createTables() error {
+	d := s.opts.dialect
+	stmts := []string{d.createTable(s.opts.checkpointTable,
+		[]string{"name", "shard", "repl_id", "offset BIGINT", "db BIGINT"}, 2)}
+	if s.opts.stringTable != "" {
+		stmts = append(stmts, d.createTable(s.opts.stringTable, []string{"id", "value"}, 1))
+	}
+	for _, h := range s.opts.hashTables {
+		if len(h.columns) > 0 {
+			stmts = append(stmts, d.createTable(h.table, append([]string{"id"}, h.columns...), 1))
+		} else {
+			stmts = append(stmts, d.createTable(h.table, []string{"id", "field", "value"}, 2))
+		}
+	}
+	for _, q := range stmts {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load returns the checkpoints saved with the data, making the sink a
+// CheckpointStore.
+func (s *SQLSink) Load() (Checkpoints, error) {
+	var cps Checkpoints
+	d := s.opts.dialect
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s, %s, %s, %s FROM %s WHERE %s = %s",
+		d.quote("shard"), d.quote("repl_id"), d.quote("offset"), d.quote("db"), d.quote(s.opts.checkpointTable),
+		d.quote("name"), d.placeholders(1, 1)[0]), s.opts.name)
+	if err != nil {
+		return cps, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var shard string
+		var cp Checkpoint
+		if err := rows.Scan(&shard, &cp.ReplId, &cp.Offset, &cp.DB); err != nil {
+			return cps, err
+		}
+		if shard == "" {
+			cps.Checkpoint = cp
+			continue
+		}
+		if cps.Shards == nil {
+			cps.Shards = make(map[string]Checkpoint)
+		}
+		cps.Shards[shard] = cp
+	}
+	return cps, rows.Err()
+}
+
+// Save does nothing, the checkpoints are saved with the data.
+func (s *SQLSink) Save(cps Checkpoints) error { return nil }
+
+// Applied returns the offset of the last command committed, -1 until the
+// snapshot of a full sync is.
+func (s *SQLSink) Applied() int64 { return atomic.LoadInt64(&s.applied) }
+
+// Skipped returns the number of write commands ignored.
+func (s *SQLSink) Skipped() int64 { return atomic.LoadInt64(&s.skipped) }
+
+// Command implements CommandDecoder.
+func (s *SQLSink) Command(cmd *Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	if cmd.Phase == PhaseRDB && cmd.Name() == "PING" {
+		// the start of a snapshot, committed apart from the stream
+		// before it
+		if err := s.fail(s.commit()); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&s.applied, -1)
+		s.batch = append(s.batch, s.snapshot(cmd.Shard)...)
+		s.dbs[cmd.Shard] = 0
+		return nil
+	}
+	if db, ok := selectedDB(cmd); ok && cmd.Phase != PhaseRDB {
+		s.dbs[cmd.Shard] = db
+	}
+	stmts, ok := s.statements(cmd)
+	if !ok {
+		s.skip(cmd.Name())
+	}
+	s.batch = append(s.batch, stmts...)
+	if cmd.Phase != PhaseRDB {
+		s.cps[cmd.Shard] = Checkpoint{ReplId: cmd.ReplId, Offset: cmd.Offset, DB: s.dbs[cmd.Shard]}
+		s.last = cmd.Offset
+		s.dirty = true
+	}
+	if len(s.batch) >= s.opts.batchSize {
+		return s.fail(s.commit())
+	}
+	return nil
+}
+
+// Flush commits the pending statements.
+func (s *SQLSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.fail(s.commit())
+}
+
+// Close commits the pending statements. The database is left open.
+func (s *SQLSink) Close() error {
+	s.stopFlusher()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.err
+	if err == nil {
+		err = s.commit()
+	}
+	if s.ownDB {
+		if cerr := s.db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// commit applies the batch and the checkpoints in one transaction.
+func (s *SQLSink) commit() error {
+	if len(s.batch) == 0 && !s.dirty {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, st := range s.batch {
+		if _, err := tx.Exec(st.query, st.args...); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("%s: %v", st.query, err)
+		}
+	}
+	if s.dirty {
+		q := s.opts.dialect.upsert(s.opts.checkpointTable, []string{"name", "shard", "repl_id", "offset", "db"}, 2)
+		for shard, cp := range s.cps {
+			if _, err := tx.Exec(q, s.opts.name, shard, cp.ReplId, cp.Offset, cp.DB); err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("%s: %v", q, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.batch = nil
+	if s.dirty {
+		s.cps = make(map[string]Checkpoint)
+		s.dirty = false
+		atomic.StoreInt64(&s.applied, s.last)
+	}
+	return nil
+}
+
+func (s *SQLSink) hashTable(key string) *sqlHashTable {
+	for i, h := range s.opts.hashTables {
+		if ok, _ := path.Match(h.pattern, key); ok {
+			return &s.opts.hashTables[i]
+		}
+	}
+	return nil
+}
+
+// statements maps cmd to the statements applying it, none if it does not
+// change the tables, false if it is not supported.
+func (s *SQLSink) statements(cmd *Command) ([]sqlStmt, bool) {
+	d := cmd.D
+	switch cmd.Name() {
+	case "SET", "SETNX", "GETSET":
+		if len(d) >= 3 {
+			return s.setString(d[1], d[2]), true
+		}
+	case "SETEX", "PSETEX":
+		if len(d) == 4 {
+			return s.setString(d[1], d[3]), true
+		}
+	case "MSET", "MSETNX":
+		var stmts []sqlStmt
+		for i := 1; i+1 < len(d); i += 2 {
+			stmts = append(stmts, s.setString(d[i], d[i+1])...)
+		}
+		return stmts, true
+	case "HSET", "HSETNX", "HMSET":
+		if len(d) >= 4 {
+			return s.setHash(d[1], d[2:]), true
+		}
+	case "HDEL":
+		if len(d) >= 3 {
+			return s.delHash(d[1], d[2:]), true
+		}
+	case "DEL", "UNLINK":
+		var stmts []sqlStmt
+		for _, key := range d[1:] {
+			stmts = append(stmts, s.del(key)...)
+		}
+		return stmts, true
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		if len(d) >= 3 && expiresNow(cmd.Name(), d[2]) {
+			return s.del(d[1]), true
+		}
+		// keys expiring later are deleted by the DEL the master sends then
+		return nil, true
+	case "RENAME", "RENAMENX", "COPY":
+		if len(d) >= 3 {
+			return s.copyKey(cmd.Name(), d[1], d[2]), true
+		}
+	case "FLUSHDB", "FLUSHALL":
+		var stmts []sqlStmt
+		for _, table := range s.tables() {
+			stmts = append(stmts, sqlStmt{query: "DELETE FROM " + s.opts.dialect.quote(table)})
+		}
+		return stmts, true
+	case "PERSIST", "MOVE", "SWAPDB":
+		// rows have no TTL and databases share the tables
+		return nil, true
+	}
+	if spec, ok := LookupCommand(cmd.Name()); ok && spec.IsWrite() {
+		return nil, false
+	}
+	return nil, true
+}
+
+// skip counts a write command not applied.
+func (s *SQLSink) skip(name string) {
+	atomic.AddInt64(&s.skipped, 1)
+	s.opts.logger.Debug("sql command skipped", "command", name)
+}
+
+// snapshot returns the statements starting the snapshot of shard: the
+// tables are emptied, but for a cluster shard, and the checkpoint removed.
+func (s *SQLSink) snapshot(shard string) []sqlStmt {
+	dl := s.opts.dialect
+	var stmts []sqlStmt
+	if shard == "" {
+		for _, table := range s.tables() {
+			stmts = append(stmts, sqlStmt{query: "DELETE FROM " + dl.quote(table)})
+		}
+	}
+	ph := dl.placeholders(2, 1)
+	return append(stmts, sqlStmt{fmt.Sprintf("DELETE FROM %s WHERE %s = %s AND %s = %s",
+		dl.quote(s.opts.checkpointTable), dl.quote("name"), ph[0], dl.quote("shard"), ph[1]),
+		[]interface{}{s.opts.name, shard}})
+}
+
+// copyKey copies the rows of from to to, deleting those of from but for
+// COPY. A hash is only copied within its table.
+func (s *SQLSink) copyKey(name, from, to string) []sqlStmt {
+	dl := s.opts.dialect
+	stmts := s.del(to)
+	copyRows := func(table string, cols []string) {
+		ph := dl.placeholders(2, 1)
+		q := fmt.Sprintf("INSERT INTO %s (%s, %s) SELECT %s, %s FROM %s WHERE %s = %s",
+			dl.quote(table), dl.quote("id"), strings.Join(dl.quoteAll(cols), ", "),
+			ph[0], strings.Join(dl.quoteAll(cols), ", "), dl.quote(table), dl.quote("id"), ph[1])
+		stmts = append(stmts, sqlStmt{q, []interface{}{to, from}})
+	}
+	if s.opts.stringTable != "" {
+		copyRows(s.opts.stringTable, []string{"value"})
+	}
+	switch hf, ht := s.hashTable(from), s.hashTable(to); {
+	case ht == nil:
+	case ht == hf && len(ht.columns) > 0:
+		copyRows(ht.table, ht.columns)
+	case ht == hf:
+		copyRows(ht.table, []string{"field", "value"})
+	default:
+		// the fields are not known, or in a table of another layout
+		s.skip(name)
+	}
+	if name != "COPY" && from != to {
+		stmts = append(stmts, s.del(from)...)
+	}
+	return stmts
+}
+
+func (s *SQLSink) tables() []string {
+	var tables []string
+	if s.opts.stringTable != "" {
+		tables = append(tables, s.opts.stringTable)
+	}
+	for _, h := range s.opts.hashTables {
+		tables = append(tables, h.table)
+	}
+	return tables
+}
+
+func (s *SQLSink) setString(key, value string) []sqlStmt {
+	if s.opts.stringTable == "" {
+		return nil
+	}
+	return []sqlStmt{{s.opts.dialect.upsert(s.opts.stringTable, []string{"id", "value"}, 1), []interface{}{key, value}}}
+}
+
+func (s *SQLSink) setHash(key string, pairs []string) []sqlStmt {
+	h := s.hashTable(key)
+	if h == nil {
+		return nil
+	}
+	dl := s.opts.dialect
+	if len(h.columns) == 0 {
+		var stmts []sqlStmt
+		q := dl.upsert(h.table, []string{"id", "field", "value"}, 2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			stmts = append(stmts, sqlStmt{q, []interface{}{key, pairs[i], pairs[i+1]}})
+		}
+		return stmts
+	}
+	values := make(map[string]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		values[pairs[i]] = pairs[i+1]
+	}
+	cols, args := []string{"id"}, []interface{}{key}
+	for _, c := range h.columns {
+		if v, ok := values[c]; ok {
+			cols, args = append(cols, c), append(args, v)
+		}
+	}
+	if len(cols) == 1 {
+		return nil
+	}
+	return []sqlStmt{{dl.upsert(h.table, cols, 1), args}}
+}
+
+func (s *SQLSink) delHash(key string, fields []string) []sqlStmt {
+	h := s.hashTable(key)
+	if h == nil {
+		return nil
+	}
+	dl := s.opts.dialect
+	if len(h.columns) == 0 {
+		var stmts []sqlStmt
+		ph := dl.placeholders(2, 1)
+		q := fmt.Sprintf("DELETE FROM %s WHERE %s = %s AND %s = %s",
+			dl.quote(h.table), dl.quote("id"), ph[0], dl.quote("field"), ph[1])
+		for _, f := range fields {
+			stmts = append(stmts, sqlStmt{q, []interface{}{key, f}})
+		}
+		return stmts
+	}
+	var sets []string
+	for _, c := range h.columns {
+		for _, f := range fields {
+			if f == c {
+				sets = append(sets, dl.quote(c)+" = NULL")
+				break
+			}
+		}
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	q := fmt.Sprintf("UPDATE %s SET %s WHERE %s = %s",
+		dl.quote(h.table), strings.Join(sets, ", "), dl.quote("id"), dl.placeholders(1, 1)[0])
+	return []sqlStmt{{q, []interface{}{key}}}
+}
+
+// del deletes key from the string table and its hash table, its type
+// being unknown.
+func (s *SQLSink) del(key string) []sqlStmt {
+	var tables []string
+	if s.opts.stringTable != "" {
+		tables = append(tables, s.opts.stringTable)
+	}
+	if h := s.hashTable(key); h != nil {
+		tables = append(tables, h.table)
+	}
+	stmts := make([]sqlStmt, len(tables))
+	for i, table := range tables {
+		dl := s.opts.dialect
+		stmts[i] = sqlStmt{fmt.Sprintf("DELETE FROM %s WHERE %s = %s",
+			dl.quote(table), dl.quote("id"), dl.placeholders(1, 1)[0]), []interface{}{key}}
+	}
+	return stmts
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSQL is a database/sql driver recording the statements committed, one
+// string each with its arguments. Queries return rows.
+type fakeSQL struct {
+	mu        sync.Mutex
+	committed []string
+	rows      [][]driver.Value
+	fail      func(query string) error
+}
+
+var (
+	fakeSQLMu  sync.Mutex
+	fakeSQLDBs = make(map[string]*fakeSQL)
+)
+
+func init() { sql.Register("canalfake", fakeSQLDriver{}) }
+
+// newFakeSQL returns a fake database and a *sql.DB opened on it.
+func newFakeSQL(t *testing.T) (*fakeSQL, *sql.DB) {
+	f := &fakeSQL{}
+	fakeSQLMu.Lock()
+	fakeSQLDBs[t.Name()] = f
+	fakeSQLMu.Unlock()
+	db, err := sql.Open("canalfake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, db
+}
+
+func (f *fakeSQL) statements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.committed...)
+}
+
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(dsn string) (driver.Conn, error) {
+	fakeSQLMu.Lock()
+	defer fakeSQLMu.Unlock()
+	f := fakeSQLDBs[dsn]
+	if f == nil {
+		return nil, fmt.Errorf("no fake database %q", dsn)
+	}
+	return &fakeSQLConn{db: f}, nil
+}
+
+type fakeSQLConn struct {
+	db  *fakeSQL
+	log []string // statements of the transaction
+	tx  bool
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{c, query}, nil
+}
+
+func (c *fakeSQLConn) Close() error { return nil }
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	c.tx, c.log = true, nil
+	return c, nil
+}
+
+func (c *fakeSQLConn) Commit() error {
+	c.db.mu.Lock()
+	c.db.committed = append(c.db.committed, c.log...)
+	c.db.mu.Unlock()
+	c.tx, c.log = false, nil
+	return nil
+}
+
+func (c *fakeSQLConn) Rollback() error {
+	c.tx, c.log = false, nil
+	return nil
+}
+
+type fakeSQLStmt struct {
+	conn  *fakeSQLConn
+	query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.conn.db.fail != nil {
+		if err := s.conn.db.fail(s.query); err != nil {
+			return nil, err
+		}
+	}
+	stmt := s.query
+	if len(args) > 0 {
+		stmt += fmt.Sprint(args)
+	}
+	if s.conn.tx {
+		s.conn.log = append(s.conn.log, stmt)
+	} else {
+		s.conn.db.mu.Lock()
+		s.conn.db.committed = append(s.conn.db.committed, stmt)
+		s.conn.db.mu.Unlock()
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeSQLRows{rows: s.conn.db.rows}, nil
+}
+
+type fakeSQLRows struct{ rows [][]driver.Value }
+
+func (r *fakeSQLRows) Columns() []string { return []string{"shard", "repl_id", "offset", "db"} }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func sqlCommands(s *SQLSink, offset int64, phase Phase, cmds ...string) error {
+	for _, c := range cmds {
+		if err := s.Command(&Command{D: strings.Fields(c), Offset: offset, ReplId: "abc", Phase: phase}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSQLSink(t *testing.T) {
+	f, db := newFakeSQL(t)
+	defer db.Close()
+	s, err := NewSQLSink(db, SQLSinkBatch(100, 0),
+		SQLSinkHashTable("user:*", "users", "name", "age"),
+		SQLSinkHashTable("cart:*", "carts"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, sqlCommands(s, 10, PhaseStreaming,
+		"SET a 1",
+		"MSET b 2 c 3",
+		"HSET user:1 name x age 3 other y",
+		"HSET cart:1 apple 2",
+		"HDEL user:1 age other",
+		"HDEL cart:1 apple",
+		"HSET misc f v",
+		"RPUSH list x",
+		"DEL user:1 b",
+		"EXPIRE c 0",
+	))
+	assert.Equal(t, int64(-1), s.Applied())
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, int64(10), s.Applied())
+
+	assert.Equal(t, []string{
+		"INSERT INTO `redis_strings` (`id`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)[a 1]",
+		"INSERT INTO `redis_strings` (`id`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)[b 2]",
+		"INSERT INTO `redis_strings` (`id`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)[c 3]",
+		"INSERT INTO `users` (`id`, `name`, `age`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `name` = VALUES(`name`), `age` = VALUES(`age`)[user:1 x 3]",
+		"INSERT INTO `carts` (`id`, `field`, `value`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)[cart:1 apple 2]",
+		"UPDATE `users` SET `age` = NULL WHERE `id` = ?[user:1]",
+		"DELETE FROM `carts` WHERE `id` = ? AND `field` = ?[cart:1 apple]",
+		"DELETE FROM `redis_strings` WHERE `id` = ?[user:1]",
+		"DELETE FROM `users` WHERE `id` = ?[user:1]",
+		"DELETE FROM `redis_strings` WHERE `id` = ?[b]",
+		"DELETE FROM `redis_strings` WHERE `id` = ?[c]",
+		"INSERT INTO `canal_checkpoints` (`name`, `shard`, `repl_id`, `offset`, `db`) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE `repl_id` = VALUES(`repl_id`), `offset` = VALUES(`offset`), `db` = VALUES(`db`)[default  abc 10 0]",
+	}, f.statements())
+	assert.Nil(t, s.Close())
+}
+
+func TestSQLSinkTransactions(t *testing.T) {
+	f, db := newFakeSQL(t)
+	defer db.Close()
+	s, err := NewSQLSink(db, SQLSinkBatch(2, 0), SQLSinkStringTable("kv"), SQLSinkCheckpoint("cp", "p1"))
+	assert.Nil(t, err)
+
+	// a snapshot does not move the checkpoint
+	assert.Nil(t, sqlCommands(s, 5, PhaseRDB, "SET a 1", "SET b 2"))
+	assert.Len(t, f.statements(), 2)
+	assert.Equal(t, int64(-1), s.Applied())
+
+	assert.Nil(t, sqlCommands(s, 20, PhaseStreaming, "PING", "SET c 3", "FLUSHALL"))
+	assert.Equal(t, int64(20), s.Applied())
+	assert.Equal(t, []string{
+		"INSERT INTO `kv` (`id`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)[c 3]",
+		"DELETE FROM `kv`",
+		"INSERT INTO `cp` (`name`, `shard`, `repl_id`, `offset`, `db`) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE `repl_id` = VALUES(`repl_id`), `offset` = VALUES(`offset`), `db` = VALUES(`db`)[p1  abc 20 0]",
+	}, f.statements()[2:])
+
+	// a failed statement rolls the transaction back
+	f.fail = func(query string) error {
+		if strings.Contains(query, "DELETE") {
+			return errors.New("locked")
+		}
+		return nil
+	}
+	assert.Nil(t, sqlCommands(s, 30, PhaseStreaming, "SET d 4"))
+	err = sqlCommands(s, 40, PhaseStreaming, "DEL d")
+	assert.NotNil(t, err)
+	assert.Len(t, f.statements(), 5)
+	assert.Equal(t, int64(20), s.Applied())
+	assert.Equal(t, err, sqlCommands(s, 50, PhaseStreaming, "SET e 5"))
+	assert.Equal(t, err, s.Close())
+}
+
+func TestSQLSinkSnapshot(t *testing.T) {
+	f, db := newFakeSQL(t)
+	defer db.Close()
+	s, err := NewSQLSink(db, SQLSinkBatch(2, 0), SQLSinkStringTable("kv"), SQLSinkCheckpoint("cp", "p1"),
+		SQLSinkHashTable("user:*", "users"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, sqlCommands(s, 10, PhaseStreaming, "SET stale 1"))
+	// the tables are emptied with the first rows of the snapshot
+	assert.Nil(t, sqlCommands(s, 100, PhaseRDB, "PING"))
+	assert.Equal(t, int64(-1), s.Applied())
+	assert.Equal(t, []string{
+		"INSERT INTO `kv` (`id`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)[stale 1]",
+		"INSERT INTO `cp` (`name`, `shard`, `repl_id`, `offset`, `db`) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE `repl_id` = VALUES(`repl_id`), `offset` = VALUES(`offset`), `db` = VALUES(`db`)[p1  abc 10 0]",
+	}, f.statements())
+	assert.Nil(t, sqlCommands(s, 100, PhaseRDB, "SET a 1"))
+	assert.Equal(t, []string{
+		"DELETE FROM `kv`",
+		"DELETE FROM `users`",
+		"DELETE FROM `cp` WHERE `name` = ? AND `shard` = ?[p1 ]",
+		"INSERT INTO `kv` (`id`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `value` = VALUES(`value`)[a 1]",
+	}, f.statements()[2:])
+
+	// a cluster shard only removes its checkpoint
+	assert.Nil(t, s.Command(&Command{D: []string{"PING"}, Offset: 200, ReplId: "def", Shard: "s1", Phase: PhaseRDB}))
+	assert.Nil(t, s.Flush())
+	assert.Equal(t, []string{"DELETE FROM `cp` WHERE `name` = ? AND `shard` = ?[p1 s1]"}, f.statements()[6:])
+	assert.Nil(t, sqlCommands(s, 214, PhaseStreaming, "PING"))
+	assert.Nil(t, s.Close())
+	assert.Equal(t, int64(214), s.Applied())
+}
+
+func TestSQLSinkKeyspace(t *testing.T) {
+	f, db := newFakeSQL(t)
+	defer db.Close()
+	s, err := NewSQLSink(db, SQLSinkBatch(100, 0), SQLSinkLogger(NopLogger{}),
+		SQLSinkHashTable("user:*", "users", "name"), SQLSinkHashTable("cart:*", "carts"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, sqlCommands(s, 10, PhaseStreaming,
+		"RENAME user:1 user:2",
+		"COPY cart:1 cart:2",
+		"RENAME cart:2 user:3",
+		"INCR a",
+		"EXPIRE a 100",
+	))
+	assert.Nil(t, s.Close())
+	assert.Equal(t, int64(2), s.Skipped()) // RENAME to another table, INCR
+	assert.Equal(t, []string{
+		"DELETE FROM `redis_strings` WHERE `id` = ?[user:2]",
+		"DELETE FROM `users` WHERE `id` = ?[user:2]",
+		"INSERT INTO `redis_strings` (`id`, `value`) SELECT ?, `value` FROM `redis_strings` WHERE `id` = ?[user:2 user:1]",
+		"INSERT INTO `users` (`id`, `name`) SELECT ?, `name` FROM `users` WHERE `id` = ?[user:2 user:1]",
+		"DELETE FROM `redis_strings` WHERE `id` = ?[user:1]",
+		"DELETE FROM `users` WHERE `id` = ?[user:1]",
+		"DELETE FROM `redis_strings` WHERE `id` = ?[cart:2]",
+		"DELETE FROM `carts` WHERE `id` = ?[cart:2]",
+		"INSERT INTO `redis_strings` (`id`, `value`) SELECT ?, `value` FROM `redis_strings` WHERE `id` = ?[cart:2 cart:1]",
+		"INSERT INTO `carts` (`id`, `field`, `value`) SELECT ?, `field`, `value` FROM `carts` WHERE `id` = ?[cart:2 cart:1]",
+		"DELETE FROM `redis_strings` WHERE `id` = ?[user:3]",
+		"DELETE FROM `users` WHERE `id` = ?[user:3]",
+		"INSERT INTO `redis_strings` (`id`, `value`) SELECT ?, `value` FROM `redis_strings` WHERE `id` = ?[user:3 cart:2]",
+		"DELETE FROM `redis_strings` WHERE `id` = ?[cart:2]",
+		"DELETE FROM `carts` WHERE `id` = ?[cart:2]",
+		"INSERT INTO `canal_checkpoints` (`name`, `shard`, `repl_id`, `offset`, `db`) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE `repl_id` = VALUES(`repl_id`), `offset` = VALUES(`offset`), `db` = VALUES(`db`)[default  abc 10 0]",
+	}, f.statements())
+}
+
+func TestSQLSinkPostgres(t *testing.T) {
+	f, db := newFakeSQL(t)
+	defer db.Close()
+	f.rows = [][]driver.Value{{"", "abc", int64(42), int64(0)}, {"127.0.0.1:7000", "def", int64(7), int64(3)}}
+	s, err := NewSQLSink(db, SQLSinkDialect(SQLDialectPostgres), SQLSinkCreateTables(true),
+		SQLSinkBatch(1, 0), SQLSinkHashTable("user:*", "users", "name"))
+	assert.Nil(t, err)
+
+	cps, err := s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, Checkpoints{
+		Checkpoint: Checkpoint{ReplId: "abc", Offset: 42},
+		Shards:     map[string]Checkpoint{"127.0.0.1:7000": {ReplId: "def", Offset: 7, DB: 3}},
+	}, cps)
+
+	assert.Nil(t, s.Command(&Command{D: []string{"SELECT", "2"}, Offset: 40, ReplId: "abc", Shard: "s1"}))
+	assert.Nil(t, s.Command(&Command{D: []string{"HSET", "user:1", "name", "x"}, Offset: 50, ReplId: "abc", Shard: "s1"}))
+	assert.Equal(t, []string{
+		`CREATE TABLE IF NOT EXISTS "canal_checkpoints" ("name" TEXT NOT NULL, "shard" TEXT NOT NULL, "repl_id" TEXT, "offset" BIGINT, "db" BIGINT, PRIMARY KEY ("name", "shard"))`,
+		`CREATE TABLE IF NOT EXISTS "redis_strings" ("id" TEXT NOT NULL, "value" TEXT, PRIMARY KEY ("id"))`,
+		`CREATE TABLE IF NOT EXISTS "users" ("id" TEXT NOT NULL, "name" TEXT, PRIMARY KEY ("id"))`,
+		`INSERT INTO "users" ("id", "name") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "name" = excluded."name"[user:1 x]`,
+		`INSERT INTO "canal_checkpoints" ("name", "shard", "repl_id", "offset", "db") VALUES ($1, $2, $3, $4, $5) ON CONFLICT ("name", "shard") DO UPDATE SET "repl_id" = excluded."repl_id", "offset" = excluded."offset", "db" = excluded."db"[default s1 abc 50 2]`,
+	}, f.statements())
+	assert.Nil(t, s.Close())
+}
+
+func TestSQLSinkInterval(t *testing.T) {
+	f, db := newFakeSQL(t)
+	defer db.Close()
+	s, err := NewSQLSink(db, SQLSinkBatch(100, 20*time.Millisecond))
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, sqlCommands(s, 10, PhaseStreaming, "SET a 1"))
+	for deadline := time.Now().Add(2 * time.Second); s.Applied() != 10 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(10), s.Applied())
+	assert.Len(t, f.statements(), 2)
+}
+
+func TestParseSQLDialect(t *testing.T) {
+	for _, d := range []SQLDialect{SQLDialectMySQL, SQLDialectPostgres, SQLDialectSQLite} {
+		parsed, err := ParseSQLDialect(d.String())
+		assert.Nil(t, err)
+		assert.Equal(t, d, parsed)
+	}
+	_, err := ParseSQLDialect("oracle")
+	assert.NotNil(t, err)
+	assert.Equal(t, `INSERT INTO "t" ("id", "v") VALUES (?, ?) ON CONFLICT ("id") DO UPDATE SET "v" = excluded."v"`,
+		SQLDialectSQLite.upsert("t", []string{"id", "v"}, 1))
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StreamSinkOption specifies an option for a StreamSink.
+type StreamSinkOption struct {
+	f func(*streamSinkOptions)
+}
+
+type streamSinkOptions struct {
+	redisOpts []RedisSinkOption
+	maxLen    int64
+	db        int
+	routes    []streamRoute
+}
+
+type streamRoute struct {
+	prefix string
+	stream string
+}
+
+// StreamSinkRedisOptions specifies the options of the connection to the
+// target server: dialing, pipelining window, flush interval and retries.
+func StreamSinkRedisOptions(opts ...RedisSinkOption) StreamSinkOption {
+	return StreamSinkOption{func(o *streamSinkOptions) {
+		o.redisOpts = opts
+	}}
+}
+
+// StreamSinkMaxLen specifies the approximate length streams are trimmed
+// to, with MAXLEN ~. Default is zero, streams are not trimmed.
+func StreamSinkMaxLen(n int64) StreamSinkOption {
+	return StreamSinkOption{func(o *streamSinkOptions) {
+		o.maxLen = n
+	}}
+}
+
+// StreamSinkDB specifies the database of the streams. Default is 0.
+func StreamSinkDB(db int) StreamSinkOption {
+	return StreamSinkOption{func(o *streamSinkOptions) {
+		o.db = db
+	}}
+}
+
+// StreamSinkRoute sends the events whose first key starts with prefix to
+// stream instead of the default one. The longest matching prefix wins.
+func StreamSinkRoute(prefix, stream string) StreamSinkOption {
+	return StreamSinkOption{func(o *streamSinkOptions) {
+		o.routes = append(o.routes, streamRoute{prefix, stream})
+	}}
+}
+
+// StreamSink is a CommandDecoder appending each change event to a Redis
+// Stream of another server, for consumer groups. An entry has the fields
+// cmd, db, keys, args and offset, keys and args being JSON arrays of
+// strings, plus encoding "base64" when they are base64 encoded like in
+// the JSON Event. Entries get ids from the target, so the tail replayed
+// after a transient error may be appended twice.
+type StreamSink struct {
+	stream string
+	opts   streamSinkOptions
+	sink   *RedisSink
+	dbs    dbTracker
+}
+
+// NewStreamSink connects to the server at addr and appends to stream.
+func NewStreamSink(addr, stream string, opts ...StreamSinkOption) (*StreamSink, error) {
+	s := &StreamSink{stream: stream}
+	for _, opt := range opts {
+		opt.f(&s.opts)
+	}
+	// longest prefixes first
+	sort.SliceStable(s.opts.routes, func(i, j int) bool {
+		return len(s.opts.routes[i].prefix) > len(s.opts.routes[j].prefix)
+	})
+	sink, err := NewRedisSink(addr, s.opts.redisOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.db != 0 {
+		// sets the database the sink selects before the first XADD
+		sel, _ := NewCommand("SELECT", strconv.Itoa(s.opts.db))
+		if err := sink.Command(sel); err != nil {
+			_ = sink.Close()
+			return nil, err
+		}
+	}
+	s.sink = sink
+	return s, nil
+}
+
+// Applied returns the offset of the last event acknowledged by the target.
+func (s *StreamSink) Applied() int64 { return s.sink.Applied() }
+
+// Command implements CommandDecoder.
+func (s *StreamSink) Command(cmd *Command) error {
+	e := s.dbs.event(cmd)
+	switch e.Command {
+	case "PING", "REPLCONF":
+		// not appended, but they let Applied move past the snapshot
+		return s.sink.Command(cmd)
+	case "", "SELECT":
+		return nil
+	}
+	xadd := &Command{D: s.xadd(e), Offset: cmd.Offset, Shard: cmd.Shard, ReplId: cmd.ReplId, Phase: cmd.Phase}
+	return s.sink.Command(xadd)
+}
+
+// Flush sends the buffered entries and waits for their replies.
+func (s *StreamSink) Flush() error { return s.sink.Flush() }
+
+// Close flushes the buffered entries and closes the connection.
+func (s *StreamSink) Close() error { return s.sink.Close() }
+
+// streamFor returns the stream of the events with the key.
+func (s *StreamSink) streamFor(keys []string) string {
+	if len(keys) > 0 {
+		for _, r := range s.opts.routes {
+			if strings.HasPrefix(keys[0], r.prefix) {
+				return r.stream
+			}
+		}
+	}
+	return s.stream
+}
+
+func (s *StreamSink) xadd(e *Event) []string {
+	d := []string{"XADD", s.streamFor(e.Keys)}
+	if s.opts.maxLen > 0 {
+		d = append(d, "MAXLEN", "~", strconv.FormatInt(s.opts.maxLen, 10))
+	}
+	keys, args := e.Keys, e.Args
+	encoded := !validUTF8(keys) || !validUTF8(args)
+	if encoded {
+		keys, args = encodeBase64(keys), encodeBase64(args)
+	}
+	d = append(d, "*",
+		"cmd", e.Command,
+		"db", strconv.Itoa(e.DB),
+		"keys", jsonStrings(keys),
+		"args", jsonStrings(args),
+		"offset", strconv.FormatInt(e.Offset, 10))
+	if encoded {
+		d = append(d, "encoding", "base64")
+	}
+	return d
+}
+
+// jsonStrings returns ss as a JSON array, [] when empty.
+func jsonStrings(ss []string) string {
+	if ss == nil {
+		ss = []string{}
+	}
+	b, _ := json.Marshal(ss)
+	return string(b)
+}
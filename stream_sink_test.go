@@ -0,0 +1,93 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamSink(t *testing.T) {
+	srv := newFakeRedis(t, func(d []string) Value {
+		if d[0] == "XADD" {
+			return StringValue("1-0")
+		}
+		return SimpleStringValue("OK")
+	})
+	defer srv.close()
+
+	sink, err := NewStreamSink(srv.addr(), "changes",
+		StreamSinkMaxLen(1000),
+		StreamSinkDB(3),
+		StreamSinkRoute("user:", "users"),
+		StreamSinkRoute("user:admin:", "admins"),
+		StreamSinkRedisOptions(RedisSinkFlushInterval(time.Hour)),
+	)
+	assert.Nil(t, err)
+
+	for i, d := range [][]string{
+		{"SET", "a", "1"},
+		{"SELECT", "2"},
+		{"PING"},
+		{"HSET", "user:1", "name", "x"},
+		{"DEL", "user:admin:2", "b"},
+		{"FLUSHALL"},
+		{"SET", "c", "\xff"},
+	} {
+		assert.Nil(t, sink.Command(&Command{D: d, Offset: int64(10 * (i + 1))}))
+	}
+	assert.Nil(t, sink.Close())
+
+	assert.Equal(t, []string{
+		"SELECT 3",
+		`XADD changes MAXLEN ~ 1000 * cmd SET db 0 keys ["a"] args ["a","1"] offset 10`,
+		`XADD users MAXLEN ~ 1000 * cmd HSET db 2 keys ["user:1"] args ["user:1","name","x"] offset 40`,
+		`XADD admins MAXLEN ~ 1000 * cmd DEL db 2 keys ["user:admin:2","b"] args ["user:admin:2","b"] offset 50`,
+		`XADD changes MAXLEN ~ 1000 * cmd FLUSHALL db 2 keys [] args [] offset 60`,
+		`XADD changes MAXLEN ~ 1000 * cmd SET db 2 keys ["Yw=="] args ["Yw==","/w=="] offset 70 encoding base64`,
+	}, srv.commands())
+	assert.Equal(t, int64(70), sink.Applied())
+}
+
+func TestStreamSinkSnapshot(t *testing.T) {
+	srv := newFakeRedis(t, nil)
+	defer srv.close()
+	sink, err := NewStreamSink(srv.addr(), "changes", StreamSinkRedisOptions(RedisSinkFlushInterval(time.Hour)))
+	assert.Nil(t, err)
+
+	assert.Nil(t, sink.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 100, Phase: PhaseRDB}))
+	assert.Nil(t, sink.Flush())
+	assert.Equal(t, int64(-1), sink.Applied())
+	assert.Nil(t, sink.Command(&Command{D: []string{"PING"}, Offset: 114, Phase: PhaseStreaming}))
+	assert.Equal(t, int64(114), sink.Applied())
+	assert.Nil(t, sink.Close())
+	assert.Len(t, srv.commands(), 1)
+}
+
+func TestStreamSinkUntrimmed(t *testing.T) {
+	srv := newFakeRedis(t, nil)
+	defer srv.close()
+
+	sink, err := NewStreamSink(srv.addr(), "changes")
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Command(&Command{D: []string{"INCR", "n"}, Offset: 5}))
+	assert.Nil(t, sink.Flush())
+	assert.Equal(t, []string{`XADD changes * cmd INCR db 0 keys ["n"] args ["n"] offset 5`}, srv.commands())
+	assert.Nil(t, sink.Close())
+}
@@ -0,0 +1,338 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// WebhookSinkOption specifies an option for a WebhookSink.
+type WebhookSinkOption struct {
+	f func(*webhookSinkOptions)
+}
+
+type webhookSinkOptions struct {
+	client        *http.Client
+	header        http.Header
+	batchSize     int
+	batchInterval time.Duration
+	maxRetries    int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	deadLetter    string
+	logger        Logger
+}
+
+// WebhookSinkClient specifies the HTTP client. Default has a 10s timeout.
+func WebhookSinkClient(c *http.Client) WebhookSinkOption {
+	return WebhookSinkOption{func(o *webhookSinkOptions) {
+		o.client = c
+	}}
+}
+
+// WebhookSinkHeader adds a header to the requests, for authentication.
+func WebhookSinkHeader(key, value string) WebhookSinkOption {
+	return WebhookSinkOption{func(o *webhookSinkOptions) {
+		o.header.Add(key, value)
+	}}
+}
+
+// WebhookSinkBatch specifies how many events a batch holds at most and how
+// long a partial batch waits before it is posted, zero waiting for Flush or
+// Close. Default is 100 and 1s.
+func WebhookSinkBatch(size int, interval time.Duration) WebhookSinkOption {
+	return WebhookSinkOption{func(o *webhookSinkOptions) {
+		o.batchSize = size
+		o.batchInterval = interval
+	}}
+}
+
+// WebhookSinkRetry specifies how many times a batch is posted again after a
+// 5xx, 429 or transport error, waiting from min to max, doubling each time.
+// Default is 5 retries from 100ms to 10s.
+func WebhookSinkRetry(maxRetries int, min, max time.Duration) WebhookSinkOption {
+	return WebhookSinkOption{func(o *webhookSinkOptions) {
+		o.maxRetries = maxRetries
+		o.minBackoff = min
+		o.maxBackoff = max
+	}}
+}
+
+// WebhookSinkDeadLetter specifies a file the batches failing permanently
+// are appended to, one JSON object per line, before the sink moves on.
+// Without it, such a batch stops the sink.
+func WebhookSinkDeadLetter(path string) WebhookSinkOption {
+	return WebhookSinkOption{func(o *webhookSinkOptions) {
+		o.deadLetter = path
+	}}
+}
+
+// WebhookSinkLogger specifies the Logger of retries and dead letters.
+func WebhookSinkLogger(l Logger) WebhookSinkOption {
+	return WebhookSinkOption{func(o *webhookSinkOptions) {
+		o.logger = l
+	}}
+}
+
+// WebhookBatch is the body posted by a WebhookSink.
+type WebhookBatch struct {
+	// Key is the same for every post of the batch: the replId, offset and
+	// rank among the events of that offset of its first event, and the
+	// number of events. It is also sent as the Idempotency-Key header.
+	Key    string   `json:"key"`
+	Events []*Event `json:"events"`
+}
+
+// WebhookError is a batch post answered with a non 2xx status.
+type WebhookError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("webhook: %d %s", e.StatusCode, e.Body)
+}
+
+// WebhookSink is a CommandDecoder posting batches of change events, in
+// their JSON encoding, to a URL. An offset is applied once the batch
+// holding it is answered with a 2xx status, or dead lettered, and not
+// before the snapshot of a full sync is entirely posted. SELECT and
+// replication heartbeats are not posted, each Event has its database.
+type WebhookSink struct {
+	url  string
+	opts webhookSinkOptions
+
+	sinkCore
+	dbs     dbTracker
+	batch   []*Event
+	seq     int    // rank of the last event among those of its offset
+	last    int64  // offset of the last event
+	key     string // key of the batch
+	dead    *os.File
+	applied int64
+}
+
+// NewWebhookSink returns a WebhookSink posting to url.
+func NewWebhookSink(url string, opts ...WebhookSinkOption) (*WebhookSink, error) {
+	s := &WebhookSink{
+		url: url,
+		opts: webhookSinkOptions{
+			client:        &http.Client{Timeout: 10 * time.Second},
+			header:        make(http.Header),
+			batchSize:     100,
+			batchInterval: time.Second,
+			maxRetries:    5,
+			minBackoff:    100 * time.Millisecond,
+			maxBackoff:    10 * time.Second,
+			logger:        defaultLogger,
+		},
+		last:    -1,
+		applied: -1,
+	}
+	for _, opt := range opts {
+		opt.f(&s.opts)
+	}
+	if s.opts.batchSize < 1 {
+		s.opts.batchSize = 1
+	}
+	if s.opts.deadLetter != "" {
+		f, err := os.OpenFile(s.opts.deadLetter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.dead = f
+	}
+	s.startFlusher(s.opts.batchInterval, s.post)
+	return s, nil
+}
+
+// Applied returns the offset of the last event acknowledged.
+func (s *WebhookSink) Applied() int64 { return atomic.LoadInt64(&s.applied) }
+
+// Command implements CommandDecoder.
+func (s *WebhookSink) Command(cmd *Command) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	e := s.dbs.event(cmd)
+	switch e.Command {
+	case "PING", "REPLCONF":
+		// with nothing pending everything before a heartbeat is applied
+		if e.Phase == PhaseRDB {
+			// the start of a snapshot, possibly an empty one
+			if err := s.fail(s.post()); err != nil {
+				return err
+			}
+			atomic.StoreInt64(&s.applied, -1)
+		} else if len(s.batch) == 0 && e.Offset > 0 {
+			atomic.StoreInt64(&s.applied, e.Offset)
+		}
+		return nil
+	case "", "SELECT":
+		return nil
+	}
+	if e.Offset == s.last {
+		s.seq++
+	} else {
+		s.seq, s.last = 0, e.Offset
+	}
+	if len(s.batch) == 0 {
+		s.key = fmt.Sprintf("%s-%d-%d", e.ReplId, e.Offset, s.seq)
+	}
+	s.batch = append(s.batch, e)
+	if len(s.batch) >= s.opts.batchSize {
+		return s.fail(s.post())
+	}
+	return nil
+}
+
+// Flush posts the pending batch.
+func (s *WebhookSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.fail(s.post())
+}
+
+// Close posts the pending batch and closes the dead letter file. A batch
+// being retried is given up.
+func (s *WebhookSink) Close() error {
+	s.stopFlusher()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.err
+	if err == nil {
+		err = s.post()
+	}
+	if s.dead != nil {
+		if cerr := s.dead.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// post sends the batch until it is acknowledged or fails permanently.
+func (s *WebhookSink) post() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	events := s.batch
+	batch := WebhookBatch{
+		Key:    fmt.Sprintf("%s-%d", s.key, len(events)),
+		Events: events,
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	b := newBackoff(s.opts.minBackoff, s.opts.maxBackoff)
+	for attempt := 0; ; attempt++ {
+		err = s.send(batch.Key, body)
+		if err == nil {
+			break
+		}
+		if !retryable(err) || attempt >= s.opts.maxRetries {
+			if s.dead == nil {
+				return err
+			}
+			if derr := s.deadLetter(batch, err); derr != nil {
+				return derr
+			}
+			s.opts.logger.Warn("webhook batch dead lettered", "key", batch.Key, "err", err)
+			break
+		}
+		s.opts.logger.Debug("webhook batch retried", "key", batch.Key, "attempt", attempt+1, "err", err)
+		if !b.wait(s.stop) {
+			return ErrSinkClosed
+		}
+	}
+	// the snapshot events all carry the offset of the full sync, which is
+	// only reached once the whole snapshot is posted: there is no position
+	// to resume from until then
+	if last := events[len(events)-1]; last.Phase == PhaseRDB {
+		atomic.StoreInt64(&s.applied, -1)
+	} else {
+		atomic.StoreInt64(&s.applied, last.Offset)
+	}
+	s.batch = nil
+	return nil
+}
+
+func (s *WebhookSink) send(key string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range s.opts.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := s.opts.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	return &WebhookError{StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(msg))}
+}
+
+// retryable reports whether a post may succeed later: transport errors,
+// 5xx and 429.
+func retryable(err error) bool {
+	if e, ok := err.(*WebhookError); ok {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func (s *WebhookSink) deadLetter(batch WebhookBatch, cause error) error {
+	b, err := json.Marshal(struct {
+		WebhookBatch
+		Error string    `json:"error"`
+		Time  time.Time `json:"time"`
+	}{batch, cause.Error(), time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err := s.dead.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return s.dead.Sync()
+}
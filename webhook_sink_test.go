@@ -0,0 +1,229 @@
+/*
+Copyright 2019 yametech.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package canal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookPost struct {
+	key   string
+	batch WebhookBatch
+}
+
+// webhookServer answers the posts with the statuses given, then 200.
+func webhookServer(statuses ...int) (*httptest.Server, func() []webhookPost) {
+	var (
+		mu    sync.Mutex
+		posts []webhookPost
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch WebhookBatch
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		posts = append(posts, webhookPost{r.Header.Get("Idempotency-Key"), batch})
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return srv, func() []webhookPost {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookPost(nil), posts...)
+	}
+}
+
+func webhookCommands(s *WebhookSink, offset int64, cmds ...string) error {
+	for _, c := range cmds {
+		if err := s.Command(&Command{D: strings.Fields(c), Offset: offset, ReplId: "abc"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestWebhookSinkBatches(t *testing.T) {
+	srv, posts := webhookServer()
+	defer srv.Close()
+	s, err := NewWebhookSink(srv.URL, WebhookSinkBatch(2, time.Hour))
+	assert.NoError(t, err)
+
+	assert.NoError(t, webhookCommands(s, 10, "set a 1", "select 2", "ping", "set b 2"))
+	assert.Equal(t, int64(10), s.Applied())
+	assert.NoError(t, webhookCommands(s, 20, "del a"))
+	assert.Equal(t, int64(10), s.Applied())
+	assert.NoError(t, s.Close())
+	assert.Equal(t, int64(20), s.Applied())
+
+	ps := posts()
+	if assert.Len(t, ps, 2) {
+		assert.Equal(t, "abc-10-0-2", ps[0].key)
+		assert.Equal(t, ps[0].key, ps[0].batch.Key)
+		if assert.Len(t, ps[0].batch.Events, 2) {
+			assert.Equal(t, 0, ps[0].batch.Events[0].DB)
+			assert.Equal(t, "SET", ps[0].batch.Events[1].Command)
+			assert.Equal(t, 2, ps[0].batch.Events[1].DB)
+		}
+		assert.Equal(t, "abc-20-0-1", ps[1].key)
+	}
+}
+
+func TestWebhookSinkInterval(t *testing.T) {
+	srv, posts := webhookServer()
+	defer srv.Close()
+	s, err := NewWebhookSink(srv.URL, WebhookSinkBatch(100, 50*time.Millisecond))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, webhookCommands(s, 10, "set a 1"))
+	for deadline := time.Now().Add(2 * time.Second); s.Applied() != 10 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(10), s.Applied())
+	assert.Len(t, posts(), 1)
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	srv, posts := webhookServer(http.StatusServiceUnavailable, http.StatusInternalServerError)
+	defer srv.Close()
+	s, err := NewWebhookSink(srv.URL, WebhookSinkBatch(1, 0), WebhookSinkRetry(3, time.Millisecond, time.Millisecond))
+	assert.NoError(t, err)
+
+	assert.NoError(t, webhookCommands(s, 10, "set a 1"))
+	assert.Equal(t, int64(10), s.Applied())
+	ps := posts()
+	if assert.Len(t, ps, 3) {
+		assert.Equal(t, ps[0].key, ps[2].key)
+	}
+	assert.NoError(t, s.Close())
+}
+
+func TestWebhookSinkFailure(t *testing.T) {
+	srv, _ := webhookServer(http.StatusBadRequest)
+	defer srv.Close()
+	s, err := NewWebhookSink(srv.URL, WebhookSinkBatch(1, 0))
+	assert.NoError(t, err)
+
+	err = webhookCommands(s, 10, "set a 1")
+	if assert.IsType(t, &WebhookError{}, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*WebhookError).StatusCode)
+	}
+	assert.Equal(t, int64(-1), s.Applied())
+	assert.Equal(t, err, webhookCommands(s, 20, "set b 2"))
+	assert.Equal(t, err, s.Close())
+}
+
+func TestWebhookSinkDeadLetter(t *testing.T) {
+	srv, posts := webhookServer(http.StatusUnprocessableEntity, http.StatusBadGateway, http.StatusBadGateway)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "webhook")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.jsonl")
+	s, err := NewWebhookSink(srv.URL, WebhookSinkBatch(1, 0),
+		WebhookSinkRetry(1, time.Millisecond, time.Millisecond), WebhookSinkDeadLetter(path))
+	assert.NoError(t, err)
+
+	// rejected, then retried until given up
+	assert.NoError(t, webhookCommands(s, 10, "set a 1"))
+	assert.NoError(t, webhookCommands(s, 20, "set b 2"))
+	assert.NoError(t, webhookCommands(s, 30, "set c 3"))
+	assert.Equal(t, int64(30), s.Applied())
+	assert.NoError(t, s.Close())
+	assert.Len(t, posts(), 4)
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var keys []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var dead struct {
+			Key    string   `json:"key"`
+			Events []*Event `json:"events"`
+			Error  string   `json:"error"`
+		}
+		assert.NoError(t, json.Unmarshal(sc.Bytes(), &dead))
+		assert.Len(t, dead.Events, 1)
+		assert.Contains(t, dead.Error, "webhook: ")
+		keys = append(keys, dead.Key)
+	}
+	assert.Equal(t, []string{"abc-10-0-1", "abc-20-0-1"}, keys)
+}
+
+func TestWebhookSinkSnapshotKeys(t *testing.T) {
+	srv, posts := webhookServer()
+	defer srv.Close()
+	s, err := NewWebhookSink(srv.URL, WebhookSinkBatch(2, 0))
+	assert.NoError(t, err)
+
+	// the commands of a snapshot share one offset
+	assert.NoError(t, webhookCommands(s, 10, "set a 1", "set b 2", "set c 3", "set d 4"))
+	assert.NoError(t, s.Close())
+	var keys []string
+	for _, p := range posts() {
+		keys = append(keys, p.key)
+	}
+	assert.Equal(t, []string{"abc-10-0-2", "abc-10-2-2"}, keys)
+}
+
+func TestWebhookSinkSnapshotApplied(t *testing.T) {
+	srv, posts := webhookServer()
+	defer srv.Close()
+	s, err := NewWebhookSink(srv.URL, WebhookSinkBatch(2, 0))
+	assert.NoError(t, err)
+
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, s.Command(&Command{D: []string{"SET", key, "1"}, Offset: 10, Phase: PhaseRDB}))
+	}
+	assert.NoError(t, s.Command(&Command{D: []string{"SET", "d", "1"}, Offset: 40, Phase: PhaseStreaming}))
+	assert.Len(t, posts(), 2)
+	// the tail of the snapshot and a streamed event were posted
+	assert.Equal(t, int64(40), s.Applied())
+
+	s2, err := NewWebhookSink(srv.URL, WebhookSinkBatch(2, 0))
+	assert.NoError(t, err)
+	assert.NoError(t, s2.Command(&Command{D: []string{"SET", "old", "1"}, Offset: 5, Phase: PhaseStreaming}))
+	assert.NoError(t, s2.Flush())
+	assert.Equal(t, int64(5), s2.Applied())
+	for _, key := range []string{"a", "b"} {
+		assert.NoError(t, s2.Command(&Command{D: []string{"SET", key, "1"}, Offset: 10, Phase: PhaseRDB}))
+	}
+	assert.Equal(t, int64(-1), s2.Applied())
+	assert.NoError(t, s2.Command(&Command{D: []string{"PING"}, Offset: 24, Phase: PhaseStreaming}))
+	assert.Equal(t, int64(24), s2.Applied())
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s2.Close())
+}